@@ -0,0 +1,85 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package blob implements the delivery by reference of notification
+// payloads too large to be sent inline.
+//
+// The push server keeps such a payload apart and sends instead a
+// reference saying where to fetch it from and how to check it; the
+// client daemon fetches it before handing the payload to the app
+// helper.
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	"github.com/ubports/ubuntu-push/protocol"
+)
+
+// ErrBadBlob is returned when a fetched payload doesn't match its reference.
+var ErrBadBlob = errors.New("blob does not match its reference")
+
+// Ref refers to a payload kept apart.
+type Ref struct {
+	// where to fetch the payload from, relative to the API URL
+	URL    string `json:"url"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// MakeRef returns the payload of the protocol.KindBlob notification
+// to send instead of data, kept apart at url.
+func MakeRef(url string, data json.RawMessage) (json.RawMessage, error) {
+	return json.Marshal(&Ref{
+		URL:    url,
+		Size:   len(data),
+		SHA256: digest(data),
+	})
+}
+
+// ExtractRef returns the reference carried by notif, or nil if notif
+// is not a well-formed protocol.KindBlob one.
+func ExtractRef(notif *protocol.Notification) *Ref {
+	if notif.Kind != protocol.KindBlob {
+		return nil
+	}
+	var ref Ref
+	err := json.Unmarshal(notif.Payload, &ref)
+	if err != nil || ref.URL == "" || ref.SHA256 == "" {
+		return nil
+	}
+	return &ref
+}
+
+// Check checks that data is the payload ref refers to.
+func (ref *Ref) Check(data []byte) error {
+	if len(data) != ref.Size || digest(data) != ref.SHA256 {
+		return ErrBadBlob
+	}
+	var dummy interface{}
+	if json.Unmarshal(data, &dummy) != nil {
+		return ErrBadBlob
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package blob
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/ubports/ubuntu-push/protocol"
+)
+
+func TestBlob(t *testing.T) { TestingT(t) }
+
+type blobSuite struct{}
+
+var _ = Suite(&blobSuite{})
+
+func (s *blobSuite) TestMakeRefExtractCheck(c *C) {
+	data := json.RawMessage(`{"big":"` + strings.Repeat("x", 100) + `"}`)
+	payload, err := MakeRef("blob/42", data)
+	c.Assert(err, IsNil)
+	ref := ExtractRef(&protocol.Notification{Kind: protocol.KindBlob, Payload: payload})
+	c.Assert(ref, NotNil)
+	c.Check(ref.URL, Equals, "blob/42")
+	c.Check(ref.Size, Equals, len(data))
+	c.Check(ref.SHA256, HasLen, 64)
+	c.Check(ref.Check(data), IsNil)
+}
+
+func (s *blobSuite) TestExtractRefNotRef(c *C) {
+	payload, err := MakeRef("blob/42", json.RawMessage(`{"a":1}`))
+	c.Assert(err, IsNil)
+	// it takes the kind, whatever the payload looks like
+	c.Check(ExtractRef(&protocol.Notification{Payload: payload}), IsNil)
+	c.Check(ExtractRef(&protocol.Notification{Kind: protocol.KindClear, Payload: payload}), IsNil)
+	for _, bad := range []string{`{"a":1}`, `[1]`, `null`, `{"url":"blob/1"}`} {
+		c.Check(ExtractRef(&protocol.Notification{Kind: protocol.KindBlob, Payload: json.RawMessage(bad)}), IsNil, Commentf(bad))
+	}
+}
+
+func (s *blobSuite) TestCheckFailures(c *C) {
+	data := json.RawMessage(`{"a":1}`)
+	ref := &Ref{URL: "blob/1", Size: len(data), SHA256: digest(data)}
+	c.Check(ref.Check([]byte(`{"a":2}`)), Equals, ErrBadBlob)
+	c.Check(ref.Check([]byte(`{"a":1} `)), Equals, ErrBadBlob)
+	// matching digest but not JSON
+	bad := []byte(`{"a":`)
+	badRef := &Ref{URL: "blob/2", Size: len(bad), SHA256: digest(bad)}
+	c.Check(badRef.Check(bad), Equals, ErrBadBlob)
+}
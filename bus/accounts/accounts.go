@@ -117,6 +117,22 @@ func (a *accounts) startWatch() error {
 	return nil
 }
 
+// Defaults returns an Accounts that tracks nothing, for systems
+// without the accounts service sound settings: not silent, no
+// vibration, and no message sound.
+func Defaults() Accounts {
+	return defaults{}
+}
+
+type defaults struct{}
+
+func (defaults) Start() error             { return nil }
+func (defaults) Cancel() error            { return nil }
+func (defaults) SilentMode() bool         { return false }
+func (defaults) Vibrate() bool            { return false }
+func (defaults) MessageSoundFile() string { return "" }
+func (defaults) String() string           { return "&accounts{defaults}" }
+
 // cancel the asynchronous updating of properties.
 func (a *accounts) Cancel() error {
 	return a.cancellable.Cancel()
@@ -55,6 +55,15 @@ func (s *AccSuite) TestBusAddressPathUidLoaded(c *C) {
 	c.Check(BusAddress.Path, Matches, `.*\d+`)
 }
 
+func (s *AccSuite) TestDefaults(c *C) {
+	a := Defaults()
+	c.Check(a.Start(), IsNil)
+	c.Check(a.SilentMode(), Equals, false)
+	c.Check(a.Vibrate(), Equals, false)
+	c.Check(a.MessageSoundFile(), Equals, "")
+	c.Check(a.Cancel(), IsNil)
+}
+
 func (s *AccSuite) TestCancelCancelsCancellable(c *C) {
 	err := errors.New("cancel error")
 	t := &TestCancellable{err: err}
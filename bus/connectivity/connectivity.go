@@ -20,15 +20,21 @@
 // It can potentially fire two falses in a row, if a disconnected
 // state is followed by a dbus watch error. Other than that, it's edge
 // triggered.
+//
+// When URfkill is available, flight mode (with the WLAN killswitch
+// still blocking) counts as disconnected straight away, without
+// waiting for NetworkManager to catch up.
 package connectivity
 
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ubports/ubuntu-push/bus"
 	"github.com/ubports/ubuntu-push/bus/networkmanager"
+	"github.com/ubports/ubuntu-push/bus/urfkill"
 	"github.com/ubports/ubuntu-push/config"
 	"github.com/ubports/ubuntu-push/logger"
 	"github.com/ubports/ubuntu-push/util"
@@ -45,19 +51,32 @@ type ConnectivityConfig struct {
 	ConnectivityCheckURL string `json:"connectivity_check_url"`
 	// The expected MD5 of the content at the ConnectivityCheckURL
 	ConnectivityCheckMD5 string `json:"connectivity_check_md5"`
+	// Whether to hold back avoidable traffic (like the online
+	// connectivity check) while on a metered connection.
+	DeferWhenMetered bool `json:"defer_when_metered"`
 }
 
 // ConnectedState helps tracking connectivity.
 type ConnectedState struct {
 	networkStateCh <-chan networkmanager.State
 	networkConCh   <-chan string
+	meteredCh      <-chan networkmanager.Metered
+	flightModeCh   <-chan bool
+	wlanKillswitch <-chan urfkill.KillswitchState
 	config         ConnectivityConfig
 	log            logger.Logger
 	endp           bus.Endpoint
+	nm             networkmanager.NetworkManager
+	urfkillEndp    bus.Endpoint
+	wlanEndp       bus.Endpoint
 	connAttempts   uint32
 	webchk         Webchecker
 	webgetCh       chan bool
 	currentState   networkmanager.State
+	primaryType    string
+	flightMode     bool
+	wlanState      urfkill.KillswitchState
+	metered        int32
 	lastSent       bool
 	timer          *time.Timer
 	doneLck        sync.Mutex
@@ -65,6 +84,9 @@ type ConnectedState struct {
 	canceled       bool
 	stateWatch     bus.Cancellable
 	conWatch       bus.Cancellable
+	meteredWatch   bus.Cancellable
+	flightWatch    bus.Cancellable
+	wlanWatch      bus.Cancellable
 }
 
 // New makes a ConnectedState for connectivity tracking.
@@ -82,6 +104,16 @@ func New(endp bus.Endpoint, config ConnectivityConfig, log logger.Logger) *Conne
 	}
 }
 
+// TrackRadios makes the ConnectedState also follow URfkill's flight
+// mode and WLAN killswitch, over the given endpoints for
+// urfkill.BusAddress and urfkill.WLANKillswitchBusAddress. Call it
+// before Track(). As URfkill is optional, failing to reach it only
+// means radios aren't tracked.
+func (cs *ConnectedState) TrackRadios(urfkillEndp, wlanEndp bus.Endpoint) {
+	cs.urfkillEndp = urfkillEndp
+	cs.wlanEndp = wlanEndp
+}
+
 // cancel watches if any
 func (cs *ConnectedState) reset() {
 	if cs.stateWatch != nil {
@@ -92,6 +124,86 @@ func (cs *ConnectedState) reset() {
 		cs.conWatch.Cancel()
 		cs.conWatch = nil
 	}
+	if cs.meteredWatch != nil {
+		cs.meteredWatch.Cancel()
+		cs.meteredWatch = nil
+	}
+	if cs.flightWatch != nil {
+		cs.flightWatch.Cancel()
+		cs.flightWatch = nil
+	}
+	if cs.wlanWatch != nil {
+		cs.wlanWatch.Cancel()
+		cs.wlanWatch = nil
+	}
+}
+
+// radiosOff says whether flight mode has the radios switched off
+// under the primary connection. Flight mode with WLAN switched back
+// on isn't off, and neither is it for a wired connection.
+func (cs *ConnectedState) radiosOff() bool {
+	return cs.flightMode && cs.wlanState != urfkill.KillswitchStateUnblocked && overTheAir(cs.primaryType)
+}
+
+// overTheAir says whether a connection of the given NetworkManager
+// type goes over a radio. Not knowing the type, it might.
+func overTheAir(conType string) bool {
+	switch conType {
+	case "", "802-11-wireless", "802-11-olpc-mesh", "gsm", "cdma", "bluetooth", "wimax":
+		return true
+	}
+	return false
+}
+
+// checkPrimaryType asks NetworkManager for the type of the primary
+// connection, if the radios are tracked for it to matter.
+func (cs *ConnectedState) checkPrimaryType() {
+	cs.primaryType = ""
+	if cs.nm != nil && cs.flightModeCh != nil {
+		cs.primaryType = cs.nm.GetPrimaryConnectionType()
+	}
+}
+
+// startRadios sets up the URfkill watches, if TrackRadios asked for
+// them, and gets the initial flight mode and killswitch state.
+func (cs *ConnectedState) startRadios() {
+	cs.flightModeCh = nil
+	cs.wlanKillswitch = nil
+	cs.flightMode = false
+	cs.wlanState = urfkill.KillswitchStateUnblocked
+	if cs.urfkillEndp == nil || cs.wlanEndp == nil {
+		return
+	}
+	// we may be starting over
+	cs.urfkillEndp.Close()
+	cs.wlanEndp.Close()
+	if err := cs.urfkillEndp.Dial(); err != nil {
+		cs.log.Debugf("unable to dial urfkill, not tracking flight mode: %s", err)
+		return
+	}
+	if err := cs.wlanEndp.Dial(); err != nil {
+		cs.log.Debugf("unable to dial urfkill WLAN killswitch, not tracking flight mode: %s", err)
+		cs.urfkillEndp.Close()
+		return
+	}
+	ur := urfkill.New(cs.urfkillEndp, cs.wlanEndp, cs.log)
+	var err error
+	cs.flightModeCh, cs.flightWatch, err = ur.WatchFlightMode()
+	if err != nil {
+		cs.log.Debugf("failed to set up the flight mode watch: %s", err)
+		return
+	}
+	cs.wlanKillswitch, cs.wlanWatch, err = ur.WatchWLANKillswitchState()
+	if err != nil {
+		cs.log.Debugf("failed to set up the WLAN killswitch watch: %s", err)
+		cs.flightWatch.Cancel()
+		cs.flightWatch = nil
+		cs.flightModeCh = nil
+		return
+	}
+	cs.flightMode = ur.IsFlightMode()
+	cs.wlanState = ur.GetWLANKillswitchState()
+	cs.log.Debugf("flight mode starts as %v, WLAN killswitch as %d", cs.flightMode, cs.wlanState)
 }
 
 // start connects to the bus, gets the initial NetworkManager state, and sets
@@ -134,6 +246,20 @@ func (cs *ConnectedState) start() networkmanager.State {
 
 		cs.networkStateCh = stateCh
 		cs.networkConCh = conCh
+		cs.nm = nm
+
+		cs.meteredCh = nil
+		if cs.config.DeferWhenMetered {
+			// without the watch it's only checked on the timer
+			cs.meteredCh, cs.meteredWatch, err = nm.WatchMetered()
+			if err != nil {
+				cs.log.Debugf("failed to set up the metered watch: %s", err)
+			}
+			cs.checkMetered()
+		}
+
+		cs.startRadios()
+		cs.checkPrimaryType()
 
 		return initial
 
@@ -145,6 +271,58 @@ func (cs *ConnectedState) start() networkmanager.State {
 
 var errCanceled = errors.New("canceled")
 
+// Metered says whether the connection was metered when last
+// checked. It is only ever true with DeferWhenMetered set.
+func (cs *ConnectedState) Metered() bool {
+	return atomic.LoadInt32(&cs.metered) != 0
+}
+
+// checkMetered asks NetworkManager whether the connection is
+// metered, if we care.
+func (cs *ConnectedState) checkMetered() bool {
+	m := networkmanager.MeteredUnknown
+	if cs.config.DeferWhenMetered && cs.nm != nil {
+		m = cs.nm.GetMetered()
+		cs.log.Debugf("connectivity: %q connection metered: %s", cs.nm.GetPrimaryConnectionType(), m)
+	}
+	return cs.setMetered(m)
+}
+
+// setMetered records whether the connection is metered, if we care.
+func (cs *ConnectedState) setMetered(m networkmanager.Metered) bool {
+	metered := cs.config.DeferWhenMetered && m.IsMetered()
+	var v int32
+	if metered {
+		v = 1
+	}
+	atomic.StoreInt32(&cs.metered, v)
+	return metered
+}
+
+// radiosChanged reacts to a flight mode or killswitch change that
+// took the radios from wasOff to radiosOff(). It returns true if a
+// 'disconnected' needs sending.
+func (cs *ConnectedState) radiosChanged(wasOff bool) bool {
+	off := cs.radiosOff()
+	if off == wasOff {
+		return false
+	}
+	if off {
+		cs.webgetCh = nil
+		if cs.lastSent == true {
+			cs.log.Debugf("connectivity: radios off. lastSent: %v, sending 'disconnected'.", cs.lastSent)
+			cs.lastSent = false
+			return true
+		}
+		cs.log.Debugf("connectivity: radios off. lastSent: %v, Ignoring.", cs.lastSent)
+		return false
+	}
+	// radios are back; check promptly
+	cs.log.Debugf("connectivity: radios on again, checking.")
+	cs.timer.Reset(cs.config.StabilizingTimeout.Duration)
+	return false
+}
+
 // step takes one step forwards in the “am I connected?”
 // answering state machine.
 func (cs *ConnectedState) step() (bool, error) {
@@ -159,6 +337,7 @@ Loop:
 			return false, errCanceled
 		case <-cs.networkConCh:
 			cs.webgetCh = nil
+			cs.checkPrimaryType()
 			cs.timer.Reset(stabilizingTimeout)
 			if cs.lastSent == true {
 				log.Debugf("connectivity: PrimaryConnection changed. lastSent: %v, sending 'disconnected'.", cs.lastSent)
@@ -192,8 +371,51 @@ Loop:
 				log.Debugf("connectivity: %s -> %s. lastSent: %v, Ignoring.", lastState, v, cs.lastSent)
 			}
 
+		case m, ok := <-cs.meteredCh:
+			if !ok {
+				return false, errors.New("got not-OK from Metered watch")
+			}
+			wasMetered := cs.Metered()
+			metered := cs.setMetered(m)
+			log.Debugf("connectivity: metered changed to %s.", m)
+			if wasMetered && !metered && cs.currentState == networkmanager.ConnectedGlobal {
+				// off the metered connection, check for real
+				cs.timer.Reset(stabilizingTimeout)
+			}
+
+		case flightMode, ok := <-cs.flightModeCh:
+			if !ok {
+				return false, errors.New("got not-OK from FlightModeChanged watch")
+			}
+			wasOff := cs.radiosOff()
+			cs.flightMode = flightMode
+			if cs.radiosChanged(wasOff) {
+				break Loop
+			}
+
+		case wlanState, ok := <-cs.wlanKillswitch:
+			if !ok {
+				return false, errors.New("got not-OK from WLAN killswitch watch")
+			}
+			wasOff := cs.radiosOff()
+			cs.wlanState = wlanState
+			if cs.radiosChanged(wasOff) {
+				break Loop
+			}
+
 		case <-cs.timer.C:
-			if cs.currentState == networkmanager.ConnectedGlobal {
+			if cs.radiosOff() {
+				log.Debugf("connectivity: timer signal, radios off, not checking.")
+			} else if cs.currentState == networkmanager.ConnectedGlobal && cs.checkMetered() {
+				// NetworkManager's word will have to do
+				log.Debugf("connectivity: timer signal, state: ConnectedGlobal, metered, not checking.")
+				cs.timer.Reset(recheckTimeout)
+				if cs.lastSent == false {
+					log.Debugf("connectivity: metered, lastSent: %v, sending 'connected'.", cs.lastSent)
+					cs.lastSent = true
+					break Loop
+				}
+			} else if cs.currentState == networkmanager.ConnectedGlobal {
 				log.Debugf("connectivity: timer signal, state: ConnectedGlobal, checking...")
 				// use a buffered channel, otherwise
 				// we may leak webcheckers that cannot
@@ -28,6 +28,7 @@ import (
 	"github.com/ubports/ubuntu-push/bus"
 	"github.com/ubports/ubuntu-push/bus/networkmanager"
 	testingbus "github.com/ubports/ubuntu-push/bus/testing"
+	"github.com/ubports/ubuntu-push/bus/urfkill"
 	"github.com/ubports/ubuntu-push/config"
 	"github.com/ubports/ubuntu-push/logger"
 	helpers "github.com/ubports/ubuntu-push/testing"
@@ -318,6 +319,222 @@ func (s *ConnSuite) TestSteps(c *C) {
 	c.Check(e, NotNil)
 }
 
+func (s *ConnSuite) TestStepsRadios(c *C) {
+	cfg := ConnectivityConfig{
+		RecheckTimeout: config.ConfigTimeDuration{50 * time.Millisecond},
+	}
+	ch := make(chan networkmanager.State, 10)
+	fch := make(chan bool, 10)
+	wch := make(chan urfkill.KillswitchState, 10)
+	cs := &ConnectedState{
+		config:         cfg,
+		networkStateCh: ch,
+		flightModeCh:   fch,
+		wlanKillswitch: wch,
+		timer:          time.NewTimer(time.Second),
+		log:            s.log,
+		webchk:         testWebchk(func(ch chan<- bool) { ch <- true }),
+		lastSent:       false,
+	}
+	ch <- networkmanager.ConnectedGlobal
+	f, e := cs.step()
+	c.Check(e, IsNil)
+	c.Check(f, Equals, true)
+
+	// flight mode switches WLAN off, then flags itself on
+	wch <- urfkill.KillswitchStateSoftBlocked
+	fch <- true
+	f, e = cs.step()
+	c.Check(e, IsNil)
+	c.Check(f, Equals, false)
+	c.Check(cs.radiosOff(), Equals, true)
+
+	// while in flight mode the rechecks don't say we're connected
+	_ch := make(chan bool, 1)
+	go func() {
+		f, e := cs.step()
+		c.Check(e, IsNil)
+		_ch <- f
+	}()
+	select {
+	case <-_ch:
+		c.Fatal("got a value in flight mode")
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	// switching WLAN back on, even in flight mode, gets us going again
+	wch <- urfkill.KillswitchStateUnblocked
+	select {
+	case f = <-_ch:
+		c.Check(f, Equals, true)
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for 'connected'")
+	}
+
+	close(fch) // this should make it error out
+	_, e = cs.step()
+	c.Check(e, NotNil)
+}
+
+type testNM struct {
+	networkmanager.NetworkManager
+	metered networkmanager.Metered
+	conType string
+}
+
+func (nm *testNM) GetMetered() networkmanager.Metered { return nm.metered }
+func (nm *testNM) GetPrimaryConnectionType() string   { return nm.conType }
+
+func (s *ConnSuite) TestStepsMetered(c *C) {
+	cfg := ConnectivityConfig{
+		RecheckTimeout:   config.ConfigTimeDuration{50 * time.Millisecond},
+		DeferWhenMetered: true,
+	}
+	ch := make(chan networkmanager.State, 10)
+	nm := &testNM{metered: networkmanager.MeteredGuessYes, conType: "gsm"}
+	webchecks := 0
+	cs := &ConnectedState{
+		config:         cfg,
+		networkStateCh: ch,
+		nm:             nm,
+		timer:          time.NewTimer(time.Second),
+		log:            s.log,
+		webchk:         testWebchk(func(ch chan<- bool) { webchecks++; ch <- true }),
+		lastSent:       false,
+	}
+	ch <- networkmanager.ConnectedGlobal
+	f, e := cs.step()
+	c.Check(e, IsNil)
+	c.Check(f, Equals, true)
+	c.Check(cs.Metered(), Equals, true)
+	c.Check(webchecks, Equals, 0)
+
+	ch <- networkmanager.Disconnected
+	f, e = cs.step()
+	c.Check(e, IsNil)
+	c.Check(f, Equals, false)
+
+	// off the metered connection, we check again
+	nm.metered = networkmanager.MeteredNo
+	ch <- networkmanager.ConnectedGlobal
+	f, e = cs.step()
+	c.Check(e, IsNil)
+	c.Check(f, Equals, true)
+	c.Check(cs.Metered(), Equals, false)
+	c.Check(webchecks, Equals, 1)
+}
+
+func (s *ConnSuite) TestStepsMeteredChanges(c *C) {
+	cfg := ConnectivityConfig{
+		RecheckTimeout:   config.ConfigTimeDuration{time.Hour},
+		DeferWhenMetered: true,
+	}
+	mch := make(chan networkmanager.Metered, 10)
+	nm := &testNM{metered: networkmanager.MeteredYes, conType: "gsm"}
+	webchecks := make(chan bool, 10)
+	cs := &ConnectedState{
+		config:       cfg,
+		meteredCh:    mch,
+		nm:           nm,
+		timer:        time.NewTimer(time.Hour),
+		log:          s.log,
+		webchk:       testWebchk(func(ch chan<- bool) { webchecks <- true; ch <- true }),
+		currentState: networkmanager.ConnectedGlobal,
+		lastSent:     true,
+		done:         make(chan struct{}),
+	}
+	cs.checkMetered()
+	c.Check(cs.Metered(), Equals, true)
+
+	// the change is picked up without waiting for the timer, and
+	// off the metered connection it's checked for real
+	nm.metered = networkmanager.MeteredNo
+	mch <- networkmanager.MeteredNo
+	go cs.step()
+	select {
+	case <-webchecks:
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for the connection check")
+	}
+	c.Check(cs.Metered(), Equals, false)
+	close(cs.done)
+}
+
+func (s *ConnSuite) TestStepsRadiosWired(c *C) {
+	cfg := ConnectivityConfig{
+		RecheckTimeout:     config.ConfigTimeDuration{time.Hour},
+		StabilizingTimeout: config.ConfigTimeDuration{10 * time.Millisecond},
+	}
+	conCh := make(chan string, 10)
+	fch := make(chan bool, 10)
+	wch := make(chan urfkill.KillswitchState, 10)
+	nm := &testNM{conType: "802-11-wireless"}
+	cs := &ConnectedState{
+		config:         cfg,
+		networkConCh:   conCh,
+		flightModeCh:   fch,
+		wlanKillswitch: wch,
+		nm:             nm,
+		timer:          time.NewTimer(time.Hour),
+		log:            s.log,
+		webchk:         testWebchk(func(ch chan<- bool) { ch <- true }),
+		currentState:   networkmanager.ConnectedGlobal,
+		lastSent:       true,
+	}
+	cs.checkPrimaryType()
+
+	// over WLAN, flight mode is off
+	wch <- urfkill.KillswitchStateSoftBlocked
+	fch <- true
+	f, e := cs.step()
+	c.Check(e, IsNil)
+	c.Check(f, Equals, false)
+	c.Check(cs.radiosOff(), Equals, true)
+
+	// but wired ethernet keeps working through it
+	nm.conType = "802-3-ethernet"
+	conCh <- "/org/freedesktop/NetworkManager/ActiveConnection/2"
+	f, e = cs.step()
+	c.Check(e, IsNil)
+	c.Check(f, Equals, true)
+	c.Check(cs.radiosOff(), Equals, false)
+}
+
+func (s *ConnSuite) TestOverTheAir(c *C) {
+	c.Check(overTheAir("802-11-wireless"), Equals, true)
+	c.Check(overTheAir("gsm"), Equals, true)
+	c.Check(overTheAir(""), Equals, true)
+	c.Check(overTheAir("802-3-ethernet"), Equals, false)
+}
+
+// if urfkill can't be reached we carry on without it
+func (s *ConnSuite) TestStartRadiosNoURfkill(c *C) {
+	cs := ConnectedState{config: ConnectivityConfig{}, log: s.log}
+	cs.TrackRadios(testingbus.NewTestingEndpoint(condition.Work(false), nil),
+		testingbus.NewTestingEndpoint(condition.Work(false), nil))
+	cs.startRadios()
+	c.Check(cs.flightModeCh, IsNil)
+	c.Check(cs.wlanKillswitch, IsNil)
+	c.Check(cs.radiosOff(), Equals, false)
+}
+
+func (s *ConnSuite) TestStartRadiosWorks(c *C) {
+	urEndp := testingbus.NewTestingEndpoint(condition.Work(true), condition.Work(true), true)
+	wlanEndp := testingbus.NewTestingEndpoint(condition.Work(true), condition.Work(true), int32(urfkill.KillswitchStateSoftBlocked))
+	nopTicker := make(chan []interface{})
+	testingbus.SetWatchSource(urEndp, "FlightModeChanged", nopTicker)
+	testingbus.SetWatchSource(wlanEndp, "PropertiesChanged", nopTicker)
+	defer close(nopTicker)
+
+	cs := ConnectedState{config: ConnectivityConfig{}, log: s.log}
+	cs.TrackRadios(urEndp, wlanEndp)
+	cs.startRadios()
+	defer cs.reset()
+	c.Check(cs.flightModeCh, NotNil)
+	c.Check(cs.wlanKillswitch, NotNil)
+	c.Check(cs.radiosOff(), Equals, true)
+}
+
 /*
    tests for ConnectedState()
 */
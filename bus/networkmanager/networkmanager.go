@@ -17,7 +17,8 @@
 // Package networkmanager wraps a couple of NetworkManager's DBus API
 // points: the org.freedesktop.NetworkManager.state call, and
 // listening for the StateChange signal, similarly for the primary
-// connection and wireless enabled state.
+// connection and wireless enabled state. It can also tell whether
+// the connection is metered, and what type it is.
 package networkmanager
 
 import (
@@ -56,6 +57,17 @@ type NetworkManager interface {
 	// WatchWirelessEnabled listens for changes of NetworkManager's
 	// wireless state, and sends them out over the channel returned.
 	WatchWirelessEnabled() (<-chan bool, bus.Cancellable, error)
+	// GetMetered fetches and returns whether NetworkManager
+	// thinks the current connection is metered.
+	GetMetered() Metered
+	// WatchMetered listens for changes of whether NetworkManager
+	// thinks the connection is metered, and sends them out over
+	// the channel returned.
+	WatchMetered() (<-chan Metered, bus.Cancellable, error)
+	// GetPrimaryConnectionType fetches and returns the type of
+	// NetworkManager's primary connection, e.g. "802-11-wireless"
+	// or "gsm".
+	GetPrimaryConnectionType() string
 }
 
 type networkManager struct {
@@ -205,3 +217,66 @@ func (nm *networkManager) WatchWirelessEnabled() (<-chan bool, bus.Cancellable,
 
 	return ch, w, nil
 }
+
+func (nm *networkManager) GetMetered() Metered {
+	got, err := nm.bus.GetProperty("Metered")
+	if err != nil {
+		nm.log.Errorf("failed getting Metered: %s", err)
+		nm.log.Debugf("defaulting Metered to Unknown")
+		return MeteredUnknown
+	}
+
+	v, ok := got.(uint32)
+	if !ok {
+		nm.log.Errorf("got weird Metered: %#v", got)
+		return MeteredUnknown
+	}
+
+	return Metered(v)
+}
+
+func (nm *networkManager) WatchMetered() (<-chan Metered, bus.Cancellable, error) {
+	ch := make(chan Metered)
+	w, err := nm.bus.WatchSignal("PropertiesChanged",
+		func(ppsi ...interface{}) {
+			pps, ok := ppsi[0].(map[string]dbus.Variant)
+			if !ok {
+				nm.log.Errorf("got weird PropertiesChanged: %#v", ppsi[0])
+				return
+			}
+			v, ok := pps["Metered"]
+			if !ok {
+				return
+			}
+			m, ok := v.Value.(uint32)
+			if !ok {
+				nm.log.Errorf("got weird Metered via PropertiesChanged: %#v", v)
+				return
+			}
+			nm.log.Debugf("got Metered change: %s", Metered(m))
+			ch <- Metered(m)
+		}, func() { close(ch) })
+	if err != nil {
+		nm.log.Debugf("failed to set up the watch: %s", err)
+		return nil, nil, err
+	}
+
+	return ch, w, nil
+}
+
+func (nm *networkManager) GetPrimaryConnectionType() string {
+	got, err := nm.bus.GetProperty("PrimaryConnectionType")
+	if err != nil {
+		nm.log.Errorf("failed getting PrimaryConnectionType: %s", err)
+		nm.log.Debugf("defaulting PrimaryConnectionType to empty")
+		return ""
+	}
+
+	v, ok := got.(string)
+	if !ok {
+		nm.log.Errorf("got weird PrimaryConnectionType: %#v", got)
+		return ""
+	}
+
+	return v
+}
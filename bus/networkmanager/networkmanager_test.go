@@ -340,3 +340,79 @@ func (s *NMSuite) TestWatchWirelessEnabledIgnoresRubbishValues(c *C) {
 	c.Check(ok, Equals, true)
 	c.Check(v, Equals, false)
 }
+
+// TestMeteredNames checks that networkmanager.Metered values
+// serialize correctly, and which of them count as metered.
+func (s *NMSuite) TestMeteredNames(c *C) {
+	var i Metered
+	for i = 0; i < _max_metered; i++ {
+		c.Check(meteredNames[i], Equals, i.String())
+	}
+	i = _max_metered
+	c.Check(i.String(), Equals, "Unknown")
+	c.Check(MeteredYes.IsMetered(), Equals, true)
+	c.Check(MeteredGuessYes.IsMetered(), Equals, true)
+	c.Check(MeteredNo.IsMetered(), Equals, false)
+	c.Check(MeteredGuessNo.IsMetered(), Equals, false)
+	c.Check(MeteredUnknown.IsMetered(), Equals, false)
+}
+
+// GetMetered returns the right value when everything works
+func (s *NMSuite) TestGetMetered(c *C) {
+	nm := New(testingbus.NewTestingEndpoint(nil, condition.Work(true), uint32(MeteredGuessYes)), s.log)
+	c.Check(nm.GetMetered(), Equals, MeteredGuessYes)
+}
+
+// GetMetered returns the right value when dbus fails
+func (s *NMSuite) TestGetMeteredFail(c *C) {
+	nm := New(testingbus.NewTestingEndpoint(nil, condition.Work(false), uint32(MeteredYes)), s.log)
+	c.Check(nm.GetMetered(), Equals, MeteredUnknown)
+}
+
+// GetMetered returns the right value when dbus works but delivers rubbish values
+func (s *NMSuite) TestGetMeteredRubbishValues(c *C) {
+	nm := New(testingbus.NewTestingEndpoint(nil, condition.Work(true), "yes"), s.log)
+	c.Check(nm.GetMetered(), Equals, MeteredUnknown)
+}
+
+// WatchMetered sends a stream of metered states over the channel,
+// ignoring other properties and rubbish values
+func (s *NMSuite) TestWatchMetered(c *C) {
+	tc := testingbus.NewTestingEndpoint(nil, condition.Work(true),
+		map[string]dbus.Variant{"Metered": dbus.Variant{uint32(MeteredYes)}},
+		map[string]dbus.Variant{"foo": dbus.Variant{}},
+		map[string]dbus.Variant{"Metered": dbus.Variant{"yes"}},
+		map[string]dbus.Variant{"Metered": dbus.Variant{uint32(MeteredGuessNo)}},
+	)
+	nm := New(tc, s.log)
+	ch, w, err := nm.WatchMetered()
+	c.Assert(err, IsNil)
+	defer w.Cancel()
+	l := []Metered{<-ch, <-ch}
+	c.Check(l, DeepEquals, []Metered{MeteredYes, MeteredGuessNo})
+}
+
+// WatchMetered returns on error if the dbus call fails
+func (s *NMSuite) TestWatchMeteredFails(c *C) {
+	nm := New(testingbus.NewTestingEndpoint(nil, condition.Work(false)), s.log)
+	_, _, err := nm.WatchMetered()
+	c.Check(err, NotNil)
+}
+
+// GetPrimaryConnectionType returns the right type when everything works
+func (s *NMSuite) TestGetPrimaryConnectionType(c *C) {
+	nm := New(testingbus.NewTestingEndpoint(nil, condition.Work(true), "gsm"), s.log)
+	c.Check(nm.GetPrimaryConnectionType(), Equals, "gsm")
+}
+
+// GetPrimaryConnectionType returns empty when dbus fails
+func (s *NMSuite) TestGetPrimaryConnectionTypeFail(c *C) {
+	nm := New(testingbus.NewTestingEndpoint(nil, condition.Work(false), "gsm"), s.log)
+	c.Check(nm.GetPrimaryConnectionType(), Equals, "")
+}
+
+// GetPrimaryConnectionType returns empty when dbus works but delivers rubbish values
+func (s *NMSuite) TestGetPrimaryConnectionTypeRubbishValues(c *C) {
+	nm := New(testingbus.NewTestingEndpoint(nil, condition.Work(true), int32(42)), s.log)
+	c.Check(nm.GetPrimaryConnectionType(), Equals, "")
+}
@@ -50,3 +50,38 @@ func (state State) String() string {
 	}
 	return names[Unknown]
 }
+
+type Metered uint32
+
+// the NetworkManager metered values (NMMetered), as per
+// https://developer.gnome.org/NetworkManager/stable/nm-dbus-types.html
+const (
+	MeteredUnknown Metered = iota
+	MeteredYes
+	MeteredNo
+	MeteredGuessYes
+	MeteredGuessNo
+	_max_metered
+)
+
+var meteredNames = map[Metered]string{
+	MeteredUnknown:  "Unknown",
+	MeteredYes:      "Yes",
+	MeteredNo:       "No",
+	MeteredGuessYes: "Guess Yes",
+	MeteredGuessNo:  "Guess No",
+}
+
+// give its metered value a descriptive stringification
+func (m Metered) String() string {
+	if s, ok := meteredNames[m]; ok {
+		return s
+	}
+	return meteredNames[MeteredUnknown]
+}
+
+// IsMetered says whether traffic should be treated as costly;
+// NetworkManager's guesses are taken at face value.
+func (m Metered) IsMetered() bool {
+	return m == MeteredYes || m == MeteredGuessYes
+}
@@ -24,6 +24,7 @@ package notifications
 import (
 	"encoding/json"
 	"errors"
+	"sync"
 
 	"launchpad.net/go-dbus/v1"
 
@@ -61,11 +62,18 @@ type RawNotifications struct {
 	bus   bus.Endpoint
 	log   logger.Logger
 	sound sounds.Sound
+	// the ids of the bubbles showing progress, by app and tag, so
+	// that updates replace them; finished ones are forgotten
+	lock     sync.Mutex
+	replaces map[string]uint32
 }
 
+// the most progress bubbles kept track of at once
+var maxReplaces = 64
+
 // Raw returns a new RawNotifications that'll use the provided bus.Endpoint
 func Raw(endp bus.Endpoint, log logger.Logger, sound sounds.Sound) *RawNotifications {
-	return &RawNotifications{endp, log, sound}
+	return &RawNotifications{bus: endp, log: log, sound: sound}
 }
 
 /*
@@ -169,7 +177,25 @@ func (raw *RawNotifications) Present(app *click.AppId, nid string, notification
 		}
 	}
 
+	if card.Image != "" {
+		hints["image-path"] = &dbus.Variant{card.Image}
+	}
+
 	appId := app.Original()
+	var reuseId uint32
+	replaceKey := ""
+	done := false
+	if progress, ok := card.Progress(); ok {
+		done = progress == 100
+		hints["value"] = &dbus.Variant{progress}
+		if notification.Tag != "" {
+			replaceKey = appId + "/" + notification.Tag
+			raw.lock.Lock()
+			reuseId = raw.replaces[replaceKey]
+			raw.lock.Unlock()
+		}
+	}
+
 	actions := make([]string, 2*len(card.Actions))
 	for i, action := range card.Actions {
 		act, err := json.Marshal(&RawAction{
@@ -198,12 +224,32 @@ func (raw *RawNotifications) Present(app *click.AppId, nid string, notification
 
 	raw.log.Debugf("[%s] creating popup (or snap decision) for %s (summary: %s)", nid, app.Base(), card.Summary)
 
-	_, err := raw.Notify(appId, 0, card.Icon, card.Summary, card.Body, actions, hints, 30*1000)
+	id, err := raw.Notify(appId, reuseId, card.Icon, card.Summary, card.Body, actions, hints, 30*1000)
 
 	if err != nil {
 		raw.log.Errorf("[%s] call to Notify failed: %v", nid, err)
 		return false
 	}
 
+	if replaceKey != "" {
+		raw.lock.Lock()
+		if raw.replaces == nil {
+			raw.replaces = make(map[string]uint32)
+		}
+		if done {
+			delete(raw.replaces, replaceKey)
+		} else {
+			if _, ok := raw.replaces[replaceKey]; !ok && len(raw.replaces) >= maxReplaces {
+				// make room; that bubble is most likely long gone
+				for k := range raw.replaces {
+					delete(raw.replaces, k)
+					break
+				}
+			}
+			raw.replaces[replaceKey] = id
+		}
+		raw.lock.Unlock()
+	}
+
 	return true
 }
@@ -240,6 +240,60 @@ func (s *RawSuite) TestPresentTwoActions(c *C) {
 	c.Check(hints["x-canonical-secondary-icon"], NotNil)
 }
 
+func (s *RawSuite) TestPresentImageAndProgress(c *C) {
+	endp := testibus.NewMultiValuedTestingEndpoint(nil, condition.Work(true), []interface{}{uint32(7)}, []interface{}{uint32(8)}, []interface{}{uint32(9)})
+	raw := Raw(endp, s.log, nil)
+	progress := 42
+	notif := &launch_helper.Notification{Card: &launch_helper.Card{Summary: "summary", Popup: true, Image: "/tmp/img.png", RawProgress: &progress}, Tag: "dl"}
+	c.Assert(raw.Present(s.app, "notifId", notif), Equals, true)
+	// the same tag again replaces the bubble
+	c.Assert(raw.Present(s.app, "notifId2", notif), Equals, true)
+	// a different tag doesn't
+	notif.Tag = "other"
+	c.Assert(raw.Present(s.app, "notifId3", notif), Equals, true)
+	callArgs := testibus.GetCallArgs(endp)
+	c.Assert(callArgs, HasLen, 3)
+	c.Check(callArgs[0].Args[1], Equals, uint32(0))
+	c.Check(callArgs[1].Args[1], Equals, uint32(7))
+	c.Check(callArgs[2].Args[1], Equals, uint32(0))
+	hints, ok := callArgs[0].Args[6].(map[string]*dbus.Variant)
+	c.Assert(ok, Equals, true)
+	c.Check(hints["image-path"].Value, Equals, "/tmp/img.png")
+	c.Check(hints["value"].Value, Equals, int32(42))
+}
+
+func (s *RawSuite) TestPresentProgressForgetsFinished(c *C) {
+	endp := testibus.NewMultiValuedTestingEndpoint(nil, condition.Work(true), []interface{}{uint32(7)}, []interface{}{uint32(8)}, []interface{}{uint32(9)})
+	raw := Raw(endp, s.log, nil)
+	progress := 100
+	notif := &launch_helper.Notification{Card: &launch_helper.Card{Summary: "summary", Popup: true, RawProgress: &progress}, Tag: "dl"}
+	c.Assert(raw.Present(s.app, "notifId", notif), Equals, true)
+	c.Check(raw.replaces, HasLen, 0)
+	// so a new download gets a new bubble
+	c.Assert(raw.Present(s.app, "notifId2", notif), Equals, true)
+	callArgs := testibus.GetCallArgs(endp)
+	c.Assert(callArgs, HasLen, 2)
+	c.Check(callArgs[1].Args[1], Equals, uint32(0))
+}
+
+func (s *RawSuite) TestPresentProgressBounded(c *C) {
+	defer func(n int) { maxReplaces = n }(maxReplaces)
+	maxReplaces = 2
+	endp := testibus.NewTestingEndpoint(nil, condition.Work(true), uint32(1), uint32(2), uint32(3), uint32(4))
+	raw := Raw(endp, s.log, nil)
+	progress := 42
+	for _, tag := range []string{"a", "b", "c", "c"} {
+		notif := &launch_helper.Notification{Card: &launch_helper.Card{Summary: "summary", Popup: true, RawProgress: &progress}, Tag: tag}
+		c.Assert(raw.Present(s.app, "notifId", notif), Equals, true)
+	}
+	c.Check(raw.replaces, HasLen, 2)
+	c.Check(raw.replaces[s.app.Original()+"/c"], Equals, uint32(4))
+	// the last update replaced the bubble of the first
+	callArgs := testibus.GetCallArgs(endp)
+	c.Assert(callArgs, HasLen, 4)
+	c.Check(callArgs[3].Args[1], Equals, uint32(3))
+}
+
 func (s *RawSuite) TestPresentUsesSymbolic(c *C) {
 	endp := testibus.NewTestingEndpoint(nil, condition.Work(true), uint32(1))
 	raw := Raw(endp, s.log, nil)
@@ -0,0 +1,76 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package systemimage
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// OSReleaseFiles are where OSRelease looks for the os-release(5)
+// file, in order.
+var OSReleaseFiles = []string{"/etc/os-release", "/usr/lib/os-release"}
+
+// OSRelease stands in for the system-image service on systems that
+// don't have it, making up the information from os-release(5): the
+// device is the OS id, and the channel its version id.
+func OSRelease() (*InfoResult, error) {
+	var err error
+	for _, filename := range OSReleaseFiles {
+		var m map[string]string
+		m, err = readOSRelease(filename)
+		if err == nil {
+			return &InfoResult{
+				Device:        m["ID"],
+				Channel:       m["VERSION_ID"],
+				VersionDetail: map[string]string{},
+				Raw:           m,
+			}, nil
+		}
+	}
+	return nil, err
+}
+
+func readOSRelease(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := kv[1]
+		if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		} else if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		m[kv[0]] = value
+	}
+	return m, scanner.Err()
+}
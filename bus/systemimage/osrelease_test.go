@@ -0,0 +1,73 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package systemimage
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	. "launchpad.net/gocheck"
+)
+
+type osReleaseSuite struct {
+	files []string
+}
+
+var _ = Suite(&osReleaseSuite{})
+
+func (s *osReleaseSuite) SetUpTest(c *C) {
+	s.files = OSReleaseFiles
+}
+
+func (s *osReleaseSuite) TearDownTest(c *C) {
+	OSReleaseFiles = s.files
+}
+
+func (s *osReleaseSuite) TestOSRelease(c *C) {
+	dir := c.MkDir()
+	filename := filepath.Join(dir, "os-release")
+	err := ioutil.WriteFile(filename, []byte(`# made up
+NAME="Debian GNU/Linux"
+ID=debian
+VERSION_ID="12"
+PRETTY_NAME='Debian 12'
+
+bogus
+`), 0644)
+	c.Assert(err, IsNil)
+	OSReleaseFiles = []string{filepath.Join(dir, "missing"), filename}
+
+	info, err := OSRelease()
+	c.Assert(err, IsNil)
+	c.Check(info, DeepEquals, &InfoResult{
+		Device:        "debian",
+		Channel:       "12",
+		VersionDetail: map[string]string{},
+		Raw: map[string]string{
+			"NAME":        "Debian GNU/Linux",
+			"ID":          "debian",
+			"VERSION_ID":  "12",
+			"PRETTY_NAME": "Debian 12",
+		},
+	})
+}
+
+func (s *osReleaseSuite) TestOSReleaseFails(c *C) {
+	OSReleaseFiles = []string{filepath.Join(c.MkDir(), "missing")}
+	_, err := OSRelease()
+	c.Check(err, NotNil)
+}
@@ -0,0 +1,66 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package upower wraps the bits of UPower's DBus API the poller uses
+// to tell whether the device is running on battery.
+package upower
+
+import (
+	"github.com/ubports/ubuntu-push/bus"
+	"github.com/ubports/ubuntu-push/logger"
+)
+
+// UPower lives on a well-knwon bus.Address
+var BusAddress bus.Address = bus.Address{
+	Interface: "org.freedesktop.UPower",
+	Path:      "/org/freedesktop/UPower",
+	Name:      "org.freedesktop.UPower",
+}
+
+type UPower interface {
+	// OnBattery returns whether the system is running on battery
+	// power. When UPower can't be asked it assumes it is, as that
+	// is the conservative answer.
+	OnBattery() bool
+}
+
+type upower struct {
+	bus bus.Endpoint
+	log logger.Logger
+}
+
+// New returns a new UPower that'll use the provided bus.Endpoint
+func New(endp bus.Endpoint, log logger.Logger) UPower {
+	return &upower{endp, log}
+}
+
+// ensure upower implements UPower
+var _ UPower = &upower{}
+
+func (up *upower) OnBattery() bool {
+	got, err := up.bus.GetProperty("OnBattery")
+	if err != nil {
+		up.log.Errorf("failed getting OnBattery: %s", err)
+		up.log.Debugf("defaulting OnBattery to true")
+		return true
+	}
+	v, ok := got.(bool)
+	if !ok {
+		up.log.Errorf("got weird OnBattery: %#v", got)
+		return true
+	}
+	return v
+}
@@ -0,0 +1,61 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package upower
+
+import (
+	"testing"
+
+	. "launchpad.net/gocheck"
+
+	testingbus "github.com/ubports/ubuntu-push/bus/testing"
+	"github.com/ubports/ubuntu-push/logger"
+	helpers "github.com/ubports/ubuntu-push/testing"
+	"github.com/ubports/ubuntu-push/testing/condition"
+)
+
+// hook up gocheck
+func Test(t *testing.T) { TestingT(t) }
+
+type UPSuite struct {
+	log logger.Logger
+}
+
+var _ = Suite(&UPSuite{})
+
+func (s *UPSuite) SetUpTest(c *C) {
+	s.log = helpers.NewTestLogger(c, "debug")
+}
+
+// OnBattery returns the right value when everything works
+func (s *UPSuite) TestOnBattery(c *C) {
+	up := New(testingbus.NewTestingEndpoint(nil, condition.Work(true), false), s.log)
+	c.Check(up.OnBattery(), Equals, false)
+	up = New(testingbus.NewTestingEndpoint(nil, condition.Work(true), true), s.log)
+	c.Check(up.OnBattery(), Equals, true)
+}
+
+// OnBattery assumes battery when dbus fails
+func (s *UPSuite) TestOnBatteryFail(c *C) {
+	up := New(testingbus.NewTestingEndpoint(nil, condition.Work(false), false), s.log)
+	c.Check(up.OnBattery(), Equals, true)
+}
+
+// OnBattery assumes battery when dbus delivers rubbish values
+func (s *UPSuite) TestOnBatteryRubbishValues(c *C) {
+	up := New(testingbus.NewTestingEndpoint(nil, condition.Work(true), "no"), s.log)
+	c.Check(up.OnBattery(), Equals, true)
+}
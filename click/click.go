@@ -217,7 +217,21 @@ func (cu *ClickUser) Installed(app *AppId, setVersion bool) bool {
 		}
 		return true
 	} else {
-		_, err := xdg.Data.Find(filepath.Join("applications", app.DesktopId()))
-		return err == nil
+		return desktopFileExists(app)
 	}
 }
+
+func desktopFileExists(app *AppId) bool {
+	_, err := xdg.Data.Find(filepath.Join("applications", app.DesktopId()))
+	return err == nil
+}
+
+// DesktopUser checks for installed apps on systems without click,
+// where only legacy (desktop file) apps can be installed.
+type DesktopUser struct{}
+
+// Installed checks if the app has a desktop file; click apps never
+// are installed.
+func (DesktopUser) Installed(app *AppId, setVersion bool) bool {
+	return !app.Click && desktopFileExists(app)
+}
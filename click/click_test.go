@@ -181,6 +181,20 @@ func (s *clickSuite) TestInstalledLegacy(c *C) {
 	c.Check(u.Installed(app, false), Equals, true)
 }
 
+func (s *clickSuite) TestDesktopUserInstalled(c *C) {
+	u := DesktopUser{}
+	app, err := ParseAppId(fmt.Sprintf("_python%s", GetPyVer()))
+	c.Assert(err, IsNil)
+	c.Check(u.Installed(app, false), Equals, true)
+	app, err = ParseAppId("_non-existent-app")
+	c.Assert(err, IsNil)
+	c.Check(u.Installed(app, false), Equals, false)
+	app, err = ParseAppId("com.ubuntu.clock_clock")
+	c.Assert(err, IsNil)
+	c.Check(u.Installed(app, true), Equals, false)
+	c.Check(app.Version, Equals, "")
+}
+
 func (s *clickSuite) TestParseAndVerifyAppId(c *C) {
 	u, err := User()
 	c.Assert(err, IsNil)
@@ -19,6 +19,7 @@
 package client
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
@@ -29,17 +30,25 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/ubports/ubuntu-push/blob"
 	"github.com/ubports/ubuntu-push/bus"
 	"github.com/ubports/ubuntu-push/bus/connectivity"
 	"github.com/ubports/ubuntu-push/bus/networkmanager"
 	"github.com/ubports/ubuntu-push/bus/systemimage"
+	"github.com/ubports/ubuntu-push/bus/urfkill"
 	"github.com/ubports/ubuntu-push/click"
+	"github.com/ubports/ubuntu-push/client/history"
 	"github.com/ubports/ubuntu-push/client/service"
 	"github.com/ubports/ubuntu-push/client/session"
 	"github.com/ubports/ubuntu-push/client/session/seenstate"
 	"github.com/ubports/ubuntu-push/config"
+	"github.com/ubports/ubuntu-push/envelope"
 	"github.com/ubports/ubuntu-push/identifier"
 	"github.com/ubports/ubuntu-push/launch_helper"
 	"github.com/ubports/ubuntu-push/logger"
@@ -68,8 +77,14 @@ type ClientConfig struct {
 	CertPEMFile string `json:"cert_pem_file"`
 	SessionURL      string `json:"session_url"`
 	RegistrationURL string `json:"registration_url"`
+	// The helper printing the Authorization the device presents to
+	// the registration url, telling the server whose device it is;
+	// it is run with the url of the request. None if empty
+	AuthHelper string `json:"auth_helper"`
 	// The logging level (one of "debug", "info", "error")
 	LogLevel logger.ConfigLogLevel `json:"log_level"`
+	// The logging format (one of "text", "json")
+	LogFormat logger.ConfigLogFormat `json:"log_format"`
 	// fallback values for simplified notification usage
 	FallbackVibration *launch_helper.Vibration `json:"fallback_vibration"`
 	FallbackSound     string                   `json:"fallback_sound"`
@@ -80,6 +95,18 @@ type ClientConfig struct {
 	PollPolldWait   config.ConfigTimeDuration `json:"poll_polld_wait"`
 	PollDoneWait    config.ConfigTimeDuration `json:"poll_done_wait"`
 	PollBusyWait    config.ConfigTimeDuration `json:"poll_busy_wait"`
+	// bounds for adapting the poll interval; zero keeps it fixed
+	PollMinInterval config.ConfigTimeDuration `json:"poll_min_interval"`
+	PollMaxInterval config.ConfigTimeDuration `json:"poll_max_interval"`
+	// limits the notification history is pruned to; zero disables
+	HistoryMaxEntries int                       `json:"history_max_entries"`
+	HistoryMaxAge     config.ConfigTimeDuration `json:"history_max_age"`
+	// run without the Ubuntu Touch services, eg on a plain desktop
+	Headless bool `json:"headless"`
+	// the largest payload fetched when delivered by reference, and
+	// by app
+	MaxBlobSize     int            `json:"max_blob_size"`
+	AppMaxBlobSizes map[string]int `json:"app_max_blob_sizes"`
 }
 
 // PushService is the interface we use of service.PushService.
@@ -88,6 +115,9 @@ type PushService interface {
 	Start() error
 	// Unregister unregisters the token for appId.
 	Unregister(appId string) error
+	// Dismiss reports the user dealt with the notifications of
+	// appId with the given tags.
+	Dismiss(appId string, tags []string) error
 }
 
 type PostalService interface {
@@ -97,8 +127,16 @@ type PostalService interface {
 	// and a postal message, presents the former and stores the
 	// latter in the application's mailbox.
 	Post(app *click.AppId, nid string, payload json.RawMessage)
+	// PostByRef is Post for a payload delivered by reference,
+	// fetching it first.
+	PostByRef(app *click.AppId, nid string, ref *blob.Ref)
+	// ClearPersistent clears the persistent notifications of app
+	// with the given notification ids or tags.
+	ClearPersistent(app *click.AppId, nids []string, tags []string) int
 	// IsRunning() returns whether the service is running
 	IsRunning() bool
+	// Debug reports the service's internal state
+	Debug() service.PostalDebugInfo
 	// Stop() stops the service
 	Stop()
 }
@@ -113,6 +151,9 @@ type PushClient struct {
 	idder              identifier.Id
 	deviceId           string
 	connectivityEndp   bus.Endpoint
+	connState          *connectivity.ConnectedState
+	urfkillEndp        bus.Endpoint
+	wlanKillswitchEndp bus.Endpoint
 	systemImageEndp    bus.Endpoint
 	systemImageInfo    *systemimage.InfoResult
 	connCh             chan bool
@@ -120,10 +161,16 @@ type PushClient struct {
 	sessionConnectedCh chan uint32
 	pushService        PushService
 	postalService      PostalService
+	historyService     *service.HistoryService
+	debugService       *service.DebugService
 	unregisterCh       chan *click.AppId
 	trackAddressees    map[string]*click.AppId
 	installedChecker   click.InstalledChecker
 	poller             poller.Poller
+	keyStore           *envelope.KeyStore
+	quietHours         *service.QuietHours
+	history            history.History
+	connected          int32
 	// session-side channels
 	broadcastCh     chan *session.BroadcastNotification
 	notificationsCh chan session.AddressedNotification
@@ -142,6 +189,11 @@ func NewPushClient(configPath string, leveldbPath string) *PushClient {
 
 var newIdentifier = identifier.New
 
+// how long the auth helper gets to print the authorization
+var authHelperTimeout = 10 * time.Second
+
+var errAuthHelperTimeout = errors.New("timed out")
+
 // configure loads its configuration, and sets it up.
 func (client *PushClient) configure() error {
 	_, err := os.Stat(client.configPath)
@@ -159,23 +211,46 @@ func (client *PushClient) configure() error {
 	}
 
 	// later, we'll be specifying more logging options in the config file
-	client.log = logger.NewSimpleLogger(os.Stderr, client.config.LogLevel.Level())
+	client.log = logger.NewLogger(os.Stderr, client.config.LogLevel.Level(), client.config.LogFormat.Format(), "client")
 
-	clickUser, err := click.User()
-	if err != nil {
-		return fmt.Errorf("libclick: %v", err)
+	if client.config.Headless {
+		client.installedChecker = click.DesktopUser{}
+	} else {
+		clickUser, err := click.User()
+		if err != nil {
+			return fmt.Errorf("libclick: %v", err)
+		}
+		// overridden for testing
+		client.installedChecker = clickUser
 	}
-	// overridden for testing
-	client.installedChecker = clickUser
 
 	client.unregisterCh = make(chan *click.AppId, 10)
 
+	// app keys for sealed payloads, the quiet hours and the
+	// notification history live next to the levels db
+	keysDir := ""
+	quietHoursPath := ""
+	historyPath := client.leveldbPath
+	if client.leveldbPath != "" && client.leveldbPath != ":memory:" {
+		keysDir = filepath.Join(filepath.Dir(client.leveldbPath), "keys")
+		quietHoursPath = filepath.Join(filepath.Dir(client.leveldbPath), "quiet-hours.json")
+		historyPath = filepath.Join(filepath.Dir(client.leveldbPath), "history.db")
+	}
+	client.keyStore = envelope.NewKeyStore(keysDir)
+	client.quietHours = service.NewQuietHours(quietHoursPath)
+	client.history, err = client.historyFactory(historyPath)
+	if err != nil {
+		return err
+	}
+
 	// overridden for testing
 	client.idder, err = newIdentifier()
 	if err != nil {
 		return err
 	}
 	client.connectivityEndp = bus.SystemBus.Endpoint(networkmanager.BusAddress, client.log)
+	client.urfkillEndp = bus.SystemBus.Endpoint(urfkill.BusAddress, client.log)
+	client.wlanKillswitchEndp = bus.SystemBus.Endpoint(urfkill.WLANKillswitchBusAddress, client.log)
 	client.systemImageEndp = bus.SystemBus.Endpoint(systemimage.BusAddress, client.log)
 
 	client.connCh = make(chan bool, 1)
@@ -206,6 +281,7 @@ func (client *PushClient) deriveSessionConfig(info map[string]interface{}) sessi
 		PEM:              client.pem,
 		Info:             info,
 		AddresseeChecker: client,
+		MeteredChecker:   client,
 		BroadcastCh:      client.broadcastCh,
 		NotificationsCh:  client.notificationsCh,
 	}
@@ -221,15 +297,78 @@ func (client *PushClient) derivePushServiceSetup() (*service.PushServiceSetup, e
 	setup.RegURL = purl
 	setup.DeviceId = client.deviceId
 	setup.InstalledChecker = client.installedChecker
+	setup.KeyStore = client.keyStore
+	setup.AuthGetter = client.getAuthorization
 	return setup, nil
 }
 
+// getAuthorization gets the Authorization to present to url from the
+// auth helper, if there is one.
+func (client *PushClient) getAuthorization(url string) string {
+	if client.config.AuthHelper == "" {
+		return ""
+	}
+	var auth bytes.Buffer
+	cmd := exec.Command(client.config.AuthHelper, url)
+	cmd.Stdout = &auth
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err = <-done:
+		case <-time.After(authHelperTimeout):
+			cmd.Process.Kill()
+			err = errAuthHelperTimeout
+		}
+	}
+	if err != nil {
+		// carry on without, the server will just not know the user
+		client.log.Errorf("unable to get the authorization from %s: %v", client.config.AuthHelper, err)
+		return ""
+	}
+	return strings.TrimSpace(auth.String())
+}
+
 // derivePostalServiceSetup derives the service setup from the client configuration bits.
 func (client *PushClient) derivePostalServiceSetup() *service.PostalServiceSetup {
+	// the registration url is checked by derivePushServiceSetup
+	blobURL, _ := url.Parse(client.config.RegistrationURL)
+	var dismissals service.DismissalReporter
+	if client.config.AuthHelper != "" {
+		// the server only takes dismissals from authenticated
+		// devices
+		dismissals = client
+	}
 	return &service.PostalServiceSetup{
 		InstalledChecker:  client.installedChecker,
 		FallbackVibration: client.config.FallbackVibration,
 		FallbackSound:     client.config.FallbackSound,
+		KeyStore:          client.keyStore,
+		QuietHours:        client.quietHours,
+		History:           client.history,
+		Dismissals:        dismissals,
+		Metered:           client,
+		Headless:          client.config.Headless,
+		BlobURL:           blobURL,
+		MaxBlobSize:       client.config.MaxBlobSize,
+		AppMaxBlobSizes:   client.config.AppMaxBlobSizes,
+	}
+}
+
+// deriveHistoryServiceSetup derives the service setup from the client configuration bits.
+func (client *PushClient) deriveHistoryServiceSetup() *service.HistoryServiceSetup {
+	return &service.HistoryServiceSetup{
+		History:    client.history,
+		MaxEntries: client.config.HistoryMaxEntries,
+		MaxAge:     client.config.HistoryMaxAge.TimeDuration(),
+	}
+}
+
+// deriveDebugServiceSetup derives the service setup from the client configuration bits.
+func (client *PushClient) deriveDebugServiceSetup() *service.DebugServiceSetup {
+	return &service.DebugServiceSetup{
+		Reporter: client,
 	}
 }
 
@@ -238,6 +377,8 @@ func (client *PushClient) derivePollerSetup() *poller.PollerSetup {
 	return &poller.PollerSetup{
 		Times: poller.Times{
 			AlarmInterval:      client.config.PollInterval.TimeDuration(),
+			MinAlarmInterval:   client.config.PollMinInterval.TimeDuration(),
+			MaxAlarmInterval:   client.config.PollMaxInterval.TimeDuration(),
 			SessionStateSettle: client.config.PollSettle.TimeDuration(),
 			NetworkWait:        client.config.PollNetworkWait.TimeDuration(),
 			PolldWait:          client.config.PollPolldWait.TimeDuration(),
@@ -258,13 +399,19 @@ func (client *PushClient) getDeviceId() error {
 	}
 	h := sha256.Sum224(b)
 	client.deviceId = base64.StdEncoding.EncodeToString(h[:])
+	client.log = logger.With(client.log, logger.Fields{logger.FieldDevice: client.deviceId})
 	return nil
 }
 
 // takeTheBus starts the connection(s) to D-Bus and sets up associated event channels
 func (client *PushClient) takeTheBus() error {
+	if client.config.Headless {
+		return client.takeTheBusHeadless()
+	}
 	cs := connectivity.New(client.connectivityEndp,
 		client.config.ConnectivityConfig, client.log)
+	cs.TrackRadios(client.urfkillEndp, client.wlanKillswitchEndp)
+	client.connState = cs
 	go cs.Track(client.connCh)
 	util.NewAutoRedialer(client.systemImageEndp).Redial()
 	sysimg := systemimage.New(client.systemImageEndp, client.log)
@@ -287,12 +434,42 @@ func (client *PushClient) takeTheBus() error {
 	return nil
 }
 
+// takeTheBusHeadless is takeTheBus for systems without the Ubuntu
+// Touch services: there are no radios to track, os-release stands in
+// for system-image, and, as in containers, there might be no
+// NetworkManager either, in which case we assume we're connected.
+func (client *PushClient) takeTheBusHeadless() error {
+	if err := client.connectivityEndp.Dial(); err != nil {
+		client.log.Infof("no NetworkManager (%v); assuming connectivity", err)
+		client.connCh <- true
+	} else {
+		client.connectivityEndp.Close()
+		cs := connectivity.New(client.connectivityEndp,
+			client.config.ConnectivityConfig, client.log)
+		client.connState = cs
+		go cs.Track(client.connCh)
+	}
+	info, err := systemimage.OSRelease()
+	if err != nil {
+		client.log.Errorf("unable to read os-release: %v", err)
+		info = &systemimage.InfoResult{Device: "unknown"}
+	}
+	client.systemImageInfo = info
+	return nil
+}
+
 // initSessionAndPoller creates the session and the poller objects
 func (client *PushClient) initSessionAndPoller() error {
+	kinds := []string{protocol.KindClear}
+	if client.config.RegistrationURL != "" {
+		// payloads by reference are fetched from there
+		kinds = append(kinds, protocol.KindBlob)
+	}
 	info := map[string]interface{}{
-		"device":       client.systemImageInfo.Device,
-		"channel":      client.systemImageInfo.Channel,
-		"build_number": client.systemImageInfo.BuildNumber,
+		"device":           client.systemImageInfo.Device,
+		"channel":          client.systemImageInfo.Channel,
+		"build_number":     client.systemImageInfo.BuildNumber,
+		protocol.KindsInfo: strings.Join(kinds, ","),
 	}
 	sess, err := session.NewSession(client.config.Addr,
 		client.deriveSessionConfig(info), client.deviceId,
@@ -302,12 +479,18 @@ func (client *PushClient) initSessionAndPoller() error {
 	}
 	client.session = sess
 	sess.KeepConnection()
-	client.poller = poller.New(client.derivePollerSetup())
+	if !client.config.Headless {
+		// there's no powerd nor polld to poll with otherwise
+		client.poller = poller.New(client.derivePollerSetup())
+	}
 	return nil
 }
 
 // runPoller starts and runs the poller
 func (client *PushClient) runPoller() error {
+	if client.poller == nil {
+		return nil
+	}
 	if err := client.poller.Start(); err != nil {
 		return err
 	}
@@ -326,6 +509,36 @@ func (client *PushClient) seenStateFactory() (seenstate.SeenState, error) {
 	}
 }
 
+// historyFactory returns the notification History kept at path
+func (client *PushClient) historyFactory(path string) (history.History, error) {
+	if path == "" {
+		return history.NewHistory()
+	}
+	h, err := history.NewSqliteHistory(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening notification history: %v", err)
+	}
+	return h, nil
+}
+
+// Metered says whether we're on a metered connection and should
+// hold back avoidable traffic (only ever true with defer_when_metered).
+func (client *PushClient) Metered() bool {
+	return client.connState != nil && client.connState.Metered()
+}
+
+// ReportDismissal reports in the background that the user dealt with
+// the notifications of app with the given tags, for the server to
+// clear them from the user's other devices.
+func (client *PushClient) ReportDismissal(app *click.AppId, tags []string) {
+	go func() {
+		err := client.pushService.Dismiss(app.Original(), tags)
+		if err != nil {
+			client.log.Errorf("unable to report dismissal of %v for %s: %v", tags, app.Original(), err)
+		}
+	}()
+}
+
 // StartAddresseeBatch starts a batch of checks for addressees.
 func (client *PushClient) StartAddresseeBatch() {
 	client.trackAddressees = make(map[string]*click.AppId, 10)
@@ -404,6 +617,9 @@ func (client *PushClient) filterBroadcastNotification(msg *session.BroadcastNoti
 
 // handleBroadcastNotification deals with receiving a broadcast notification
 func (client *PushClient) handleBroadcastNotification(msg *session.BroadcastNotification) error {
+	if msg.To != nil {
+		return client.handleAppBroadcastNotification(msg)
+	}
 	if !client.filterBroadcastNotification(msg) {
 		client.log.Debugf("not posting broadcast notification %d; filtered.", msg.TopLevel)
 		return nil
@@ -420,18 +636,80 @@ func (client *PushClient) handleBroadcastNotification(msg *session.BroadcastNoti
 	return nil
 }
 
+// handleAppBroadcastNotification deals with receiving a broadcast
+// notification on an app-scoped channel, posting each payload to the
+// addressee app like a unicast.
+func (client *PushClient) handleAppBroadcastNotification(msg *session.BroadcastNotification) error {
+	for _, decoded := range msg.Decoded {
+		payload, err := json.Marshal(decoded)
+		if err != nil {
+			client.log.Errorf("while posting broadcast notification %d for %s: %v", msg.TopLevel, msg.To, err)
+			return err
+		}
+		client.postalService.Post(msg.To, "", payload)
+	}
+	client.log.Debugf("posted broadcast notification %d for %s.", msg.TopLevel, msg.To)
+	return nil
+}
+
 // handleUnicastNotification deals with receiving a unicast notification
 func (client *PushClient) handleUnicastNotification(anotif session.AddressedNotification) error {
 	app := anotif.To
 	msg := anotif.Notification
+	if msg.Kind == protocol.KindClear {
+		instr := protocol.ExtractClearInstruction(msg)
+		if instr == nil {
+			client.log.Errorf("malformed clear instruction %s for %s.", msg.MsgId, msg.AppId)
+			return nil
+		}
+		var nids, tags []string
+		if instr.MsgId != "" {
+			nids = []string{instr.MsgId}
+		}
+		if instr.Tag != "" {
+			tags = []string{instr.Tag}
+		}
+		n := client.postalService.ClearPersistent(app, nids, tags)
+		client.log.Debugf("cleared %d notifications for %s as instructed by %s.", n, msg.AppId, msg.MsgId)
+		return nil
+	}
+	if msg.Kind == protocol.KindBlob {
+		ref := blob.ExtractRef(msg)
+		if ref == nil {
+			client.log.Errorf("malformed payload reference %s for %s.", msg.MsgId, msg.AppId)
+			return nil
+		}
+		client.postalService.PostByRef(app, msg.MsgId, ref)
+		client.log.Debugf("posted unicast notification %s for %s by reference.", msg.MsgId, msg.AppId)
+		return nil
+	}
+	if msg.Kind != "" {
+		// from a newer server
+		client.log.Debugf("ignoring notification %s for %s of unknown kind %q.", msg.MsgId, msg.AppId, msg.Kind)
+		return nil
+	}
 	client.postalService.Post(app, msg.MsgId, msg.Payload)
 	client.log.Debugf("posted unicast notification %s for %s.", msg.MsgId, msg.AppId)
 	return nil
 }
 
+// noteDelivery lets the poller know something arrived
+func (client *PushClient) noteDelivery() {
+	if client.poller != nil {
+		client.poller.Delivered()
+	}
+}
+
 func (client *PushClient) handeConnNotification(conn bool) {
+	var connected int32
+	if conn {
+		connected = 1
+	}
+	atomic.StoreInt32(&client.connected, connected)
 	client.session.HasConnectivity(conn)
-	client.poller.HasConnectivity(conn)
+	if client.poller != nil {
+		client.poller.HasConnectivity(conn)
+	}
 }
 
 // doLoop connects events with their handlers
@@ -442,8 +720,10 @@ func (client *PushClient) doLoop(connhandler func(bool), bcasthandler func(*sess
 			connhandler(state)
 		case bcast := <-client.broadcastCh:
 			bcasthandler(bcast)
+			client.noteDelivery()
 		case aucast := <-client.notificationsCh:
 			ucasthandler(aucast)
+			client.noteDelivery()
 		case count := <-client.sessionConnectedCh:
 			client.log.Debugf("session connected after %d attempts", count)
 		case app := <-client.unregisterCh:
@@ -502,6 +782,80 @@ func (client *PushClient) startPostalService() error {
 	return nil
 }
 
+func (client *PushClient) setupHistoryService() error {
+	setup := client.deriveHistoryServiceSetup()
+	client.historyService = service.NewHistoryService(setup, client.log)
+	return nil
+}
+
+func (client *PushClient) startHistoryService() error {
+	if err := client.historyService.Start(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (client *PushClient) setupDebugService() error {
+	setup := client.deriveDebugServiceSetup()
+	client.debugService = service.NewDebugService(setup, client.log)
+	return nil
+}
+
+func (client *PushClient) startDebugService() error {
+	if err := client.debugService.Start(); err != nil {
+		return err
+	}
+	return nil
+}
+
+type connectivityReport struct {
+	Connected bool `json:"connected"`
+	Metered   bool `json:"metered"`
+}
+
+type pollerReport struct {
+	Interval   string    `json:"interval"`
+	LastWakeup time.Time `json:"last_wakeup"`
+	NextWakeup time.Time `json:"next_wakeup"`
+}
+
+type debugReport struct {
+	DeviceId     string                   `json:"device_id"`
+	Session      *session.DebugInfo       `json:"session"`
+	Connectivity connectivityReport       `json:"connectivity"`
+	Poller       *pollerReport            `json:"poller"`
+	Postal       *service.PostalDebugInfo `json:"postal"`
+}
+
+// DebugReport gathers a snapshot of the daemon's internal state, for
+// the debug service.
+func (client *PushClient) DebugReport() interface{} {
+	report := debugReport{
+		DeviceId: client.deviceId,
+		Connectivity: connectivityReport{
+			Connected: atomic.LoadInt32(&client.connected) == 1,
+			Metered:   client.Metered(),
+		},
+	}
+	if client.session != nil {
+		info := client.session.Debug()
+		report.Session = &info
+	}
+	if client.poller != nil {
+		status := client.poller.Status()
+		report.Poller = &pollerReport{
+			Interval:   status.Interval.String(),
+			LastWakeup: status.LastWakeup,
+			NextWakeup: status.NextWakeup,
+		}
+	}
+	if client.postalService != nil {
+		info := client.postalService.Debug()
+		report.Postal = &info
+	}
+	return report
+}
+
 // Start calls doStart with the "real" starters
 func (client *PushClient) Start() error {
 	return client.doStart(
@@ -509,10 +863,14 @@ func (client *PushClient) Start() error {
 		client.getDeviceId,
 		client.setupPushService,
 		client.setupPostalService,
+		client.setupHistoryService,
 		client.startPushService,
 		client.startPostalService,
+		client.startHistoryService,
 		client.takeTheBus,
 		client.initSessionAndPoller,
 		client.runPoller,
+		client.setupDebugService,
+		client.startDebugService,
 	)
 }
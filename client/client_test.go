@@ -28,12 +28,14 @@ import (
 	"path/filepath"
 	"reflect"
 	//"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"launchpad.net/go-dbus/v1"
 	. "launchpad.net/gocheck"
 
+	"github.com/ubports/ubuntu-push/blob"
 	"github.com/ubports/ubuntu-push/bus"
 	"github.com/ubports/ubuntu-push/bus/networkmanager"
 	"github.com/ubports/ubuntu-push/bus/systemimage"
@@ -48,6 +50,8 @@ import (
 	"github.com/ubports/ubuntu-push/launch_helper"
 	"github.com/ubports/ubuntu-push/poller"
 	"github.com/ubports/ubuntu-push/protocol"
+	"github.com/ubports/ubuntu-push/server/api"
+	"github.com/ubports/ubuntu-push/server/fakeserver"
 	helpers "github.com/ubports/ubuntu-push/testing"
 	"github.com/ubports/ubuntu-push/testing/condition"
 	"github.com/ubports/ubuntu-push/util"
@@ -89,6 +93,7 @@ type dumbPush struct {
 	dumbCommon
 	unregCount int
 	unregArgs  []string
+	dismissCh  chan string
 }
 
 func (d *dumbPush) Unregister(appId string) error {
@@ -97,17 +102,36 @@ func (d *dumbPush) Unregister(appId string) error {
 	return d.err
 }
 
+func (d *dumbPush) Dismiss(appId string, tags []string) error {
+	d.dismissCh <- appId + ":" + strings.Join(tags, ",")
+	return d.err
+}
+
 type postArgs struct {
 	app     *click.AppId
 	nid     string
 	payload json.RawMessage
 }
 
+type refArgs struct {
+	app *click.AppId
+	nid string
+	ref *blob.Ref
+}
+
+type clearArgs struct {
+	app  *click.AppId
+	nids []string
+	tags []string
+}
+
 type dumbPostal struct {
 	dumbCommon
 	bcastCount int
 	postCount  int
 	postArgs   []postArgs
+	refArgs    []refArgs
+	clearArgs  []clearArgs
 }
 
 func (d *dumbPostal) Post(app *click.AppId, nid string, payload json.RawMessage) {
@@ -118,6 +142,19 @@ func (d *dumbPostal) Post(app *click.AppId, nid string, payload json.RawMessage)
 	d.postArgs = append(d.postArgs, postArgs{app, nid, payload})
 }
 
+func (d *dumbPostal) PostByRef(app *click.AppId, nid string, ref *blob.Ref) {
+	d.refArgs = append(d.refArgs, refArgs{app, nid, ref})
+}
+
+func (d *dumbPostal) ClearPersistent(app *click.AppId, nids []string, tags []string) int {
+	d.clearArgs = append(d.clearArgs, clearArgs{app, nids, tags})
+	return len(nids) + len(tags)
+}
+
+func (d *dumbPostal) Debug() service.PostalDebugInfo {
+	return service.PostalDebugInfo{HelperBacklog: 2, Mailboxes: map[string]int{"app": 3}}
+}
+
 var _ PostalService = (*dumbPostal)(nil)
 var _ PushService = (*dumbPush)(nil)
 
@@ -172,18 +209,28 @@ func (cs *clientSuite) writeTestConfig(overrides map[string]interface{}) {
 		"stabilizing_timeout":    "0ms",
 		"connectivity_check_url": "",
 		"connectivity_check_md5": "",
-		"addr":             ":0",
-		"cert_pem_file":    pem_file,
-		"recheck_timeout":  "3h",
-		"session_url":      "xyzzy://",
-		"registration_url": "reg://",
-		"log_level":        "debug",
-		"poll_interval":    "5m",
-		"poll_settle":      "20ms",
-		"poll_net_wait":    "1m",
-		"poll_polld_wait":  "3m",
-		"poll_done_wait":   "5s",
-		"poll_busy_wait":   "0s",
+		"defer_when_metered":     false,
+		"addr":                   ":0",
+		"cert_pem_file":          pem_file,
+		"recheck_timeout":        "3h",
+		"session_url":            "xyzzy://",
+		"registration_url":       "reg://",
+		"auth_helper":            "",
+		"log_level":              "debug",
+		"log_format":             "text",
+		"poll_interval":          "5m",
+		"poll_settle":            "20ms",
+		"poll_net_wait":          "1m",
+		"poll_polld_wait":        "3m",
+		"poll_done_wait":         "5s",
+		"poll_busy_wait":         "0s",
+		"poll_min_interval":      "1m",
+		"poll_max_interval":      "20m",
+		"history_max_entries":    100,
+		"history_max_age":        "24h",
+		"headless":               false,
+		"max_blob_size":          1048576,
+		"app_max_blob_sizes":     map[string]int{"com.example.big_big": 4194304},
 	}
 	for k, v := range overrides {
 		cfgMap[k] = v
@@ -266,10 +313,14 @@ func (cs *clientSuite) TestConfigureSetsUpEndpoints(c *C) {
 	cli := NewPushClient(cs.configPath, cs.leveldbPath)
 
 	c.Check(cli.connectivityEndp, IsNil)
+	c.Check(cli.urfkillEndp, IsNil)
+	c.Check(cli.wlanKillswitchEndp, IsNil)
 	c.Check(cli.systemImageEndp, IsNil)
 	err := cli.configure()
 	c.Assert(err, IsNil)
 	c.Check(cli.connectivityEndp, NotNil)
+	c.Check(cli.urfkillEndp, NotNil)
+	c.Check(cli.wlanKillswitchEndp, NotNil)
 	c.Check(cli.systemImageEndp, NotNil)
 }
 
@@ -292,6 +343,14 @@ func (cs *clientSuite) TestConfigureSetsUpAddresseeChecks(c *C) {
 	c.Assert(cli.installedChecker.Installed(app, false), Equals, false)
 }
 
+func (cs *clientSuite) TestConfigureHeadless(c *C) {
+	cs.writeTestConfig(map[string]interface{}{"headless": true})
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	err := cli.configure()
+	c.Assert(err, IsNil)
+	c.Check(cli.installedChecker, Equals, click.DesktopUser{})
+}
+
 func (cs *clientSuite) TestConfigureBailsOnBadFilename(c *C) {
 	cli := NewPushClient("/does/not/exist", cs.leveldbPath)
 	err := cli.configure()
@@ -420,6 +479,7 @@ func (cs *clientSuite) TestDeriveSessionConfig(c *C) {
 		PEM:              cli.pem,
 		Info:             info,
 		AddresseeChecker: cli,
+		MeteredChecker:   cli,
 		BroadcastCh:      make(chan *session.BroadcastNotification),
 		NotificationsCh:  make(chan session.AddressedNotification),
 	}
@@ -456,6 +516,8 @@ func (cs *clientSuite) TestDerivePushServiceSetup(c *C) {
 		DeviceId:         "zoo",
 		RegURL:           helpers.ParseURL("reg://"),
 		InstalledChecker: cli.installedChecker,
+		KeyStore:         cli.keyStore,
+		AuthGetter:       func(string) string { return "" },
 	}
 	// sanity check that we are looking at all fields
 	vExpected := reflect.ValueOf(expected).Elem()
@@ -468,9 +530,39 @@ func (cs *clientSuite) TestDerivePushServiceSetup(c *C) {
 	// finally compare
 	setup, err := cli.derivePushServiceSetup()
 	c.Assert(err, IsNil)
+	// funcs can't be compared
+	c.Check(setup.AuthGetter, NotNil)
+	setup.AuthGetter = nil
+	expected.AuthGetter = nil
 	c.Check(setup, DeepEquals, expected)
 }
 
+func (cs *clientSuite) TestGetAuthorization(c *C) {
+	helper := filepath.Join(c.MkDir(), "auth-helper")
+	c.Assert(ioutil.WriteFile(helper, []byte("#!/bin/sh\necho \"auth for $1\"\n"), 0755), IsNil)
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	cli.log = cs.log
+	cli.config.AuthHelper = helper
+	c.Check(cli.getAuthorization("http://reg/register"), Equals, "auth for http://reg/register")
+	cli.config.AuthHelper = ""
+	c.Check(cli.getAuthorization("http://reg/register"), Equals, "")
+	cli.config.AuthHelper = helper + "-missing"
+	c.Check(cli.getAuthorization("http://reg/register"), Equals, "")
+	c.Check(cs.log.Captured(), Matches, "(?ms).*unable to get the authorization from .*")
+}
+
+func (cs *clientSuite) TestGetAuthorizationTimeout(c *C) {
+	defer func(timeout time.Duration) { authHelperTimeout = timeout }(authHelperTimeout)
+	authHelperTimeout = 50 * time.Millisecond
+	helper := filepath.Join(c.MkDir(), "auth-helper")
+	c.Assert(ioutil.WriteFile(helper, []byte("#!/bin/sh\nexec sleep 10\n"), 0755), IsNil)
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	cli.log = cs.log
+	cli.config.AuthHelper = helper
+	c.Check(cli.getAuthorization("http://reg/register"), Equals, "")
+	c.Check(cs.log.Captured(), Matches, "(?ms).*unable to get the authorization from .*: timed out.*")
+}
+
 func (cs *clientSuite) TestDerivePushServiceSetupError(c *C) {
 	cs.writeTestConfig(map[string]interface{}{
 		"registration_url": "%gh",
@@ -486,14 +578,23 @@ func (cs *clientSuite) TestDerivePushServiceSetupError(c *C) {
     derivePostalConfig tests
 ******************************************************************/
 func (cs *clientSuite) TestDerivePostalServiceSetup(c *C) {
-	cs.writeTestConfig(map[string]interface{}{})
+	cs.writeTestConfig(map[string]interface{}{"headless": true, "auth_helper": "auth-helper"})
 	cli := NewPushClient(cs.configPath, cs.leveldbPath)
 	err := cli.configure()
 	c.Assert(err, IsNil)
 	expected := &service.PostalServiceSetup{
+		Headless:          true,
 		InstalledChecker:  cli.installedChecker,
 		FallbackVibration: cli.config.FallbackVibration,
 		FallbackSound:     cli.config.FallbackSound,
+		KeyStore:          cli.keyStore,
+		QuietHours:        cli.quietHours,
+		History:           cli.history,
+		Dismissals:        cli,
+		Metered:           cli,
+		BlobURL:           helpers.ParseURL("reg://"),
+		MaxBlobSize:       1048576,
+		AppMaxBlobSizes:   map[string]int{"com.example.big_big": 4194304},
 	}
 	// sanity check that we are looking at all fields
 	vExpected := reflect.ValueOf(expected).Elem()
@@ -508,6 +609,16 @@ func (cs *clientSuite) TestDerivePostalServiceSetup(c *C) {
 	c.Check(setup, DeepEquals, expected)
 }
 
+func (cs *clientSuite) TestDerivePostalServiceSetupNoAuthHelper(c *C) {
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	err := cli.configure()
+	c.Assert(err, IsNil)
+	// dismissals aren't reported without credentials to report them
+	// with
+	setup := cli.derivePostalServiceSetup()
+	c.Check(setup.Dismissals, IsNil)
+}
+
 /*****************************************************************
     derivePollerSetup tests
 ******************************************************************/
@@ -518,6 +629,7 @@ func (s *derivePollerSession) State() session.ClientSessionState { return sessio
 func (s *derivePollerSession) HasConnectivity(bool)              {}
 func (s *derivePollerSession) KeepConnection() error             { return nil }
 func (s *derivePollerSession) StopKeepConnection()               {}
+func (s *derivePollerSession) Debug() session.DebugInfo          { return session.DebugInfo{} }
 
 func (cs *clientSuite) TestDerivePollerSetup(c *C) {
 	cs.writeTestConfig(map[string]interface{}{})
@@ -528,6 +640,8 @@ func (cs *clientSuite) TestDerivePollerSetup(c *C) {
 	expected := &poller.PollerSetup{
 		Times: poller.Times{
 			AlarmInterval:      5 * time.Minute,
+			MinAlarmInterval:   time.Minute,
+			MaxAlarmInterval:   20 * time.Minute,
 			SessionStateSettle: 20 * time.Millisecond,
 			NetworkWait:        time.Minute,
 			PolldWait:          3 * time.Minute,
@@ -683,6 +797,8 @@ func (cs *clientSuite) TestTakeTheBusWorks(c *C) {
 	cli.config.ConnectivityConfig.ConnectivityCheckURL = ts.URL
 	cli.config.ConnectivityConfig.ConnectivityCheckMD5 = staticHash
 	cli.connectivityEndp = cEndp
+	cli.urfkillEndp = testibus.NewTestingEndpoint(condition.Work(false), nil)
+	cli.wlanKillswitchEndp = testibus.NewTestingEndpoint(condition.Work(false), nil)
 	cli.systemImageEndp = siEndp
 
 	c.Assert(cli.takeTheBus(), IsNil)
@@ -696,6 +812,67 @@ func (cs *clientSuite) TestTakeTheBusWorks(c *C) {
 	c.Check(siCond.OK(), Equals, true)
 }
 
+func (cs *clientSuite) TestTakeTheBusHeadless(c *C) {
+	cs.writeTestConfig(map[string]interface{}{"headless": true})
+	oldFiles := systemimage.OSReleaseFiles
+	defer func() { systemimage.OSReleaseFiles = oldFiles }()
+	osRelease := filepath.Join(c.MkDir(), "os-release")
+	c.Assert(ioutil.WriteFile(osRelease, []byte("ID=debian\nVERSION_ID=\"12\"\n"), 0644), IsNil)
+	systemimage.OSReleaseFiles = []string{osRelease}
+
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	err := cli.configure()
+	c.Assert(err, IsNil)
+	cli.log = cs.log
+	// no NetworkManager, and nothing else is needed
+	cli.connectivityEndp = testibus.NewTestingEndpoint(condition.Work(false), nil)
+	cli.urfkillEndp = nil
+	cli.wlanKillswitchEndp = nil
+	cli.systemImageEndp = nil
+
+	c.Assert(cli.takeTheBus(), IsNil)
+	c.Check(takeNextBool(cli.connCh), Equals, true)
+	c.Check(cli.connState, IsNil)
+	c.Check(cli.systemImageInfo.Device, Equals, "debian")
+	c.Check(cli.systemImageInfo.Channel, Equals, "12")
+	c.Check(cs.log.Captured(), Matches, `(?s).*no NetworkManager.*assuming connectivity.*`)
+}
+
+func (cs *clientSuite) TestTakeTheBusHeadlessTracksNetworkManager(c *C) {
+	cs.writeTestConfig(map[string]interface{}{"headless": true})
+	oldFiles := systemimage.OSReleaseFiles
+	defer func() { systemimage.OSReleaseFiles = oldFiles }()
+	systemimage.OSReleaseFiles = []string{filepath.Join(c.MkDir(), "missing")}
+	ts := httptest.NewServer(mkHandler(staticText))
+	defer ts.Close()
+
+	cEndp := testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true),
+		uint32(networkmanager.Connecting),
+		dbus.ObjectPath("hello"),
+	)
+	tickerCh := make(chan []interface{})
+	nopTickerCh := make(chan []interface{})
+	testibus.SetWatchSource(cEndp, "StateChanged", tickerCh)
+	testibus.SetWatchSource(cEndp, "PropertiesChanged", nopTickerCh)
+	defer close(tickerCh)
+	defer close(nopTickerCh)
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	err := cli.configure()
+	c.Assert(err, IsNil)
+	cli.log = cs.log
+	cli.config.ConnectivityConfig.ConnectivityCheckURL = ts.URL
+	cli.config.ConnectivityConfig.ConnectivityCheckMD5 = staticHash
+	cli.connectivityEndp = cEndp
+
+	c.Assert(cli.takeTheBus(), IsNil)
+	c.Check(takeNextBool(cli.connCh), Equals, false)
+	tickerCh <- []interface{}{uint32(networkmanager.ConnectedGlobal)}
+	c.Check(takeNextBool(cli.connCh), Equals, true)
+	c.Check(cli.connState, NotNil)
+	// no os-release to be found
+	c.Check(cli.systemImageInfo.Device, Equals, "unknown")
+}
+
 // takeTheBus can, in fact, fail
 func (cs *clientSuite) TestTakeTheBusCanFail(c *C) {
 	cli := NewPushClient(cs.configPath, cs.leveldbPath)
@@ -711,6 +888,128 @@ func (cs *clientSuite) TestTakeTheBusCanFail(c *C) {
 	c.Assert(cli.setupPostalService(), IsNil)
 }
 
+func (cs *clientSuite) TestDeriveHistoryServiceSetup(c *C) {
+	cs.writeTestConfig(map[string]interface{}{})
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	err := cli.configure()
+	c.Assert(err, IsNil)
+	expected := &service.HistoryServiceSetup{
+		History:    cli.history,
+		MaxEntries: 100,
+		MaxAge:     24 * time.Hour,
+	}
+	// sanity check that we are looking at all fields
+	vExpected := reflect.ValueOf(expected).Elem()
+	nf := vExpected.NumField()
+	for i := 0; i < nf; i++ {
+		fv := vExpected.Field(i)
+		// field isn't empty/zero
+		c.Assert(fv.Interface(), Not(DeepEquals), reflect.Zero(fv.Type()).Interface(), Commentf("forgot about: %s", vExpected.Type().Field(i).Name))
+	}
+	// finally compare
+	setup := cli.deriveHistoryServiceSetup()
+	c.Check(setup, DeepEquals, expected)
+}
+
+func (cs *clientSuite) TestSetupAndStartHistoryService(c *C) {
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	cli.log = cs.log
+	c.Assert(cli.configure(), IsNil)
+	c.Assert(cli.setupHistoryService(), IsNil)
+	c.Assert(cli.historyService, NotNil)
+	cli.historyService.Bus = testibus.NewTestingEndpoint(condition.Work(true), nil)
+	c.Check(cli.startHistoryService(), IsNil)
+	c.Check(cli.historyService.IsRunning(), Equals, true)
+	cli.historyService.Stop()
+}
+
+func (cs *clientSuite) TestDeriveDebugServiceSetup(c *C) {
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	expected := &service.DebugServiceSetup{
+		Reporter: cli,
+	}
+	// sanity check that we are looking at all fields
+	vExpected := reflect.ValueOf(expected).Elem()
+	nf := vExpected.NumField()
+	for i := 0; i < nf; i++ {
+		fv := vExpected.Field(i)
+		// field isn't empty/zero
+		c.Assert(fv.Interface(), Not(DeepEquals), reflect.Zero(fv.Type()).Interface(), Commentf("forgot about: %s", vExpected.Type().Field(i).Name))
+	}
+	// finally compare
+	setup := cli.deriveDebugServiceSetup()
+	c.Check(setup, DeepEquals, expected)
+}
+
+func (cs *clientSuite) TestSetupAndStartDebugService(c *C) {
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	cli.log = cs.log
+	c.Assert(cli.setupDebugService(), IsNil)
+	c.Assert(cli.debugService, NotNil)
+	cli.debugService.Bus = testibus.NewTestingEndpoint(condition.Work(true), nil)
+	c.Check(cli.startDebugService(), IsNil)
+	c.Check(cli.debugService.IsRunning(), Equals, true)
+	cli.debugService.Stop()
+}
+
+func (cs *clientSuite) TestDebugReport(c *C) {
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	cli.log = cs.log
+	cli.deviceId = "dev-id"
+	cli.session = &loopSession{}
+	cli.poller = &loopPoller{}
+	cli.postalService = new(dumbPostal)
+	cli.handeConnNotification(true)
+	b, err := json.Marshal(cli.DebugReport())
+	c.Assert(err, IsNil)
+	var report map[string]interface{}
+	c.Assert(json.Unmarshal(b, &report), IsNil)
+	c.Check(report["device_id"], Equals, "dev-id")
+	c.Check(report["connectivity"], DeepEquals, map[string]interface{}{
+		"connected": true,
+		"metered":   false,
+	})
+	c.Check(report["session"], NotNil)
+	c.Check(report["poller"], NotNil)
+	c.Check(report["postal"], DeepEquals, map[string]interface{}{
+		"helper_backlog": float64(2),
+		"mailboxes":      map[string]interface{}{"app": float64(3)},
+	})
+}
+
+func (cs *clientSuite) TestDebugReportNothingYet(c *C) {
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	b, err := json.Marshal(cli.DebugReport())
+	c.Assert(err, IsNil)
+	c.Check(string(b), Matches, `.*"session":null,.*"poller":null,"postal":null}`)
+}
+
+/*****************************************************************
+    historyFactory tests
+******************************************************************/
+
+func (cs *clientSuite) TestHistoryFactoryNoPath(c *C) {
+	cli := NewPushClient(cs.configPath, "")
+	h, err := cli.historyFactory("")
+	c.Assert(err, IsNil)
+	defer h.Close()
+	c.Check(fmt.Sprintf("%T", h), Equals, "*history.memHistory")
+}
+
+func (cs *clientSuite) TestHistoryFactoryWithPath(c *C) {
+	cli := NewPushClient(cs.configPath, "")
+	h, err := cli.historyFactory(":memory:")
+	c.Assert(err, IsNil)
+	defer h.Close()
+	c.Check(fmt.Sprintf("%T", h), Equals, "*history.sqliteHistory")
+}
+
+func (cs *clientSuite) TestHistoryFactoryCanFail(c *C) {
+	cli := NewPushClient(cs.configPath, "")
+	_, err := cli.historyFactory("/does/not/exist/history.db")
+	c.Check(err, ErrorMatches, "opening notification history: .*")
+}
+
 /*****************************************************************
     seenStateFactory tests
 ******************************************************************/
@@ -834,6 +1133,32 @@ func (cs *clientSuite) TestHandleBroadcastNotificationNothingToDo(c *C) {
 	c.Check(d.bcastCount, Equals, 0)
 }
 
+func (cs *clientSuite) TestHandleAppBroadcastNotification(c *C) {
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	cli.systemImageInfo = siInfoRes
+	cli.log = cs.log
+	d := new(dumbPostal)
+	cli.postalService = d
+	msg := &session.BroadcastNotification{
+		TopLevel: 2,
+		Decoded: []map[string]interface{}{
+			map[string]interface{}{"m": float64(1)},
+			map[string]interface{}{"m": float64(2)},
+		},
+		To: appHello,
+	}
+	c.Check(cli.handleBroadcastNotification(msg), IsNil)
+	// posted to the app, not to system settings
+	c.Check(d.bcastCount, Equals, 0)
+	c.Check(d.postCount, Equals, 2)
+	c.Assert(d.postArgs, HasLen, 2)
+	c.Check(d.postArgs[0].app, Equals, appHello)
+	c.Check(d.postArgs[0].nid, Equals, "")
+	c.Check(string(d.postArgs[0].payload), Equals, `{"m":1}`)
+	c.Check(d.postArgs[1].app, Equals, appHello)
+	c.Check(string(d.postArgs[1].payload), Equals, `{"m":2}`)
+}
+
 /*****************************************************************
     handleUnicastNotification tests
 ******************************************************************/
@@ -856,6 +1181,98 @@ func (cs *clientSuite) TestHandleUcastNotification(c *C) {
 	c.Check(d.postArgs[0].payload, DeepEquals, notif.Payload)
 }
 
+func (cs *clientSuite) TestHandleUcastClearInstruction(c *C) {
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	cli.log = cs.log
+	d := new(dumbPostal)
+	cli.postalService = d
+
+	byId := &protocol.Notification{AppId: appIdHello, MsgId: "43", Kind: protocol.KindClear, Payload: protocol.ClearPayload(&protocol.ClearInstruction{MsgId: "42"})}
+	c.Check(cli.handleUnicastNotification(session.AddressedNotification{appHello, byId}), IsNil)
+	byTag := &protocol.Notification{AppId: appIdHello, MsgId: "44", Kind: protocol.KindClear, Payload: protocol.ClearPayload(&protocol.ClearInstruction{Tag: "tag1"})}
+	c.Check(cli.handleUnicastNotification(session.AddressedNotification{appHello, byTag}), IsNil)
+	// nothing posted, cleared instead
+	c.Check(d.postCount, Equals, 0)
+	c.Check(d.clearArgs, DeepEquals, []clearArgs{
+		{appHello, []string{"42"}, nil},
+		{appHello, nil, []string{"tag1"}},
+	})
+}
+
+func (cs *clientSuite) TestHandleUcastPayloadLikeClearInstruction(c *C) {
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	cli.log = cs.log
+	d := new(dumbPostal)
+	cli.postalService = d
+
+	// an app payload is the app's whatever it looks like
+	payload := protocol.ClearPayload(&protocol.ClearInstruction{MsgId: "42"})
+	notif := &protocol.Notification{AppId: appIdHello, MsgId: "43", Payload: payload}
+	c.Check(cli.handleUnicastNotification(session.AddressedNotification{appHello, notif}), IsNil)
+	c.Check(d.postCount, Equals, 1)
+	c.Check(d.clearArgs, HasLen, 0)
+}
+
+func (cs *clientSuite) TestHandleUcastByRef(c *C) {
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	cli.log = cs.log
+	d := new(dumbPostal)
+	cli.postalService = d
+
+	data, err := blob.MakeRef("blob/b1", json.RawMessage(`{"m":1}`))
+	c.Assert(err, IsNil)
+	notif := &protocol.Notification{AppId: appIdHello, MsgId: "43", Kind: protocol.KindBlob, Payload: data}
+	c.Check(cli.handleUnicastNotification(session.AddressedNotification{appHello, notif}), IsNil)
+	c.Check(d.postCount, Equals, 0)
+	c.Assert(d.refArgs, HasLen, 1)
+	c.Check(d.refArgs[0].nid, Equals, "43")
+	c.Check(d.refArgs[0].ref, DeepEquals, blob.ExtractRef(notif))
+	// a malformed reference is dropped
+	notif = &protocol.Notification{AppId: appIdHello, MsgId: "44", Kind: protocol.KindBlob, Payload: json.RawMessage(`{"m":1}`)}
+	c.Check(cli.handleUnicastNotification(session.AddressedNotification{appHello, notif}), IsNil)
+	c.Check(d.postCount, Equals, 0)
+	c.Check(d.refArgs, HasLen, 1)
+	c.Check(cs.log.Captured(), Matches, `(?s).*ERROR malformed payload reference 44 for .*`)
+}
+
+func (cs *clientSuite) TestHandleUcastUnknownKind(c *C) {
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	cli.log = cs.log
+	d := new(dumbPostal)
+	cli.postalService = d
+
+	notif := &protocol.Notification{AppId: appIdHello, MsgId: "43", Kind: "future", Payload: json.RawMessage(`{}`)}
+	c.Check(cli.handleUnicastNotification(session.AddressedNotification{appHello, notif}), IsNil)
+	c.Check(d.postCount, Equals, 0)
+	c.Check(d.clearArgs, HasLen, 0)
+}
+
+func (cs *clientSuite) TestReportDismissal(c *C) {
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	cli.log = cs.log
+	d := &dumbPush{dismissCh: make(chan string)}
+	cli.pushService = d
+
+	cli.ReportDismissal(appHello, []string{"tag1", "tag2"})
+	c.Check(<-d.dismissCh, Equals, appIdHello+":tag1,tag2")
+}
+
+func (cs *clientSuite) TestReportDismissalError(c *C) {
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	cli.log = cs.log
+	d := &dumbPush{dismissCh: make(chan string)}
+	d.err = errors.New("BAD")
+	cli.pushService = d
+
+	cli.ReportDismissal(appHello, []string{"tag1"})
+	<-d.dismissCh
+	// the error is logged after the report is made
+	for i := 0; i < 100 && cs.log.Captured() == ""; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(cs.log.Captured(), Matches, "ERROR unable to report dismissal of \\[tag1\\] for "+appIdHello+": BAD\n")
+}
+
 /*****************************************************************
     handleUnregister tests
 ******************************************************************/
@@ -874,6 +1291,10 @@ func (ps *testPushService) Unregister(appId string) error {
 	return ps.err
 }
 
+func (ps *testPushService) Dismiss(appId string, tags []string) error {
+	return ps.err
+}
+
 func (cs *clientSuite) TestHandleUnregister(c *C) {
 	cli := NewPushClient(cs.configPath, cs.leveldbPath)
 	cli.log = cs.log
@@ -1022,11 +1443,14 @@ func (s *loopSession) State() session.ClientSessionState {
 func (s *loopSession) HasConnectivity(hasConn bool) { s.hasConn = hasConn }
 func (s *loopSession) KeepConnection() error        { return nil }
 func (s *loopSession) StopKeepConnection()          {}
+func (s *loopSession) Debug() session.DebugInfo     { return session.DebugInfo{} }
 
 func (p *loopPoller) HasConnectivity(hasConn bool) {}
 func (p *loopPoller) IsConnected() bool            { return false }
 func (p *loopPoller) Start() error                 { return nil }
 func (p *loopPoller) Run() error                   { return nil }
+func (p *loopPoller) Delivered()                   {}
+func (p *loopPoller) Status() poller.Status        { return poller.Status{} }
 
 func (cs *clientSuite) TestLoop(c *C) {
 	cli := NewPushClient(cs.configPath, cs.leveldbPath)
@@ -1130,6 +1554,8 @@ func (cs *clientSuite) TestStart(c *C) {
 	// and everthying us just peachy!
 	cli.pushService.(*service.PushService).Stop() // cleanup
 	cli.postalService.Stop()                      // cleanup
+	cli.historyService.Stop()                     // cleanup
+	cli.debugService.Stop()                       // cleanup
 }
 
 func (cs *clientSuite) TestStartCanFail(c *C) {
@@ -1140,6 +1566,19 @@ func (cs *clientSuite) TestStartCanFail(c *C) {
 	c.Check(err, NotNil)
 }
 
+func (cs *clientSuite) TestInitSessionAndPollerHeadless(c *C) {
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	cli.log = cs.log
+	cli.systemImageInfo = siInfoRes
+	cli.config.Headless = true
+	c.Assert(cli.initSessionAndPoller(), IsNil)
+	c.Check(cli.session, NotNil)
+	c.Check(cli.poller, IsNil)
+	c.Check(cli.runPoller(), IsNil)
+	// and connectivity changes don't need the poller
+	cli.handeConnNotification(true)
+}
+
 func (cs *clientSuite) TestinitSessionAndPollerErr(c *C) {
 	cli := NewPushClient(cs.configPath, cs.leveldbPath)
 	cli.log = cs.log
@@ -1148,3 +1587,169 @@ func (cs *clientSuite) TestinitSessionAndPollerErr(c *C) {
 	cli.pem = []byte("foo")
 	c.Assert(cli.initSessionAndPoller(), NotNil)
 }
+
+/*****************************************************************
+    end to end tests, against a fake server
+******************************************************************/
+
+// fakeServerClient sets up a headless client talking to srv, with its
+// session kept connected.
+func (cs *clientSuite) fakeServerClient(c *C, srv *fakeserver.Server) *PushClient {
+	pemPath := filepath.Join(c.MkDir(), "fake.pem")
+	c.Assert(ioutil.WriteFile(pemPath, srv.CertPEM, 0644), IsNil)
+	cs.writeTestConfig(map[string]interface{}{
+		"addr":             srv.DeliveryHostsURL(),
+		"registration_url": srv.URL,
+		"cert_pem_file":    pemPath,
+		"connect_timeout":  "1s",
+		"exchange_timeout": "1s",
+		"headless":         true,
+	})
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	c.Assert(cli.configure(), IsNil)
+	cli.log = cs.log
+	cli.installedChecker = testInstalledChecker(func(*click.AppId, bool) bool { return true })
+	cli.deviceId = "DEV"
+	cli.systemImageInfo = siInfoRes
+	c.Assert(cli.initSessionAndPoller(), IsNil)
+	cli.session.HasConnectivity(true)
+	return cli
+}
+
+func (cs *clientSuite) takeNextUnicast(c *C, cli *PushClient) session.AddressedNotification {
+	select {
+	case anotif := <-cli.notificationsCh:
+		return anotif
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for a notification")
+	}
+	return session.AddressedNotification{}
+}
+
+func (cs *clientSuite) TestFakeServerUnicast(c *C) {
+	srv, err := fakeserver.New(nil)
+	c.Assert(err, IsNil)
+	defer srv.Close()
+	cli := cs.fakeServerClient(c, srv)
+	defer cli.session.StopKeepConnection()
+	c.Assert(srv.WaitForDevice("DEV", 5*time.Second), Equals, true)
+	_, err = srv.Notify("DEV", appIdHello, json.RawMessage(`{"m":1}`))
+	c.Assert(err, IsNil)
+	anotif := cs.takeNextUnicast(c, cli)
+	c.Check(anotif.To, DeepEquals, appHello)
+	c.Check(string(anotif.Notification.Payload), Equals, `{"m":1}`)
+	// the server breaks the connection; what is sent meanwhile
+	// arrives once the client is back
+	c.Assert(srv.BreakConnection("DEV", "BYE"), Equals, true)
+	_, err = srv.Notify("DEV", appIdHello, json.RawMessage(`{"m":2}`))
+	c.Assert(err, IsNil)
+	anotif = cs.takeNextUnicast(c, cli)
+	c.Check(string(anotif.Notification.Payload), Equals, `{"m":2}`)
+}
+
+func (cs *clientSuite) TestFakeServerSlowConnAck(c *C) {
+	srv, err := fakeserver.New(nil)
+	c.Assert(err, IsNil)
+	defer srv.Close()
+	// slower than the exchange timeout at first
+	srv.SetConnAckDelay(1500 * time.Millisecond)
+	_, err = srv.Notify("DEV", appIdHello, json.RawMessage(`{"m":1}`))
+	c.Assert(err, IsNil)
+	cli := cs.fakeServerClient(c, srv)
+	defer cli.session.StopKeepConnection()
+	c.Check(srv.WaitForDevice("DEV", 500*time.Millisecond), Equals, false)
+	// the client gives up on it and tries again
+	srv.SetConnAckDelay(0)
+	anotif := cs.takeNextUnicast(c, cli)
+	c.Check(string(anotif.Notification.Payload), Equals, `{"m":1}`)
+}
+
+// helperInputs passes on the inputs it is asked to run.
+type helperInputs chan *launch_helper.HelperInput
+
+func (hi helperInputs) Run(kind string, input *launch_helper.HelperInput) {
+	hi <- input
+}
+
+func (hi helperInputs) Start() chan *launch_helper.HelperResult {
+	return nil
+}
+
+func (hi helperInputs) Stop() {}
+
+func (hi helperInputs) Backlog() int {
+	return 0
+}
+
+func (cs *clientSuite) TestFakeServerLargePayload(c *C) {
+	srv, err := fakeserver.New(&fakeserver.Config{MaxPayloadSize: 8192})
+	c.Assert(err, IsNil)
+	defer srv.Close()
+	cli := cs.fakeServerClient(c, srv)
+	defer cli.session.StopKeepConnection()
+	c.Assert(srv.WaitForDevice("DEV", 5*time.Second), Equals, true)
+	payload := `{"m":"` + strings.Repeat("x", 5000) + `"}`
+	_, err = srv.Notify("DEV", appIdHello, json.RawMessage(payload))
+	c.Assert(err, IsNil)
+	// what arrives is a reference
+	anotif := cs.takeNextUnicast(c, cli)
+	c.Check(anotif.Notification.Kind, Equals, protocol.KindBlob)
+	ref := blob.ExtractRef(anotif.Notification)
+	c.Assert(ref, NotNil)
+	// which the postal service fetches before running the helper
+	svc := service.NewPostalService(cli.derivePostalServiceSetup(), cs.log)
+	inputs := make(helperInputs, 1)
+	svc.HelperPool = inputs
+	svc.PostByRef(anotif.To, anotif.Notification.MsgId, ref)
+	select {
+	case input := <-inputs:
+		c.Check(string(input.Payload), Equals, payload)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for the helper to run")
+	}
+}
+
+func (cs *clientSuite) TestFakeServerUserUnicast(c *C) {
+	srv, err := fakeserver.New(&fakeserver.Config{
+		Users: map[string]string{"Bearer tok1": "user1"},
+	})
+	c.Assert(err, IsNil)
+	defer srv.Close()
+	cli := cs.fakeServerClient(c, srv)
+	defer cli.session.StopKeepConnection()
+	helper := filepath.Join(c.MkDir(), "auth-helper")
+	c.Assert(ioutil.WriteFile(helper, []byte("#!/bin/sh\necho Bearer tok1\n"), 0755), IsNil)
+	cli.config.AuthHelper = helper
+	c.Assert(cli.setupPushService(), IsNil)
+	// the server learns whose device it is from the registration
+	_, err = cli.pushService.(*service.PushService).Register(appIdHello)
+	c.Assert(err, IsNil)
+	c.Assert(srv.WaitForDevice("DEV", 5*time.Second), Equals, true)
+	msgIds, err := srv.NotifyUser("user1", appIdHello, json.RawMessage(`{"m":1}`))
+	c.Assert(err, IsNil)
+	c.Check(msgIds, HasLen, 1)
+	anotif := cs.takeNextUnicast(c, cli)
+	c.Check(anotif.To, DeepEquals, appHello)
+	c.Check(anotif.Notification.MsgId, Equals, msgIds["DEV"])
+	c.Check(string(anotif.Notification.Payload), Equals, `{"m":1}`)
+}
+
+func (cs *clientSuite) TestFakeServerRegistrationErrors(c *C) {
+	srv, err := fakeserver.New(nil)
+	c.Assert(err, IsNil)
+	defer srv.Close()
+	cs.writeTestConfig(map[string]interface{}{
+		"registration_url": srv.URL,
+	})
+	cli := NewPushClient(cs.configPath, cs.leveldbPath)
+	c.Assert(cli.configure(), IsNil)
+	cli.log = cs.log
+	cli.deviceId = "DEV"
+	c.Assert(cli.setupPushService(), IsNil)
+	c.Check(cli.pushService.Unregister(appIdHello), IsNil)
+	srv.RejectAuth(true)
+	c.Check(cli.pushService.Unregister(appIdHello), Equals, service.ErrBadAuth)
+	srv.RejectAuth(false)
+	srv.FailRequests("/unregister", api.ErrStoreUnavailable)
+	c.Check(cli.pushService.Unregister(appIdHello), Equals, service.ErrBadServer)
+}
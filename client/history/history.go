@@ -0,0 +1,183 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package history keeps a record of the notifications the client
+// presented to the user, and of what the user did with them.
+package history
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Entry is the record of one presented notification.
+type Entry struct {
+	Nid       string    `json:"nid"`
+	AppId     string    `json:"app_id"`
+	Package   string    `json:"package"`
+	Summary   string    `json:"summary"`
+	Body      string    `json:"body"`
+	Tag       string    `json:"tag"`
+	Presented time.Time `json:"presented"`
+	Actions   []string  `json:"actions"`   // the actions the user invoked, in order
+	Dismissed bool      `json:"dismissed"` // whether the user dismissed it
+}
+
+// Query selects entries from a History.
+type Query struct {
+	// AppId matches either the full app id or the package of the
+	// entries; empty matches everything.
+	AppId string
+	// Since and Until bound the presentation time (inclusively);
+	// zero values leave that side unbounded.
+	Since time.Time
+	Until time.Time
+	// Limit is the maximum number of entries returned; 0 means no
+	// limit.
+	Limit int
+}
+
+func (q *Query) matches(e *Entry) bool {
+	if q.AppId != "" && q.AppId != e.AppId && q.AppId != e.Package {
+		return false
+	}
+	if !q.Since.IsZero() && e.Presented.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.Presented.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+type History interface {
+	// Record adds an entry for a just presented notification.
+	Record(Entry) error
+	// MarkActioned notes the user invoked action on notification nid.
+	MarkActioned(nid string, action string) error
+	// MarkDismissed notes the user dismissed notification nid.
+	MarkDismissed(nid string) error
+	// Query returns the matching entries, most recent first.
+	Query(Query) ([]Entry, error)
+	// Prune removes entries older than maxAge and all but the
+	// maxEntries most recent ones (zero disables either limit),
+	// returning how many were removed.
+	Prune(maxEntries int, maxAge time.Duration) (int, error)
+	// Close closes the history.
+	Close()
+}
+
+type memHistory struct {
+	lock    sync.Mutex
+	entries []*Entry // in presentation order
+}
+
+// byPresented sorts entries by presentation time.
+type byPresented []*Entry
+
+func (b byPresented) Len() int           { return len(b) }
+func (b byPresented) Less(i, j int) bool { return b[i].Presented.Before(b[j].Presented) }
+func (b byPresented) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func (m *memHistory) find(nid string) *Entry {
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		if m.entries[i].Nid == nid {
+			return m.entries[i]
+		}
+	}
+	return nil
+}
+
+func (m *memHistory) Record(e Entry) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	e.Actions = append([]string(nil), e.Actions...)
+	if old := m.find(e.Nid); old != nil {
+		*old = e
+	} else {
+		m.entries = append(m.entries, &e)
+	}
+	sort.Stable(byPresented(m.entries))
+	return nil
+}
+
+func (m *memHistory) MarkActioned(nid string, action string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if e := m.find(nid); e != nil {
+		e.Actions = append(e.Actions, action)
+	}
+	return nil
+}
+
+func (m *memHistory) MarkDismissed(nid string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if e := m.find(nid); e != nil {
+		e.Dismissed = true
+	}
+	return nil
+}
+
+func (m *memHistory) Query(q Query) ([]Entry, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var acc []Entry
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		if q.Limit > 0 && len(acc) >= q.Limit {
+			break
+		}
+		e := m.entries[i]
+		if q.matches(e) {
+			c := *e
+			c.Actions = append([]string(nil), e.Actions...)
+			acc = append(acc, c)
+		}
+	}
+	return acc, nil
+}
+
+func (m *memHistory) Prune(maxEntries int, maxAge time.Duration) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	n := len(m.entries)
+	keep := m.entries
+	if maxAge > 0 {
+		cutoff := time.Now().Add(-maxAge)
+		i := 0
+		for i < len(keep) && keep[i].Presented.Before(cutoff) {
+			i++
+		}
+		keep = keep[i:]
+	}
+	if maxEntries > 0 && len(keep) > maxEntries {
+		keep = keep[len(keep)-maxEntries:]
+	}
+	m.entries = append([]*Entry(nil), keep...)
+	return n - len(m.entries), nil
+}
+
+func (m *memHistory) Close() {
+}
+
+var _ History = (*memHistory)(nil)
+
+// NewHistory returns an implementation of History that is
+// memory-based and does not save state.
+func NewHistory() (History, error) {
+	return &memHistory{}, nil
+}
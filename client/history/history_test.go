@@ -0,0 +1,152 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package history
+
+import (
+	"testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+func TestHistory(t *testing.T) { TestingT(t) }
+
+type hSuite struct {
+	constructor func() (History, error)
+}
+
+var _ = Suite(&hSuite{})
+
+func (s *hSuite) SetUpSuite(c *C) {
+	s.constructor = NewHistory
+}
+
+var t0 = time.Date(2014, 7, 1, 12, 0, 0, 0, time.UTC)
+
+func (s *hSuite) fill(c *C) History {
+	h, err := s.constructor()
+	c.Assert(err, IsNil)
+	nids := []string{"x", "y", "z"}
+	for i, app := range []string{"com.example.a_a_1", "com.example.b_b_1", "com.example.a_a_1"} {
+		c.Assert(h.Record(Entry{
+			Nid:       nids[i],
+			AppId:     app,
+			Package:   app[:len("com.example.a")],
+			Summary:   "summary",
+			Body:      "body",
+			Tag:       "tag",
+			Presented: t0.Add(time.Duration(i) * time.Hour),
+		}), IsNil)
+	}
+	return h
+}
+
+func nids(entries []Entry) []string {
+	acc := []string{}
+	for _, e := range entries {
+		acc = append(acc, e.Nid)
+	}
+	return acc
+}
+
+func (s *hSuite) TestRecordAndQuery(c *C) {
+	h := s.fill(c)
+	defer h.Close()
+	entries, err := h.Query(Query{})
+	c.Assert(err, IsNil)
+	c.Check(nids(entries), DeepEquals, []string{"z", "y", "x"})
+	e := entries[2]
+	c.Check(e.AppId, Equals, "com.example.a_a_1")
+	c.Check(e.Package, Equals, "com.example.a")
+	c.Check(e.Summary, Equals, "summary")
+	c.Check(e.Body, Equals, "body")
+	c.Check(e.Tag, Equals, "tag")
+	c.Check(e.Presented.Equal(t0), Equals, true)
+	c.Check(e.Actions, HasLen, 0)
+	c.Check(e.Dismissed, Equals, false)
+}
+
+func (s *hSuite) TestQueryFilters(c *C) {
+	h := s.fill(c)
+	defer h.Close()
+	for _, t := range []struct {
+		q        Query
+		expected []string
+	}{
+		{Query{AppId: "com.example.a_a_1"}, []string{"z", "x"}},
+		{Query{AppId: "com.example.b"}, []string{"y"}},
+		{Query{AppId: "com.example.c"}, []string{}},
+		{Query{Since: t0.Add(time.Hour)}, []string{"z", "y"}},
+		{Query{Until: t0.Add(time.Hour)}, []string{"y", "x"}},
+		{Query{Since: t0.Add(time.Hour), Until: t0.Add(time.Hour)}, []string{"y"}},
+		{Query{AppId: "com.example.a", Since: t0.Add(time.Minute)}, []string{"z"}},
+		{Query{Limit: 2}, []string{"z", "y"}},
+	} {
+		entries, err := h.Query(t.q)
+		c.Assert(err, IsNil)
+		c.Check(nids(entries), DeepEquals, t.expected, Commentf("%#v", t.q))
+	}
+}
+
+func (s *hSuite) TestMarks(c *C) {
+	h := s.fill(c)
+	defer h.Close()
+	c.Check(h.MarkActioned("x", "http://one"), IsNil)
+	c.Check(h.MarkActioned("x", "http://two"), IsNil)
+	c.Check(h.MarkDismissed("y"), IsNil)
+	// unknown ids are ignored
+	c.Check(h.MarkActioned("nope", "http://three"), IsNil)
+	c.Check(h.MarkDismissed("nope"), IsNil)
+	entries, err := h.Query(Query{})
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 3)
+	c.Check(entries[2].Actions, DeepEquals, []string{"http://one", "http://two"})
+	c.Check(entries[2].Dismissed, Equals, false)
+	c.Check(entries[1].Actions, HasLen, 0)
+	c.Check(entries[1].Dismissed, Equals, true)
+}
+
+func (s *hSuite) TestPruneBySize(c *C) {
+	h := s.fill(c)
+	defer h.Close()
+	n, err := h.Prune(2, 0)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 1)
+	entries, err := h.Query(Query{})
+	c.Assert(err, IsNil)
+	c.Check(nids(entries), DeepEquals, []string{"z", "y"})
+}
+
+func (s *hSuite) TestPruneByAge(c *C) {
+	h := s.fill(c)
+	defer h.Close()
+	c.Assert(h.Record(Entry{Nid: "now", Presented: time.Now()}), IsNil)
+	n, err := h.Prune(0, time.Hour)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 3)
+	entries, err := h.Query(Query{})
+	c.Assert(err, IsNil)
+	c.Check(nids(entries), DeepEquals, []string{"now"})
+}
+
+func (s *hSuite) TestPruneNoLimits(c *C) {
+	h := s.fill(c)
+	defer h.Close()
+	n, err := h.Prune(0, 0)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 0)
+}
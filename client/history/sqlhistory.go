@@ -0,0 +1,163 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package history
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type sqliteHistory struct {
+	db *sql.DB
+}
+
+// NewSqliteHistory returns an implementation of History that keeps
+// and persists the entries in an sqlite database.
+func NewSqliteHistory(filename string) (History, error) {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open sqlite history %#v: %v", filename, err)
+	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS history (nid text primary key, app_id text, package text, summary text, body text, tag text, presented integer, actions text, dismissed integer)")
+	if err != nil {
+		return nil, fmt.Errorf("cannot (re)create sqlite history table: %v", err)
+	}
+	return &sqliteHistory{db}, nil
+}
+
+// Closes closes the underlying db.
+func (h *sqliteHistory) Close() {
+	h.db.Close()
+}
+
+func (h *sqliteHistory) Record(e Entry) error {
+	actions, err := json.Marshal(e.Actions)
+	if err != nil {
+		return fmt.Errorf("cannot marshal actions of %#v: %v", e.Nid, err)
+	}
+	_, err = h.db.Exec("REPLACE INTO history (nid, app_id, package, summary, body, tag, presented, actions, dismissed) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		e.Nid, e.AppId, e.Package, e.Summary, e.Body, e.Tag, e.Presented.UnixNano(), string(actions), e.Dismissed)
+	if err != nil {
+		return fmt.Errorf("cannot record %#v in history: %v", e.Nid, err)
+	}
+	return nil
+}
+
+func (h *sqliteHistory) MarkActioned(nid string, action string) error {
+	var raw string
+	err := h.db.QueryRow("SELECT actions FROM history WHERE nid = ?", nid).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot retrieve actions of %#v from history: %v", nid, err)
+	}
+	var actions []string
+	if err = json.Unmarshal([]byte(raw), &actions); err != nil {
+		return fmt.Errorf("cannot unmarshal actions of %#v: %v", nid, err)
+	}
+	updated, _ := json.Marshal(append(actions, action))
+	_, err = h.db.Exec("UPDATE history SET actions = ? WHERE nid = ?", string(updated), nid)
+	if err != nil {
+		return fmt.Errorf("cannot mark %#v as actioned in history: %v", nid, err)
+	}
+	return nil
+}
+
+func (h *sqliteHistory) MarkDismissed(nid string) error {
+	_, err := h.db.Exec("UPDATE history SET dismissed = 1 WHERE nid = ?", nid)
+	if err != nil {
+		return fmt.Errorf("cannot mark %#v as dismissed in history: %v", nid, err)
+	}
+	return nil
+}
+
+func (h *sqliteHistory) Query(q Query) ([]Entry, error) {
+	var conds []string
+	var args []interface{}
+	if q.AppId != "" {
+		conds = append(conds, "(app_id = ? OR package = ?)")
+		args = append(args, q.AppId, q.AppId)
+	}
+	if !q.Since.IsZero() {
+		conds = append(conds, "presented >= ?")
+		args = append(args, q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		conds = append(conds, "presented <= ?")
+		args = append(args, q.Until.UnixNano())
+	}
+	stmt := "SELECT nid, app_id, package, summary, body, tag, presented, actions, dismissed FROM history"
+	if len(conds) > 0 {
+		stmt += " WHERE " + strings.Join(conds, " AND ")
+	}
+	stmt += " ORDER BY presented DESC"
+	if q.Limit > 0 {
+		stmt += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+	rows, err := h.db.Query(stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query history: %v", err)
+	}
+	defer rows.Close()
+	var acc []Entry
+	for rows.Next() {
+		var e Entry
+		var presented int64
+		var actions string
+		err = rows.Scan(&e.Nid, &e.AppId, &e.Package, &e.Summary, &e.Body, &e.Tag, &presented, &actions, &e.Dismissed)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read entry from history: %v", err)
+		}
+		if err = json.Unmarshal([]byte(actions), &e.Actions); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal actions of %#v: %v", e.Nid, err)
+		}
+		e.Presented = time.Unix(0, presented)
+		acc = append(acc, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read entries from history: %v", err)
+	}
+	return acc, nil
+}
+
+func (h *sqliteHistory) Prune(maxEntries int, maxAge time.Duration) (int, error) {
+	n := 0
+	if maxAge > 0 {
+		res, err := h.db.Exec("DELETE FROM history WHERE presented < ?", time.Now().Add(-maxAge).UnixNano())
+		if err != nil {
+			return n, fmt.Errorf("cannot prune history by age: %v", err)
+		}
+		k, _ := res.RowsAffected()
+		n += int(k)
+	}
+	if maxEntries > 0 {
+		res, err := h.db.Exec("DELETE FROM history WHERE nid NOT IN (SELECT nid FROM history ORDER BY presented DESC LIMIT ?)", maxEntries)
+		if err != nil {
+			return n, fmt.Errorf("cannot prune history by size: %v", err)
+		}
+		k, _ := res.RowsAffected()
+		n += int(k)
+	}
+	return n, nil
+}
@@ -0,0 +1,66 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package history
+
+import (
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+	. "launchpad.net/gocheck"
+)
+
+type sqlhSuite struct{ hSuite }
+
+var _ = Suite(&sqlhSuite{})
+
+func (s *sqlhSuite) SetUpSuite(c *C) {
+	s.constructor = func() (History, error) { return NewSqliteHistory(":memory:") }
+}
+
+func (s *sqlhSuite) TestNewCanFail(c *C) {
+	h, err := NewSqliteHistory("/does/not/exist")
+	c.Assert(h, IsNil)
+	c.Check(err, NotNil)
+}
+
+func (s *sqlhSuite) TestPersists(c *C) {
+	filename := c.MkDir() + "/test.db"
+	h, err := NewSqliteHistory(filename)
+	c.Assert(err, IsNil)
+	c.Assert(h.Record(Entry{Nid: "x", AppId: "com.example.a_a_1", Presented: t0}), IsNil)
+	h.Close()
+	h, err = NewSqliteHistory(filename)
+	c.Assert(err, IsNil)
+	defer h.Close()
+	entries, err := h.Query(Query{})
+	c.Assert(err, IsNil)
+	c.Check(nids(entries), DeepEquals, []string{"x"})
+}
+
+func (s *sqlhSuite) TestQueryCanFail(c *C) {
+	filename := c.MkDir() + "/test.db"
+	db, err := sql.Open("sqlite3", filename)
+	c.Assert(err, IsNil)
+	// create the wrong kind of table
+	_, err = db.Exec("CREATE TABLE history (foo)")
+	c.Assert(err, IsNil)
+	h, err := NewSqliteHistory(filename)
+	c.Assert(err, IsNil)
+	_, err = h.Query(Query{})
+	c.Check(err, ErrorMatches, "cannot query history: .*")
+	c.Check(h.Record(Entry{Nid: "x"}), ErrorMatches, "cannot record .*")
+}
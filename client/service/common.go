@@ -53,6 +53,7 @@ var (
 	ErrBadArgType     = errors.New("bad argument type")
 	ErrBadJSON        = errors.New("bad json data")
 	ErrAppIdMismatch  = errors.New("package must be prefix of app id")
+	ErrNotForPackages = errors.New("not available to packages")
 )
 
 // IsRunning() returns whether the service's state is StateRunning
@@ -130,3 +131,21 @@ func (svc *DBusService) grabDBusPackageAndAppId(path string, args []interface{},
 	}
 	return
 }
+
+// grabScope() extracts the package the caller is restricted to from
+// the last element of the dbus path; "" (quoted as "_") means no
+// restriction, for the methods that aren't meant for apps.
+func grabScope(path string) string {
+	return string(nih.Unquote([]byte(path[strings.LastIndex(path, "/")+1:])))
+}
+
+// appListed() checks whether app is in ids, given as package names
+// or app ids with or without version.
+func appListed(app *click.AppId, ids []string) bool {
+	for _, id := range ids {
+		if id == app.Package || id == app.Base() || id == app.Original() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"encoding/json"
+
+	"github.com/ubports/ubuntu-push/bus"
+	"github.com/ubports/ubuntu-push/logger"
+)
+
+// A DebugReporter reports on the state of the client, for
+// troubleshooting.
+type DebugReporter interface {
+	DebugReport() interface{}
+}
+
+// DebugServiceSetup encapsulates the params for setting up a
+// DebugService.
+type DebugServiceSetup struct {
+	Reporter DebugReporter
+}
+
+// DebugService is the dbus api for looking into the client.
+type DebugService struct {
+	DBusService
+	reporter DebugReporter
+}
+
+var (
+	DebugServiceBusAddress = bus.Address{
+		Interface: "com.ubuntu.PushDebug",
+		Path:      "/com/ubuntu/PushDebug",
+		Name:      "com.ubuntu.PushDebug",
+	}
+)
+
+// NewDebugService() builds a new service and returns it.
+func NewDebugService(setup *DebugServiceSetup, log logger.Logger) *DebugService {
+	var svc = &DebugService{}
+	svc.Log = log
+	svc.Bus = bus.SessionBus.Endpoint(DebugServiceBusAddress, log)
+	svc.reporter = setup.Reporter
+	return svc
+}
+
+// Start() dials the bus, grab the name, and listens for method calls.
+func (svc *DebugService) Start() error {
+	return svc.DBusService.Start(bus.DispatchMap{
+		"Report": svc.report,
+	}, DebugServiceBusAddress, svc.init)
+}
+
+func (svc *DebugService) init() error {
+	if svc.reporter == nil {
+		return ErrNotConfigured
+	}
+	return nil
+}
+
+func (svc *DebugService) report(path string, args, _ []interface{}) ([]interface{}, error) {
+	if len(args) != 0 {
+		return nil, ErrBadArgCount
+	}
+	if grabScope(path) != "" {
+		return nil, ErrNotForPackages
+	}
+	b, err := json.Marshal(svc.reporter.DebugReport())
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{string(b)}, nil
+}
@@ -0,0 +1,76 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	. "launchpad.net/gocheck"
+
+	testibus "github.com/ubports/ubuntu-push/bus/testing"
+	helpers "github.com/ubports/ubuntu-push/testing"
+	"github.com/ubports/ubuntu-push/testing/condition"
+)
+
+type debugSuite struct {
+	log *helpers.TestLogger
+}
+
+var _ = Suite(&debugSuite{})
+
+type fakeReporter map[string]interface{}
+
+func (r fakeReporter) DebugReport() interface{} { return map[string]interface{}(r) }
+
+func (ds *debugSuite) SetUpTest(c *C) {
+	ds.log = helpers.NewTestLogger(c, "debug")
+}
+
+func (ds *debugSuite) newService() *DebugService {
+	svc := NewDebugService(&DebugServiceSetup{Reporter: fakeReporter{"state": "Running"}}, ds.log)
+	svc.Bus = testibus.NewTestingEndpoint(condition.Work(true), nil)
+	return svc
+}
+
+func (ds *debugSuite) TestStart(c *C) {
+	svc := ds.newService()
+	c.Check(svc.Start(), IsNil)
+	c.Check(svc.IsRunning(), Equals, true)
+	svc.Stop()
+}
+
+func (ds *debugSuite) TestStartNoReporter(c *C) {
+	svc := ds.newService()
+	svc.reporter = nil
+	c.Check(svc.Start(), Equals, ErrNotConfigured)
+}
+
+func (ds *debugSuite) TestReport(c *C) {
+	svc := ds.newService()
+	rvs, err := svc.report("/_", nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(rvs, DeepEquals, []interface{}{`{"state":"Running"}`})
+}
+
+func (ds *debugSuite) TestReportFails(c *C) {
+	svc := ds.newService()
+	_, err := svc.report("/_", []interface{}{1}, nil)
+	c.Check(err, Equals, ErrBadArgCount)
+	_, err = svc.report(aPackageOnBus, nil, nil)
+	c.Check(err, Equals, ErrNotForPackages)
+	svc.reporter = fakeReporter{"bad": make(chan int)}
+	_, err = svc.report("/_", nil, nil)
+	c.Check(err, NotNil)
+}
@@ -0,0 +1,183 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/ubports/ubuntu-push/bus"
+	"github.com/ubports/ubuntu-push/client/history"
+	"github.com/ubports/ubuntu-push/logger"
+)
+
+// HistoryServiceSetup encapsulates the params for setting up a
+// HistoryService.
+type HistoryServiceSetup struct {
+	History    history.History
+	MaxEntries int
+	MaxAge     time.Duration
+}
+
+// HistoryService is the dbus api to the notification history.
+type HistoryService struct {
+	DBusService
+	history    history.History
+	maxEntries int
+	maxAge     time.Duration
+}
+
+var (
+	HistoryServiceBusAddress = bus.Address{
+		Interface: "com.ubuntu.PushHistory",
+		Path:      "/com/ubuntu/PushHistory",
+		Name:      "com.ubuntu.PushHistory",
+	}
+)
+
+// how often the history is pruned to the configured limits
+var historyPruneInterval = time.Hour
+
+// NewHistoryService() builds a new service and returns it.
+func NewHistoryService(setup *HistoryServiceSetup, log logger.Logger) *HistoryService {
+	var svc = &HistoryService{}
+	svc.Log = log
+	svc.Bus = bus.SessionBus.Endpoint(HistoryServiceBusAddress, log)
+	svc.history = setup.History
+	svc.maxEntries = setup.MaxEntries
+	svc.maxAge = setup.MaxAge
+	return svc
+}
+
+// Start() dials the bus, grab the name, and listens for method calls.
+func (svc *HistoryService) Start() error {
+	return svc.DBusService.Start(bus.DispatchMap{
+		"Query": svc.query,
+		"Prune": svc.prune,
+	}, HistoryServiceBusAddress, svc.init)
+}
+
+func (svc *HistoryService) init() error {
+	if svc.history == nil {
+		return ErrNotConfigured
+	}
+	svc.autoPrune()
+	go svc.pruneLoop()
+	return nil
+}
+
+// autoPrune prunes the history to the configured limits.
+func (svc *HistoryService) autoPrune() {
+	n, err := svc.history.Prune(svc.maxEntries, svc.maxAge)
+	if err != nil {
+		svc.Log.Errorf("unable to prune history: %v", err)
+		return
+	}
+	if n > 0 {
+		svc.Log.Debugf("pruned %d entries from history", n)
+	}
+}
+
+func (svc *HistoryService) pruneLoop() {
+	for {
+		time.Sleep(historyPruneInterval)
+		if !svc.IsRunning() {
+			return
+		}
+		svc.autoPrune()
+	}
+}
+
+func timeArg(arg interface{}) (time.Time, bool) {
+	secs, ok := arg.(int64)
+	if !ok {
+		return time.Time{}, false
+	}
+	if secs == 0 {
+		return time.Time{}, true
+	}
+	return time.Unix(secs, 0), true
+}
+
+func (svc *HistoryService) query(path string, args, _ []interface{}) ([]interface{}, error) {
+	if len(args) != 4 {
+		return nil, ErrBadArgCount
+	}
+	var q history.Query
+	var ok bool
+	q.AppId, ok = args[0].(string)
+	if !ok {
+		return nil, ErrBadArgType
+	}
+	q.Since, ok = timeArg(args[1])
+	if !ok {
+		return nil, ErrBadArgType
+	}
+	q.Until, ok = timeArg(args[2])
+	if !ok {
+		return nil, ErrBadArgType
+	}
+	limit, ok := args[3].(uint32)
+	if !ok {
+		return nil, ErrBadArgType
+	}
+	q.Limit = int(limit)
+	if scope := grabScope(path); scope != "" {
+		if q.AppId == "" {
+			q.AppId = scope
+		} else if q.AppId != scope && !strings.HasPrefix(q.AppId, scope+"_") {
+			return nil, ErrAppIdMismatch
+		}
+	}
+
+	entries, err := svc.history.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, len(entries))
+	for i, entry := range entries {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = string(b)
+	}
+	return []interface{}{res}, nil
+}
+
+func (svc *HistoryService) prune(path string, args, _ []interface{}) ([]interface{}, error) {
+	if len(args) != 2 {
+		return nil, ErrBadArgCount
+	}
+	if grabScope(path) != "" {
+		return nil, ErrNotForPackages
+	}
+	maxEntries, ok := args[0].(uint32)
+	if !ok {
+		return nil, ErrBadArgType
+	}
+	maxAge, ok := args[1].(int64)
+	if !ok {
+		return nil, ErrBadArgType
+	}
+	n, err := svc.history.Prune(int(maxEntries), time.Duration(maxAge)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{uint32(n)}, nil
+}
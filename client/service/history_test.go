@@ -0,0 +1,168 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	testibus "github.com/ubports/ubuntu-push/bus/testing"
+	"github.com/ubports/ubuntu-push/client/history"
+	helpers "github.com/ubports/ubuntu-push/testing"
+	"github.com/ubports/ubuntu-push/testing/condition"
+)
+
+type historySuite struct {
+	log  *helpers.TestLogger
+	hist history.History
+}
+
+var _ = Suite(&historySuite{})
+
+func (hs *historySuite) SetUpTest(c *C) {
+	hs.log = helpers.NewTestLogger(c, "debug")
+	hs.hist, _ = history.NewHistory()
+	now := time.Now()
+	pkgs := []string{aPackage, "com.example.other", aPackage}
+	for i, app := range []string{anAppId, "com.example.other_app", anAppId} {
+		c.Assert(hs.hist.Record(history.Entry{
+			Nid:       []string{"x", "y", "z"}[i],
+			AppId:     app,
+			Package:   pkgs[i],
+			Summary:   "hello",
+			Presented: now.Add(time.Duration(i-3) * time.Hour),
+		}), IsNil)
+	}
+}
+
+func (hs *historySuite) newService() *HistoryService {
+	svc := NewHistoryService(&HistoryServiceSetup{History: hs.hist}, hs.log)
+	svc.Bus = testibus.NewTestingEndpoint(condition.Work(true), nil)
+	return svc
+}
+
+func (hs *historySuite) TestStart(c *C) {
+	svc := hs.newService()
+	c.Check(svc.Start(), IsNil)
+	c.Check(svc.IsRunning(), Equals, true)
+	svc.Stop()
+}
+
+func (hs *historySuite) TestStartNoHistory(c *C) {
+	svc := hs.newService()
+	svc.history = nil
+	c.Check(svc.Start(), Equals, ErrNotConfigured)
+}
+
+func (hs *historySuite) TestStartPrunes(c *C) {
+	svc := hs.newService()
+	svc.maxEntries = 1
+	c.Assert(svc.Start(), IsNil)
+	defer svc.Stop()
+	entries, err := hs.hist.Query(history.Query{})
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Check(entries[0].Nid, Equals, "z")
+	c.Check(hs.log.Captured(), Matches, `(?ms).*pruned 2 entries from history.*`)
+}
+
+func (hs *historySuite) decode(c *C, rvs []interface{}) []string {
+	c.Assert(rvs, HasLen, 1)
+	raw, ok := rvs[0].([]string)
+	c.Assert(ok, Equals, true)
+	nids := []string{}
+	for _, s := range raw {
+		var e history.Entry
+		c.Assert(json.Unmarshal([]byte(s), &e), IsNil)
+		nids = append(nids, e.Nid)
+	}
+	return nids
+}
+
+func (hs *historySuite) TestQuery(c *C) {
+	svc := hs.newService()
+	hour := time.Now().Add(-90 * time.Minute).Unix()
+	for _, t := range []struct {
+		path     string
+		args     []interface{}
+		expected []string
+	}{
+		{"/_", []interface{}{"", int64(0), int64(0), uint32(0)}, []string{"z", "y", "x"}},
+		{"/_", []interface{}{anAppId, int64(0), int64(0), uint32(0)}, []string{"z", "x"}},
+		{"/_", []interface{}{"", hour, int64(0), uint32(0)}, []string{"z"}},
+		{"/_", []interface{}{"", int64(0), hour, uint32(0)}, []string{"y", "x"}},
+		{"/_", []interface{}{"", int64(0), int64(0), uint32(1)}, []string{"z"}},
+		{aPackageOnBus, []interface{}{"", int64(0), int64(0), uint32(0)}, []string{"z", "x"}},
+		{aPackageOnBus, []interface{}{anAppId, int64(0), int64(0), uint32(0)}, []string{"z", "x"}},
+	} {
+		rvs, err := svc.query(t.path, t.args, nil)
+		c.Assert(err, IsNil)
+		c.Check(hs.decode(c, rvs), DeepEquals, t.expected, Commentf("%s %v", t.path, t.args))
+	}
+}
+
+func (hs *historySuite) TestQueryFails(c *C) {
+	svc := hs.newService()
+	for i, t := range []struct {
+		path string
+		args []interface{}
+		err  error
+	}{
+		{"/_", []interface{}{}, ErrBadArgCount},
+		{"/_", []interface{}{1, int64(0), int64(0), uint32(0)}, ErrBadArgType},
+		{"/_", []interface{}{"", 0, int64(0), uint32(0)}, ErrBadArgType},
+		{"/_", []interface{}{"", int64(0), "", uint32(0)}, ErrBadArgType},
+		{"/_", []interface{}{"", int64(0), int64(0), 0}, ErrBadArgType},
+		{aPackageOnBus, []interface{}{"com.example.other_app", int64(0), int64(0), uint32(0)}, ErrAppIdMismatch},
+	} {
+		_, err := svc.query(t.path, t.args, nil)
+		c.Check(err, Equals, t.err, Commentf("%d", i))
+	}
+}
+
+func (hs *historySuite) TestPrune(c *C) {
+	svc := hs.newService()
+	rvs, err := svc.prune("/_", []interface{}{uint32(0), int64(150 * 60)}, nil)
+	c.Assert(err, IsNil)
+	c.Check(rvs, DeepEquals, []interface{}{uint32(1)})
+	rvs, err = svc.prune("/_", []interface{}{uint32(1), int64(0)}, nil)
+	c.Assert(err, IsNil)
+	c.Check(rvs, DeepEquals, []interface{}{uint32(1)})
+	entries, err := hs.hist.Query(history.Query{})
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Check(entries[0].Nid, Equals, "z")
+}
+
+func (hs *historySuite) TestPruneFails(c *C) {
+	svc := hs.newService()
+	for i, t := range []struct {
+		path string
+		args []interface{}
+		err  error
+	}{
+		{"/_", []interface{}{}, ErrBadArgCount},
+		{aPackageOnBus, []interface{}{uint32(0), int64(0)}, ErrNotForPackages},
+		{"/_", []interface{}{0, int64(0)}, ErrBadArgType},
+		{"/_", []interface{}{uint32(0), 0}, ErrBadArgType},
+	} {
+		_, err := svc.prune(t.path, t.args, nil)
+		c.Check(err, Equals, t.err, Commentf("%d", i))
+	}
+}
@@ -0,0 +1,228 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ubports/ubuntu-push/click"
+	"github.com/ubports/ubuntu-push/launch_helper"
+)
+
+var (
+	ErrBadImage      = errors.New("image must be an https URL or a file in the app's cache dir")
+	ErrImageTooLarge = errors.New("image too large")
+	ErrImageMetered  = errors.New("not fetching images over a metered connection")
+)
+
+var (
+	// the largest image attachment accepted, in bytes
+	maxImageSize int64 = 2 << 20
+	// how long fetching an image attachment can take
+	imageFetchTimeout = 10 * time.Second
+	// how long a fetched image is kept around for the bubble
+	// showing it, if there's no card in the messaging menu
+	imageLinger = time.Minute
+)
+
+// a fetchedImage is an image attachment downloaded for a notification.
+type fetchedImage struct {
+	path    string
+	fetched time.Time
+}
+
+// httpsOnly keeps image downloads from being redirected away from https.
+func httpsOnly(req *http.Request, via []*http.Request) error {
+	if req.URL.Scheme != "https" {
+		return ErrBadImage
+	}
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return nil
+}
+
+// fetchesImage says whether presenting the notification means
+// downloading an image first.
+func (svc *PostalService) fetchesImage(notif *launch_helper.Notification) bool {
+	if notif.Card == nil || !strings.HasPrefix(notif.Card.Image, "https://") {
+		return false
+	}
+	return svc.metered == nil || !svc.metered.Metered()
+}
+
+// queuePresent queues the presentation of a notification with an
+// image to download, and of the ones of the same app that follow it
+// while that's going on, so that the download neither holds up the
+// handling of other notifications nor lets later ones of the app
+// overtake it. It returns false if the notification can be presented
+// right away instead.
+func (svc *PostalService) queuePresent(app *click.AppId, nid string, notif *launch_helper.Notification) bool {
+	queued := svc.presenting.add(app.Original(), svc.fetchesImage(notif), func() {
+		svc.present(app, nid, svc.withLocalImage(app, nid, notif))
+	})
+	if queued {
+		svc.Log.Debugf("[%s] presentation queued behind an image download", nid)
+	}
+	return queued
+}
+
+// withLocalImage returns the notification with its card's image
+// attachment resolved to a local file, or dropped if it can't be.
+func (svc *PostalService) withLocalImage(app *click.AppId, nid string, notif *launch_helper.Notification) *launch_helper.Notification {
+	if notif.Card == nil || notif.Card.Image == "" {
+		return notif
+	}
+	image, fetched, err := svc.localImage(app, notif.Card.Image)
+	if err != nil {
+		svc.Log.Errorf("[%s] dropping image %#v: %v", nid, notif.Card.Image, err)
+	}
+	if fetched {
+		svc.keepImage(nid, image)
+	}
+	card := *notif.Card
+	card.Image = image
+	withImage := *notif
+	withImage.Card = &card
+	return &withImage
+}
+
+// localImage checks an image reference, downloading it into the
+// app's cache dir if it's a URL, and returns the path of the file,
+// and whether it was downloaded.
+func (svc *PostalService) localImage(app *click.AppId, image string) (string, bool, error) {
+	dir, err := launch_helper.GetTempDir(app.Package)
+	if err != nil {
+		return "", false, err
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", false, err
+	}
+	u, err := url.Parse(image)
+	if err != nil {
+		return "", false, ErrBadImage
+	}
+	switch u.Scheme {
+	case "https":
+		if svc.metered != nil && svc.metered.Metered() {
+			return "", false, ErrImageMetered
+		}
+		path, err := svc.downloadImage(image, dir)
+		return path, err == nil, err
+	case "file", "":
+		path, err := filepath.EvalSymlinks(u.Path)
+		if err != nil {
+			return "", false, err
+		}
+		if !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return "", false, ErrBadImage
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", false, err
+		}
+		if !fi.Mode().IsRegular() {
+			return "", false, ErrBadImage
+		}
+		if fi.Size() > maxImageSize {
+			return "", false, ErrImageTooLarge
+		}
+		return path, false, nil
+	default:
+		return "", false, ErrBadImage
+	}
+}
+
+func (svc *PostalService) downloadImage(src, dir string) (string, error) {
+	resp, err := svc.imageCli.Get(src)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching image: %s", resp.Status)
+	}
+	if resp.ContentLength > maxImageSize {
+		return "", ErrImageTooLarge
+	}
+	f, err := ioutil.TempFile(dir, "push-image")
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(f, io.LimitReader(resp.Body, maxImageSize+1))
+	f.Close()
+	if err == nil && n > maxImageSize {
+		err = ErrImageTooLarge
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// keepImage notes the image downloaded for the notification, for it
+// to be removed once the notification is gone.
+func (svc *PostalService) keepImage(nid string, path string) {
+	svc.imagesLock.Lock()
+	if svc.images == nil {
+		svc.images = make(map[string]*fetchedImage)
+	}
+	svc.images[nid] = &fetchedImage{path: path, fetched: time.Now()}
+	svc.imagesLock.Unlock()
+	time.AfterFunc(imageLinger, svc.sweepImages)
+}
+
+// forgetImage removes the image downloaded for the notification, if any.
+func (svc *PostalService) forgetImage(nid string) {
+	svc.imagesLock.Lock()
+	defer svc.imagesLock.Unlock()
+	if img := svc.images[nid]; img != nil {
+		os.Remove(img.path)
+		delete(svc.images, nid)
+	}
+}
+
+// sweepImages removes the downloaded images that are no longer
+// shown, neither in a bubble nor in the messaging menu.
+func (svc *PostalService) sweepImages() {
+	var old []string
+	svc.imagesLock.Lock()
+	for nid, img := range svc.images {
+		if time.Since(img.fetched) >= imageLinger {
+			old = append(old, nid)
+		}
+	}
+	svc.imagesLock.Unlock()
+	// not holding the lock, as the messaging menu reports
+	// dismissals while holding its own
+	for _, nid := range old {
+		if svc.messagingMenu == nil || !svc.messagingMenu.Has(nid) {
+			svc.forgetImage(nid)
+		}
+	}
+}
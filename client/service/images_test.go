@@ -0,0 +1,285 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/ubports/ubuntu-push/click"
+	clickhelp "github.com/ubports/ubuntu-push/click/testing"
+	"github.com/ubports/ubuntu-push/launch_helper"
+	helpers "github.com/ubports/ubuntu-push/testing"
+)
+
+type imagesSuite struct {
+	log        *helpers.TestLogger
+	dir        string
+	getTempDir func(string) (string, error)
+	maxSize    int64
+	linger     time.Duration
+}
+
+var _ = Suite(&imagesSuite{})
+
+func (is *imagesSuite) SetUpTest(c *C) {
+	is.log = helpers.NewTestLogger(c, "debug")
+	is.getTempDir = launch_helper.GetTempDir
+	d := c.MkDir()
+	is.dir = filepath.Join(d, aPackage)
+	launch_helper.GetTempDir = func(pkgName string) (string, error) {
+		tmpDir := filepath.Join(d, pkgName)
+		return tmpDir, os.MkdirAll(tmpDir, 0700)
+	}
+	is.maxSize = maxImageSize
+	maxImageSize = 10
+	is.linger = imageLinger
+}
+
+func (is *imagesSuite) TearDownTest(c *C) {
+	launch_helper.GetTempDir = is.getTempDir
+	maxImageSize = is.maxSize
+	imageLinger = is.linger
+}
+
+type meteredFlag bool
+
+func (m meteredFlag) Metered() bool { return bool(m) }
+
+// newService makes a service that trusts the test TLS servers.
+func (is *imagesSuite) newService(setup *PostalServiceSetup) *PostalService {
+	svc := NewPostalService(setup, is.log)
+	svc.imageCli = &http.Client{
+		Transport:     &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		CheckRedirect: httpsOnly,
+	}
+	return svc
+}
+
+func (is *imagesSuite) TestLocalImageFile(c *C) {
+	svc := is.newService(&PostalServiceSetup{})
+	app := clickhelp.MustParseAppId(anAppId)
+	_, err := launch_helper.GetTempDir(aPackage)
+	c.Assert(err, IsNil)
+	path := filepath.Join(is.dir, "img.png")
+	c.Assert(ioutil.WriteFile(path, []byte("png"), 0600), IsNil)
+	image, fetched, err := svc.localImage(app, path)
+	c.Assert(err, IsNil)
+	c.Check(image, Equals, path)
+	c.Check(fetched, Equals, false)
+	image, fetched, err = svc.localImage(app, "file://"+path)
+	c.Assert(err, IsNil)
+	c.Check(image, Equals, path)
+	c.Check(fetched, Equals, false)
+}
+
+func (is *imagesSuite) TestLocalImageFileFails(c *C) {
+	svc := is.newService(&PostalServiceSetup{})
+	app := clickhelp.MustParseAppId(anAppId)
+	_, err := launch_helper.GetTempDir(aPackage)
+	c.Assert(err, IsNil)
+	big := filepath.Join(is.dir, "big.png")
+	c.Assert(ioutil.WriteFile(big, []byte("this is too big"), 0600), IsNil)
+	outside := filepath.Join(filepath.Dir(is.dir), "outside.png")
+	c.Assert(ioutil.WriteFile(outside, []byte("png"), 0600), IsNil)
+	link := filepath.Join(is.dir, "link.png")
+	c.Assert(os.Symlink(outside, link), IsNil)
+	badImage := regexp.QuoteMeta(ErrBadImage.Error())
+	tooLarge := regexp.QuoteMeta(ErrImageTooLarge.Error())
+	for _, t := range []struct {
+		image string
+		err   string
+	}{
+		{big, tooLarge},
+		{outside, badImage},
+		{link, badImage},
+		{is.dir + "/../" + aPackage + "/../outside.png", badImage},
+		{is.dir, badImage},
+		{filepath.Join(is.dir, "nope.png"), ".*no such file.*"},
+		{"ftp://example.com/img.png", badImage},
+		{"http://example.com/img.png", badImage},
+		{"img.png", ".*no such file.*|" + badImage},
+	} {
+		_, _, err := svc.localImage(app, t.image)
+		c.Check(err, ErrorMatches, t.err, Commentf(t.image))
+	}
+}
+
+func (is *imagesSuite) TestLocalImageDownloads(c *C) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Write([]byte("png"))
+		case "/big":
+			w.Write([]byte(strings.Repeat("x", 100)))
+		case "/chunked":
+			w.Write([]byte("xxxxxx"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("xxxxxx"))
+		case "/insecure":
+			http.Redirect(w, r, "http://example.com/img.png", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	svc := is.newService(&PostalServiceSetup{})
+	app := clickhelp.MustParseAppId(anAppId)
+
+	image, fetched, err := svc.localImage(app, ts.URL+"/small")
+	c.Assert(err, IsNil)
+	c.Check(fetched, Equals, true)
+	c.Check(filepath.Dir(image), Equals, is.dir)
+	content, err := ioutil.ReadFile(image)
+	c.Assert(err, IsNil)
+	c.Check(string(content), Equals, "png")
+
+	_, _, err = svc.localImage(app, ts.URL+"/big")
+	c.Check(err, Equals, ErrImageTooLarge)
+	_, _, err = svc.localImage(app, ts.URL+"/chunked")
+	c.Check(err, Equals, ErrImageTooLarge)
+	_, _, err = svc.localImage(app, ts.URL+"/missing")
+	c.Check(err, ErrorMatches, "fetching image: 404.*")
+	_, _, err = svc.localImage(app, ts.URL+"/insecure")
+	c.Check(err, ErrorMatches, ".*"+regexp.QuoteMeta(ErrBadImage.Error()))
+	// only the good one is left behind
+	files, err := ioutil.ReadDir(is.dir)
+	c.Assert(err, IsNil)
+	c.Check(files, HasLen, 1)
+}
+
+func (is *imagesSuite) TestLocalImageMetered(c *C) {
+	svc := is.newService(&PostalServiceSetup{Metered: meteredFlag(true)})
+	app := clickhelp.MustParseAppId(anAppId)
+	_, fetched, err := svc.localImage(app, "https://example.com/img.png")
+	c.Check(err, Equals, ErrImageMetered)
+	c.Check(fetched, Equals, false)
+	// so there's nothing to wait for
+	notif := &launch_helper.Notification{Card: &launch_helper.Card{Image: "https://example.com/img.png"}}
+	c.Check(svc.fetchesImage(notif), Equals, false)
+	svc.metered = meteredFlag(false)
+	c.Check(svc.fetchesImage(notif), Equals, true)
+}
+
+func (is *imagesSuite) TestWithLocalImage(c *C) {
+	svc := is.newService(&PostalServiceSetup{})
+	app := clickhelp.MustParseAppId(anAppId)
+	notif := &launch_helper.Notification{Card: &launch_helper.Card{Summary: "hi"}}
+	// no image, nothing to do
+	c.Check(svc.withLocalImage(app, "nid", notif), Equals, notif)
+	c.Check(svc.withLocalImage(app, "nid", &launch_helper.Notification{}), NotNil)
+
+	// a bad image is dropped, leaving the original alone
+	notif.Card.Image = "ftp://example.com/img.png"
+	fixed := svc.withLocalImage(app, "nid", notif)
+	c.Check(fixed.Card.Image, Equals, "")
+	c.Check(fixed.Card.Summary, Equals, "hi")
+	c.Check(notif.Card.Image, Equals, "ftp://example.com/img.png")
+	c.Check(is.log.Captured(), Matches, `(?ms).*\[nid\] dropping image "ftp://example.com/img.png": .*`)
+}
+
+type chanPresenter chan string
+
+func (ch chanPresenter) Present(_ *click.AppId, nid string, _ *launch_helper.Notification) bool {
+	ch <- nid
+	return true
+}
+
+func (is *imagesSuite) TestQueuePresent(c *C) {
+	release := make(chan bool)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("png"))
+	}))
+	defer ts.Close()
+	svc := is.newService(&PostalServiceSetup{})
+	presented := make(chanPresenter, 3)
+	svc.Presenters = []Presenter{presented}
+	app1 := clickhelp.MustParseAppId(anAppId)
+	app2 := clickhelp.MustParseAppId("com.example.other_app")
+	withImage := &launch_helper.Notification{Card: &launch_helper.Card{Summary: "hi", Image: ts.URL + "/img.png"}}
+	plain := &launch_helper.Notification{Card: &launch_helper.Card{Summary: "hi"}}
+
+	c.Check(svc.queuePresent(app1, "n1", withImage), Equals, true)
+	// the app's later ones wait their turn
+	c.Check(svc.queuePresent(app1, "n2", plain), Equals, true)
+	// the other apps' don't
+	c.Check(svc.queuePresent(app2, "n3", plain), Equals, false)
+	select {
+	case nid := <-presented:
+		c.Fatalf("%s presented before the image was fetched", nid)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	for _, expected := range []string{"n1", "n2"} {
+		select {
+		case nid := <-presented:
+			c.Check(nid, Equals, expected)
+		case <-time.After(5 * time.Second):
+			c.Fatalf("timed out waiting for %s", expected)
+		}
+	}
+	svc.imagesLock.Lock()
+	defer svc.imagesLock.Unlock()
+	c.Assert(svc.images["n1"], NotNil)
+	c.Check(filepath.Dir(svc.images["n1"].path), Equals, is.dir)
+}
+
+func (is *imagesSuite) TestImagesRemoved(c *C) {
+	svc := is.newService(&PostalServiceSetup{})
+	fmm := &fakeMM{has: map[string]bool{"shown": true}}
+	svc.messagingMenu = fmm
+	imageLinger = time.Hour
+	_, err := launch_helper.GetTempDir(aPackage)
+	c.Assert(err, IsNil)
+	paths := make(map[string]string)
+	for _, nid := range []string{"shown", "gone", "actioned", "recent"} {
+		paths[nid] = filepath.Join(is.dir, nid)
+		c.Assert(ioutil.WriteFile(paths[nid], []byte("png"), 0600), IsNil)
+		svc.keepImage(nid, paths[nid])
+	}
+	exists := func(nid string) bool {
+		_, err := os.Stat(paths[nid])
+		return err == nil
+	}
+	svc.forgetImage("actioned")
+	c.Check(exists("actioned"), Equals, false)
+	// age them all but the recent one
+	svc.imagesLock.Lock()
+	for nid, img := range svc.images {
+		if nid != "recent" {
+			img.fetched = img.fetched.Add(-2 * time.Hour)
+		}
+	}
+	svc.imagesLock.Unlock()
+	svc.sweepImages()
+	// the card is still in the messaging menu
+	c.Check(exists("shown"), Equals, true)
+	c.Check(exists("gone"), Equals, false)
+	// its bubble might still be up
+	c.Check(exists("recent"), Equals, true)
+	c.Check(svc.images, HasLen, 2)
+}
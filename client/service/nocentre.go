@@ -0,0 +1,50 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"github.com/ubports/ubuntu-push/click"
+	"github.com/ubports/ubuntu-push/launch_helper"
+	"github.com/ubports/ubuntu-push/messaging/reply"
+)
+
+// noCentre is the notification centre of headless systems, where
+// there's no messaging menu to keep persistent cards in.
+type noCentre struct {
+	ch chan *reply.MMActionReply
+}
+
+func newNoCentre() *noCentre {
+	return &noCentre{ch: make(chan *reply.MMActionReply)}
+}
+
+var _ notificationCentre = &noCentre{} // ensures it conforms
+
+func (nc *noCentre) Present(*click.AppId, string, *launch_helper.Notification) bool {
+	return false
+}
+
+func (nc *noCentre) GetCh() chan *reply.MMActionReply        { return nc.ch }
+func (nc *noCentre) RemoveNotification(string, bool)         {}
+func (nc *noCentre) Tags(*click.AppId) []string              { return nil }
+func (nc *noCentre) Has(string) bool                         { return false }
+func (nc *noCentre) Tag(string) string                       { return "" }
+func (nc *noCentre) Clear(*click.AppId, ...string) int       { return 0 }
+func (nc *noCentre) ClearIds(*click.AppId, ...string) int    { return 0 }
+func (nc *noCentre) Groups(*click.AppId) []string            { return nil }
+func (nc *noCentre) ClearGroups(*click.AppId, ...string) int { return 0 }
+func (nc *noCentre) Expand(string)                           {}
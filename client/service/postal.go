@@ -18,11 +18,20 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/pborman/uuid"
 
+	"github.com/ubports/ubuntu-push/blob"
 	"github.com/ubports/ubuntu-push/bus"
 	"github.com/ubports/ubuntu-push/bus/accounts"
 	"github.com/ubports/ubuntu-push/bus/emblemcounter"
@@ -32,6 +41,9 @@ import (
 	"github.com/ubports/ubuntu-push/bus/windowstack"
 	"github.com/ubports/ubuntu-push/click"
 	"github.com/ubports/ubuntu-push/click/cnotificationsettings"
+	"github.com/ubports/ubuntu-push/client/history"
+	"github.com/ubports/ubuntu-push/envelope"
+	http13 "github.com/ubports/ubuntu-push/http13client"
 	"github.com/ubports/ubuntu-push/launch_helper"
 	"github.com/ubports/ubuntu-push/logger"
 	"github.com/ubports/ubuntu-push/messaging"
@@ -54,7 +66,26 @@ type notificationCentre interface {
 	GetCh() chan *reply.MMActionReply
 	RemoveNotification(string, bool)
 	Tags(*click.AppId) []string
+	Has(string) bool
+	Tag(string) string
 	Clear(*click.AppId, ...string) int
+	ClearIds(*click.AppId, ...string) int
+	Groups(*click.AppId) []string
+	ClearGroups(*click.AppId, ...string) int
+	Expand(string)
+}
+
+// A DismissalReporter passes on that the user dealt with the
+// notifications of an app with the given tags, for them to be
+// cleared from the user's other devices too.
+type DismissalReporter interface {
+	ReportDismissal(app *click.AppId, tags []string)
+}
+
+// A MeteredChecker says whether the connection is metered, for
+// bulky downloads to wait for a better one.
+type MeteredChecker interface {
+	Metered() bool
 }
 
 // PostalServiceSetup is a configuration object for the service
@@ -62,12 +93,26 @@ type PostalServiceSetup struct {
 	InstalledChecker  click.InstalledChecker
 	FallbackVibration *launch_helper.Vibration
 	FallbackSound     string
+	KeyStore          *envelope.KeyStore
+	QuietHours        *QuietHours
+	History           history.History
+	Dismissals        DismissalReporter
+	Metered           MeteredChecker
+	// Headless makes do without the Ubuntu Touch session services
+	Headless bool
+	// BlobURL is what the payloads delivered by reference are
+	// fetched relative to
+	BlobURL *url.URL
+	// the largest payload fetched by reference, and by app
+	MaxBlobSize     int
+	AppMaxBlobSizes map[string]int
 }
 
 // PostalService is the dbus api
 type PostalService struct {
 	DBusService
 	mbox          map[string]*mBox
+	replies       map[string][]string
 	msgHandler    messageHandler
 	launchers     map[string]launch_helper.HelperLauncher
 	HelperPool    launch_helper.HelperPool
@@ -94,6 +139,36 @@ type PostalService struct {
 	// fallback values for simplified notification usage
 	fallbackVibration *launch_helper.Vibration
 	fallbackSound     string
+	// keys to open sealed payloads
+	keyStore *envelope.KeyStore
+	// the do-not-disturb schedule
+	quietHours *QuietHours
+	// the record of presented notifications
+	history history.History
+	// where to report dismissals for other devices
+	dismissals DismissalReporter
+	// out-of-process presenters, by bus name and object path
+	remotePresenters map[string]*remotePresenter
+	presentersLock   sync.Mutex
+	// without the Ubuntu Touch session services
+	headless bool
+	// for fetching the payloads delivered by reference
+	blobURL *url.URL
+	blobCli *http13.Client
+	// whether the connection is metered
+	metered MeteredChecker
+	// for fetching image attachments, and the files they were
+	// fetched into, by notification id
+	imageCli   *http.Client
+	images     map[string]*fetchedImage
+	imagesLock sync.Mutex
+	// the presentations waiting behind an image download
+	presenting appQueues
+	// the payloads delivered by reference waiting to be fetched
+	fetching appQueues
+	// the largest payload fetched by reference, and by app
+	maxBlobSz     int
+	appMaxBlobSzs map[string]int
 }
 
 var (
@@ -107,6 +182,21 @@ var (
 var (
 	SystemUpdateUrl  = "settings:///system/system-update"
 	useTrivialHelper = os.Getenv("UBUNTU_PUSH_USE_TRIVIAL_HELPER") != ""
+	// how long fetching a payload delivered by reference can take
+	blobFetchTimeout = 30 * time.Second
+	// how long to wait before trying again to fetch a payload
+	// delivered by reference, after each failure
+	blobRetryDelays = []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute, 10 * time.Minute}
+	// how long fetching a payload delivered by reference is held
+	// back while the connection is metered, and how often it's
+	// checked again meanwhile
+	blobMeteredWait    = time.Hour
+	blobMeteredRecheck = time.Minute
+)
+
+var (
+	ErrBlobTooLarge = errors.New("blob too large")
+	ErrBadBlobURL   = errors.New("bad blob url")
 )
 
 // NewPostalService() builds a new service and returns it.
@@ -117,6 +207,23 @@ func NewPostalService(setup *PostalServiceSetup, log logger.Logger) *PostalServi
 	svc.installedChecker = setup.InstalledChecker
 	svc.fallbackVibration = setup.FallbackVibration
 	svc.fallbackSound = setup.FallbackSound
+	svc.keyStore = setup.KeyStore
+	svc.quietHours = setup.QuietHours
+	svc.history = setup.History
+	svc.dismissals = setup.Dismissals
+	svc.headless = setup.Headless
+	svc.blobURL = setup.BlobURL
+	svc.maxBlobSz = setup.MaxBlobSize
+	svc.appMaxBlobSzs = setup.AppMaxBlobSizes
+	svc.blobCli = &http13.Client{
+		Timeout:   blobFetchTimeout,
+		Transport: &http13.Transport{TLSHandshakeTimeout: blobFetchTimeout},
+	}
+	svc.metered = setup.Metered
+	svc.imageCli = &http.Client{
+		Timeout:       imageFetchTimeout,
+		CheckRedirect: httpsOnly,
+	}
 	svc.NotificationsEndp = bus.SessionBus.Endpoint(notifications.BusAddress, log)
 	svc.EmblemCounterEndp = bus.SessionBus.Endpoint(emblemcounter.BusAddress, log)
 	svc.AccountsEndp = bus.SystemBus.Endpoint(accounts.BusAddress, log)
@@ -145,11 +252,18 @@ func (svc *PostalService) GetMessageHandler() messageHandler {
 // Start() dials the bus, grab the name, and listens for method calls.
 func (svc *PostalService) Start() error {
 	return svc.DBusService.Start(bus.DispatchMap{
-		"PopAll":          svc.popAll,
-		"Post":            svc.post,
-		"ListPersistent":  svc.listPersistent,
-		"ClearPersistent": svc.clearPersistent,
-		"SetCounter":      svc.setCounter,
+		"PopAll":                svc.popAll,
+		"Post":                  svc.post,
+		"ListPersistent":        svc.listPersistent,
+		"ClearPersistent":       svc.clearPersistent,
+		"SetCounter":            svc.setCounter,
+		"GetQuietHours":         svc.getQuietHours,
+		"SetQuietHours":         svc.setQuietHours,
+		"RegisterPresenter":     svc.registerPresenter,
+		"UnregisterPresenter":   svc.unregisterPresenter,
+		"PopReplies":            svc.popReplies,
+		"ListPersistentGroups":  svc.listPersistentGroups,
+		"ClearPersistentGroups": svc.clearPersistentGroups,
 	}, PostalServiceBusAddress, svc.init)
 }
 
@@ -158,9 +272,13 @@ func (svc *PostalService) init() error {
 	if err != nil {
 		return err
 	}
-	svc.urlDispatcher = urldispatcher.New(svc.Log)
-
-	svc.accounts = accounts.New(svc.AccountsEndp, svc.Log)
+	if svc.headless {
+		svc.urlDispatcher = urldispatcher.NewXdgOpen(svc.Log)
+		svc.accounts = accounts.Defaults()
+	} else {
+		svc.urlDispatcher = urldispatcher.New(svc.Log)
+		svc.accounts = accounts.New(svc.AccountsEndp, svc.Log)
+	}
 	err = svc.accounts.Start()
 	if err != nil {
 		return err
@@ -168,22 +286,34 @@ func (svc *PostalService) init() error {
 
 	svc.sound = sounds.New(svc.Log, svc.accounts, svc.fallbackSound)
 	svc.notifications = notifications.Raw(svc.NotificationsEndp, svc.Log, svc.sound)
-	svc.emblemCounter = emblemcounter.New(svc.EmblemCounterEndp, svc.Log)
-	svc.haptic = haptic.New(svc.HapticEndp, svc.Log, svc.accounts, svc.fallbackVibration)
-	svc.messagingMenu = messaging.New(svc.Log)
-	svc.Presenters = []Presenter{
-		svc.notifications,
-		svc.emblemCounter,
-		svc.haptic,
-		svc.messagingMenu,
-	}
-	if useTrivialHelper {
+	if svc.headless {
+		// bubbles are all there is: no launcher, haptics,
+		// messaging menu, greeter nor window stack
+		svc.messagingMenu = newNoCentre()
+		svc.Presenters = []Presenter{svc.notifications}
+	} else {
+		svc.emblemCounter = emblemcounter.New(svc.EmblemCounterEndp, svc.Log)
+		svc.haptic = haptic.New(svc.HapticEndp, svc.Log, svc.accounts, svc.fallbackVibration)
+		mm := messaging.New(svc.Log)
+		mm.OnDismiss = func(nid string) {
+			svc.recordDismissed(nid)
+			svc.forgetImage(nid)
+		}
+		svc.messagingMenu = mm
+		svc.Presenters = []Presenter{
+			svc.notifications,
+			svc.emblemCounter,
+			svc.haptic,
+			svc.messagingMenu,
+		}
+		svc.unityGreeter = unitygreeter.New(svc.UnityGreeterEndp, svc.Log)
+		svc.windowStack = windowstack.New(svc.WindowStackEndp, svc.Log)
+	}
+	if useTrivialHelper || svc.headless {
 		svc.HelperPool = launch_helper.NewTrivialHelperPool(svc.Log)
 	} else {
 		svc.HelperPool = launch_helper.NewHelperPool(svc.launchers, svc.Log)
 	}
-	svc.unityGreeter = unitygreeter.New(svc.UnityGreeterEndp, svc.Log)
-	svc.windowStack = windowstack.New(svc.WindowStackEndp, svc.Log)
 
 	go svc.consumeHelperResults(svc.HelperPool.Start())
 	go svc.handleActions(actionsCh, svc.messagingMenu.GetCh())
@@ -205,10 +335,14 @@ Handle:
 				svc.Log.Debugf("handleActions got nil action; ignoring")
 			} else {
 				url := action.Action
+				svc.recordActioned(action.Nid, url)
+				tag := svc.messagingMenu.Tag(action.Nid)
 				// remove the notification from the messaging menu
 				svc.messagingMenu.RemoveNotification(action.Nid, true)
+				svc.forgetImage(action.Nid)
 				// this ignores the error (it's been logged already)
 				svc.urlDispatcher.DispatchURL(url, action.App)
+				svc.reportDismissal(action.App, tag)
 			}
 		case mmuAction, ok := <-mmuActionsCh:
 			if !ok {
@@ -216,13 +350,26 @@ Handle:
 			}
 			if mmuAction == nil {
 				svc.Log.Debugf("handleActions (MMU) got nil action; ignoring")
+			} else if mmuAction.Kind == reply.KindExpand {
+				svc.Log.Debugf("handleActions (MMU) expanding %s", mmuAction.Notification)
+				svc.messagingMenu.Expand(mmuAction.Notification)
+			} else if mmuAction.Kind == reply.KindReply {
+				svc.Log.Debugf("handleActions (MMU) got a reply to %s", mmuAction.Notification)
+				svc.recordActioned(mmuAction.Notification, mmuAction.Action)
+				svc.messagingMenu.RemoveNotification(mmuAction.Notification, false)
+				svc.forgetImage(mmuAction.Notification)
+				svc.deliverReply(mmuAction)
+				svc.reportDismissal(mmuAction.App, mmuAction.Tag)
 			} else {
 				svc.Log.Debugf("handleActions (MMU) got: %v", mmuAction)
 				url := mmuAction.Action
+				svc.recordActioned(mmuAction.Notification, url)
 				// remove the notification from the messagingmenu map
 				svc.messagingMenu.RemoveNotification(mmuAction.Notification, false)
+				svc.forgetImage(mmuAction.Notification)
 				// this ignores the error (it's been logged already)
 				svc.urlDispatcher.DispatchURL(url, mmuAction.App)
+				svc.reportDismissal(mmuAction.App, mmuAction.Tag)
 			}
 
 		}
@@ -241,6 +388,10 @@ func (svc *PostalService) takeTheBus() (<-chan *notifications.RawAction, error)
 		{"unitygreeter", svc.UnityGreeterEndp},
 		{"windowstack", svc.WindowStackEndp},
 	}
+	if svc.headless {
+		// only the notifications are there
+		endps = endps[:1]
+	}
 	for _, endp := range endps {
 		if endp.endp == nil {
 			svc.Log.Errorf("endpoint for %s is nil", endp.name)
@@ -287,7 +438,125 @@ func (svc *PostalService) clearPersistent(path string, args, _ []interface{}) ([
 		}
 		tags[i] = tag
 	}
-	return []interface{}{uint32(svc.messagingMenu.Clear(app, tags...))}, nil
+	n := svc.messagingMenu.Clear(app, tags...)
+	svc.sweepImages()
+	svc.reportDismissal(app, tags...)
+	return []interface{}{uint32(n)}, nil
+}
+
+func (svc *PostalService) listPersistentGroups(path string, args, _ []interface{}) ([]interface{}, error) {
+	app, err := svc.grabDBusPackageAndAppId(path, args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := svc.messagingMenu.Groups(app)
+	return []interface{}{groups}, nil
+}
+
+func (svc *PostalService) clearPersistentGroups(path string, args, _ []interface{}) ([]interface{}, error) {
+	if len(args) == 0 {
+		return nil, ErrBadArgCount
+	}
+	app, err := svc.grabDBusPackageAndAppId(path, args[:1], 0)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, len(args)-1)
+	for i, igroup := range args[1:] {
+		group, ok := igroup.(string)
+		if !ok {
+			return nil, ErrBadArgType
+		}
+		groups[i] = group
+	}
+	n := svc.messagingMenu.ClearGroups(app, groups...)
+	svc.sweepImages()
+	return []interface{}{uint32(n)}, nil
+}
+
+// reportDismissal passes on that the user dealt with the
+// notifications of app with the given tags; untagged ones can't be
+// told apart across devices and aren't reported.
+func (svc *PostalService) reportDismissal(app *click.AppId, tags ...string) {
+	if svc.dismissals == nil {
+		return
+	}
+	var reported []string
+	for _, tag := range tags {
+		if tag != "" {
+			reported = append(reported, tag)
+		}
+	}
+	if len(reported) > 0 {
+		svc.dismissals.ReportDismissal(app, reported)
+	}
+}
+
+// ClearPersistent clears the persistent notifications of app with
+// the given notification ids or tags, returning how many were cleared.
+func (svc *PostalService) ClearPersistent(app *click.AppId, nids []string, tags []string) int {
+	n := 0
+	if len(nids) > 0 {
+		n += svc.messagingMenu.ClearIds(app, nids...)
+	}
+	if len(tags) > 0 {
+		n += svc.messagingMenu.Clear(app, tags...)
+	}
+	svc.sweepImages()
+	return n
+}
+
+func (svc *PostalService) getQuietHours(path string, args, _ []interface{}) ([]interface{}, error) {
+	if len(args) != 0 {
+		return nil, ErrBadArgCount
+	}
+	if svc.quietHours == nil {
+		return nil, ErrNotConfigured
+	}
+	sched, err := svc.quietHours.Get()
+	if err != nil {
+		return nil, err
+	}
+	exceptions := sched.Exceptions
+	if exceptions == nil {
+		exceptions = []string{}
+	}
+	return []interface{}{sched.DoNotDisturb, sched.Start, sched.End, exceptions}, nil
+}
+
+func (svc *PostalService) setQuietHours(path string, args, _ []interface{}) ([]interface{}, error) {
+	if len(args) < 3 {
+		return nil, ErrBadArgCount
+	}
+	if grabScope(path) != "" {
+		return nil, ErrNotForPackages
+	}
+	if svc.quietHours == nil {
+		return nil, ErrNotConfigured
+	}
+	var sched QuietSchedule
+	var ok bool
+	sched.DoNotDisturb, ok = args[0].(bool)
+	if !ok {
+		return nil, ErrBadArgType
+	}
+	sched.Start, ok = args[1].(string)
+	if !ok {
+		return nil, ErrBadArgType
+	}
+	sched.End, ok = args[2].(string)
+	if !ok {
+		return nil, ErrBadArgType
+	}
+	for _, iexc := range args[3:] {
+		exc, ok := iexc.(string)
+		if !ok {
+			return nil, ErrBadArgType
+		}
+		sched.Exceptions = append(sched.Exceptions, exc)
+	}
+	return nil, svc.quietHours.Set(sched)
 }
 
 func (svc *PostalService) setCounter(path string, args, _ []interface{}) ([]interface{}, error) {
@@ -305,7 +574,9 @@ func (svc *PostalService) setCounter(path string, args, _ []interface{}) ([]inte
 		return nil, ErrBadArgType
 	}
 
-	svc.emblemCounter.SetCounter(app, count, visible)
+	if svc.emblemCounter != nil {
+		svc.emblemCounter.SetCounter(app, count, visible)
+	}
 	return nil, nil
 }
 
@@ -332,6 +603,72 @@ func (svc *PostalService) popAll(path string, args, _ []interface{}) ([]interfac
 	return []interface{}{msgs}, nil
 }
 
+// PostalDebugInfo is a snapshot of the postal service for
+// troubleshooting.
+type PostalDebugInfo struct {
+	HelperBacklog int            `json:"helper_backlog"`
+	Mailboxes     map[string]int `json:"mailboxes"`
+}
+
+// Debug returns a snapshot of the service for troubleshooting: how
+// many inputs wait for a helper, and how many messages wait in each
+// app's mailbox.
+func (svc *PostalService) Debug() PostalDebugInfo {
+	svc.lock.RLock()
+	defer svc.lock.RUnlock()
+	info := PostalDebugInfo{Mailboxes: make(map[string]int, len(svc.mbox))}
+	if svc.HelperPool != nil {
+		info.HelperBacklog = svc.HelperPool.Backlog()
+	}
+	for appId, box := range svc.mbox {
+		info.Mailboxes[appId] = len(box.AllMessages())
+	}
+	return info
+}
+
+// an inlineReply is what the user typed into the inline reply of a card
+type inlineReply struct {
+	Nid  string `json:"nid"`
+	Tag  string `json:"tag"`
+	Text string `json:"text"`
+}
+
+// deliverReply queues an inline reply for the app to pick up with
+// PopReplies, and tells it about it with the Reply signal.
+func (svc *PostalService) deliverReply(mmuAction *reply.MMActionReply) {
+	app := mmuAction.App
+	appId := app.Original()
+	b, err := json.Marshal(inlineReply{mmuAction.Notification, mmuAction.Tag, mmuAction.Reply})
+	if err != nil {
+		svc.Log.Errorf("unable to marshal reply for %s: %v", appId, err)
+		return
+	}
+	svc.lock.Lock()
+	if svc.replies == nil {
+		svc.replies = make(map[string][]string)
+	}
+	svc.replies[appId] = append(svc.replies[appId], string(b))
+	svc.lock.Unlock()
+
+	svc.Bus.Signal("Reply", "/"+string(nih.Quote([]byte(app.Package))), []interface{}{appId})
+}
+
+func (svc *PostalService) popReplies(path string, args, _ []interface{}) ([]interface{}, error) {
+	app, err := svc.grabDBusPackageAndAppId(path, args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+
+	appId := app.Original()
+	replies := svc.replies[appId]
+	delete(svc.replies, appId)
+
+	return []interface{}{replies}, nil
+}
+
 var newNid = uuid.New
 
 func (svc *PostalService) post(path string, args, _ []interface{}) ([]interface{}, error) {
@@ -360,6 +697,119 @@ func (svc *PostalService) Post(app *click.AppId, nid string, payload json.RawMes
 	if nid == "" {
 		nid = newNid()
 	}
+	svc.run(app, nid, payload)
+}
+
+// PostByRef is Post for a notification whose payload was delivered
+// by reference. The payload is fetched in the background, trying
+// again a few times if that fails for a passing reason. Payloads of
+// the same app are fetched in order, but the app's notifications
+// delivered inline don't wait for them and can overtake them.
+func (svc *PostalService) PostByRef(app *click.AppId, nid string, ref *blob.Ref) {
+	svc.fetching.add(app.Original(), true, func() {
+		svc.fetchAndRun(app, nid, ref)
+	})
+}
+
+// fetchAndRun fetches the payload ref refers to and runs the helper
+// on it.
+func (svc *PostalService) fetchAndRun(app *click.AppId, nid string, ref *blob.Ref) {
+	svc.waitUnmetered(nid)
+	for attempt := 0; ; attempt++ {
+		payload, err := svc.fetchBlob(app, ref)
+		if err == nil {
+			svc.run(app, nid, payload)
+			return
+		}
+		if !transientBlobError(err) || attempt >= len(blobRetryDelays) {
+			svc.Log.Errorf("dropping notification %s for %s: could not fetch payload: %v", nid, app.Original(), err)
+			return
+		}
+		svc.Log.Debugf("[%s] could not fetch payload, trying again: %v", nid, err)
+		time.Sleep(blobRetryDelays[attempt])
+	}
+}
+
+// waitUnmetered holds back fetching a payload while the connection is
+// metered, for a while.
+func (svc *PostalService) waitUnmetered(nid string) {
+	if svc.metered == nil || !svc.metered.Metered() {
+		return
+	}
+	svc.Log.Debugf("[%s] metered connection, holding back fetching the payload", nid)
+	for waited := time.Duration(0); waited < blobMeteredWait && svc.metered.Metered(); waited += blobMeteredRecheck {
+		time.Sleep(blobMeteredRecheck)
+	}
+}
+
+// a blobStatusError is the unexpected status the blob endpoint
+// replied with.
+type blobStatusError int
+
+func (e blobStatusError) Error() string {
+	return fmt.Sprintf("blob endpoint replied %d", int(e))
+}
+
+// transientBlobError says whether fetching a payload might work if
+// tried again: the server is having trouble or couldn't be reached.
+func transientBlobError(err error) bool {
+	switch err := err.(type) {
+	case blobStatusError:
+		return err >= 500
+	case net.Error, *url.Error:
+		return true
+	}
+	return false
+}
+
+// maxBlobSize returns the largest payload fetched by reference for
+// the app.
+func (svc *PostalService) maxBlobSize(app *click.AppId) int {
+	if size, ok := svc.appMaxBlobSzs[app.Original()]; ok {
+		return size
+	}
+	return svc.maxBlobSz
+}
+
+// fetchBlob fetches the payload ref refers to from the server, and
+// checks it.
+func (svc *PostalService) fetchBlob(app *click.AppId, ref *blob.Ref) (json.RawMessage, error) {
+	if ref.Size > svc.maxBlobSize(app) {
+		return nil, ErrBlobTooLarge
+	}
+	if svc.blobURL == nil {
+		return nil, ErrBadBlobURL
+	}
+	burl, err := svc.blobURL.Parse(ref.URL)
+	// only ever fetch from the server itself
+	if err != nil || burl.Scheme != svc.blobURL.Scheme || burl.Host != svc.blobURL.Host {
+		return nil, ErrBadBlobURL
+	}
+	resp, err := svc.blobCli.Get(burl.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, blobStatusError(resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(ref.Size)+1))
+	if err != nil {
+		return nil, err
+	}
+	err = ref.Check(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(data), nil
+}
+
+// run runs the helper on the payload, opening it first if sealed.
+func (svc *PostalService) run(app *click.AppId, nid string, payload json.RawMessage) {
+	payload, ok := svc.unseal(app, nid, payload)
+	if !ok {
+		return
+	}
 	arg := launch_helper.HelperInput{
 		App:            app,
 		NotificationId: nid,
@@ -374,6 +824,27 @@ func (svc *PostalService) Post(app *click.AppId, nid string, payload json.RawMes
 	svc.HelperPool.Run(kind, &arg)
 }
 
+// unseal opens an end-to-end encrypted payload with the app key,
+// passing other payloads through.
+func (svc *PostalService) unseal(app *click.AppId, nid string, payload json.RawMessage) (json.RawMessage, bool) {
+	if !envelope.IsSealed(payload) {
+		return payload, true
+	}
+	if svc.keyStore == nil {
+		svc.Log.Errorf("dropping sealed notification %s for %s: %v", nid, app.Original(), ErrNoKeyStore)
+		return nil, false
+	}
+	key, err := svc.keyStore.Lookup(app.Original())
+	if err == nil {
+		payload, err = envelope.Open(key, payload)
+	}
+	if err != nil {
+		svc.Log.Errorf("dropping sealed notification %s for %s: %v", nid, app.Original(), err)
+		return nil, false
+	}
+	return payload, true
+}
+
 func (svc *PostalService) consumeHelperResults(ch chan *launch_helper.HelperResult) {
 	for res := range ch {
 		svc.handleHelperResult(res)
@@ -429,8 +900,8 @@ func (svc *PostalService) messageHandler(app *click.AppId, nid string, output *l
 		return false
 	}
 
-	locked := svc.unityGreeter.IsActive()
-	focused := svc.windowStack.IsAppFocused(app)
+	locked := svc.unityGreeter != nil && svc.unityGreeter.IsActive()
+	focused := svc.windowStack != nil && svc.windowStack.IsAppFocused(app)
 
 	if !locked && focused {
 		svc.Log.Debugf("notification skipped because app is focused.")
@@ -439,13 +910,96 @@ func (svc *PostalService) messageHandler(app *click.AppId, nid string, output *l
 
 	if !areNotificationsEnabled(app) {
 		svc.Log.Debugf("notification skipped (except emblem counter) because app has notifications disabled")
-		return svc.emblemCounter.Present(app, nid, output.Notification)
+		return svc.emblemCounter != nil && svc.emblemCounter.Present(app, nid, output.Notification)
+	}
+
+	notif := output.Notification
+	if svc.isQuiet(app) {
+		svc.Log.Debugf("quiet hours: notification presented without popup, sound or vibration")
+		quiet := *notif
+		quiet.RawSound = nil
+		quiet.RawVibration = nil
+		if notif.Card != nil && notif.Card.Popup {
+			card := *notif.Card
+			card.Popup = false
+			quiet.Card = &card
+		}
+		notif = &quiet
+	}
+	if svc.queuePresent(app, nid, notif) {
+		// it'll be presented once the image is fetched
+		return true
 	}
+	return svc.present(app, nid, svc.withLocalImage(app, nid, notif))
+}
 
+// present hands the notification to the presenters, recording it if
+// any of them presented it.
+func (svc *PostalService) present(app *click.AppId, nid string, notif *launch_helper.Notification) bool {
 	b := false
 	for _, p := range svc.Presenters {
 		// we don't want this to shortcut :)
-		b = p.Present(app, nid, output.Notification) || b
+		b = p.Present(app, nid, notif) || b
+	}
+	b = svc.presentRemote(app, nid, notif) || b
+	if b {
+		svc.recordPresented(app, nid, notif)
 	}
 	return b
 }
+
+// recordPresented adds the card of a presented notification to the
+// history.
+func (svc *PostalService) recordPresented(app *click.AppId, nid string, notif *launch_helper.Notification) {
+	card := notif.Card
+	if svc.history == nil || card == nil || card.Summary == "" {
+		return
+	}
+	err := svc.history.Record(history.Entry{
+		Nid:       nid,
+		AppId:     app.Original(),
+		Package:   app.Package,
+		Summary:   card.Summary,
+		Body:      card.Body,
+		Tag:       notif.Tag,
+		Presented: time.Now(),
+	})
+	if err != nil {
+		svc.Log.Errorf("unable to record notification %s in history: %v", nid, err)
+	}
+}
+
+// recordActioned notes in the history that the user invoked action
+// on the notification.
+func (svc *PostalService) recordActioned(nid string, action string) {
+	if svc.history == nil {
+		return
+	}
+	if err := svc.history.MarkActioned(nid, action); err != nil {
+		svc.Log.Errorf("unable to record action on notification %s in history: %v", nid, err)
+	}
+}
+
+// recordDismissed notes in the history that the user dismissed the
+// notification.
+func (svc *PostalService) recordDismissed(nid string) {
+	if svc.history == nil {
+		return
+	}
+	if err := svc.history.MarkDismissed(nid); err != nil {
+		svc.Log.Errorf("unable to record dismissal of notification %s in history: %v", nid, err)
+	}
+}
+
+// isQuiet checks the do-not-disturb schedule for app.
+func (svc *PostalService) isQuiet(app *click.AppId) bool {
+	if svc.quietHours == nil {
+		return false
+	}
+	quiet, err := svc.quietHours.Quiet(app)
+	if err != nil {
+		svc.Log.Errorf("unable to check quiet hours: %v", err)
+		return false
+	}
+	return quiet
+}
@@ -21,21 +21,28 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"launchpad.net/go-dbus/v1"
 	. "launchpad.net/gocheck"
 
+	"github.com/ubports/ubuntu-push/blob"
 	"github.com/ubports/ubuntu-push/bus"
 	"github.com/ubports/ubuntu-push/bus/notifications"
 	testibus "github.com/ubports/ubuntu-push/bus/testing"
 	"github.com/ubports/ubuntu-push/bus/windowstack"
 	"github.com/ubports/ubuntu-push/click"
 	clickhelp "github.com/ubports/ubuntu-push/click/testing"
+	"github.com/ubports/ubuntu-push/client/history"
+	"github.com/ubports/ubuntu-push/envelope"
 	"github.com/ubports/ubuntu-push/launch_helper"
 	"github.com/ubports/ubuntu-push/messaging/reply"
 	"github.com/ubports/ubuntu-push/nih"
@@ -296,6 +303,33 @@ func (ps *postalSuite) TestTakeTheBusOk(c *C) {
 	c.Check(err, IsNil)
 }
 
+func (ps *postalSuite) TestStartHeadless(c *C) {
+	ps.cfg.Headless = true
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	// only the notifications are needed
+	svc.EmblemCounterEndp = testibus.NewTestingEndpoint(condition.Work(false), nil)
+	svc.AccountsEndp = svc.EmblemCounterEndp
+	svc.HapticEndp = svc.EmblemCounterEndp
+	svc.UnityGreeterEndp = svc.EmblemCounterEndp
+	svc.WindowStackEndp = svc.EmblemCounterEndp
+	c.Assert(svc.Start(), IsNil)
+	defer svc.Stop()
+	c.Check(svc.Presenters, DeepEquals, []Presenter{svc.notifications})
+	c.Check(svc.messagingMenu, FitsTypeOf, &noCentre{})
+	c.Check(svc.emblemCounter, IsNil)
+
+	// the counter and the focus checks are skipped
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	_, err := svc.setCounter(aPackageOnBus, []interface{}{anAppId, int32(42), true}, nil)
+	c.Check(err, IsNil)
+	rec := new(recordingPresenter)
+	svc.Presenters = []Presenter{rec}
+	card := &launch_helper.Card{Summary: "summary-value", Popup: true}
+	output := &launch_helper.HelperOutput{Notification: &launch_helper.Notification{Card: card}}
+	c.Check(svc.messageHandler(app, "", output), Equals, true)
+	c.Check(rec.notifs, HasLen, 1)
+}
+
 func (ps *postalSuite) TestStartFailsOnBusDialFailure(c *C) {
 	// XXX actually, we probably want to autoredial this
 	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
@@ -357,6 +391,17 @@ func (ps *postalSuite) TestPostHappyPath(c *C) {
 	c.Check(box.nids[0], Not(Equals), "")
 }
 
+func (ps *postalSuite) TestDebug(c *C) {
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	c.Check(svc.Debug(), DeepEquals, PostalDebugInfo{Mailboxes: map[string]int{}})
+	c.Assert(svc.Start(), IsNil)
+	defer svc.Stop()
+	svc.mbox = map[string]*mBox{anAppId: new(mBox)}
+	svc.mbox[anAppId].Append(json.RawMessage(`"one"`), "nid-1")
+	svc.mbox[anAppId].Append(json.RawMessage(`"two"`), "nid-2")
+	c.Check(svc.Debug(), DeepEquals, PostalDebugInfo{Mailboxes: map[string]int{anAppId: 2}})
+}
+
 func (ps *postalSuite) TestPostFailsIfBadArgs(c *C) {
 	for i, s := range []struct {
 		args []interface{}
@@ -604,6 +649,83 @@ func (ps *postalSuite) TestMessageHandlerPresents(c *C) {
 	c.Check(ps.log.Captured(), Matches, `(?sm).* notification has no Sound:.*`)
 }
 
+type recordingPresenter struct {
+	notifs []*launch_helper.Notification
+}
+
+func (r *recordingPresenter) Present(_ *click.AppId, _ string, notif *launch_helper.Notification) bool {
+	r.notifs = append(r.notifs, notif)
+	return true
+}
+
+func (ps *postalSuite) TestMessageHandlerQuietHours(c *C) {
+	ps.winStackBus = testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true), []windowstack.WindowsInfo{},
+		[]windowstack.WindowsInfo{})
+	ps.unityGreeterBus = testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true), false, false)
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	c.Assert(svc.Start(), IsNil)
+	rec := new(recordingPresenter)
+	svc.Presenters = []Presenter{rec}
+	svc.quietHours = NewQuietHours("")
+	c.Assert(svc.quietHours.Set(QuietSchedule{DoNotDisturb: true, Exceptions: []string{"com.example.important"}}), IsNil)
+
+	card := &launch_helper.Card{Summary: "summary-value", Popup: true, Persist: true}
+	emb := &launch_helper.EmblemCounter{Count: 2, Visible: true}
+	notif := &launch_helper.Notification{Card: card, EmblemCounter: emb, RawSound: json.RawMessage(`true`), RawVibration: json.RawMessage(`true`)}
+	output := &launch_helper.HelperOutput{Notification: notif}
+	b := svc.messageHandler(clickhelp.MustParseAppId("com.example.test_test-app_0"), "", output)
+	c.Check(b, Equals, true)
+	c.Assert(rec.notifs, HasLen, 1)
+	// card and emblem survive; popup, sound and vibration don't
+	c.Check(rec.notifs[0].Card, DeepEquals, &launch_helper.Card{Summary: "summary-value", Persist: true})
+	c.Check(rec.notifs[0].EmblemCounter, Equals, emb)
+	c.Check(rec.notifs[0].RawSound, IsNil)
+	c.Check(rec.notifs[0].RawVibration, IsNil)
+	// the helper output is left alone
+	c.Check(string(notif.RawSound), Equals, "true")
+	c.Check(card.Popup, Equals, true)
+	c.Check(ps.log.Captured(), Matches, `(?sm).*quiet hours: notification presented without popup, sound or vibration.*`)
+
+	// exceptions get through untouched
+	b = svc.messageHandler(clickhelp.MustParseAppId("com.example.important_app_0"), "", output)
+	c.Check(b, Equals, true)
+	c.Assert(rec.notifs, HasLen, 2)
+	c.Check(rec.notifs[1], Equals, notif)
+}
+
+func (ps *postalSuite) TestMessageHandlerRecordsHistory(c *C) {
+	ps.winStackBus = testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true), []windowstack.WindowsInfo{},
+		[]windowstack.WindowsInfo{})
+	ps.unityGreeterBus = testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true), false, false)
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	c.Assert(svc.Start(), IsNil)
+	svc.Presenters = []Presenter{new(recordingPresenter)}
+	svc.history, _ = history.NewHistory()
+
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	card := &launch_helper.Card{Summary: "summary-value", Body: "body-value", Persist: true}
+	output := &launch_helper.HelperOutput{Notification: &launch_helper.Notification{Card: card, Tag: "a-tag"}}
+	c.Check(svc.messageHandler(app, "nid-1", output), Equals, true)
+	// no card, nothing to record
+	output = &launch_helper.HelperOutput{Notification: &launch_helper.Notification{}}
+	c.Check(svc.messageHandler(app, "nid-2", output), Equals, true)
+
+	svc.recordActioned("nid-1", "potato://")
+	svc.recordDismissed("nid-1")
+	entries, err := svc.history.Query(history.Query{})
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	e := entries[0]
+	c.Check(e.Nid, Equals, "nid-1")
+	c.Check(e.AppId, Equals, "com.example.test_test-app_0")
+	c.Check(e.Package, Equals, "com.example.test")
+	c.Check(e.Summary, Equals, "summary-value")
+	c.Check(e.Body, Equals, "body-value")
+	c.Check(e.Tag, Equals, "a-tag")
+	c.Check(e.Actions, DeepEquals, []string{"potato://"})
+	c.Check(e.Dismissed, Equals, true)
+}
+
 func (ps *postalSuite) TestMessageHandlerReportsFailedNotifies(c *C) {
 	endp := testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true), 1)
 	nopTicker := make(chan []interface{})
@@ -719,6 +841,46 @@ func (ps *postalSuite) TestHandleMMUActionsDispatches(c *C) {
 	c.Assert(fakeDisp.DispatchCalls[0][1], Equals, app.DispatchPackage())
 }
 
+func (ps *postalSuite) TestHandleMMUActionsReply(c *C) {
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	fmm := new(fakeMM)
+	svc.messagingMenu = fmm
+	fakeDisp := new(fakeUrlDispatcher)
+	svc.urlDispatcher = fakeDisp
+	app := clickhelp.MustParseAppId(anAppId)
+	aCh := make(chan *notifications.RawAction)
+	rCh := make(chan *reply.MMActionReply)
+	go func() {
+		rCh <- &reply.MMActionReply{Kind: reply.KindReply, App: app, Action: reply.ReplyAction, Notification: "foo.bar", Tag: "a-tag", Reply: "hi there"}
+		close(rCh)
+	}()
+	svc.handleActions(aCh, rCh)
+	// nothing gets dispatched
+	c.Check(fakeDisp.DispatchCalls, HasLen, 0)
+	c.Check(fmm.calls, DeepEquals, []string{"remove:foo.bar:false"})
+	// the app is told about it
+	callArgs := testibus.GetCallArgs(ps.bus)
+	c.Assert(callArgs, HasLen, 1)
+	c.Check(callArgs[0].Member, Equals, "::Signal")
+	c.Check(callArgs[0].Args, DeepEquals, []interface{}{"Reply", aPackageOnBus, []interface{}{anAppId}})
+	// and can pick it up
+	replies, err := svc.popReplies(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Assert(err, IsNil)
+	c.Check(replies, DeepEquals, []interface{}{[]string{`{"nid":"foo.bar","tag":"a-tag","text":"hi there"}`}})
+	// once
+	replies, err = svc.popReplies(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Assert(err, IsNil)
+	c.Check(replies, DeepEquals, []interface{}{[]string(nil)})
+}
+
+func (ps *postalSuite) TestPopRepliesFailsIfBadArgs(c *C) {
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	_, err := svc.popReplies(aPackageOnBus, []interface{}{}, nil)
+	c.Check(err, Equals, ErrBadArgCount)
+	_, err = svc.popReplies(aPackageOnBus, []interface{}{"com.example.other_app"}, nil)
+	c.Check(err, Equals, ErrAppIdMismatch)
+}
+
 func (ps *postalSuite) TestValidateActions(c *C) {
 	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
 	c.Assert(svc.Start(), IsNil)
@@ -748,6 +910,7 @@ func (ps *postalSuite) TestValidateActionsNoCard(c *C) {
 
 type fakeMM struct {
 	calls []string
+	has   map[string]bool
 }
 
 func (*fakeMM) Present(*click.AppId, string, *launch_helper.Notification) bool { return false }
@@ -760,10 +923,31 @@ func (fmm *fakeMM) Clear(*click.AppId, ...string) int {
 	fmm.calls = append(fmm.calls, "clear")
 	return 42
 }
+func (fmm *fakeMM) ClearIds(app *click.AppId, nids ...string) int {
+	fmm.calls = append(fmm.calls, "clear-ids:"+strings.Join(nids, ","))
+	return len(nids)
+}
 func (fmm *fakeMM) Tags(*click.AppId) []string {
 	fmm.calls = append(fmm.calls, "tags")
 	return []string{"hello"}
 }
+func (fmm *fakeMM) Has(nid string) bool {
+	return fmm.has[nid]
+}
+func (fmm *fakeMM) Tag(nid string) string {
+	return "tag-" + nid
+}
+func (fmm *fakeMM) Groups(*click.AppId) []string {
+	fmm.calls = append(fmm.calls, "groups")
+	return []string{"chat"}
+}
+func (fmm *fakeMM) ClearGroups(app *click.AppId, groups ...string) int {
+	fmm.calls = append(fmm.calls, "clear-groups:"+strings.Join(groups, ","))
+	return 3
+}
+func (fmm *fakeMM) Expand(entry string) {
+	fmm.calls = append(fmm.calls, "expand:"+entry)
+}
 
 func (ps *postalSuite) TestListPersistent(c *C) {
 	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
@@ -807,6 +991,195 @@ func (ps *postalSuite) TestClearPersistent(c *C) {
 	c.Check(icleared[0], Equals, uint32(42))
 }
 
+type fakeDismissals struct {
+	reported []string
+}
+
+func (fd *fakeDismissals) ReportDismissal(app *click.AppId, tags []string) {
+	fd.reported = append(fd.reported, app.Original()+":"+strings.Join(tags, ","))
+}
+
+func (ps *postalSuite) TestClearPersistentReportsDismissal(c *C) {
+	fd := new(fakeDismissals)
+	ps.cfg.Dismissals = fd
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	svc.messagingMenu = new(fakeMM)
+
+	_, err := svc.clearPersistent(aPackageOnBus, []interface{}{anAppId, "one", "", "two"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(fd.reported, DeepEquals, []string{anAppId + ":one,two"})
+
+	// clearing everything isn't reported
+	_, err = svc.clearPersistent(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Assert(err, IsNil)
+	c.Check(fd.reported, HasLen, 1)
+}
+
+func (ps *postalSuite) TestHandleActionsReportDismissal(c *C) {
+	fd := new(fakeDismissals)
+	ps.cfg.Dismissals = fd
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	svc.messagingMenu = new(fakeMM)
+	svc.urlDispatcher = &fakeUrlDispatcher{DispatchShouldFail: true}
+	app := clickhelp.MustParseAppId(anAppId)
+	aCh := make(chan *notifications.RawAction)
+	rCh := make(chan *reply.MMActionReply)
+	go func() {
+		aCh <- &notifications.RawAction{App: app, Action: "potato://", Nid: "xyzzy"}
+		rCh <- &reply.MMActionReply{App: app, Action: "potato://", Notification: "foo.bar", Tag: "a-tag"}
+		rCh <- &reply.MMActionReply{Kind: reply.KindReply, App: app, Action: reply.ReplyAction, Notification: "foo.baz", Tag: "b-tag"}
+		rCh <- &reply.MMActionReply{App: app, Action: "potato://", Notification: "foo.qux"}
+		close(aCh)
+	}()
+	svc.handleActions(aCh, rCh)
+	c.Check(fd.reported, DeepEquals, []string{
+		anAppId + ":tag-xyzzy",
+		anAppId + ":a-tag",
+		anAppId + ":b-tag",
+	})
+}
+
+func (ps *postalSuite) TestListPersistentGroups(c *C) {
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	fmm := new(fakeMM)
+	svc.messagingMenu = fmm
+
+	igroups, err := svc.listPersistentGroups(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Assert(err, IsNil)
+	c.Check(igroups, DeepEquals, []interface{}{[]string{"chat"}})
+	c.Check(fmm.calls, DeepEquals, []string{"groups"})
+
+	_, err = svc.listPersistentGroups(aPackageOnBus, []interface{}{}, nil)
+	c.Check(err, Equals, ErrBadArgCount)
+}
+
+func (ps *postalSuite) TestClearPersistentGroups(c *C) {
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	fmm := new(fakeMM)
+	svc.messagingMenu = fmm
+
+	icleared, err := svc.clearPersistentGroups(aPackageOnBus, []interface{}{anAppId, "chat", "mail"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(icleared, DeepEquals, []interface{}{uint32(3)})
+	c.Check(fmm.calls, DeepEquals, []string{"clear-groups:chat,mail"})
+
+	for i, args := range [][]interface{}{{}, {42}, {anAppId, 42}} {
+		_, err = svc.clearPersistentGroups(aPackageOnBus, args, nil)
+		c.Check(err, NotNil, Commentf("%d", i))
+	}
+}
+
+func (ps *postalSuite) TestHandleMMUActionsOpenLikeReply(c *C) {
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	fmm := new(fakeMM)
+	svc.messagingMenu = fmm
+	fakeDisp := &fakeUrlDispatcher{DispatchShouldFail: true}
+	svc.urlDispatcher = fakeDisp
+	app := clickhelp.MustParseAppId(anAppId)
+	aCh := make(chan *notifications.RawAction)
+	rCh := make(chan *reply.MMActionReply)
+	go func() {
+		// an app action that happens to look like the reply one
+		rCh <- &reply.MMActionReply{App: app, Action: reply.ReplyAction, Notification: "foo.bar"}
+		close(rCh)
+	}()
+	svc.handleActions(aCh, rCh)
+	c.Assert(fakeDisp.DispatchCalls, HasLen, 1)
+	c.Check(fakeDisp.DispatchCalls[0][0], Equals, reply.ReplyAction)
+	c.Check(fmm.calls, DeepEquals, []string{"remove:foo.bar:false"})
+	c.Check(testibus.GetCallArgs(ps.bus), HasLen, 0)
+}
+
+func (ps *postalSuite) TestHandleMMUActionsExpand(c *C) {
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	fmm := new(fakeMM)
+	svc.messagingMenu = fmm
+	fakeDisp := new(fakeUrlDispatcher)
+	svc.urlDispatcher = fakeDisp
+	app := clickhelp.MustParseAppId(anAppId)
+	aCh := make(chan *notifications.RawAction)
+	rCh := make(chan *reply.MMActionReply)
+	go func() {
+		rCh <- &reply.MMActionReply{Kind: reply.KindExpand, App: app, Notification: "group:x"}
+		close(rCh)
+	}()
+	svc.handleActions(aCh, rCh)
+	c.Check(fakeDisp.DispatchCalls, HasLen, 0)
+	c.Check(fmm.calls, DeepEquals, []string{"expand:group:x"})
+}
+
+func (ps *postalSuite) TestClearPersistentByIdsAndTags(c *C) {
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	fmm := new(fakeMM)
+	svc.messagingMenu = fmm
+	app := clickhelp.MustParseAppId(anAppId)
+
+	c.Check(svc.ClearPersistent(app, nil, nil), Equals, 0)
+	c.Check(fmm.calls, HasLen, 0)
+	c.Check(svc.ClearPersistent(app, []string{"n1", "n2"}, nil), Equals, 2)
+	c.Check(svc.ClearPersistent(app, nil, []string{"one"}), Equals, 42)
+	c.Check(fmm.calls, DeepEquals, []string{"clear-ids:n1,n2", "clear"})
+}
+
+func (ps *postalSuite) TestUnseal(c *C) {
+	app := clickhelp.MustParseAppId(anAppId)
+	ks := envelope.NewKeyStore("")
+	key, err := ks.Ensure(app.Original())
+	c.Assert(err, IsNil)
+	setup := *ps.cfg
+	setup.KeyStore = ks
+	svc := NewPostalService(&setup, ps.log)
+
+	// regular payloads pass through
+	plain := json.RawMessage(`{"message":"hello"}`)
+	payload, ok := svc.unseal(app, "m1", plain)
+	c.Check(ok, Equals, true)
+	c.Check(payload, DeepEquals, plain)
+
+	sealed, err := envelope.Seal(&key.PublicKey, plain)
+	c.Assert(err, IsNil)
+	payload, ok = svc.unseal(app, "m2", sealed)
+	c.Check(ok, Equals, true)
+	c.Check(payload, DeepEquals, plain)
+
+	// no key for another app
+	other := clickhelp.MustParseAppId("com.example.test_test-number-two")
+	_, ok = svc.unseal(other, "m3", sealed)
+	c.Check(ok, Equals, false)
+	c.Check(ps.log.Captured(), Matches, `(?s).*ERROR dropping sealed notification m3 for com.example.test_test-number-two: no key for app.*`)
+}
+
+func (ps *postalSuite) TestUnsealAfterForget(c *C) {
+	app := clickhelp.MustParseAppId(anAppId)
+	ks := envelope.NewKeyStore("")
+	key, err := ks.Ensure(app.Original())
+	c.Assert(err, IsNil)
+	setup := *ps.cfg
+	setup.KeyStore = ks
+	svc := NewPostalService(&setup, ps.log)
+	sealed, err := envelope.Seal(&key.PublicKey, json.RawMessage(`{"message":"hello"}`))
+	c.Assert(err, IsNil)
+
+	// unregistering forgets the key, what was sealed with it is lost
+	c.Assert(ks.Forget(app.Original()), IsNil)
+	_, ok := svc.unseal(app, "m1", sealed)
+	c.Check(ok, Equals, false)
+	// even once registered again with a new key
+	_, err = ks.Ensure(app.Original())
+	c.Assert(err, IsNil)
+	_, ok = svc.unseal(app, "m2", sealed)
+	c.Check(ok, Equals, false)
+	c.Check(ps.log.Captured(), Matches, `(?s).*ERROR dropping sealed notification m1 .*: no key for app.*ERROR dropping sealed notification m2 .*`)
+}
+
+func (ps *postalSuite) TestUnsealNoKeyStore(c *C) {
+	app := clickhelp.MustParseAppId(anAppId)
+	svc := NewPostalService(ps.cfg, ps.log)
+	_, ok := svc.unseal(app, "m1", json.RawMessage(`{"ubuntu-push-envelope":{}}`))
+	c.Check(ok, Equals, false)
+	c.Check(ps.log.Captured(), Matches, `(?s).*ERROR dropping sealed notification m1 .*: no key store.*`)
+}
+
 func (ps *postalSuite) TestClearPersistentErrors(c *C) {
 	for i, s := range []struct {
 		args []interface{}
@@ -864,6 +1237,50 @@ func (ps *postalSuite) TestSetCounterErrors(c *C) {
 	}
 }
 
+func (ps *postalSuite) TestQuietHoursDBus(c *C) {
+	svc := new(PostalService)
+	_, err := svc.getQuietHours(aPackageOnBus, nil, nil)
+	c.Check(err, Equals, ErrNotConfigured)
+	svc.quietHours = NewQuietHours("")
+
+	rv, err := svc.getQuietHours(aPackageOnBus, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(rv, DeepEquals, []interface{}{false, "", "", []string{}})
+
+	_, err = svc.setQuietHours("/_", []interface{}{false, "22:00", "07:30", "com.example.app", "com.example.other_app"}, nil)
+	c.Assert(err, IsNil)
+	rv, err = svc.getQuietHours(aPackageOnBus, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(rv, DeepEquals, []interface{}{false, "22:00", "07:30", []string{"com.example.app", "com.example.other_app"}})
+}
+
+func (ps *postalSuite) TestQuietHoursDBusErrors(c *C) {
+	svc := new(PostalService)
+	svc.quietHours = NewQuietHours("")
+	_, err := svc.getQuietHours(aPackageOnBus, []interface{}{1}, nil)
+	c.Check(err, Equals, ErrBadArgCount)
+	for i, s := range []struct {
+		args []interface{}
+		err  error
+	}{
+		{[]interface{}{true, "", ""}, nil}, // for reference
+		{[]interface{}{}, ErrBadArgCount},
+		{[]interface{}{true, ""}, ErrBadArgCount},
+		{[]interface{}{"true", "", ""}, ErrBadArgType},
+		{[]interface{}{true, 22, ""}, ErrBadArgType},
+		{[]interface{}{true, "", 7}, ErrBadArgType},
+		{[]interface{}{true, "", "", 42}, ErrBadArgType},
+		{[]interface{}{true, "22:00", ""}, ErrBadQuietTime},
+		{[]interface{}{true, "25:00", "07:00"}, ErrBadQuietTime},
+	} {
+		_, err := svc.setQuietHours("/_", s.args, nil)
+		c.Check(err, Equals, s.err, Commentf("iter %d", i))
+	}
+	// apps don't get to change it
+	_, err = svc.setQuietHours(aPackageOnBus, []interface{}{true, "", ""}, nil)
+	c.Check(err, Equals, ErrNotForPackages)
+}
+
 func (ps *postalSuite) TestBlacklisted(c *C) {
 	ps.winStackBus = testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true), []windowstack.WindowsInfo{},
 		[]windowstack.WindowsInfo{},
@@ -903,3 +1320,220 @@ func (ps *postalSuite) TestFocusedAppButLockedScreenNotification(c *C) {
 
 	c.Check(svc.messageHandler(app, "0", output), Equals, true)
 }
+
+// recordingHelperPool passes on the inputs it is asked to run.
+type recordingHelperPool struct {
+	ch chan *launch_helper.HelperInput
+}
+
+func (hp *recordingHelperPool) Run(kind string, input *launch_helper.HelperInput) {
+	hp.ch <- input
+}
+
+func (hp *recordingHelperPool) Start() chan *launch_helper.HelperResult { return nil }
+func (hp *recordingHelperPool) Stop()                                   {}
+func (hp *recordingHelperPool) Backlog() int                            { return 0 }
+
+// serveBlobs serves the blobs by path.
+func serveBlobs(blobs map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := blobs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(data))
+	}))
+}
+
+// refTo returns the reference to payload, kept apart at url.
+func refTo(c *C, url string, payload json.RawMessage) *blob.Ref {
+	data, err := blob.MakeRef(url, payload)
+	c.Assert(err, IsNil)
+	var ref blob.Ref
+	c.Assert(json.Unmarshal(data, &ref), IsNil)
+	return &ref
+}
+
+func (ps *postalSuite) TestPostByRef(c *C) {
+	payload := json.RawMessage(`{"message":"` + strings.Repeat("x", 3000) + `"}`)
+	srv := serveBlobs(map[string]string{"/blob/b1": string(payload)})
+	defer srv.Close()
+	setup := *ps.cfg
+	setup.BlobURL = helpers.ParseURL(srv.URL)
+	setup.MaxBlobSize = 4096
+	svc := NewPostalService(&setup, ps.log)
+	pool := &recordingHelperPool{make(chan *launch_helper.HelperInput, 1)}
+	svc.HelperPool = pool
+	app := clickhelp.MustParseAppId(anAppId)
+
+	svc.PostByRef(app, "m1", refTo(c, "blob/b1", payload))
+	select {
+	case input := <-pool.ch:
+		c.Check(input.NotificationId, Equals, "m1")
+		c.Check(input.Payload, DeepEquals, payload)
+	case <-time.After(5 * time.Second):
+		c.Fatal("helper not run")
+	}
+
+	// a broken reference gets the notification dropped, right away
+	svc.PostByRef(app, "m2", refTo(c, "blob/b2", payload))
+	select {
+	case <-pool.ch:
+		c.Fatal("helper run")
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.Check(ps.log.Captured(), Matches, `(?s).*ERROR dropping notification m2 for .*: could not fetch payload: blob endpoint replied 404.*`)
+}
+
+func (ps *postalSuite) TestPostByRefRetries(c *C) {
+	defer func(delays []time.Duration) { blobRetryDelays = delays }(blobRetryDelays)
+	blobRetryDelays = []time.Duration{10 * time.Millisecond, 10 * time.Millisecond}
+	payload := json.RawMessage(`{"a":1}`)
+	later := json.RawMessage(`{"b":2}`)
+	tries := make(chan bool, 5)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blob/b2" {
+			w.Write(later)
+			return
+		}
+		tries <- true
+		if len(tries) < 2 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(payload)
+	}))
+	defer srv.Close()
+	setup := *ps.cfg
+	setup.BlobURL = helpers.ParseURL(srv.URL)
+	setup.MaxBlobSize = 4096
+	svc := NewPostalService(&setup, ps.log)
+	pool := &recordingHelperPool{make(chan *launch_helper.HelperInput, 2)}
+	svc.HelperPool = pool
+	app := clickhelp.MustParseAppId(anAppId)
+
+	svc.PostByRef(app, "m1", refTo(c, "blob/b1", payload))
+	// a later payload of the app is fetched after it
+	svc.PostByRef(app, "m2", refTo(c, "blob/b2", later))
+	for _, nid := range []string{"m1", "m2"} {
+		select {
+		case input := <-pool.ch:
+			c.Check(input.NotificationId, Equals, nid)
+		case <-time.After(5 * time.Second):
+			c.Fatal("helper not run")
+		}
+	}
+	c.Check(tries, HasLen, 2)
+	c.Check(ps.log.Captured(), Matches, `(?s).*DEBUG \[m1\] could not fetch payload, trying again: blob endpoint replied 503.*`)
+}
+
+// flippingMetered is metered until flipped.
+type flippingMetered struct {
+	lock    sync.Mutex
+	metered bool
+}
+
+func (m *flippingMetered) Metered() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.metered
+}
+
+func (m *flippingMetered) flip() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.metered = !m.metered
+}
+
+func (ps *postalSuite) TestPostByRefWaitsWhileMetered(c *C) {
+	defer func(recheck time.Duration) { blobMeteredRecheck = recheck }(blobMeteredRecheck)
+	blobMeteredRecheck = 10 * time.Millisecond
+	payload := json.RawMessage(`{"a":1}`)
+	srv := serveBlobs(map[string]string{"/blob/b1": string(payload)})
+	defer srv.Close()
+	metered := &flippingMetered{metered: true}
+	setup := *ps.cfg
+	setup.BlobURL = helpers.ParseURL(srv.URL)
+	setup.MaxBlobSize = 4096
+	setup.Metered = metered
+	svc := NewPostalService(&setup, ps.log)
+	pool := &recordingHelperPool{make(chan *launch_helper.HelperInput, 2)}
+	svc.HelperPool = pool
+	app := clickhelp.MustParseAppId(anAppId)
+
+	svc.PostByRef(app, "m1", refTo(c, "blob/b1", payload))
+	// notifications of the app delivered inline aren't held up
+	svc.Post(app, "m2", json.RawMessage(`{"b":2}`))
+	select {
+	case input := <-pool.ch:
+		c.Check(input.NotificationId, Equals, "m2")
+	case <-time.After(5 * time.Second):
+		c.Fatal("helper not run")
+	}
+	select {
+	case <-pool.ch:
+		c.Fatal("fetched while metered")
+	case <-time.After(100 * time.Millisecond):
+	}
+	metered.flip()
+	select {
+	case input := <-pool.ch:
+		c.Check(input.NotificationId, Equals, "m1")
+	case <-time.After(5 * time.Second):
+		c.Fatal("helper not run")
+	}
+	c.Check(ps.log.Captured(), Matches, `(?s).*DEBUG \[m1\] metered connection, holding back fetching the payload.*`)
+}
+
+func (ps *postalSuite) TestTransientBlobError(c *C) {
+	c.Check(transientBlobError(blobStatusError(500)), Equals, true)
+	c.Check(transientBlobError(blobStatusError(404)), Equals, false)
+	c.Check(transientBlobError(&url.Error{"Get", "https://example.com", errors.New("refused")}), Equals, true)
+	c.Check(transientBlobError(blob.ErrBadBlob), Equals, false)
+	c.Check(transientBlobError(ErrBlobTooLarge), Equals, false)
+	c.Check(transientBlobError(ErrBadBlobURL), Equals, false)
+}
+
+func (ps *postalSuite) TestFetchBlob(c *C) {
+	payload := json.RawMessage(`{"a":1}`)
+	srv := serveBlobs(map[string]string{
+		"/blob/good": string(payload),
+		"/blob/bad":  `{"a":2}`,
+		"/blob/long": string(payload) + strings.Repeat(" ", 100),
+	})
+	defer srv.Close()
+	setup := *ps.cfg
+	setup.BlobURL = helpers.ParseURL(srv.URL)
+	setup.MaxBlobSize = 100
+	setup.AppMaxBlobSizes = map[string]int{aPackage + "_test-number-two": 5}
+	svc := NewPostalService(&setup, ps.log)
+	app := clickhelp.MustParseAppId(anAppId)
+
+	data, err := svc.fetchBlob(app, refTo(c, "blob/good", payload))
+	c.Assert(err, IsNil)
+	c.Check(data, DeepEquals, payload)
+	_, err = svc.fetchBlob(app, refTo(c, "blob/bad", payload))
+	c.Check(err, Equals, blob.ErrBadBlob)
+	_, err = svc.fetchBlob(app, refTo(c, "blob/long", payload))
+	c.Check(err, Equals, blob.ErrBadBlob)
+	_, err = svc.fetchBlob(app, refTo(c, "blob/none", payload))
+	c.Check(err, ErrorMatches, "blob endpoint replied 404")
+	// only from the server itself
+	_, err = svc.fetchBlob(app, refTo(c, "http://example.com/blob/good", payload))
+	c.Check(err, Equals, ErrBadBlobURL)
+	tooLarge := refTo(c, "blob/good", payload)
+	tooLarge.Size = 101
+	_, err = svc.fetchBlob(app, tooLarge)
+	c.Check(err, Equals, ErrBlobTooLarge)
+	// the limit can be set by app
+	_, err = svc.fetchBlob(clickhelp.MustParseAppId(aPackage+"_test-number-two"), refTo(c, "blob/good", payload))
+	c.Check(err, Equals, ErrBlobTooLarge)
+
+	svc = NewPostalService(ps.cfg, ps.log)
+	_, err = svc.fetchBlob(app, refTo(c, "blob/good", payload))
+	c.Check(err, Equals, ErrBlobTooLarge)
+	svc = NewPostalService(&PostalServiceSetup{MaxBlobSize: 100}, ps.log)
+	_, err = svc.fetchBlob(app, refTo(c, "blob/good", payload))
+	c.Check(err, Equals, ErrBadBlobURL)
+}
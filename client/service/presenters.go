@@ -0,0 +1,235 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ubports/ubuntu-push/bus"
+	"github.com/ubports/ubuntu-push/click"
+	"github.com/ubports/ubuntu-push/launch_helper"
+	"github.com/ubports/ubuntu-push/logger"
+)
+
+// PresenterInterface is the dbus interface out-of-process presenters
+// implement. Its only method is
+//
+//	void Present(string APP_ID, string NID, string NOTIFICATION)
+//
+// with the notification as JSON; replying with an error means the
+// notification wasn't presented.
+const PresenterInterface = "com.ubuntu.Postal.Presenter"
+
+var (
+	ErrBadPresenter     = errors.New("bad presenter")
+	ErrUnknownPresenter = errors.New("unknown presenter")
+)
+
+var (
+	// how long a presenter gets if it doesn't ask for a timeout
+	defaultPresenterTimeout = 2 * time.Second
+	// the most any presenter gets
+	maxPresenterTimeout = 10 * time.Second
+	// how many failures in a row get a presenter dropped
+	maxPresenterFailures = 3
+)
+
+// overridden for testing
+var newPresenterEndpoint = func(addr bus.Address, log logger.Logger) bus.Endpoint {
+	return bus.SessionBus.Endpoint(addr, log)
+}
+
+// a remotePresenter hands notifications over dbus to an
+// out-of-process presenter.
+type remotePresenter struct {
+	id      string // the bus name and object path
+	endp    bus.Endpoint
+	apps    []string // the apps it may present for; all if empty
+	timeout time.Duration
+	// failures in a row, with the presenters lock held
+	failures int
+}
+
+// accepts checks whether the presenter takes the notifications of app.
+func (rp *remotePresenter) accepts(app *click.AppId) bool {
+	return len(rp.apps) == 0 || appListed(app, rp.apps)
+}
+
+// call calls the presenter, giving up on it after its timeout.
+func (rp *remotePresenter) call(app *click.AppId, nid string, payload string) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- rp.endp.Call("Present", []interface{}{app.Original(), nid, payload})
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(rp.timeout):
+		return fmt.Errorf("timed out after %s", rp.timeout)
+	}
+}
+
+// presenterKey identifies a presenter by bus name and object path
+// (bus names can't have slashes, so this is unambiguous).
+func presenterKey(name, path string) string {
+	return name + path
+}
+
+// presentRemote hands the notification to the registered
+// out-of-process presenters that take the app's notifications,
+// returning whether there were any. It doesn't wait for them, so
+// neither the other presenters nor the next notification are held
+// up by a slow one.
+func (svc *PostalService) presentRemote(app *click.AppId, nid string, notification *launch_helper.Notification) bool {
+	svc.presentersLock.Lock()
+	var presenters []*remotePresenter
+	for _, rp := range svc.remotePresenters {
+		if rp.accepts(app) {
+			presenters = append(presenters, rp)
+		}
+	}
+	svc.presentersLock.Unlock()
+	if len(presenters) == 0 {
+		return false
+	}
+
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		svc.Log.Errorf("[%s] unable to marshal notification for presenters: %v", nid, err)
+		return false
+	}
+	for _, rp := range presenters {
+		go svc.callPresenter(rp, app, nid, string(payload))
+	}
+	return true
+}
+
+// callPresenter calls the presenter, dropping it once it has failed
+// or timed out maxPresenterFailures times in a row (e.g. because it
+// went away without unregistering).
+func (svc *PostalService) callPresenter(rp *remotePresenter, app *click.AppId, nid string, payload string) {
+	err := rp.call(app, nid, payload)
+	svc.presentersLock.Lock()
+	defer svc.presentersLock.Unlock()
+	if err == nil {
+		rp.failures = 0
+		return
+	}
+	svc.Log.Errorf("[%s] presenter %s failed: %v", nid, rp.id, err)
+	rp.failures++
+	if rp.failures < maxPresenterFailures || svc.remotePresenters[rp.id] != rp {
+		return
+	}
+	rp.endp.Close()
+	delete(svc.remotePresenters, rp.id)
+	svc.Log.Errorf("dropped presenter %s after %d failures in a row", rp.id, rp.failures)
+}
+
+// registerPresenter is only served on the unrestricted object path,
+// which confined apps can't reach; whatever can is trusted with all
+// notifications already (it could watch the session bus), so the
+// apps a presenter lists only narrow down what it gets and aren't
+// checked against anything.
+func (svc *PostalService) registerPresenter(path string, args, _ []interface{}) ([]interface{}, error) {
+	if len(args) < 3 {
+		return nil, ErrBadArgCount
+	}
+	if grabScope(path) != "" {
+		return nil, ErrNotForPackages
+	}
+	name, ok := args[0].(string)
+	if !ok {
+		return nil, ErrBadArgType
+	}
+	opath, ok := args[1].(string)
+	if !ok {
+		return nil, ErrBadArgType
+	}
+	timeoutMs, ok := args[2].(uint32)
+	if !ok {
+		return nil, ErrBadArgType
+	}
+	apps := make([]string, len(args)-3)
+	for i, iapp := range args[3:] {
+		apps[i], ok = iapp.(string)
+		if !ok {
+			return nil, ErrBadArgType
+		}
+	}
+	if name == "" || len(opath) == 0 || opath[0] != '/' {
+		return nil, ErrBadPresenter
+	}
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	if timeout == 0 {
+		timeout = defaultPresenterTimeout
+	}
+	if timeout > maxPresenterTimeout {
+		timeout = maxPresenterTimeout
+	}
+
+	addr := bus.Address{Name: name, Path: opath, Interface: PresenterInterface}
+	endp := newPresenterEndpoint(addr, svc.Log)
+	if err := endp.Dial(); err != nil {
+		return nil, err
+	}
+	key := presenterKey(name, opath)
+	rp := &remotePresenter{id: key, endp: endp, apps: apps, timeout: timeout}
+
+	svc.presentersLock.Lock()
+	defer svc.presentersLock.Unlock()
+	if svc.remotePresenters == nil {
+		svc.remotePresenters = make(map[string]*remotePresenter)
+	}
+	if old, ok := svc.remotePresenters[key]; ok {
+		old.endp.Close()
+	}
+	svc.remotePresenters[key] = rp
+	svc.Log.Infof("registered presenter %s (timeout %s, apps %v)", key, timeout, apps)
+	return nil, nil
+}
+
+func (svc *PostalService) unregisterPresenter(path string, args, _ []interface{}) ([]interface{}, error) {
+	if len(args) != 2 {
+		return nil, ErrBadArgCount
+	}
+	if grabScope(path) != "" {
+		return nil, ErrNotForPackages
+	}
+	name, ok := args[0].(string)
+	if !ok {
+		return nil, ErrBadArgType
+	}
+	opath, ok := args[1].(string)
+	if !ok {
+		return nil, ErrBadArgType
+	}
+
+	svc.presentersLock.Lock()
+	defer svc.presentersLock.Unlock()
+	key := presenterKey(name, opath)
+	rp, ok := svc.remotePresenters[key]
+	if !ok {
+		return nil, ErrUnknownPresenter
+	}
+	rp.endp.Close()
+	delete(svc.remotePresenters, key)
+	svc.Log.Infof("unregistered presenter %s", key)
+	return nil, nil
+}
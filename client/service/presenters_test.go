@@ -0,0 +1,264 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/ubports/ubuntu-push/bus"
+	testibus "github.com/ubports/ubuntu-push/bus/testing"
+	clickhelp "github.com/ubports/ubuntu-push/click/testing"
+	"github.com/ubports/ubuntu-push/launch_helper"
+	"github.com/ubports/ubuntu-push/logger"
+	helpers "github.com/ubports/ubuntu-push/testing"
+	"github.com/ubports/ubuntu-push/testing/condition"
+)
+
+type presentersSuite struct {
+	log         *helpers.TestLogger
+	endps       []bus.Endpoint
+	addrs       []bus.Address
+	oldEndpoint func(bus.Address, logger.Logger) bus.Endpoint
+}
+
+var _ = Suite(&presentersSuite{})
+
+func (ps *presentersSuite) SetUpTest(c *C) {
+	ps.log = helpers.NewTestLogger(c, "debug")
+	ps.endps = nil
+	ps.addrs = nil
+	ps.oldEndpoint = newPresenterEndpoint
+	newPresenterEndpoint = func(addr bus.Address, _ logger.Logger) bus.Endpoint {
+		ps.addrs = append(ps.addrs, addr)
+		endp := testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true))
+		ps.endps = append(ps.endps, endp)
+		return endp
+	}
+}
+
+func (ps *presentersSuite) TearDownTest(c *C) {
+	newPresenterEndpoint = ps.oldEndpoint
+}
+
+// a blockingEndpoint never answers calls
+type blockingEndpoint struct {
+	bus.Endpoint
+	release chan bool
+}
+
+func (b *blockingEndpoint) Call(string, []interface{}, ...interface{}) error {
+	<-b.release
+	return nil
+}
+
+// waitForCalls waits a bit for endp to be called, as presenters are
+// called in the background.
+func waitForCalls(endp bus.Endpoint) {
+	for i := 0; i < 100 && len(testibus.GetCallArgs(endp)) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+var presentedNotif = &launch_helper.Notification{Card: &launch_helper.Card{Summary: "hello"}, Tag: "a-tag"}
+
+func (ps *presentersSuite) TestRemotePresenterCalls(c *C) {
+	endp := testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true))
+	rp := &remotePresenter{id: "x/y", endp: endp, timeout: time.Second}
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	c.Check(rp.call(app, "nid-1", `{"tag":"a-tag"}`), IsNil)
+	callArgs := testibus.GetCallArgs(endp)
+	c.Assert(callArgs, HasLen, 1)
+	c.Check(callArgs[0].Member, Equals, "Present")
+	c.Check(callArgs[0].Args, DeepEquals, []interface{}{"com.example.test_test-app_0", "nid-1", `{"tag":"a-tag"}`})
+}
+
+func (ps *presentersSuite) TestRemotePresenterAccepts(c *C) {
+	rp := &remotePresenter{id: "x/y"}
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	c.Check(rp.accepts(app), Equals, true)
+	rp.apps = []string{"com.example.other"}
+	c.Check(rp.accepts(app), Equals, false)
+	rp.apps = append(rp.apps, "com.example.test_test-app")
+	c.Check(rp.accepts(app), Equals, true)
+}
+
+func (ps *presentersSuite) TestRemotePresenterFails(c *C) {
+	endp := testibus.NewTestingEndpoint(condition.Work(true), condition.Work(false))
+	rp := &remotePresenter{id: "x/y", endp: endp, timeout: time.Second}
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	c.Check(rp.call(app, "nid-1", "{}"), NotNil)
+}
+
+func (ps *presentersSuite) TestRemotePresenterTimesOut(c *C) {
+	endp := &blockingEndpoint{release: make(chan bool)}
+	defer close(endp.release)
+	rp := &remotePresenter{id: "x/y", endp: endp, timeout: 10 * time.Millisecond}
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	c.Check(rp.call(app, "nid-1", "{}"), ErrorMatches, "timed out after 10ms")
+}
+
+func (ps *presentersSuite) TestPresentRemoteDoesNotWait(c *C) {
+	svc := NewPostalService(&PostalServiceSetup{}, ps.log)
+	slow := &blockingEndpoint{release: make(chan bool)}
+	defer close(slow.release)
+	fast := testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true))
+	other := testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true))
+	svc.remotePresenters = map[string]*remotePresenter{
+		"slow":  {id: "slow", endp: slow, timeout: maxPresenterTimeout},
+		"fast":  {id: "fast", endp: fast, timeout: maxPresenterTimeout},
+		"other": {id: "other", endp: other, apps: []string{"com.example.other"}, timeout: maxPresenterTimeout},
+	}
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	t0 := time.Now()
+	c.Check(svc.presentRemote(app, "nid-1", presentedNotif), Equals, true)
+	c.Check(time.Since(t0) < time.Second, Equals, true)
+	waitForCalls(fast)
+	callArgs := testibus.GetCallArgs(fast)
+	c.Assert(callArgs, HasLen, 1)
+	var notif launch_helper.Notification
+	c.Assert(json.Unmarshal([]byte(callArgs[0].Args[2].(string)), &notif), IsNil)
+	c.Check(notif.Card.Summary, Equals, "hello")
+	c.Check(notif.Tag, Equals, "a-tag")
+	// not for this app
+	c.Check(testibus.GetCallArgs(other), HasLen, 0)
+}
+
+func (ps *presentersSuite) TestPresentRemoteNone(c *C) {
+	svc := NewPostalService(&PostalServiceSetup{}, ps.log)
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	c.Check(svc.presentRemote(app, "nid-1", presentedNotif), Equals, false)
+	svc.remotePresenters = map[string]*remotePresenter{
+		"other": {id: "other", apps: []string{"com.example.other"}},
+	}
+	c.Check(svc.presentRemote(app, "nid-1", presentedNotif), Equals, false)
+}
+
+func (ps *presentersSuite) TestCallPresenterDropsDeadPresenters(c *C) {
+	svc := NewPostalService(&PostalServiceSetup{}, ps.log)
+	// fails twice, then works
+	endp := testibus.NewTestingEndpoint(condition.Work(true), condition.Fail2Work(2))
+	rp := &remotePresenter{id: "x/y", endp: endp, timeout: time.Second}
+	svc.remotePresenters = map[string]*remotePresenter{"x/y": rp}
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	svc.callPresenter(rp, app, "nid-1", "{}")
+	svc.callPresenter(rp, app, "nid-2", "{}")
+	c.Check(rp.failures, Equals, 2)
+	svc.callPresenter(rp, app, "nid-3", "{}")
+	c.Check(rp.failures, Equals, 0)
+	c.Check(svc.remotePresenters, HasLen, 1)
+
+	rp.endp = testibus.NewTestingEndpoint(condition.Work(true), condition.Work(false))
+	for i := 0; i < maxPresenterFailures; i++ {
+		c.Check(svc.remotePresenters, HasLen, 1)
+		svc.callPresenter(rp, app, "nid", "{}")
+	}
+	c.Check(svc.remotePresenters, HasLen, 0)
+	c.Check(ps.log.Captured(), Matches, `(?ms).*\[nid-1\] presenter x/y failed: .*dropped presenter x/y after 3 failures in a row.*`)
+}
+
+func (ps *presentersSuite) TestCallPresenterLeavesReplacementAlone(c *C) {
+	svc := NewPostalService(&PostalServiceSetup{}, ps.log)
+	endp := testibus.NewTestingEndpoint(condition.Work(true), condition.Work(false))
+	rp := &remotePresenter{id: "x/y", endp: endp, timeout: time.Second, failures: maxPresenterFailures}
+	// registered again meanwhile
+	svc.remotePresenters = map[string]*remotePresenter{"x/y": {id: "x/y"}}
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	svc.callPresenter(rp, app, "nid-1", "{}")
+	c.Check(svc.remotePresenters, HasLen, 1)
+}
+
+func (ps *presentersSuite) TestRegisterAndUnregister(c *C) {
+	svc := NewPostalService(&PostalServiceSetup{}, ps.log)
+	_, err := svc.registerPresenter("/_", []interface{}{"com.example.Watch", "/watch", uint32(0), "com.example.test"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(ps.addrs, DeepEquals, []bus.Address{{Name: "com.example.Watch", Path: "/watch", Interface: PresenterInterface}})
+	rp := svc.remotePresenters["com.example.Watch/watch"]
+	c.Assert(rp, NotNil)
+	c.Check(rp.apps, DeepEquals, []string{"com.example.test"})
+	c.Check(rp.timeout, Equals, defaultPresenterTimeout)
+
+	// re-registering replaces it
+	_, err = svc.registerPresenter("/_", []interface{}{"com.example.Watch", "/watch", uint32(60000)}, nil)
+	c.Assert(err, IsNil)
+	c.Check(svc.remotePresenters, HasLen, 1)
+	rp = svc.remotePresenters["com.example.Watch/watch"]
+	c.Check(rp.apps, HasLen, 0)
+	c.Check(rp.timeout, Equals, maxPresenterTimeout)
+
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	c.Check(svc.presentRemote(app, "nid-1", presentedNotif), Equals, true)
+	waitForCalls(ps.endps[1])
+	c.Check(testibus.GetCallArgs(ps.endps[1]), HasLen, 1)
+
+	_, err = svc.unregisterPresenter("/_", []interface{}{"com.example.Watch", "/watch"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(svc.remotePresenters, HasLen, 0)
+	_, err = svc.unregisterPresenter("/_", []interface{}{"com.example.Watch", "/watch"}, nil)
+	c.Check(err, Equals, ErrUnknownPresenter)
+}
+
+func (ps *presentersSuite) TestRegisterFails(c *C) {
+	svc := NewPostalService(&PostalServiceSetup{}, ps.log)
+	for i, t := range []struct {
+		path string
+		args []interface{}
+		err  error
+	}{
+		{"/_", []interface{}{"a", "/b"}, ErrBadArgCount},
+		{aPackageOnBus, []interface{}{"a", "/b", uint32(0)}, ErrNotForPackages},
+		{"/_", []interface{}{1, "/b", uint32(0)}, ErrBadArgType},
+		{"/_", []interface{}{"a", 1, uint32(0)}, ErrBadArgType},
+		{"/_", []interface{}{"a", "/b", 0}, ErrBadArgType},
+		{"/_", []interface{}{"a", "/b", uint32(0), 1}, ErrBadArgType},
+		{"/_", []interface{}{"", "/b", uint32(0)}, ErrBadPresenter},
+		{"/_", []interface{}{"a", "b", uint32(0)}, ErrBadPresenter},
+	} {
+		_, err := svc.registerPresenter(t.path, t.args, nil)
+		c.Check(err, Equals, t.err, Commentf("%d", i))
+	}
+	c.Check(svc.remotePresenters, HasLen, 0)
+}
+
+func (ps *presentersSuite) TestRegisterDialFails(c *C) {
+	newPresenterEndpoint = func(bus.Address, logger.Logger) bus.Endpoint {
+		return testibus.NewTestingEndpoint(condition.Work(false), nil)
+	}
+	svc := NewPostalService(&PostalServiceSetup{}, ps.log)
+	_, err := svc.registerPresenter("/_", []interface{}{"a", "/b", uint32(0)}, nil)
+	c.Check(err, NotNil)
+	c.Check(svc.remotePresenters, HasLen, 0)
+}
+
+func (ps *presentersSuite) TestUnregisterFails(c *C) {
+	svc := NewPostalService(&PostalServiceSetup{}, ps.log)
+	for i, t := range []struct {
+		path string
+		args []interface{}
+		err  error
+	}{
+		{"/_", []interface{}{"a"}, ErrBadArgCount},
+		{aPackageOnBus, []interface{}{"a", "/b"}, ErrNotForPackages},
+		{"/_", []interface{}{1, "/b"}, ErrBadArgType},
+		{"/_", []interface{}{"a", 1}, ErrBadArgType},
+	} {
+		_, err := svc.unregisterPresenter(t.path, t.args, nil)
+		c.Check(err, Equals, t.err, Commentf("%d", i))
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"sync"
+)
+
+// appQueues does work in the background in order for each app, so
+// that work that takes a while (a download, say) neither holds up
+// that of other apps nor lets later work of the same app overtake it.
+type appQueues struct {
+	lock   sync.Mutex
+	queued map[string][]func()
+}
+
+// add queues f for the app if wait says so or if earlier work of the
+// app is still queued or going on. It returns false if it didn't,
+// leaving it to the caller to do f right away.
+func (q *appQueues) add(appId string, wait bool, f func()) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	queue, busy := q.queued[appId]
+	if !busy && !wait {
+		return false
+	}
+	if q.queued == nil {
+		q.queued = make(map[string][]func())
+	}
+	q.queued[appId] = append(queue, f)
+	if !busy {
+		go q.run(appId)
+	}
+	return true
+}
+
+// run does the queued work of the app, in order.
+func (q *appQueues) run(appId string) {
+	for {
+		q.lock.Lock()
+		queue := q.queued[appId]
+		if len(queue) == 0 {
+			delete(q.queued, appId)
+			q.lock.Unlock()
+			return
+		}
+		q.queued[appId] = queue[1:]
+		q.lock.Unlock()
+		queue[0]()
+	}
+}
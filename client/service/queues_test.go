@@ -0,0 +1,60 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type queuesSuite struct{}
+
+var _ = Suite(&queuesSuite{})
+
+func (qs *queuesSuite) TestAddRightAway(c *C) {
+	var q appQueues
+	c.Check(q.add("app", false, func() { c.Error("should not run") }), Equals, false)
+	c.Check(q.queued, HasLen, 0)
+}
+
+func (qs *queuesSuite) TestAddInOrder(c *C) {
+	var q appQueues
+	release := make(chan bool)
+	done := make(chan string, 4)
+	c.Assert(q.add("app", true, func() { <-release; done <- "a1" }), Equals, true)
+	// later work of the app waits behind the first
+	c.Check(q.add("app", false, func() { done <- "a2" }), Equals, true)
+	// other apps aren't held up
+	c.Check(q.add("other", false, func() { done <- "o1" }), Equals, false)
+	c.Check(q.add("other", true, func() { done <- "o2" }), Equals, true)
+	select {
+	case got := <-done:
+		c.Check(got, Equals, "o2")
+	case <-time.After(time.Second):
+		c.Fatal("timeout")
+	}
+	close(release)
+	for _, expected := range []string{"a1", "a2"} {
+		select {
+		case got := <-done:
+			c.Check(got, Equals, expected)
+		case <-time.After(time.Second):
+			c.Fatal("timeout")
+		}
+	}
+}
@@ -0,0 +1,182 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ubports/ubuntu-push/click"
+)
+
+var ErrBadQuietTime = errors.New("quiet hours times must be HH:MM, and given both or neither")
+
+// QuietSchedule is the user's do-not-disturb policy.
+type QuietSchedule struct {
+	// DoNotDisturb is quiet all the time, schedule or not
+	DoNotDisturb bool `json:"do_not_disturb"`
+	// Start and End are local times of day as "HH:MM"; the quiet
+	// period can wrap past midnight. Both empty means no schedule.
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Exceptions are the apps that aren't kept quiet, by package,
+	// versionless or full app id
+	Exceptions []string `json:"exceptions"`
+}
+
+// parseTimeOfDay parses "HH:MM" into minutes since midnight.
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, ErrBadQuietTime
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Validate checks the schedule makes sense.
+func (sched *QuietSchedule) Validate() error {
+	if sched.Start == "" && sched.End == "" {
+		return nil
+	}
+	if _, err := parseTimeOfDay(sched.Start); err != nil {
+		return err
+	}
+	if _, err := parseTimeOfDay(sched.End); err != nil {
+		return err
+	}
+	return nil
+}
+
+// quietAt says whether the schedule is in effect at t.
+func (sched *QuietSchedule) quietAt(t time.Time) bool {
+	if sched.DoNotDisturb {
+		return true
+	}
+	if sched.Start == "" {
+		return false
+	}
+	start, err := parseTimeOfDay(sched.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseTimeOfDay(sched.End)
+	if err != nil {
+		return false
+	}
+	now := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return start <= now && now < end
+	}
+	// wraps past midnight
+	return now >= start || now < end
+}
+
+func (sched *QuietSchedule) isException(app *click.AppId) bool {
+	return appListed(app, sched.Exceptions)
+}
+
+// QuietHours keeps the QuietSchedule, persisted as JSON in a
+// file. With no file the schedule is only kept in memory.
+type QuietHours struct {
+	path   string
+	lock   sync.Mutex
+	loaded bool
+	sched  QuietSchedule
+	now    func() time.Time
+}
+
+// NewQuietHours returns a QuietHours keeping its schedule in path.
+func NewQuietHours(path string) *QuietHours {
+	return &QuietHours{path: path, now: time.Now}
+}
+
+// load reads the schedule the first time it's needed, with the lock
+// held.
+func (qh *QuietHours) load() error {
+	if qh.loaded || qh.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(qh.path)
+	if os.IsNotExist(err) {
+		qh.loaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var sched QuietSchedule
+	err = json.Unmarshal(data, &sched)
+	if err == nil {
+		err = sched.Validate()
+	}
+	if err != nil {
+		return err
+	}
+	qh.sched = sched
+	qh.loaded = true
+	return nil
+}
+
+// Get returns the current schedule.
+func (qh *QuietHours) Get() (QuietSchedule, error) {
+	qh.lock.Lock()
+	defer qh.lock.Unlock()
+	err := qh.load()
+	return qh.sched, err
+}
+
+// Set validates, stores and saves the schedule.
+func (qh *QuietHours) Set(sched QuietSchedule) error {
+	if err := sched.Validate(); err != nil {
+		return err
+	}
+	qh.lock.Lock()
+	defer qh.lock.Unlock()
+	if qh.path != "" {
+		data, err := json.Marshal(&sched)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(qh.path), 0700)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(qh.path, data, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	qh.sched = sched
+	qh.loaded = true
+	return nil
+}
+
+// Quiet says whether notifications for app are to be kept quiet
+// right now.
+func (qh *QuietHours) Quiet(app *click.AppId) (bool, error) {
+	qh.lock.Lock()
+	defer qh.lock.Unlock()
+	if err := qh.load(); err != nil {
+		return false, err
+	}
+	return qh.sched.quietAt(qh.now()) && !qh.sched.isException(app), nil
+}
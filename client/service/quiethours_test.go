@@ -0,0 +1,153 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	clickhelp "github.com/ubports/ubuntu-push/click/testing"
+)
+
+type quietHoursSuite struct{}
+
+var _ = Suite(&quietHoursSuite{})
+
+func at(hhmm string) func() time.Time {
+	return func() time.Time {
+		t, err := time.Parse("15:04", hhmm)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+}
+
+func (s *quietHoursSuite) TestValidate(c *C) {
+	for i, sched := range []QuietSchedule{
+		{},
+		{DoNotDisturb: true},
+		{Start: "22:00", End: "07:00"},
+		{Start: "00:00", End: "23:59"},
+	} {
+		c.Check(sched.Validate(), IsNil, Commentf("iter %d", i))
+	}
+	for i, sched := range []QuietSchedule{
+		{Start: "22:00"},
+		{End: "07:00"},
+		{Start: "10pm", End: "07:00"},
+		{Start: "22:00", End: "24:00"},
+	} {
+		c.Check(sched.Validate(), Equals, ErrBadQuietTime, Commentf("iter %d", i))
+	}
+}
+
+func (s *quietHoursSuite) TestQuiet(c *C) {
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	qh := NewQuietHours("")
+	qh.now = at("23:00")
+	// nothing set
+	quiet, err := qh.Quiet(app)
+	c.Assert(err, IsNil)
+	c.Check(quiet, Equals, false)
+
+	c.Assert(qh.Set(QuietSchedule{DoNotDisturb: true}), IsNil)
+	quiet, err = qh.Quiet(app)
+	c.Assert(err, IsNil)
+	c.Check(quiet, Equals, true)
+
+	for i, t := range []struct {
+		start, end, now string
+		quiet           bool
+	}{
+		{"09:00", "17:00", "08:59", false},
+		{"09:00", "17:00", "09:00", true},
+		{"09:00", "17:00", "16:59", true},
+		{"09:00", "17:00", "17:00", false},
+		// wrapping past midnight
+		{"22:00", "07:00", "21:59", false},
+		{"22:00", "07:00", "22:00", true},
+		{"22:00", "07:00", "00:00", true},
+		{"22:00", "07:00", "06:59", true},
+		{"22:00", "07:00", "07:00", false},
+		{"22:00", "07:00", "12:00", false},
+	} {
+		c.Assert(qh.Set(QuietSchedule{Start: t.start, End: t.end}), IsNil)
+		qh.now = at(t.now)
+		quiet, err = qh.Quiet(app)
+		c.Assert(err, IsNil)
+		c.Check(quiet, Equals, t.quiet, Commentf("iter %d", i))
+	}
+}
+
+func (s *quietHoursSuite) TestQuietExceptions(c *C) {
+	qh := NewQuietHours("")
+	for _, exc := range []string{"com.example.test", "com.example.test_test-app", "com.example.test_test-app_0"} {
+		c.Assert(qh.Set(QuietSchedule{DoNotDisturb: true, Exceptions: []string{exc}}), IsNil)
+		quiet, err := qh.Quiet(clickhelp.MustParseAppId("com.example.test_test-app_0"))
+		c.Assert(err, IsNil)
+		c.Check(quiet, Equals, false, Commentf("%s", exc))
+		quiet, err = qh.Quiet(clickhelp.MustParseAppId("com.example.other_app_0"))
+		c.Assert(err, IsNil)
+		c.Check(quiet, Equals, true, Commentf("%s", exc))
+	}
+}
+
+func (s *quietHoursSuite) TestPersists(c *C) {
+	path := filepath.Join(c.MkDir(), "sub", "quiet-hours.json")
+	qh := NewQuietHours(path)
+	sched, err := qh.Get()
+	c.Assert(err, IsNil)
+	c.Check(sched, DeepEquals, QuietSchedule{})
+
+	sched = QuietSchedule{Start: "22:00", End: "07:00", Exceptions: []string{"com.example.test"}}
+	c.Assert(qh.Set(sched), IsNil)
+	fi, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Check(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	got, err := NewQuietHours(path).Get()
+	c.Assert(err, IsNil)
+	c.Check(got, DeepEquals, sched)
+}
+
+func (s *quietHoursSuite) TestSetRejectsBadSchedule(c *C) {
+	qh := NewQuietHours("")
+	c.Check(qh.Set(QuietSchedule{Start: "22:00"}), Equals, ErrBadQuietTime)
+	sched, err := qh.Get()
+	c.Assert(err, IsNil)
+	c.Check(sched, DeepEquals, QuietSchedule{})
+}
+
+func (s *quietHoursSuite) TestBrokenFile(c *C) {
+	path := filepath.Join(c.MkDir(), "quiet-hours.json")
+	c.Assert(ioutil.WriteFile(path, []byte("{"), 0600), IsNil)
+	qh := NewQuietHours(path)
+	_, err := qh.Get()
+	c.Check(err, NotNil)
+	quiet, err := qh.Quiet(clickhelp.MustParseAppId("com.example.test_test-app_0"))
+	c.Check(err, NotNil)
+	c.Check(quiet, Equals, false)
+	// setting it fixes things
+	c.Assert(qh.Set(QuietSchedule{DoNotDisturb: true}), IsNil)
+	_, err = qh.Get()
+	c.Check(err, IsNil)
+}
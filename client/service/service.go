@@ -30,6 +30,7 @@ import (
 
 	"github.com/ubports/ubuntu-push/bus"
 	"github.com/ubports/ubuntu-push/click"
+	"github.com/ubports/ubuntu-push/envelope"
 	"github.com/ubports/ubuntu-push/logger"
 	"github.com/ubports/ubuntu-push/nih"
 )
@@ -39,6 +40,11 @@ type PushServiceSetup struct {
 	RegURL           *url.URL
 	DeviceId         string
 	InstalledChecker click.InstalledChecker
+	KeyStore         *envelope.KeyStore
+	// AuthGetter gets the Authorization header value telling the
+	// server which user the device belongs to, given the url of
+	// the request
+	AuthGetter func(string) string
 }
 
 // PushService is the dbus api
@@ -47,6 +53,8 @@ type PushService struct {
 	regURL     *url.URL
 	deviceId   string
 	httpCli    http13.Client
+	keyStore   *envelope.KeyStore
+	authGetter func(string) string
 }
 
 var (
@@ -65,6 +73,8 @@ func NewPushService(setup *PushServiceSetup, log logger.Logger) *PushService {
 	svc.installedChecker = setup.InstalledChecker
 	svc.regURL = setup.RegURL
 	svc.deviceId = setup.DeviceId
+	svc.keyStore = setup.KeyStore
+	svc.authGetter = setup.AuthGetter
 	return svc
 }
 
@@ -85,6 +95,7 @@ func (svc *PushService) Start() error {
 	return svc.DBusService.Start(bus.DispatchMap{
 		"Register":   svc.register,
 		"Unregister": svc.unregister,
+		"PublicKey":  svc.publicKey,
 	}, PushServiceBusAddress, nil)
 }
 
@@ -93,6 +104,7 @@ var (
 	ErrBadRequest = errors.New("bad request")
 	ErrBadToken   = errors.New("bad token")
 	ErrBadAuth    = errors.New("bad auth")
+	ErrNoKeyStore = errors.New("no key store")
 )
 
 type registrationRequest struct {
@@ -107,8 +119,22 @@ type registrationReply struct {
 	Message string `json:"message"` //
 }
 
+// dismissalRequest tells the server which of the app's notifications
+// the user dealt with on this device.
+type dismissalRequest struct {
+	DeviceId string   `json:"deviceid"`
+	AppId    string   `json:"appid"`
+	Tags     []string `json:"tags"`
+}
+
 func (svc *PushService) manageReg(op, appId string) (*registrationReply, error) {
-	req_body, err := json.Marshal(registrationRequest{svc.deviceId, appId})
+	return svc.postToRegURL(op, registrationRequest{svc.deviceId, appId})
+}
+
+// postToRegURL POSTs reqObj as JSON to op at the registration HTTP
+// endpoint, and reads back the reply.
+func (svc *PushService) postToRegURL(op string, reqObj interface{}) (*registrationReply, error) {
+	req_body, err := json.Marshal(reqObj)
 	if err != nil {
 		return nil, fmt.Errorf("unable to marshal register request body: %v", err)
 	}
@@ -120,6 +146,11 @@ func (svc *PushService) manageReg(op, appId string) (*registrationReply, error)
 		panic(fmt.Errorf("unable to build register request: %v", err))
 	}
 	req.Header.Add("Content-Type", "application/json")
+	if svc.authGetter != nil {
+		if auth := svc.authGetter(url); auth != "" {
+			req.Header.Add("Authorization", auth)
+		}
+	}
 
 	resp, err := svc.httpCli.Do(req)
 	if err != nil {
@@ -167,17 +198,28 @@ func (svc *PushService) register(path string, args, _ []interface{}) ([]interfac
 		return []interface{}{rv}, nil
 	}
 
-	reply, err := svc.manageReg("/register", app.Original())
+	token, err := svc.Register(app.Original())
 	if err != nil {
 		return nil, err
 	}
 
+	return []interface{}{token}, nil
+}
+
+// Register registers appId on the device, returning the token app
+// servers address it with.
+func (svc *PushService) Register(appId string) (string, error) {
+	reply, err := svc.manageReg("/register", appId)
+	if err != nil {
+		return "", err
+	}
+
 	if !reply.Ok || reply.Token == "" {
 		svc.Log.Errorf("unexpected response: %#v", reply)
-		return nil, ErrBadToken
+		return "", ErrBadToken
 	}
 
-	return []interface{}{reply.Token}, nil
+	return reply.Token, nil
 }
 
 func (svc *PushService) unregister(path string, args, _ []interface{}) ([]interface{}, error) {
@@ -191,5 +233,51 @@ func (svc *PushService) unregister(path string, args, _ []interface{}) ([]interf
 
 func (svc *PushService) Unregister(appId string) error {
 	_, err := svc.manageReg("/unregister", appId)
-	return err
+	if err != nil {
+		return err
+	}
+	if svc.keyStore != nil {
+		err = svc.keyStore.Forget(appId)
+		if err != nil {
+			svc.Log.Errorf("unable to forget key for %s: %v", appId, err)
+		}
+	}
+	return nil
+}
+
+// Dismiss reports that the user dealt with the notifications of appId
+// with the given tags, for the server to clear them from the user's
+// other devices.
+func (svc *PushService) Dismiss(appId string, tags []string) error {
+	reply, err := svc.postToRegURL("/dismiss", dismissalRequest{svc.deviceId, appId, tags})
+	if err != nil {
+		return err
+	}
+	if !reply.Ok {
+		svc.Log.Errorf("unexpected response: %#v", reply)
+		return ErrBadServer
+	}
+	return nil
+}
+
+// publicKey returns the public key app servers use to seal payloads
+// for the app, generating the key pair on first use.
+func (svc *PushService) publicKey(path string, args, _ []interface{}) ([]interface{}, error) {
+	app, err := svc.grabDBusPackageAndAppId(path, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	if svc.keyStore == nil {
+		return nil, ErrNoKeyStore
+	}
+	key, err := svc.keyStore.Ensure(app.Original())
+	if err != nil {
+		svc.Log.Errorf("unable to get key for %s: %v", app.Original(), err)
+		return nil, err
+	}
+	pub, err := envelope.MarshalPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{pub}, nil
 }
@@ -30,6 +30,7 @@ import (
 	"github.com/ubports/ubuntu-push/bus"
 	testibus "github.com/ubports/ubuntu-push/bus/testing"
 	"github.com/ubports/ubuntu-push/click"
+	"github.com/ubports/ubuntu-push/envelope"
 	"github.com/ubports/ubuntu-push/logger"
 	"github.com/ubports/ubuntu-push/nih"
 	helpers "github.com/ubports/ubuntu-push/testing"
@@ -196,6 +197,24 @@ func (ss *serviceSuite) TestRegistrationWorks(c *C) {
 	c.Check(regs, Equals, "blob-of-bytes")
 }
 
+func (ss *serviceSuite) TestRegistrationPresentsAuthorization(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("Authorization"), Equals, "auth for "+r.URL.String())
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"ok":true,"token":"blob-of-bytes"}`)
+	}))
+	defer ts.Close()
+	setup := &PushServiceSetup{
+		DeviceId:   "fake-device-id",
+		RegURL:     helpers.ParseURL(ts.URL),
+		AuthGetter: func(url string) string { return "auth for " + url[len(ts.URL):] },
+	}
+	svc := NewPushService(setup, ss.log)
+	token, err := svc.Register(anAppId)
+	c.Assert(err, IsNil)
+	c.Check(token, Equals, "blob-of-bytes")
+}
+
 func (ss *serviceSuite) TestRegistrationOverrideWorks(c *C) {
 	envar := "PUSH_REG_" + string(nih.Quote([]byte(anAppId)))
 	os.Setenv(envar, "42")
@@ -373,3 +392,86 @@ func (ss *serviceSuite) TestUnregistrationWorks(c *C) {
 	c.Assert(err, IsNil)
 	c.Check(invoked, HasLen, 1)
 }
+
+func (ss *serviceSuite) TestUnregistrationForgetsKey(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"ok":true}`)
+	}))
+	defer ts.Close()
+	ks := envelope.NewKeyStore("")
+	_, err := ks.Ensure(anAppId)
+	c.Assert(err, IsNil)
+	setup := &PushServiceSetup{
+		DeviceId: "fake-device-id",
+		RegURL:   helpers.ParseURL(ts.URL),
+		KeyStore: ks,
+	}
+	svc := NewPushService(setup, ss.log)
+	svc.Bus = ss.bus
+	err = svc.Unregister(anAppId)
+	c.Assert(err, IsNil)
+	_, err = ks.Lookup(anAppId)
+	c.Check(err, Equals, envelope.ErrNoKey)
+}
+
+func (ss *serviceSuite) TestDismissWorks(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 256)
+		n := r.ContentLength
+		_, e := io.ReadFull(r.Body, buf[:n])
+		c.Assert(e, IsNil)
+		req := dismissalRequest{}
+		c.Assert(json.Unmarshal(buf[:n], &req), IsNil)
+		c.Check(req, DeepEquals, dismissalRequest{"fake-device-id", anAppId, []string{"one", "two"}})
+		c.Check(r.URL.Path, Equals, "/dismiss")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"ok":true,"devices":1}`)
+	}))
+	defer ts.Close()
+	setup := &PushServiceSetup{
+		DeviceId: "fake-device-id",
+		RegURL:   helpers.ParseURL(ts.URL),
+	}
+	svc := NewPushService(setup, ss.log)
+	c.Check(svc.Dismiss(anAppId, []string{"one", "two"}), IsNil)
+}
+
+func (ss *serviceSuite) TestDismissFails(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{}`)
+	}))
+	defer ts.Close()
+	setup := &PushServiceSetup{
+		DeviceId: "fake-device-id",
+		RegURL:   helpers.ParseURL(ts.URL),
+	}
+	svc := NewPushService(setup, ss.log)
+	c.Check(svc.Dismiss(anAppId, []string{"one"}), Equals, ErrBadServer)
+}
+
+func (ss *serviceSuite) TestPublicKey(c *C) {
+	ks := envelope.NewKeyStore("")
+	svc := NewPushService(&PushServiceSetup{KeyStore: ks}, ss.log)
+	res, err := svc.publicKey(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res, HasLen, 1)
+	pub, err := envelope.ParsePublicKey(res[0].(string))
+	c.Assert(err, IsNil)
+	key, err := ks.Lookup(anAppId)
+	c.Assert(err, IsNil)
+	c.Check(pub, DeepEquals, &key.PublicKey)
+	// the same key is handed out again
+	again, err := svc.publicKey(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Assert(err, IsNil)
+	c.Check(again, DeepEquals, res)
+}
+
+func (ss *serviceSuite) TestPublicKeyFailures(c *C) {
+	svc := NewPushService(testSetup, ss.log)
+	_, err := svc.publicKey(aPackageOnBus, []interface{}{}, nil)
+	c.Check(err, Equals, ErrBadArgCount)
+	_, err = svc.publicKey(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Check(err, Equals, ErrNoKeyStore)
+}
@@ -19,6 +19,8 @@
 package seenstate
 
 import (
+	"sync"
+
 	"github.com/ubports/ubuntu-push/protocol"
 )
 
@@ -35,19 +37,31 @@ type SeenState interface {
 }
 
 type memSeenState struct {
+	// the levels are also looked at for debugging
+	lock     sync.Mutex
 	levels   map[string]int64
 	seenMsgs map[string]bool
 }
 
 func (m *memSeenState) SetLevel(level string, top int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	m.levels[level] = top
 	return nil
 }
 func (m *memSeenState) GetAllLevels() (map[string]int64, error) {
-	return m.levels, nil
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	levels := make(map[string]int64, len(m.levels))
+	for level, top := range m.levels {
+		levels[level] = top
+	}
+	return levels, nil
 }
 
 func (m *memSeenState) FilterBySeen(notifs []protocol.Notification) ([]protocol.Notification, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	acc := make([]protocol.Notification, 0, len(notifs))
 	for _, notif := range notifs {
 		seen := m.seenMsgs[notif.MsgId]
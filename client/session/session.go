@@ -56,6 +56,8 @@ var (
 type BroadcastNotification struct {
 	TopLevel int64
 	Decoded  []map[string]interface{}
+	// To is the addressee of app-scoped broadcasts, nil for system ones
+	To *click.AppId
 }
 
 type serverMsg struct {
@@ -114,6 +116,11 @@ type AddresseeChecking interface {
 	CheckForAddressee(*protocol.Notification) *click.AppId
 }
 
+// MeteredChecking can tell whether the connection is metered.
+type MeteredChecking interface {
+	Metered() bool
+}
+
 // AddressedNotification carries both a protocol.Notification and a parsed
 // AppId addressee.
 type AddressedNotification struct {
@@ -130,6 +137,7 @@ type ClientSessionConfig struct {
 	PEM                    []byte
 	Info                   map[string]interface{}
 	AddresseeChecker       AddresseeChecking
+	MeteredChecker         MeteredChecking
 	BroadcastCh            chan *BroadcastNotification
 	NotificationsCh        chan AddressedNotification
 }
@@ -141,6 +149,16 @@ type ClientSession interface {
 	HasConnectivity(bool)
 	KeepConnection() error
 	StopKeepConnection()
+	// Debug returns a snapshot of the session for troubleshooting.
+	Debug() DebugInfo
+}
+
+// DebugInfo is a snapshot of a session for troubleshooting.
+type DebugInfo struct {
+	State     string           `json:"state"`
+	Host      string           `json:"host"`
+	HasCookie bool             `json:"has_cookie"`
+	Levels    map[string]int64 `json:"levels"`
 }
 
 type clientSession struct {
@@ -310,6 +328,22 @@ func (sess *clientSession) getConnection() net.Conn {
 	return sess.Connection
 }
 
+// Debug returns a snapshot of the session for troubleshooting; the
+// host is that of the current connection, if any.
+func (sess *clientSession) Debug() DebugInfo {
+	info := DebugInfo{State: sess.State().String()}
+	if conn := sess.getConnection(); conn != nil {
+		info.Host = conn.RemoteAddr().String()
+	}
+	info.HasCookie = sess.getCookie() != ""
+	levels, err := sess.SeenState.GetAllLevels()
+	if err != nil {
+		sess.Log.Errorf("unable to get levels for debugging: %v", err)
+	}
+	info.Levels = levels
+	return info
+}
+
 func (sess *clientSession) setCookie(cookie string) {
 	sess.connLock.Lock()
 	defer sess.connLock.Unlock()
@@ -337,6 +371,10 @@ func (sess *clientSession) getHosts() error {
 		if sess.deliveryHosts != nil && sess.timeSince(sess.deliveryHostsTimestamp) < sess.HostsCachingExpiryTime {
 			return nil
 		}
+		if sess.deliveryHosts != nil && sess.MeteredChecker != nil && sess.MeteredChecker.Metered() {
+			sess.Log.Debugf("getHosts: metered, sticking to cached hosts")
+			return nil
+		}
 		host, err := sess.getHost.Get()
 		if err != nil {
 			sess.Log.Errorf("getHosts: %v", err)
@@ -505,25 +543,39 @@ func (sess *clientSession) handleBroadcast(bcast *serverMsg) error {
 		return err
 	}
 	// the server assumes if we ack the broadcast, we've updated
-	// our levels. Hence the order.
-	err = sess.proto.WriteMessage(protocol.AckMsg{"ack"})
-	if err != nil {
+	// our levels. Hence the order. As the levels are updated the
+	// broadcast won't come again, so it's delivered even if the ack
+	// fails.
+	ackErr := sess.proto.WriteMessage(protocol.AckMsg{"ack"})
+	if ackErr != nil {
 		sess.setState(Error)
-		sess.Log.Errorf("unable to ack broadcast: %s", err)
-		return err
+		sess.Log.Errorf("unable to ack broadcast: %s", ackErr)
+	} else {
+		sess.clearShouldDelay()
 	}
-	sess.clearShouldDelay()
 	sess.Log.Infof("broadcast chan:%v app:%v topLevel:%d payloads:%s",
 		bcast.ChanId, bcast.AppId, bcast.TopLevel, bcast.Payloads)
 	if bcast.ChanId == protocol.SystemChannelId {
-		// the system channel id, the only one we care about for now
+		// the system channel id
 		sess.Log.Debugf("sending bcast over")
 		sess.BroadcastCh <- sess.decodeBroadcast(bcast)
 		sess.Log.Debugf("sent bcast over")
+	} else if bcast.AppId != "" {
+		// an app-scoped broadcast channel
+		sess.AddresseeChecker.StartAddresseeBatch()
+		to := sess.AddresseeChecker.CheckForAddressee(&protocol.Notification{AppId: bcast.AppId})
+		if to == nil {
+			return ackErr
+		}
+		notif := sess.decodeBroadcast(bcast)
+		notif.To = to
+		sess.Log.Debugf("sending app bcast over")
+		sess.BroadcastCh <- notif
+		sess.Log.Debugf("sent app bcast over")
 	} else {
 		sess.Log.Errorf("what is this weird channel, %#v?", bcast.ChanId)
 	}
-	return nil
+	return ackErr
 }
 
 // handle "notifications" messages
@@ -536,14 +588,16 @@ func (sess *clientSession) handleNotifications(ucast *serverMsg) error {
 		return err
 	}
 	// the server assumes if we ack the broadcast, we've updated
-	// our state. Hence the order.
-	err = sess.proto.WriteMessage(protocol.AckMsg{"ack"})
-	if err != nil {
+	// our state. Hence the order. As the notifications are marked
+	// seen they would be filtered out when the server sends them
+	// again, so they're delivered even if the ack fails.
+	ackErr := sess.proto.WriteMessage(protocol.AckMsg{"ack"})
+	if ackErr != nil {
 		sess.setState(Error)
-		sess.Log.Errorf("unable to ack notifications: %s", err)
-		return err
+		sess.Log.Errorf("unable to ack notifications: %s", ackErr)
+	} else {
+		sess.clearShouldDelay()
 	}
-	sess.clearShouldDelay()
 	sess.AddresseeChecker.StartAddresseeBatch()
 	for i := range notifs {
 		notif := &notifs[i]
@@ -551,13 +605,16 @@ func (sess *clientSession) handleNotifications(ucast *serverMsg) error {
 		if to == nil {
 			continue
 		}
-		sess.Log.Infof("unicast app:%v msg:%s payload:%s",
+		logger.With(sess.Log, logger.Fields{
+			logger.FieldMsgId: notif.MsgId,
+			logger.FieldAppId: notif.AppId,
+		}).Infof("unicast app:%v msg:%s payload:%s",
 			notif.AppId, notif.MsgId, notif.Payload)
 		sess.Log.Debugf("sending ucast over")
 		sess.NotificationsCh <- AddressedNotification{to, notif}
 		sess.Log.Debugf("sent ucast over")
 	}
-	return nil
+	return ackErr
 }
 
 // handle "connbroken" messages
@@ -38,6 +38,7 @@ import (
 	"github.com/ubports/ubuntu-push/protocol"
 	helpers "github.com/ubports/ubuntu-push/testing"
 	"github.com/ubports/ubuntu-push/testing/condition"
+	"github.com/ubports/ubuntu-push/testing/faults"
 	"github.com/ubports/ubuntu-push/util"
 )
 
@@ -351,6 +352,40 @@ func (cs *clientSessionSuite) TestGetHostsRemoteCaching(c *C) {
 	c.Check(sess.deliveryHosts, DeepEquals, []string{"baz:443"})
 }
 
+type testMeteredChecker bool
+
+func (m *testMeteredChecker) Metered() bool { return bool(*m) }
+
+func (cs *clientSessionSuite) TestGetHostsRemoteCachingMetered(c *C) {
+	hostGetter := &testHostGetter{"example.com", []string{"foo:443", "bar:443"}, nil}
+	metered := testMeteredChecker(true)
+	sess := &clientSession{
+		getHost: hostGetter,
+		ClientSessionConfig: ClientSessionConfig{
+			HostsCachingExpiryTime: 2 * time.Hour,
+			MeteredChecker:         &metered,
+		},
+		timeSince: func(ts time.Time) time.Duration {
+			return 3 * time.Hour
+		},
+		Log: cs.log,
+	}
+	// nothing cached, so we fetch even if metered
+	err := sess.getHosts()
+	c.Assert(err, IsNil)
+	c.Check(sess.deliveryHosts, DeepEquals, []string{"foo:443", "bar:443"})
+	hostGetter.hosts = []string{"baz:443"}
+	// expired, but metered
+	err = sess.getHosts()
+	c.Assert(err, IsNil)
+	c.Check(sess.deliveryHosts, DeepEquals, []string{"foo:443", "bar:443"})
+	// not metered anymore
+	metered = false
+	err = sess.getHosts()
+	c.Assert(err, IsNil)
+	c.Check(sess.deliveryHosts, DeepEquals, []string{"baz:443"})
+}
+
 func (cs *clientSessionSuite) TestGetHostsRemoteCachingReset(c *C) {
 	hostGetter := &testHostGetter{"example.com", []string{"foo:443", "bar:443"}, nil}
 	sess := &clientSession{
@@ -683,6 +718,71 @@ func (s *msgSuite) TestHandleBroadcastBadAckWrite(c *C) {
 	s.upCh <- failure
 	c.Assert(<-s.sess.errCh, Equals, failure)
 	c.Check(s.sess.State(), Equals, Error)
+	// the level is updated so the broadcast won't come again; it's
+	// delivered regardless
+	c.Check(s.sess.BroadcastCh, HasLen, 1)
+}
+
+func (s *msgSuite) TestHandleBroadcastAppChannel(c *C) {
+	ac := &testAddresseeChecking{ops: make(chan string, 10)}
+	s.sess.AddresseeChecker = ac
+	msg := new(serverMsg)
+	msg.Type = "broadcast"
+	msg.BroadcastMsg = protocol.BroadcastMsg{
+		Type:     "broadcast",
+		AppId:    "com.example.app1_app1",
+		ChanId:   "f1c9bf7096084cb2a154979ce00c7f50",
+		TopLevel: 2,
+		Payloads: []json.RawMessage{
+			json.RawMessage(`{"m":1}`),
+			json.RawMessage(`{"m":2}`),
+		},
+	}
+	go func() { s.sess.errCh <- s.sess.handleBroadcast(msg) }()
+	c.Check(takeNext(s.downCh), Equals, protocol.AckMsg{"ack"})
+	s.upCh <- nil // ack ok
+	c.Check(<-s.sess.errCh, Equals, nil)
+	c.Assert(len(s.sess.BroadcastCh), Equals, 1)
+	app1, err := click.ParseAppId("com.example.app1_app1")
+	c.Assert(err, IsNil)
+	c.Check(<-s.sess.BroadcastCh, DeepEquals, &BroadcastNotification{
+		TopLevel: 2,
+		Decoded: []map[string]interface{}{
+			map[string]interface{}{"m": float64(1)},
+			map[string]interface{}{"m": float64(2)},
+		},
+		To: app1,
+	})
+	c.Check(ac.ops, HasLen, 2)
+	c.Check(<-ac.ops, Equals, "start")
+	c.Check(<-ac.ops, Equals, "com.example.app1_app1")
+	// the session keeps track of the levels of app channels too
+	levels, err := s.sess.SeenState.GetAllLevels()
+	c.Check(err, IsNil)
+	c.Check(levels, DeepEquals, map[string]int64{"f1c9bf7096084cb2a154979ce00c7f50": 2})
+}
+
+func (s *msgSuite) TestHandleBroadcastAppChannelAddresseeCheck(c *C) {
+	ac := &testAddresseeChecking{
+		ops:     make(chan string, 10),
+		missing: "com.example.app1_app1",
+	}
+	s.sess.AddresseeChecker = ac
+	msg := new(serverMsg)
+	msg.Type = "broadcast"
+	msg.BroadcastMsg = protocol.BroadcastMsg{
+		Type:     "broadcast",
+		AppId:    "com.example.app1_app1",
+		ChanId:   "f1c9bf7096084cb2a154979ce00c7f50",
+		TopLevel: 2,
+		Payloads: []json.RawMessage{json.RawMessage(`{"m":1}`)},
+	}
+	go func() { s.sess.errCh <- s.sess.handleBroadcast(msg) }()
+	c.Check(takeNext(s.downCh), Equals, protocol.AckMsg{"ack"})
+	s.upCh <- nil // ack ok
+	c.Check(<-s.sess.errCh, IsNil)
+	c.Check(len(s.sess.BroadcastCh), Equals, 0)
+	c.Check(ac.ops, HasLen, 2)
 }
 
 func (s *msgSuite) TestHandleBroadcastWrongChannel(c *C) {
@@ -690,7 +790,6 @@ func (s *msgSuite) TestHandleBroadcastWrongChannel(c *C) {
 	msg.Type = "brodacast"
 	msg.BroadcastMsg = protocol.BroadcastMsg{
 		Type:     "broadcast",
-		AppId:    "APP",
 		ChanId:   "something awful",
 		TopLevel: 2,
 		Payloads: []json.RawMessage{json.RawMessage(`{"b":1}`)},
@@ -904,6 +1003,7 @@ func (s *msgSuite) TestHandleNotificationsFiltersSeen(c *C) {
 }
 
 func (s *msgSuite) TestHandleNotificationsBadAckWrite(c *C) {
+	s.sess.AddresseeChecker = &testAddresseeChecking{ops: make(chan string, 10)}
 	s.sess.setShouldDelay()
 	n1 := protocol.Notification{
 		AppId:   "com.example.app1_app1",
@@ -923,6 +1023,9 @@ func (s *msgSuite) TestHandleNotificationsBadAckWrite(c *C) {
 	c.Check(s.sess.State(), Equals, Error)
 	// didn't get to clear
 	c.Check(s.sess.ShouldDelay(), Equals, true)
+	// seen already, so delivered regardless
+	c.Assert(s.sess.NotificationsCh, HasLen, 1)
+	c.Check((<-s.sess.NotificationsCh).Notification, DeepEquals, &n1)
 }
 
 func (s *msgSuite) TestHandleNotificationsBrokenSeenState(c *C) {
@@ -1684,6 +1787,23 @@ func (cs *clientSessionSuite) TestRedialDelay(c *C) {
   ResetCookie() tests
 ****************************************************************/
 
+func (cs *clientSessionSuite) TestDebug(c *C) {
+	sess, err := NewSession("foo:443", dummyConf(), "", cs.lvls, cs.log)
+	c.Assert(err, IsNil)
+	c.Check(sess.Debug(), DeepEquals, DebugInfo{State: "Pristine", Levels: map[string]int64{}})
+
+	c.Assert(sess.SeenState.SetLevel("0", 42), IsNil)
+	sess.setConnection(&testConn{Name: "TestDebug"})
+	sess.setCookie("COOKIE")
+	sess.setState(Running)
+	c.Check(sess.Debug(), DeepEquals, DebugInfo{
+		State:     "Running",
+		Host:      "TestDebug",
+		HasCookie: true,
+		Levels:    map[string]int64{"0": 42},
+	})
+}
+
 func (cs *clientSessionSuite) TestResetCookie(c *C) {
 	sess, err := NewSession("foo:443", dummyConf(), "", cs.lvls, cs.log)
 	c.Assert(err, IsNil)
@@ -1885,3 +2005,110 @@ func (cs *clientSessionSuite) TestHandleConnNotConnFromConnected(c *C) {
 	}
 	c.Check(cs.log.Captured(), Matches, `(?ms).*-> Disconnected`)
 }
+
+/****************************************************************
+  fault injection scenarios
+****************************************************************/
+
+// serveNotifications plays the server for one connection of a
+// scenario, sending the pending notifications; it returns whether
+// they were acked.
+func serveNotifications(c *C, lst net.Listener, script *faults.Script, pending []protocol.Notification) bool {
+	srv, err := lst.Accept()
+	c.Assert(err, IsNil)
+	defer srv.Close()
+	srv.SetDeadline(time.Now().Add(2 * dialTestTimeout))
+	_, err = protocol.ReadWireFormatVersion(srv, dialTestTimeout)
+	c.Assert(err, IsNil)
+	proto := protocol.NewProtocol0(script.Wrap(srv))
+	var connMsg protocol.ConnectMsg
+	c.Assert(proto.ReadMessage(&connMsg), IsNil)
+	c.Assert(proto.WriteMessage(protocol.ConnAckMsg{
+		Type:   "connack",
+		Params: protocol.ConnAckParams{"10s"},
+	}), IsNil)
+	err = proto.WriteMessage(protocol.NotificationsMsg{
+		Type:          "notifications",
+		Notifications: pending,
+	})
+	if err != nil {
+		return false
+	}
+	var ack protocol.AckMsg
+	err = proto.ReadMessage(&ack)
+	return err == nil && ack.Type == "ack"
+}
+
+func (cs *clientSessionSuite) TestFaultsNoNotificationLostOrDuplicated(c *C) {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer lst.Close()
+	conf := dialTestConf(nil)
+	conf.NotificationsCh = make(chan AddressedNotification, 20)
+	sess, err := NewSession(lst.Addr().String(), conf, "wah", cs.lvls, cs.log)
+	c.Assert(err, IsNil)
+	defer sess.StopKeepConnection()
+	sess.AddresseeChecker = &testAddresseeChecking{ops: make(chan string, 100)}
+	srvScript := faults.NewScript(
+		// the server goes away mid-frame
+		[]*faults.Fault{{Match: faults.OfType("notifications"), Action: faults.Cut(20)}},
+		// garbage on the wire
+		[]*faults.Fault{{Match: faults.OfType("notifications"), Action: faults.CorruptLength(5)}},
+		nil,
+		// slow server
+		[]*faults.Fault{
+			{Match: faults.OfType("connack"), Action: faults.Delay(10 * time.Millisecond)},
+			{Match: faults.OfType("notifications"), Action: faults.Split(3, time.Millisecond)},
+		},
+	)
+	cliScript := faults.NewScript(
+		nil,
+		nil,
+		// the ack gets lost
+		[]*faults.Fault{{Match: faults.OfType("ack"), Action: faults.Drop()}},
+		// the client goes away while acking
+		[]*faults.Fault{{Match: faults.OfType("ack"), Action: faults.Cut(0)}},
+	)
+	sess.Protocolator = func(conn net.Conn) protocol.Protocol {
+		return protocol.NewProtocol0(cliScript.Wrap(conn))
+	}
+	// like Dial, but without TLS
+	connect := func() error {
+		conn, err := net.DialTimeout("tcp", lst.Addr().String(), dialTestTimeout)
+		if err != nil {
+			return err
+		}
+		sess.setConnection(conn)
+		return nil
+	}
+	notif := func(msgId string) protocol.Notification {
+		return protocol.Notification{
+			AppId:   "com.example.app_app",
+			MsgId:   msgId,
+			Payload: json.RawMessage(`{"m":"` + msgId + `"}`),
+		}
+	}
+	pending := []protocol.Notification{notif("m1"), notif("m2"), notif("m3")}
+	for i := 0; !srvScript.Done() || len(pending) > 0; i++ {
+		c.Assert(i < 10, Equals, true, Commentf("scenario doesn't end"))
+		if i == 3 {
+			// a new one comes along
+			pending = append(pending, notif("m4"))
+		}
+		dialErrCh := make(chan error, 1)
+		go func() {
+			dialErrCh <- sess.run(sess.doClose, sess.getHosts, connect, sess.start, sess.loop)
+		}()
+		if serveNotifications(c, lst, srvScript, pending) {
+			pending = nil
+		}
+		c.Assert(<-dialErrCh, IsNil)
+		c.Check(<-sess.errCh, NotNil)
+	}
+	c.Check(cliScript.Connections(), Equals, 5)
+	var got []string
+	for len(sess.NotificationsCh) > 0 {
+		got = append(got, (<-sess.NotificationsCh).Notification.MsgId)
+	}
+	c.Check(got, DeepEquals, []string{"m1", "m2", "m3", "m4"})
+}
@@ -0,0 +1,50 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// ubuntu-push-debug asks a running ubuntu-push-client for a report
+// on its internal state, and prints it.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/ubports/ubuntu-push/bus"
+	"github.com/ubports/ubuntu-push/client/service"
+	"github.com/ubports/ubuntu-push/logger"
+)
+
+func main() {
+	addr := service.DebugServiceBusAddress
+	addr.Path += "/_"
+	endp := bus.SessionBus.Endpoint(addr, logger.NewSimpleLogger(os.Stderr, "error"))
+	if err := endp.Dial(); err != nil {
+		log.Fatalf("unable to connect to the session bus: %v", err)
+	}
+	defer endp.Close()
+	var report string
+	if err := endp.Call("Report", bus.Args(), &report); err != nil {
+		log.Fatalf("unable to get a report (is ubuntu-push-client running?): %v", err)
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(report), "", "  "); err != nil {
+		log.Fatalf("unable to parse the report: %v", err)
+	}
+	fmt.Println(buf.String())
+}
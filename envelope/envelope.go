@@ -0,0 +1,171 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package envelope implements the optional end-to-end encryption of
+// notification payloads between app servers and the device.
+//
+// The app server seals a payload with the public key the app got from
+// the client daemon for its token; the push server relays the
+// resulting envelope untouched, and the client daemon opens it before
+// handing the payload to the app helper.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Scheme names the only supported sealing: a fresh AES-256-GCM key
+// for the payload, itself wrapped with RSA-OAEP (SHA-256).
+const Scheme = "rsa-oaep-aes-gcm"
+
+var (
+	ErrNotSealed     = errors.New("payload is not sealed")
+	ErrUnknownScheme = errors.New("unknown envelope scheme")
+	ErrBadEnvelope   = errors.New("cannot open envelope")
+	ErrBadPublicKey  = errors.New("bad public key")
+)
+
+// Envelope holds a sealed payload.
+type Envelope struct {
+	Scheme string `json:"scheme"`
+	// the payload key, wrapped with the public key
+	Key   []byte `json:"key"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// sealedPayload is the payload shape carrying an Envelope.
+type sealedPayload struct {
+	Envelope *Envelope `json:"ubuntu-push-envelope"`
+}
+
+// Seal encrypts payload for the holder of the private key matching
+// pub, returning the payload to send instead.
+func Seal(pub *rsa.PublicKey, payload json.RawMessage) (json.RawMessage, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	env := &Envelope{
+		Scheme: Scheme,
+		Key:    wrapped,
+		Nonce:  nonce,
+		Data:   aead.Seal(nil, nonce, payload, nil),
+	}
+	return json.Marshal(sealedPayload{env})
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// extract returns the envelope in payload, if any.
+func extract(payload json.RawMessage) *Envelope {
+	var wrapper sealedPayload
+	err := json.Unmarshal(payload, &wrapper)
+	if err != nil {
+		return nil
+	}
+	return wrapper.Envelope
+}
+
+// IsSealed returns whether payload is an envelope.
+func IsSealed(payload json.RawMessage) bool {
+	return extract(payload) != nil
+}
+
+// Open decrypts a sealed payload with priv.
+func Open(priv *rsa.PrivateKey, payload json.RawMessage) (json.RawMessage, error) {
+	env := extract(payload)
+	if env == nil {
+		return nil, ErrNotSealed
+	}
+	if env.Scheme != Scheme {
+		return nil, ErrUnknownScheme
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, env.Key, nil)
+	if err != nil {
+		return nil, ErrBadEnvelope
+	}
+	aead, err := newAEAD(key)
+	if err != nil || len(env.Nonce) != aead.NonceSize() {
+		return nil, ErrBadEnvelope
+	}
+	opened, err := aead.Open(nil, env.Nonce, env.Data, nil)
+	if err != nil {
+		return nil, ErrBadEnvelope
+	}
+	var dummy interface{}
+	err = json.Unmarshal(opened, &dummy)
+	if err != nil {
+		return nil, fmt.Errorf("sealed payload is not JSON: %v", err)
+	}
+	return json.RawMessage(opened), nil
+}
+
+// MarshalPublicKey encodes pub for handing it to app servers, as
+// base64 of its DER PKIX form.
+func MarshalPublicKey(pub *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(der), nil
+}
+
+// ParsePublicKey decodes a public key encoded by MarshalPublicKey.
+func ParsePublicKey(s string) (*rsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrBadPublicKey
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, ErrBadPublicKey
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, ErrBadPublicKey
+	}
+	return rsaPub, nil
+}
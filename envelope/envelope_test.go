@@ -0,0 +1,100 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package envelope
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"testing"
+
+	. "launchpad.net/gocheck"
+)
+
+func TestEnvelope(t *testing.T) { TestingT(t) }
+
+type envelopeSuite struct {
+	key *rsa.PrivateKey
+}
+
+var _ = Suite(&envelopeSuite{})
+
+func (s *envelopeSuite) SetUpSuite(c *C) {
+	key, err := rsa.GenerateKey(rand.Reader, KeyBits)
+	c.Assert(err, IsNil)
+	s.key = key
+}
+
+func (s *envelopeSuite) TestSealOpen(c *C) {
+	payload := json.RawMessage(`{"secret":"hello"}`)
+	sealed, err := Seal(&s.key.PublicKey, payload)
+	c.Assert(err, IsNil)
+	c.Check(IsSealed(sealed), Equals, true)
+	c.Check(string(sealed), Not(Matches), ".*hello.*")
+	opened, err := Open(s.key, sealed)
+	c.Assert(err, IsNil)
+	c.Check(opened, DeepEquals, payload)
+}
+
+func (s *envelopeSuite) TestIsSealed(c *C) {
+	c.Check(IsSealed(json.RawMessage(`{"a":1}`)), Equals, false)
+	c.Check(IsSealed(json.RawMessage(`[1]`)), Equals, false)
+	c.Check(IsSealed(json.RawMessage(`{"ubuntu-push-envelope":{}}`)), Equals, true)
+}
+
+func (s *envelopeSuite) TestOpenFailures(c *C) {
+	_, err := Open(s.key, json.RawMessage(`{"a":1}`))
+	c.Check(err, Equals, ErrNotSealed)
+	_, err = Open(s.key, json.RawMessage(`{"ubuntu-push-envelope":{"scheme":"rot13"}}`))
+	c.Check(err, Equals, ErrUnknownScheme)
+
+	other, err := rsa.GenerateKey(rand.Reader, KeyBits)
+	c.Assert(err, IsNil)
+	sealed, err := Seal(&other.PublicKey, json.RawMessage(`{}`))
+	c.Assert(err, IsNil)
+	_, err = Open(s.key, sealed)
+	c.Check(err, Equals, ErrBadEnvelope)
+
+	// tampering is detected
+	sealed, err = Seal(&s.key.PublicKey, json.RawMessage(`{}`))
+	c.Assert(err, IsNil)
+	var wrapper sealedPayload
+	c.Assert(json.Unmarshal(sealed, &wrapper), IsNil)
+	wrapper.Envelope.Data[0] ^= 1
+	sealed, err = json.Marshal(wrapper)
+	c.Assert(err, IsNil)
+	_, err = Open(s.key, sealed)
+	c.Check(err, Equals, ErrBadEnvelope)
+
+	sealed, err = Seal(&s.key.PublicKey, json.RawMessage(`not json`))
+	c.Assert(err, IsNil)
+	_, err = Open(s.key, sealed)
+	c.Check(err, ErrorMatches, "sealed payload is not JSON: .*")
+}
+
+func (s *envelopeSuite) TestPublicKeyRoundTrip(c *C) {
+	encoded, err := MarshalPublicKey(&s.key.PublicKey)
+	c.Assert(err, IsNil)
+	pub, err := ParsePublicKey(encoded)
+	c.Assert(err, IsNil)
+	c.Check(pub, DeepEquals, &s.key.PublicKey)
+
+	_, err = ParsePublicKey("!!")
+	c.Check(err, Equals, ErrBadPublicKey)
+	_, err = ParsePublicKey("AAAA")
+	c.Check(err, Equals, ErrBadPublicKey)
+}
@@ -0,0 +1,142 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package envelope
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ubports/ubuntu-push/nih"
+)
+
+var ErrNoKey = errors.New("no key for app")
+
+// KeyBits is the size of the generated keys.
+var KeyBits = 2048
+
+// KeyStore keeps the private keys of the apps, one per app, as PEM
+// files in a directory. With no directory keys are kept only in
+// memory.
+//
+// A key per app is a key per token: a client registers each app id
+// (versioned or not, as given) for its one device id, and
+// registering again hands back the same token.
+type KeyStore struct {
+	dir  string
+	lock sync.Mutex
+	keys map[string]*rsa.PrivateKey
+}
+
+// NewKeyStore returns a KeyStore keeping keys in dir.
+func NewKeyStore(dir string) *KeyStore {
+	return &KeyStore{
+		dir:  dir,
+		keys: make(map[string]*rsa.PrivateKey),
+	}
+}
+
+func (ks *KeyStore) path(appId string) string {
+	return filepath.Join(ks.dir, string(nih.Quote([]byte(appId)))+".pem")
+}
+
+// lookup finds the key for appId, with the lock held.
+func (ks *KeyStore) lookup(appId string) (*rsa.PrivateKey, error) {
+	if key, ok := ks.keys[appId]; ok {
+		return key, nil
+	}
+	if ks.dir == "" {
+		return nil, ErrNoKey
+	}
+	data, err := ioutil.ReadFile(ks.path(appId))
+	if os.IsNotExist(err) {
+		return nil, ErrNoKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrNoKey
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ks.keys[appId] = key
+	return key, nil
+}
+
+// Lookup returns the key for appId, ErrNoKey if there is none.
+func (ks *KeyStore) Lookup(appId string) (*rsa.PrivateKey, error) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	return ks.lookup(appId)
+}
+
+// Ensure returns the key for appId, generating and storing a new one
+// if there is none yet.
+func (ks *KeyStore) Ensure(appId string) (*rsa.PrivateKey, error) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	key, err := ks.lookup(appId)
+	if err != ErrNoKey {
+		return key, err
+	}
+	key, err = rsa.GenerateKey(rand.Reader, KeyBits)
+	if err != nil {
+		return nil, err
+	}
+	if ks.dir != "" {
+		err = os.MkdirAll(ks.dir, 0700)
+		if err != nil {
+			return nil, err
+		}
+		data := pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		})
+		err = ioutil.WriteFile(ks.path(appId), data, 0600)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ks.keys[appId] = key
+	return key, nil
+}
+
+// Forget drops the key for appId. Payloads already sealed with it
+// can't be opened anymore, even if a new key is made for appId later.
+func (ks *KeyStore) Forget(appId string) error {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	delete(ks.keys, appId)
+	if ks.dir == "" {
+		return nil
+	}
+	err := os.Remove(ks.path(appId))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package envelope
+
+import (
+	"os"
+	"path/filepath"
+
+	. "launchpad.net/gocheck"
+)
+
+type keyStoreSuite struct{}
+
+var _ = Suite(&keyStoreSuite{})
+
+func (s *keyStoreSuite) TestEnsurePersists(c *C) {
+	dir := filepath.Join(c.MkDir(), "keys")
+	ks := NewKeyStore(dir)
+	_, err := ks.Lookup("com.example.app_app")
+	c.Check(err, Equals, ErrNoKey)
+	key, err := ks.Ensure("com.example.app_app")
+	c.Assert(err, IsNil)
+	again, err := ks.Ensure("com.example.app_app")
+	c.Assert(err, IsNil)
+	c.Check(again, Equals, key)
+
+	fi, err := os.Stat(filepath.Join(dir, "com_2eexample_2eapp_5fapp.pem"))
+	c.Assert(err, IsNil)
+	c.Check(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	// a fresh store finds it on disk
+	loaded, err := NewKeyStore(dir).Lookup("com.example.app_app")
+	c.Assert(err, IsNil)
+	c.Check(loaded, DeepEquals, key)
+}
+
+func (s *keyStoreSuite) TestForget(c *C) {
+	dir := c.MkDir()
+	ks := NewKeyStore(dir)
+	_, err := ks.Ensure("app")
+	c.Assert(err, IsNil)
+	c.Check(ks.Forget("app"), IsNil)
+	_, err = ks.Lookup("app")
+	c.Check(err, Equals, ErrNoKey)
+	_, err = NewKeyStore(dir).Lookup("app")
+	c.Check(err, Equals, ErrNoKey)
+	// forgetting twice is fine
+	c.Check(ks.Forget("app"), IsNil)
+}
+
+func (s *keyStoreSuite) TestInMemory(c *C) {
+	ks := NewKeyStore("")
+	key, err := ks.Ensure("app")
+	c.Assert(err, IsNil)
+	found, err := ks.Lookup("app")
+	c.Assert(err, IsNil)
+	c.Check(found, Equals, key)
+	c.Check(ks.Forget("app"), IsNil)
+	_, err = ks.Lookup("app")
+	c.Check(err, Equals, ErrNoKey)
+}
@@ -55,6 +55,10 @@ func (triv *trivialHelperLauncher) Start() chan *HelperResult {
 	return triv.chOut
 }
 
+func (triv *trivialHelperLauncher) Backlog() int {
+	return len(triv.chIn)
+}
+
 func (triv *trivialHelperLauncher) Stop() {
 	close(triv.chIn)
 }
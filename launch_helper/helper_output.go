@@ -26,13 +26,18 @@ import (
 // a Card is the usual “visual” presentation of a notification, used
 // for bubbles and the notification centre (neé messaging menu)
 type Card struct {
-	Summary      string   `json:"summary"`   // required for the card to be presented
-	Body         string   `json:"body"`      // defaults to empty
-	Actions      []string `json:"actions"`   // if empty (default), bubble is non-clickable. More entries change it to be clickable and (for bubbles) snap-decisions.
-	Icon         string   `json:"icon"`      // an icon relating to the event being notified. Defaults to empty (no icon); a secondary icon relating to the application will be shown as well, irrespectively.
-	RawTimestamp int      `json:"timestamp"` // seconds since epoch, only used for persist (for now). Timestamp() returns this if non-zero, current timestamp otherwise.
-	Persist      bool     `json:"persist"`   // whether to show in notification centre; defaults to false
-	Popup        bool     `json:"popup"`     // whether to show in a bubble. Users can disable this, and can easily miss them, so don't rely on it exclusively. Defaults to false.
+	Summary      string   `json:"summary"`       // required for the card to be presented
+	Body         string   `json:"body"`          // defaults to empty
+	Actions      []string `json:"actions"`       // if empty (default), bubble is non-clickable. More entries change it to be clickable and (for bubbles) snap-decisions.
+	Icon         string   `json:"icon"`          // an icon relating to the event being notified. Defaults to empty (no icon); a secondary icon relating to the application will be shown as well, irrespectively.
+	RawTimestamp int      `json:"timestamp"`     // seconds since epoch, only used for persist (for now). Timestamp() returns this if non-zero, current timestamp otherwise.
+	Persist      bool     `json:"persist"`       // whether to show in notification centre; defaults to false
+	Popup        bool     `json:"popup"`         // whether to show in a bubble. Users can disable this, and can easily miss them, so don't rely on it exclusively. Defaults to false.
+	Image        string   `json:"image"`         // an image to attach: an http(s) URL, or the path of a file in the app's cache dir. Defaults to empty (no image).
+	RawProgress  *int     `json:"progress"`      // a percentage; a card with progress replaces the app's previous one with the same tag. Defaults to null (no progress).
+	Reply        string   `json:"reply"`         // if set, the label of an inline text-reply action, for persistent cards. Defaults to empty (no reply).
+	Group        string   `json:"group"`         // persistent cards of an app with the same group are collapsed into a single entry. Defaults to empty (no group).
+	GroupSummary string   `json:"group-summary"` // the summary of the collapsed entry, with {count} replaced by the number of cards. Defaults to "{count} new notifications".
 }
 
 // an EmblemCounter puts a number on an emblem on an app's icon in the launcher
@@ -87,6 +92,22 @@ func (card *Card) Timestamp() int64 {
 	}
 }
 
+// Progress() returns RawProgress clamped to 0..100, and whether the
+// card has a progress value at all.
+func (card *Card) Progress() (int32, bool) {
+	if card.RawProgress == nil {
+		return 0, false
+	}
+	p := *card.RawProgress
+	switch {
+	case p < 0:
+		p = 0
+	case p > 100:
+		p = 100
+	}
+	return int32(p), true
+}
+
 func (notification *Notification) Vibration(fallback *Vibration) *Vibration {
 	var b bool
 	var vib *Vibration
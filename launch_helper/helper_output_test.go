@@ -37,6 +37,23 @@ func (*outSuite) TestCardGetTimestamp(c *C) {
 	c.Check((&Card{RawTimestamp: 42}).Timestamp(), Equals, int64(42))
 }
 
+func (*outSuite) TestCardGetProgress(c *C) {
+	_, ok := (&Card{}).Progress()
+	c.Check(ok, Equals, false)
+	for s, expected := range map[string]int32{
+		`{"progress": 0}`:   0,
+		`{"progress": 42}`:  42,
+		`{"progress": -3}`:  0,
+		`{"progress": 120}`: 100,
+	} {
+		var card Card
+		c.Assert(json.Unmarshal([]byte(s), &card), IsNil)
+		p, ok := card.Progress()
+		c.Check(ok, Equals, true, Commentf(s))
+		c.Check(p, Equals, expected, Commentf(s))
+	}
+}
+
 func (*outSuite) TestBadVibeBegetsNilVibe(c *C) {
 	fbck := &Vibration{Repeat: 2}
 	for _, s := range []string{
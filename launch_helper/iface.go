@@ -20,6 +20,8 @@ type HelperPool interface {
 	Run(kind string, input *HelperInput)
 	Start() chan *HelperResult
 	Stop()
+	// Backlog returns how many inputs are waiting for a helper.
+	Backlog() int
 }
 
 var InputBufferSize = 10
@@ -24,6 +24,7 @@ import (
 	"os"
 	"path"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	xdg "launchpad.net/go-xdg/v0"
@@ -67,6 +68,8 @@ type kindHelperPool struct {
 	hmap       map[string]*HelperArgs
 	maxRuntime time.Duration
 	maxNum     int
+	// the size of the backlog, for Backlog
+	backlogSz int32
 	// hook
 	growBacklog func([]*HelperInput, *HelperInput) []*HelperInput
 }
@@ -126,6 +129,8 @@ func (pool *kindHelperPool) loop() {
 			}
 			if len(running) >= pool.maxNum || running[in.App.Original()] {
 				backlog = pool.growBacklog(backlog, in)
+				// growBacklog may have dropped entries
+				atomic.StoreInt32(&pool.backlogSz, int32(backlogLen(backlog)))
 			} else {
 				if pool.tryOne(in) {
 					running[in.App.Original()] = true
@@ -152,6 +157,7 @@ func (pool *kindHelperPool) loop() {
 				}
 			}
 			backlog = pool.shrinkBacklog(backlog, backlogSz)
+			atomic.StoreInt32(&pool.backlogSz, int32(backlogSz))
 			pool.log.Debugf("current helper input backlog has shrunk to %d entries.", backlogSz)
 		}
 	}
@@ -163,6 +169,18 @@ func (pool *kindHelperPool) doGrowBacklog(backlog []*HelperInput, in *HelperInpu
 	return backlog
 }
 
+// backlogLen counts the entries in the backlog, leaving out the
+// ones already taken out of it.
+func backlogLen(backlog []*HelperInput) int {
+	n := 0
+	for _, bentry := range backlog {
+		if bentry != nil {
+			n++
+		}
+	}
+	return n
+}
+
 func (pool *kindHelperPool) shrinkBacklog(backlog []*HelperInput, backlogSz int) []*HelperInput {
 	if backlogSz == 0 {
 		return nil
@@ -192,6 +210,10 @@ func (pool *kindHelperPool) Stop() {
 	<-pool.chStopped
 }
 
+func (pool *kindHelperPool) Backlog() int {
+	return int(atomic.LoadInt32(&pool.backlogSz))
+}
+
 func (pool *kindHelperPool) Run(kind string, input *HelperInput) {
 	input.kind = kind
 	pool.chIn <- input
@@ -313,7 +335,7 @@ func (pool *kindHelperPool) OneDone(uid string) {
 	if err != nil {
 		pool.log.Errorf("unable to read output from %v helper: %v", args.AppId, err)
 	} else {
-		pool.log.Infof("%v helper output: %s", args.AppId, payload)
+		pool.log.Debugf("%v helper output: %s", args.AppId, payload)
 		res := &HelperResult{Input: args.Input}
 		err = json.Unmarshal(payload, &res.HelperOutput)
 		if err != nil {
@@ -441,11 +441,54 @@ func (s *poolSuite) TestSecondRunSameAppToBacklog(c *C) {
 	s.pool.Run("fake", input2)
 
 	s.waitForArgs(c, "Launch")
+	for i := 0; i < 100 && s.pool.Backlog() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(s.pool.Backlog(), Equals, 1)
 	go s.fakeLauncher.done("0")
 	takeNext(ch, c)
 
 	// this is where we check that:
 	c.Check(s.log.Captured(), Matches, `(?ms).* helper input backlog has grown to 1 entries.$`)
+	for i := 0; i < 100 && s.pool.Backlog() != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(s.pool.Backlog(), Equals, 0)
+}
+
+// checks that Backlog doesn't count what growBacklog dropped
+func (s *poolSuite) TestBacklogDropped(c *C) {
+	s.pool.(*kindHelperPool).maxNum = 1
+	grown := make(chan struct{}, 2)
+	s.pool.(*kindHelperPool).growBacklog = func(bl []*HelperInput, in *HelperInput) []*HelperInput {
+		// keep only the newest
+		grown <- struct{}{}
+		return []*HelperInput{in}
+	}
+	s.pool.Start()
+	defer s.pool.Stop()
+
+	app := clickhelp.MustParseAppId("com.example.test_test-app")
+	for _, nid := range []string{"n0", "n1", "n2"} {
+		s.pool.Run("fake", &HelperInput{
+			App:            app,
+			NotificationId: nid,
+			Payload:        []byte(`"hello"`),
+		})
+	}
+	s.waitForArgs(c, "Launch")
+	<-grown
+	<-grown
+	for i := 0; i < 100 && s.pool.Backlog() != 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(s.pool.Backlog(), Equals, 1)
+}
+
+func (s *poolSuite) TestBacklogLen(c *C) {
+	in := &HelperInput{}
+	c.Check(backlogLen(nil), Equals, 0)
+	c.Check(backlogLen([]*HelperInput{nil, in, nil, in}), Equals, 2)
 }
 
 // checks that the an Nth helper run goes to the backlog
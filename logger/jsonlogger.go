@@ -0,0 +1,157 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Fields holds correlation ids attached to structured log entries.
+type Fields map[string]string
+
+// Names of the correlation fields.
+const (
+	FieldComponent = "component"
+	FieldSession   = "session"
+	FieldDevice    = "device"
+	FieldMsgId     = "msgid"
+	FieldAppId     = "appid"
+	FieldRequest   = "request"
+	FieldTenant    = "tenant"
+)
+
+// FieldLogger is a Logger able to attach Fields to its entries.
+type FieldLogger interface {
+	Logger
+	// WithFields returns a logger adding fields to every entry.
+	WithFields(fields Fields) Logger
+}
+
+// With returns a logger attaching fields to the entries logged
+// through it if lg supports that, otherwise lg itself.
+func With(lg Logger, fields Fields) Logger {
+	if flg, ok := lg.(FieldLogger); ok {
+		return flg.WithFields(fields)
+	}
+	return lg
+}
+
+type jsonLogger struct {
+	w      io.Writer
+	lock   *sync.Mutex
+	nlevel int
+	fields Fields
+}
+
+var timeNow = time.Now // for testing
+
+// NewJSONLogger creates a logger writing one JSON object per entry
+// to w, with level, timestamp, message, component and any attached
+// fields, logging only up to the given level as NewSimpleLogger.
+func NewJSONLogger(w io.Writer, level, component string) Logger {
+	fields := Fields{}
+	if component != "" {
+		fields[FieldComponent] = component
+	}
+	return &jsonLogger{
+		w:      w,
+		lock:   &sync.Mutex{},
+		nlevel: levelToNLevel[level],
+		fields: fields,
+	}
+}
+
+// NewLogger creates a logger writing to w in the given format, either
+// "text" (the default) or "json".
+func NewLogger(w io.Writer, level, format, component string) Logger {
+	if format == "json" {
+		return NewJSONLogger(w, level, component)
+	}
+	return NewSimpleLogger(w, level)
+}
+
+func (lg *jsonLogger) WithFields(fields Fields) Logger {
+	merged := make(Fields, len(lg.fields)+len(fields))
+	for k, v := range lg.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &jsonLogger{lg.w, lg.lock, lg.nlevel, merged}
+}
+
+func (lg *jsonLogger) entry(level, msg string, extra Fields) error {
+	e := make(map[string]string, len(lg.fields)+len(extra)+3)
+	for k, v := range lg.fields {
+		if v != "" {
+			e[k] = v
+		}
+	}
+	for k, v := range extra {
+		e[k] = v
+	}
+	e["time"] = timeNow().UTC().Format(time.RFC3339Nano)
+	if level != "" {
+		e["level"] = level
+	}
+	e["msg"] = msg
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	lg.lock.Lock()
+	defer lg.lock.Unlock()
+	_, err = lg.w.Write(append(b, '\n'))
+	return err
+}
+
+func (lg *jsonLogger) Output(calldepth int, s string) error {
+	return lg.entry("", s, nil)
+}
+
+func (lg *jsonLogger) Errorf(format string, v ...interface{}) {
+	lg.entry("error", fmt.Sprintf(format, v...), nil)
+}
+
+func (lg *jsonLogger) Fatalf(format string, v ...interface{}) {
+	lg.entry("error", fmt.Sprintf(format, v...), nil)
+	osExit(1)
+}
+
+func (lg *jsonLogger) PanicStackf(format string, v ...interface{}) {
+	stack := make([]byte, 8*1024) // Stack writes less but doesn't fail
+	stackWritten := runtime.Stack(stack, false)
+	lg.entry("error", fmt.Sprintf(format, v...), Fields{"stack": string(stack[:stackWritten])})
+}
+
+func (lg *jsonLogger) Infof(format string, v ...interface{}) {
+	if lg.nlevel >= lInfo {
+		lg.entry("info", fmt.Sprintf(format, v...), nil)
+	}
+}
+
+func (lg *jsonLogger) Debugf(format string, v ...interface{}) {
+	if lg.nlevel >= lDebug {
+		lg.entry("debug", fmt.Sprintf(format, v...), nil)
+	}
+}
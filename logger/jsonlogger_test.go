@@ -0,0 +1,138 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/ubports/ubuntu-push/config"
+)
+
+type jsonLoggerSuite struct{}
+
+var _ = Suite(&jsonLoggerSuite{})
+
+func (s *jsonLoggerSuite) SetUpTest(c *C) {
+	timeNow = func() time.Time {
+		return time.Date(2016, 3, 4, 5, 6, 7, 0, time.UTC)
+	}
+}
+
+func (s *jsonLoggerSuite) TearDownTest(c *C) {
+	timeNow = time.Now
+}
+
+func decodeEntries(c *C, buf *bytes.Buffer) []map[string]string {
+	var entries []map[string]string
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		c.Assert(strings.HasSuffix(line, "\n"), Equals, true)
+		var e map[string]string
+		c.Assert(json.Unmarshal([]byte(line), &e), IsNil)
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func (s *jsonLoggerSuite) TestEntries(c *C) {
+	buf := &bytes.Buffer{}
+	logger := NewJSONLogger(buf, "info", "server")
+	logger.Errorf("%v %d", "error", 1)
+	logger.Infof("%v %d", "info", 1)
+	logger.Debugf("%v %d", "debug", 1)
+	c.Check(decodeEntries(c, buf), DeepEquals, []map[string]string{
+		{"time": "2016-03-04T05:06:07Z", "level": "error", "component": "server", "msg": "error 1"},
+		{"time": "2016-03-04T05:06:07Z", "level": "info", "component": "server", "msg": "info 1"},
+	})
+}
+
+func (s *jsonLoggerSuite) TestWithFields(c *C) {
+	buf := &bytes.Buffer{}
+	logger := NewJSONLogger(buf, "debug", "")
+	sessLogger := With(logger, Fields{FieldSession: "s1", FieldDevice: "dev1"})
+	msgLogger := With(sessLogger, Fields{FieldMsgId: "m1", FieldAppId: ""})
+	msgLogger.Debugf("acked")
+	sessLogger.Infof("registered")
+	logger.Output(1, "raw")
+	c.Check(decodeEntries(c, buf), DeepEquals, []map[string]string{
+		{"time": "2016-03-04T05:06:07Z", "level": "debug", "session": "s1", "device": "dev1", "msgid": "m1", "msg": "acked"},
+		{"time": "2016-03-04T05:06:07Z", "level": "info", "session": "s1", "device": "dev1", "msg": "registered"},
+		{"time": "2016-03-04T05:06:07Z", "msg": "raw"},
+	})
+}
+
+func (s *jsonLoggerSuite) TestWithOnSimpleLogger(c *C) {
+	logger := NewSimpleLogger(&bytes.Buffer{}, "debug")
+	c.Check(With(logger, Fields{FieldSession: "s1"}), Equals, logger)
+}
+
+func (s *jsonLoggerSuite) TestFatalf(c *C) {
+	defer func() {
+		osExit = os.Exit
+	}()
+	var exitCode int
+	osExit = func(code int) {
+		exitCode = code
+	}
+	buf := &bytes.Buffer{}
+	logger := NewJSONLogger(buf, "error", "")
+	logger.Fatalf("%v %v", "error", "fatal")
+	c.Check(decodeEntries(c, buf), DeepEquals, []map[string]string{
+		{"time": "2016-03-04T05:06:07Z", "level": "error", "msg": "error fatal"},
+	})
+	c.Check(exitCode, Equals, 1)
+}
+
+func (s *jsonLoggerSuite) TestPanicStackf(c *C) {
+	buf := &bytes.Buffer{}
+	logger := NewJSONLogger(buf, "error", "")
+	logger.PanicStackf("%v", "troubles")
+	entries := decodeEntries(c, buf)
+	c.Assert(entries, HasLen, 1)
+	c.Check(entries[0]["msg"], Equals, "troubles")
+	c.Check(entries[0]["stack"], Matches, "(?s)goroutine.*jsonlogger_test.go.*")
+}
+
+func (s *jsonLoggerSuite) TestNewLogger(c *C) {
+	buf := &bytes.Buffer{}
+	NewLogger(buf, "info", "json", "client").Infof("hello")
+	c.Check(buf.String(), Matches, `\{.*"component":"client".*\}\n`)
+	buf.Reset()
+	NewLogger(buf, "info", "text", "client").Infof("hello")
+	c.Check(buf.String(), Matches, `.* INFO hello\n`)
+}
+
+type testLogFormatConfig struct {
+	Fmt ConfigLogFormat
+}
+
+func (s *jsonLoggerSuite) TestReadConfigLogFormat(c *C) {
+	var cfg testLogFormatConfig
+	err := config.ReadConfig(bytes.NewBufferString(`{"fmt": "json"}`), &cfg)
+	c.Assert(err, IsNil)
+	c.Check(cfg.Fmt.Format(), Equals, "json")
+	err = config.ReadConfig(bytes.NewBufferString(`{"fmt": "xml"}`), &cfg)
+	c.Check(err, ErrorMatches, "fmt: not a log format: xml")
+}
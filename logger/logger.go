@@ -151,3 +151,26 @@ func (cll *ConfigLogLevel) SetFromString(enc string) error {
 func (cll ConfigLogLevel) Level() string {
 	return string(cll)
 }
+
+// ConfigLogFormat can hold a log format ("text" or "json") in a
+// configuration struct.
+type ConfigLogFormat string
+
+func (clf *ConfigLogFormat) ConfigFromJSONString() {}
+
+func (clf *ConfigLogFormat) UnmarshalJSON(b []byte) error {
+	return config.UnmarshalJSONViaString(clf, b)
+}
+
+func (clf *ConfigLogFormat) SetFromString(enc string) error {
+	if enc != "text" && enc != "json" {
+		return fmt.Errorf("not a log format: %s", enc)
+	}
+	*clf = ConfigLogFormat(enc)
+	return nil
+}
+
+// Format returns the log format string held in clf.
+func (clf ConfigLogFormat) Format() string {
+	return string(clf)
+}
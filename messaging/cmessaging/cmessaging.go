@@ -24,7 +24,7 @@ package cmessaging
 
 void add_notification(const gchar* desktop_id, const gchar* notification_id,
           const gchar* icon_path, const gchar* summary, const gchar* body,
-          gint64 timestamp, const gchar** actions, gpointer obj);
+          gint64 timestamp, const gchar* reply_label, gpointer obj);
 
 void remove_notification(const gchar* desktop_id, const gchar* notification_id);
 
@@ -44,6 +44,9 @@ type Payload struct {
 	Actions []string
 	App     *click.AppId
 	Tag     string
+	// Kind is what activating the entry is about; KindOpen opens
+	// the first of the Actions.
+	Kind reply.Kind
 }
 
 func gchar(s string) *C.gchar {
@@ -55,15 +58,25 @@ func gfree(s *C.gchar) {
 }
 
 //export handleActivate
-func handleActivate(c_action *C.char, c_notification *C.char, obj unsafe.Pointer) {
+func handleActivate(c_action *C.char, c_notification *C.char, c_reply *C.char, obj unsafe.Pointer) {
 	payload := (*Payload)(obj)
 	action := C.GoString(c_action)
-	// Default action, only support ATM, is always "".
-	// Use the first action as the default if it's available.
-	if action == "" && len(payload.Actions) >= 2 {
-		action = payload.Actions[1]
+	mmar := &reply.MMActionReply{Kind: payload.Kind, Notification: C.GoString(c_notification), App: payload.App, Tag: payload.Tag}
+	switch {
+	case action == reply.ReplyAction:
+		// the only named action is the inline reply
+		mmar.Kind = reply.KindReply
+		mmar.Action = action
+		if c_reply != nil {
+			mmar.Reply = C.GoString(c_reply)
+		}
+	case payload.Kind != reply.KindOpen:
+		// nothing to open
+	case len(payload.Actions) >= 2:
+		// Default action, only support ATM, is always "".
+		// Use the first action as the default if it's available.
+		mmar.Action = payload.Actions[1]
 	}
-	mmar := &reply.MMActionReply{Notification: C.GoString(c_notification), Action: action, App: payload.App}
 	payload.Ch <- mmar
 }
 
@@ -85,7 +98,13 @@ func AddNotification(desktopId string, notificationId string, card *launch_helpe
 
 	timestamp := (C.gint64)(card.Timestamp() * 1000000)
 
-	C.add_notification(desktop_id, notification_id, icon_path, summary, body, timestamp, nil, (C.gpointer)(payload))
+	var reply_label *C.gchar
+	if card.Reply != "" {
+		reply_label = gchar(card.Reply)
+		defer gfree(reply_label)
+	}
+
+	C.add_notification(desktop_id, notification_id, icon_path, summary, body, timestamp, reply_label, (C.gpointer)(payload))
 }
 
 func RemoveNotification(desktopId string, notificationId string) {
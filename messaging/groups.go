@@ -0,0 +1,233 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package messaging
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ubports/ubuntu-push/click"
+	"github.com/ubports/ubuntu-push/launch_helper"
+	"github.com/ubports/ubuntu-push/messaging/cmessaging"
+	"github.com/ubports/ubuntu-push/messaging/reply"
+)
+
+// DefaultGroupSummary is the summary of the entry grouped cards are
+// collapsed into, when they don't say otherwise.
+const DefaultGroupSummary = "{count} new notifications"
+
+// a group holds the persistent cards of an app with the same
+// Card.Group. Once it has more than one card it's shown as a single
+// summary entry, until the user expands it.
+type group struct {
+	app      *click.AppId
+	name     string
+	template string
+	members  []*member
+	entry    string // the id of the summary entry; "" if not collapsed
+	expanded bool
+}
+
+type member struct {
+	nid     string
+	tag     string
+	card    *launch_helper.Card
+	actions []string
+}
+
+func groupKey(app *click.AppId, name string) string {
+	return app.Original() + "/" + name
+}
+
+func (g *group) summaryCard() *launch_helper.Card {
+	last := g.members[len(g.members)-1].card
+	template := g.template
+	if template == "" {
+		template = DefaultGroupSummary
+	}
+	return &launch_helper.Card{
+		Summary:      strings.Replace(template, "{count}", strconv.Itoa(len(g.members)), -1),
+		Body:         last.Summary,
+		Icon:         last.Icon,
+		RawTimestamp: int(last.Timestamp()),
+		Persist:      true,
+	}
+}
+
+// addGrouped adds a card to its group, collapsing the group if needed.
+func (mmu *MessagingMenu) addGrouped(app *click.AppId, nid string, tag string, card *launch_helper.Card, actions []string) {
+	mmu.lock.Lock()
+	defer mmu.lock.Unlock()
+	if mmu.groups == nil {
+		mmu.groups = make(map[string]*group)
+		mmu.grouped = make(map[string]*group)
+		mmu.summaries = make(map[string]*group)
+	}
+	key := groupKey(app, card.Group)
+	g := mmu.groups[key]
+	if g == nil {
+		g = &group{app: app, name: card.Group}
+		mmu.groups[key] = g
+	}
+	if card.GroupSummary != "" {
+		g.template = card.GroupSummary
+	}
+	m := &member{nid: nid, tag: tag, card: card, actions: actions}
+	g.members = append(g.members, m)
+	mmu.grouped[nid] = g
+
+	if g.expanded || len(g.members) == 1 {
+		mmu.show(g.app, m)
+		return
+	}
+	// hide the cards shown so far behind the summary
+	for _, other := range g.members {
+		if _, shown := mmu.notifications[other.nid]; shown {
+			mmu.doRemoveNotification(other.nid, true)
+		}
+	}
+	mmu.showSummary(g)
+}
+
+func (mmu *MessagingMenu) show(app *click.AppId, m *member) {
+	payload := &cmessaging.Payload{Ch: mmu.Ch, Actions: m.actions, App: app, Tag: m.tag}
+	mmu.notifications[m.nid] = payload
+	cAddNotification(app.DesktopId(), m.nid, m.card, payload)
+}
+
+// showSummary (re)creates the entry the group is collapsed into.
+func (mmu *MessagingMenu) showSummary(g *group) {
+	if g.entry != "" {
+		mmu.doRemoveNotification(g.entry, true)
+		delete(mmu.summaries, g.entry)
+	}
+	g.entry = "group:" + groupKey(g.app, g.name)
+	// activating the entry (the default action) expands it
+	payload := &cmessaging.Payload{Ch: mmu.Ch, App: g.app, Kind: reply.KindExpand}
+	mmu.notifications[g.entry] = payload
+	mmu.summaries[g.entry] = g
+	mmu.Log.Debugf("collapsing %d cards of %s into %s", len(g.members), g.app.Base(), g.entry)
+	cAddNotification(g.app.DesktopId(), g.entry, g.summaryCard(), payload)
+}
+
+// ungroup takes the card out of its group, if it's in one.
+func (mmu *MessagingMenu) ungroup(nid string) {
+	g := mmu.grouped[nid]
+	if g == nil {
+		return
+	}
+	delete(mmu.grouped, nid)
+	for i, m := range g.members {
+		if m.nid == nid {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	switch {
+	case len(g.members) == 0:
+		mmu.dropGroup(g)
+	case g.entry == "":
+		// not collapsed; nothing else to do
+	case len(g.members) == 1:
+		// no point in a summary of one card
+		mmu.doRemoveNotification(g.entry, true)
+		delete(mmu.summaries, g.entry)
+		g.entry = ""
+		mmu.show(g.app, g.members[0])
+	default:
+		mmu.showSummary(g)
+	}
+}
+
+// dropGroup forgets about the group and its hidden cards.
+func (mmu *MessagingMenu) dropGroup(g *group) {
+	if g.entry != "" {
+		delete(mmu.summaries, g.entry)
+	}
+	for _, m := range g.members {
+		delete(mmu.grouped, m.nid)
+	}
+	delete(mmu.groups, groupKey(g.app, g.name))
+}
+
+// Expand replaces the summary entry with the given id with the cards
+// it collapsed, and keeps them that way.
+func (mmu *MessagingMenu) Expand(entry string) {
+	mmu.lock.Lock()
+	defer mmu.lock.Unlock()
+	g := mmu.summaries[entry]
+	if g == nil {
+		return
+	}
+	// the messaging menu has already removed the activated entry
+	mmu.doRemoveNotification(entry, false)
+	delete(mmu.summaries, entry)
+	g.entry = ""
+	g.expanded = true
+	for _, m := range g.members {
+		mmu.show(g.app, m)
+	}
+}
+
+// Groups returns the names of the groups of app.
+func (mmu *MessagingMenu) Groups(app *click.AppId) []string {
+	orig := app.Original()
+	names := []string(nil)
+	mmu.lock.Lock()
+	defer mmu.lock.Unlock()
+	mmu.lastCleanupTime = time.Now()
+	mmu.doCleanUpNotifications()
+	for _, g := range mmu.groups {
+		if g.app.Original() == orig {
+			names = append(names, g.name)
+		}
+	}
+	return names
+}
+
+// ClearGroups removes the cards of app in the given groups, or in
+// all its groups if none are given, returning how many were removed.
+func (mmu *MessagingMenu) ClearGroups(app *click.AppId, names ...string) int {
+	orig := app.Original()
+	var nids []string
+
+	mmu.lock.RLock()
+	for _, g := range mmu.groups {
+		if g.app.Original() != orig {
+			continue
+		}
+		match := len(names) == 0
+		for _, name := range names {
+			if g.name == name {
+				match = true
+			}
+		}
+		if match {
+			for _, m := range g.members {
+				nids = append(nids, m.nid)
+			}
+		}
+	}
+	mmu.lock.RUnlock()
+
+	for _, nid := range nids {
+		mmu.RemoveNotification(nid, true)
+	}
+
+	return len(nids)
+}
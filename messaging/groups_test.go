@@ -0,0 +1,178 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package messaging
+
+import (
+	"sort"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/ubports/ubuntu-push/launch_helper"
+	"github.com/ubports/ubuntu-push/messaging/reply"
+)
+
+func grouped(group, summary, tag string) *launch_helper.Notification {
+	card := launch_helper.Card{Summary: summary, Persist: true, Group: group}
+	return &launch_helper.Notification{Card: &card, Tag: tag}
+}
+
+func (ms *MessagingSuite) TestGroupCollapses(c *C) {
+	mmu := New(ms.log)
+	c.Check(mmu.Present(ms.app, "notif1", grouped("chat", "hi", "a")), Equals, true)
+	c.Check(mmu.notifications, HasLen, 1)
+	c.Check(mmu.notifications["notif1"], NotNil)
+
+	c.Check(mmu.Present(ms.app, "notif2", grouped("chat", "there", "b")), Equals, true)
+	c.Assert(mmu.notifications, HasLen, 1)
+	entry := "group:" + ms.app.Original() + "/chat"
+	payload := mmu.notifications[entry]
+	c.Assert(payload, NotNil)
+	c.Check(payload.Actions, HasLen, 0)
+	c.Check(payload.Kind, Equals, reply.KindExpand)
+	c.Check(mmu.summaries[entry].summaryCard().Summary, Equals, "2 new notifications")
+	c.Check(mmu.summaries[entry].summaryCard().Body, Equals, "there")
+	c.Check(ms.log.Captured(), Matches, `(?s).*REMOVE:.*notif1.*ADD:.*`+entry+`.*`)
+
+	// other groups, and ungrouped cards, are kept apart
+	c.Check(mmu.Present(ms.app, "notif3", grouped("mail", "yo", "")), Equals, true)
+	c.Check(mmu.Present(ms.app, "notif4", grouped("", "sup", "")), Equals, true)
+	c.Check(mmu.notifications, HasLen, 3)
+}
+
+func (ms *MessagingSuite) TestGroupSummaryTemplate(c *C) {
+	mmu := New(ms.log)
+	notif := grouped("chat", "hi", "")
+	notif.Card.GroupSummary = "{count} messages from Bob"
+	mmu.Present(ms.app, "notif1", notif)
+	mmu.Present(ms.app, "notif2", grouped("chat", "there", ""))
+	mmu.Present(ms.app, "notif3", grouped("chat", "again", ""))
+	entry := "group:" + ms.app.Original() + "/chat"
+	c.Assert(mmu.summaries[entry], NotNil)
+	c.Check(mmu.summaries[entry].summaryCard().Summary, Equals, "3 messages from Bob")
+}
+
+func (ms *MessagingSuite) TestGroupExpand(c *C) {
+	mmu := New(ms.log)
+	mmu.Present(ms.app, "notif1", grouped("chat", "hi", ""))
+	mmu.Present(ms.app, "notif2", grouped("chat", "there", ""))
+	entry := "group:" + ms.app.Original() + "/chat"
+	c.Assert(mmu.notifications[entry], NotNil)
+
+	mmu.Expand(entry)
+	c.Check(mmu.notifications[entry], IsNil)
+	c.Check(mmu.summaries, HasLen, 0)
+	c.Check(mmu.notifications, HasLen, 2)
+
+	// and it stays expanded
+	mmu.Present(ms.app, "notif3", grouped("chat", "again", ""))
+	c.Check(mmu.notifications, HasLen, 3)
+	c.Check(mmu.notifications["notif3"], NotNil)
+
+	// expanding something unknown does nothing
+	mmu.Expand("group:nope")
+	c.Check(mmu.notifications, HasLen, 3)
+}
+
+func (ms *MessagingSuite) TestGroupTagsAndClear(c *C) {
+	mmu := New(ms.log)
+	cNotificationExists = func(did string, nid string) bool {
+		return true
+	}
+	mmu.Present(ms.app, "notif1", grouped("chat", "hi", "a"))
+	mmu.Present(ms.app, "notif2", grouped("chat", "there", "b"))
+	mmu.Present(ms.app, "notif3", grouped("chat", "again", "c"))
+	ms.checkTags(c, mmu.Tags(ms.app), []string{"a", "b", "c"})
+	// hidden cards still have their tags
+	c.Check(mmu.Tag("notif2"), Equals, "b")
+
+	// clearing a hidden card re-renders the summary
+	c.Check(mmu.Clear(ms.app, "a"), Equals, 1)
+	ms.checkTags(c, mmu.Tags(ms.app), []string{"b", "c"})
+	entry := "group:" + ms.app.Original() + "/chat"
+	c.Assert(mmu.summaries[entry], NotNil)
+	c.Check(mmu.summaries[entry].summaryCard().Summary, Equals, "2 new notifications")
+
+	// and with a single card left there's no summary
+	c.Check(mmu.ClearIds(ms.app, "notif2"), Equals, 1)
+	c.Check(mmu.summaries, HasLen, 0)
+	c.Check(mmu.notifications, HasLen, 1)
+	c.Check(mmu.notifications["notif3"], NotNil)
+	ms.checkTags(c, mmu.Tags(ms.app), []string{"c"})
+
+	c.Check(mmu.Clear(ms.app), Equals, 1)
+	c.Check(mmu.Tags(ms.app), IsNil)
+	c.Check(mmu.groups, HasLen, 0)
+	c.Check(mmu.grouped, HasLen, 0)
+}
+
+func (ms *MessagingSuite) TestGroupsAndClearGroups(c *C) {
+	mmu := New(ms.log)
+	cNotificationExists = func(did string, nid string) bool {
+		return true
+	}
+	c.Check(mmu.Groups(ms.app), IsNil)
+	mmu.Present(ms.app, "notif1", grouped("chat", "hi", ""))
+	mmu.Present(ms.app, "notif2", grouped("chat", "there", ""))
+	mmu.Present(ms.app, "notif3", grouped("mail", "yo", ""))
+	mmu.Present(ms.app, "notif4", grouped("", "sup", ""))
+	groups := mmu.Groups(ms.app)
+	sort.Strings(groups)
+	c.Check(groups, DeepEquals, []string{"chat", "mail"})
+
+	c.Check(mmu.ClearGroups(ms.app, "chat"), Equals, 2)
+	c.Check(mmu.Groups(ms.app), DeepEquals, []string{"mail"})
+	c.Check(mmu.summaries, HasLen, 0)
+	c.Check(mmu.notifications, HasLen, 2)
+
+	c.Check(mmu.ClearGroups(ms.app), Equals, 1)
+	c.Check(mmu.Groups(ms.app), IsNil)
+	c.Check(mmu.notifications, HasLen, 1)
+	c.Check(mmu.notifications["notif4"], NotNil)
+}
+
+func (ms *MessagingSuite) TestGroupHas(c *C) {
+	mmu := New(ms.log)
+	c.Assert(mmu.Present(ms.app, "notif1", grouped("chat", "hi", "a")), Equals, true)
+	c.Assert(mmu.Present(ms.app, "notif2", grouped("chat", "there", "b")), Equals, true)
+	entry := "group:" + ms.app.Original() + "/chat"
+	// the collapsed cards are there, the entry isn't a card
+	c.Check(mmu.Has("notif1"), Equals, true)
+	c.Check(mmu.Has("notif2"), Equals, true)
+	c.Check(mmu.Has(entry), Equals, false)
+	c.Check(mmu.Has("notif3"), Equals, false)
+	mmu.RemoveNotification("notif1", true)
+	c.Check(mmu.Has("notif1"), Equals, false)
+	c.Check(mmu.Has("notif2"), Equals, true)
+}
+
+func (ms *MessagingSuite) TestGroupDismissed(c *C) {
+	mmu := New(ms.log)
+	var dismissed []string
+	mmu.OnDismiss = func(nid string) { dismissed = append(dismissed, nid) }
+	mmu.Present(ms.app, "notif1", grouped("chat", "hi", ""))
+	mmu.Present(ms.app, "notif2", grouped("chat", "there", ""))
+
+	cNotificationExists = func(did string, nid string) bool {
+		return false
+	}
+	mmu.cleanUpNotifications()
+	sort.Strings(dismissed)
+	c.Check(dismissed, DeepEquals, []string{"notif1", "notif2"})
+	c.Check(mmu.groups, HasLen, 0)
+	c.Check(mmu.grouped, HasLen, 0)
+	c.Check(mmu.summaries, HasLen, 0)
+}
@@ -38,6 +38,14 @@ type MessagingMenu struct {
 	notifications   map[string]*cmessaging.Payload // keep a ref to the Payload used in the MMU callback
 	lock            sync.RWMutex
 	lastCleanupTime time.Time
+	// OnDismiss, if set, is called with the id of every notification
+	// found to have been dismissed from the messaging menu.
+	OnDismiss func(nid string)
+	// grouped cards, by app and group name, by the ids of their
+	// cards, and by the ids of the entries they're collapsed into
+	groups    map[string]*group
+	grouped   map[string]*group
+	summaries map[string]*group
 }
 
 type cleanUp func()
@@ -78,6 +86,15 @@ func (mmu *MessagingMenu) addNotification(app *click.AppId, notificationId strin
 func (mmu *MessagingMenu) RemoveNotification(notificationId string, fromUI bool) {
 	mmu.lock.Lock()
 	defer mmu.lock.Unlock()
+	mmu.doRemoveNotification(notificationId, fromUI)
+	if g := mmu.summaries[notificationId]; g != nil {
+		mmu.dropGroup(g)
+	} else {
+		mmu.ungroup(notificationId)
+	}
+}
+
+func (mmu *MessagingMenu) doRemoveNotification(notificationId string, fromUI bool) {
 	payload := mmu.notifications[notificationId]
 	delete(mmu.notifications, notificationId)
 	if payload != nil && payload.App != nil && fromUI {
@@ -96,8 +113,49 @@ func (mmu *MessagingMenu) doCleanUpNotifications() {
 	for nid, payload := range mmu.notifications {
 		if !cNotificationExists(payload.App.DesktopId(), nid) {
 			delete(mmu.notifications, nid)
+			if g := mmu.summaries[nid]; g != nil {
+				// dismissing the group dismisses all its cards
+				for _, m := range g.members {
+					mmu.dismissed(m.nid)
+				}
+				mmu.dropGroup(g)
+				continue
+			}
+			mmu.ungroup(nid)
+			mmu.dismissed(nid)
+		}
+	}
+}
+
+func (mmu *MessagingMenu) dismissed(nid string) {
+	if mmu.OnDismiss != nil {
+		mmu.OnDismiss(nid)
+	}
+}
+
+// Has says whether the card with the given id is in the messaging
+// menu, shown or collapsed into a group.
+func (mmu *MessagingMenu) Has(nid string) bool {
+	mmu.lock.RLock()
+	defer mmu.lock.RUnlock()
+	return mmu.notifications[nid] != nil && mmu.summaries[nid] == nil || mmu.grouped[nid] != nil
+}
+
+// Tag returns the tag of the card with the given id, if it has one.
+func (mmu *MessagingMenu) Tag(nid string) string {
+	mmu.lock.RLock()
+	defer mmu.lock.RUnlock()
+	if payload := mmu.notifications[nid]; payload != nil {
+		return payload.Tag
+	}
+	if g := mmu.grouped[nid]; g != nil {
+		for _, m := range g.members {
+			if m.nid == nid {
+				return m.tag
+			}
 		}
 	}
+	return ""
 }
 
 func (mmu *MessagingMenu) Tags(app *click.AppId) []string {
@@ -107,34 +165,56 @@ func (mmu *MessagingMenu) Tags(app *click.AppId) []string {
 	defer mmu.lock.Unlock()
 	mmu.lastCleanupTime = time.Now()
 	mmu.doCleanUpNotifications()
-	for _, payload := range mmu.notifications {
-		if payload.App.Original() == orig {
-			tags = append(tags, payload.Tag)
-		}
+	for _, tag := range mmu.cards(orig) {
+		tags = append(tags, tag)
 	}
 	return tags
 }
 
-func (mmu *MessagingMenu) Clear(app *click.AppId, tags ...string) int {
-	orig := app.Original()
+// cards returns the tags of the cards of the app with the given
+// original app id, by id; this includes the cards hidden in collapsed
+// groups, but not the entries they're collapsed into.
+func (mmu *MessagingMenu) cards(orig string) map[string]string {
+	cards := make(map[string]string)
+	for nid, payload := range mmu.notifications {
+		if payload.App.Original() == orig && mmu.summaries[nid] == nil {
+			cards[nid] = payload.Tag
+		}
+	}
+	for _, g := range mmu.groups {
+		if g.entry != "" && g.app.Original() == orig {
+			for _, m := range g.members {
+				cards[m.nid] = m.tag
+			}
+		}
+	}
+	return cards
+}
+
+// tagged returns the ids of the notifications of app with any of the
+// given tags, or all of them if no tags are given.
+func (mmu *MessagingMenu) tagged(app *click.AppId, tags []string) []string {
 	var nids []string
 
 	mmu.lock.RLock()
+	defer mmu.lock.RUnlock()
 	// O(n×m). Should be small n and m though.
-	for nid, payload := range mmu.notifications {
-		if payload.App.Original() == orig {
-			if len(tags) == 0 {
-				nids = append(nids, nid)
-			} else {
-				for _, tag := range tags {
-					if payload.Tag == tag {
-						nids = append(nids, nid)
-					}
+	for nid, cardTag := range mmu.cards(app.Original()) {
+		if len(tags) == 0 {
+			nids = append(nids, nid)
+		} else {
+			for _, tag := range tags {
+				if cardTag == tag {
+					nids = append(nids, nid)
 				}
 			}
 		}
 	}
-	mmu.lock.RUnlock()
+	return nids
+}
+
+func (mmu *MessagingMenu) Clear(app *click.AppId, tags ...string) int {
+	nids := mmu.tagged(app, tags)
 
 	for _, nid := range nids {
 		mmu.RemoveNotification(nid, true)
@@ -144,6 +224,27 @@ func (mmu *MessagingMenu) Clear(app *click.AppId, tags ...string) int {
 	return len(nids)
 }
 
+// ClearIds removes the notifications of app with the given ids,
+// returning how many were removed.
+func (mmu *MessagingMenu) ClearIds(app *click.AppId, nids ...string) int {
+	var found []string
+
+	mmu.lock.RLock()
+	cards := mmu.cards(app.Original())
+	for _, nid := range nids {
+		if _, ok := cards[nid]; ok {
+			found = append(found, nid)
+		}
+	}
+	mmu.lock.RUnlock()
+
+	for _, nid := range found {
+		mmu.RemoveNotification(nid, true)
+	}
+
+	return len(found)
+}
+
 var canUseListNotify = cnotificationsettings.CanUseListNotify
 
 func (mmu *MessagingMenu) Present(app *click.AppId, nid string, notification *launch_helper.Notification) bool {
@@ -179,9 +280,20 @@ func (mmu *MessagingMenu) Present(app *click.AppId, nid string, notification *la
 		actions[2*i+1] = action
 	}
 
+	if _, ok := card.Progress(); ok && notification.Tag != "" {
+		// progress updates replace the card they update
+		for _, old := range mmu.tagged(app, []string{notification.Tag}) {
+			mmu.RemoveNotification(old, true)
+		}
+	}
+
 	mmu.Log.Debugf("[%s] creating notification centre entry for %s (summary: %s)", nid, app.Base(), card.Summary)
 
-	mmu.addNotification(app, nid, notification.Tag, card, actions, nil)
+	if card.Group != "" {
+		mmu.addGrouped(app, nid, notification.Tag, card, actions)
+	} else {
+		mmu.addNotification(app, nid, notification.Tag, card, actions, nil)
+	}
 
 	return true
 }
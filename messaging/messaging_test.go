@@ -75,6 +75,25 @@ func (ms *MessagingSuite) TestPresentPresents(c *C) {
 	c.Check(ms.log.Captured(), Matches, `(?s).* ADD:.*notif-id.*`)
 }
 
+func (ms *MessagingSuite) TestPresentProgressReplaces(c *C) {
+	mmu := New(ms.log)
+	progress := 10
+	card := launch_helper.Card{Summary: "ehlo", Persist: true, RawProgress: &progress}
+	notif := launch_helper.Notification{Card: &card, Tag: "dl"}
+	c.Check(mmu.Present(ms.app, "notif-1", &notif), Equals, true)
+	// a plain card with the same tag doesn't replace it
+	c.Check(mmu.Present(ms.app, "notif-2", &launch_helper.Notification{Card: &launch_helper.Card{Summary: "ehlo", Persist: true}, Tag: "dl"}), Equals, true)
+	c.Check(mmu.notifications, HasLen, 2)
+
+	progress = 50
+	c.Check(mmu.Present(ms.app, "notif-3", &notif), Equals, true)
+	c.Check(mmu.notifications, HasLen, 1)
+	// but progress replaces everything with the tag
+	c.Check(mmu.notifications["notif-3"], NotNil)
+	c.Check(ms.log.Captured(), Matches, `(?s).* REMOVE:.*notif-1.*`)
+	c.Check(ms.log.Captured(), Matches, `(?s).* REMOVE:.*notif-2.*`)
+}
+
 func (ms *MessagingSuite) TestPresentDoesNotPresentsIfNoSummary(c *C) {
 	mmu := New(ms.log)
 	card := launch_helper.Card{Persist: true}
@@ -164,6 +183,14 @@ func (ms *MessagingSuite) TestTagsListsTags(c *C) {
 	c.Check(mmu.Tags(ms.app), IsNil)
 }
 
+func (ms *MessagingSuite) TestTag(c *C) {
+	mmu := New(ms.log)
+	card := launch_helper.Card{Summary: "hi", Persist: true}
+	c.Assert(mmu.Present(ms.app, "notif1", &launch_helper.Notification{Card: &card, Tag: "one"}), Equals, true)
+	c.Check(mmu.Tag("notif1"), Equals, "one")
+	c.Check(mmu.Tag("notif2"), Equals, "")
+}
+
 func (ms *MessagingSuite) TestClearClears(c *C) {
 	app1 := ms.app
 	app2 := clickhelp.MustParseAppId("com.example.test_test-2_0")
@@ -239,6 +266,30 @@ func (ms *MessagingSuite) TestClearClears(c *C) {
 	c.Check(mm.Tags(app3), HasLen, 0)
 }
 
+func (ms *MessagingSuite) TestClearIds(c *C) {
+	app1 := ms.app
+	app2 := clickhelp.MustParseAppId("com.example.test_test-2_0")
+	mm := New(ms.log)
+	f := func(app *click.AppId, nid string) bool {
+		card := launch_helper.Card{Summary: "nid: " + nid, Persist: true}
+		return mm.Present(app, nid, &launch_helper.Notification{Card: &card})
+	}
+	c.Assert(f(app1, "notif1"), Equals, true)
+	c.Assert(f(app1, "notif2"), Equals, true)
+	c.Assert(f(app2, "notif3"), Equals, true)
+
+	cNotificationExists = func(did string, nid string) bool {
+		return true
+	}
+
+	// only the app's own notifications are cleared
+	c.Check(mm.ClearIds(app1, "notif3"), Equals, 0)
+	c.Check(mm.ClearIds(app1, "notif1", "notif3", "foo"), Equals, 1)
+	c.Check(mm.Tags(app1), HasLen, 1)
+	c.Check(mm.Tags(app2), HasLen, 1)
+	c.Check(mm.ClearIds(app1, "notif1"), Equals, 0)
+}
+
 func (ms *MessagingSuite) TestRemoveNotification(c *C) {
 	mmu := New(ms.log)
 	card := launch_helper.Card{Summary: "ehlo", Persist: true, Actions: []string{"action-1"}}
@@ -308,6 +359,26 @@ func (ms *MessagingSuite) TestCleanupStaleNotification(c *C) {
 	c.Check(ok, Equals, false)
 }
 
+func (ms *MessagingSuite) TestCleanupReportsDismissed(c *C) {
+	mmu := New(ms.log)
+	var dismissed []string
+	mmu.OnDismiss = func(nid string) { dismissed = append(dismissed, nid) }
+	card := launch_helper.Card{Summary: "ehlo", Persist: true}
+	mmu.addNotification(ms.app, "notif-id", "", &card, nil, nil)
+
+	cNotificationExists = func(did string, nid string) bool {
+		return true
+	}
+	mmu.cleanUpNotifications()
+	c.Check(dismissed, HasLen, 0)
+
+	cNotificationExists = func(did string, nid string) bool {
+		return false
+	}
+	mmu.cleanUpNotifications()
+	c.Check(dismissed, DeepEquals, []string{"notif-id"})
+}
+
 func (ms *MessagingSuite) TestCleanupInAddNotification(c *C) {
 	mmu := New(ms.log)
 
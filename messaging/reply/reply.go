@@ -20,9 +20,30 @@ package reply
 
 import "github.com/ubports/ubuntu-push/click"
 
+// ReplyAction is the name of the messaging menu action of the inline
+// text replies to cards.
+const ReplyAction = "reply"
+
+// Kind says what a MessagingMenu action is about.
+type Kind int
+
+const (
+	// KindOpen is the activation of a card; its Action is the URL to
+	// open.
+	KindOpen Kind = iota
+	// KindReply is an inline text reply to a card.
+	KindReply
+	// KindExpand is the activation of the entry grouped cards are
+	// collapsed into.
+	KindExpand
+)
+
 // MMActionReply holds the reply from a MessagingMenu action
 type MMActionReply struct {
+	Kind         Kind
 	Notification string
 	Action       string
 	App          *click.AppId
+	Tag          string
+	Reply        string // the text, if Kind is KindReply
 }
@@ -22,11 +22,13 @@ package poller
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ubports/ubuntu-push/bus"
 	"github.com/ubports/ubuntu-push/bus/polld"
 	"github.com/ubports/ubuntu-push/bus/powerd"
+	"github.com/ubports/ubuntu-push/bus/upower"
 	"github.com/ubports/ubuntu-push/client/session"
 	"github.com/ubports/ubuntu-push/logger"
 	"github.com/ubports/ubuntu-push/util"
@@ -42,8 +44,14 @@ type stater interface {
 	State() session.ClientSessionState
 }
 
+// Times holds the poller's timings. If both MinAlarmInterval and
+// MaxAlarmInterval are set, the interval between wakeups starts at
+// AlarmInterval and adapts within those bounds to how much each
+// wakeup delivers.
 type Times struct {
 	AlarmInterval      time.Duration
+	MinAlarmInterval   time.Duration
+	MaxAlarmInterval   time.Duration
 	SessionStateSettle time.Duration
 	NetworkWait        time.Duration
 	PolldWait          time.Duration
@@ -56,6 +64,19 @@ type Poller interface {
 	Start() error
 	Run() error
 	HasConnectivity(bool)
+	// Delivered tells the poller a notification arrived, so it
+	// can adapt how often it wakes up.
+	Delivered()
+	// Status returns a snapshot of the poller's timing.
+	Status() Status
+}
+
+// Status is a snapshot of the poller's timing, for troubleshooting.
+type Status struct {
+	// the interval asked for the latest wakeup
+	Interval   time.Duration
+	LastWakeup time.Time
+	NextWakeup time.Time
 }
 
 type PollerSetup struct {
@@ -69,12 +90,17 @@ type poller struct {
 	log                  logger.Logger
 	powerd               powerd.Powerd
 	polld                polld.Polld
+	upower               upower.UPower
 	cookie               string
 	sessionState         stater
+	sched                *scheduler
+	delivered            int32
 	connCh               chan bool
-	requestWakeupCh      chan struct{}
+	requestWakeupCh      chan time.Duration
 	requestedWakeupErrCh chan error
 	holdsWakeLockCh      chan bool
+	statusLock           sync.Mutex
+	status               Status
 }
 
 func New(setup *PollerSetup) Poller {
@@ -84,8 +110,9 @@ func New(setup *PollerSetup) Poller {
 		powerd:               nil,
 		polld:                nil,
 		sessionState:         setup.SessionStateGetter,
+		sched:                newScheduler(setup.Times),
 		connCh:               make(chan bool),
-		requestWakeupCh:      make(chan struct{}),
+		requestWakeupCh:      make(chan time.Duration),
 		requestedWakeupErrCh: make(chan error),
 		holdsWakeLockCh:      make(chan bool),
 	}
@@ -99,6 +126,22 @@ func (p *poller) HasConnectivity(hasConn bool) {
 	p.connCh <- hasConn
 }
 
+func (p *poller) Delivered() {
+	atomic.AddInt32(&p.delivered, 1)
+}
+
+func (p *poller) Status() Status {
+	p.statusLock.Lock()
+	defer p.statusLock.Unlock()
+	return p.status
+}
+
+func (p *poller) updateStatus(f func(*Status)) {
+	p.statusLock.Lock()
+	defer p.statusLock.Unlock()
+	f(&p.status)
+}
+
 func (p *poller) Start() error {
 	if p.log == nil {
 		return ErrUnconfigured
@@ -127,6 +170,16 @@ func (p *poller) Start() error {
 	p.powerd = powerd.New(powerdEndp, p.log)
 	p.polld = polld.New(polldEndp, p.log)
 
+	if p.sched.adaptive() {
+		// upower is only a hint; don't wait around for it
+		upowerEndp := bus.SystemBus.Endpoint(upower.BusAddress, p.log)
+		if err := upowerEndp.Dial(); err != nil {
+			p.log.Errorf("unable to dial upower, assuming battery: %v", err)
+		} else {
+			p.upower = upower.New(upowerEndp, p.log)
+		}
+	}
+
 	// busy sleep loop to workaround go's timer/sleep
 	// not accounting for time when the system is suspended
 	// see https://bugs.launchpad.net/ubuntu/+source/ubuntu-push/+bug/1435109
@@ -188,7 +241,7 @@ func (p *poller) control(wakeupCh <-chan bool, filteredWakeUpCh chan<- bool) {
 	for {
 		select {
 		case holdsWakeLock = <-p.holdsWakeLockCh:
-		case <-p.requestWakeupCh:
+		case interval := <-p.requestWakeupCh:
 			if !t.IsZero() || dontPoll {
 				// earlier wakeup or we shouldn't be polling
 				// => don't request wakeup
@@ -199,7 +252,7 @@ func (p *poller) control(wakeupCh <-chan bool, filteredWakeUpCh chan<- bool) {
 				break
 			}
 			var err error
-			t, cookie, err = p.doRequestWakeup(p.times.AlarmInterval)
+			t, cookie, err = p.doRequestWakeup(interval)
 			p.requestedWakeupErrCh <- err
 		case b := <-wakeupCh:
 			// seems we get here also on clear wakeup, oh well
@@ -251,8 +304,8 @@ func (p *poller) control(wakeupCh <-chan bool, filteredWakeUpCh chan<- bool) {
 	}
 }
 
-func (p *poller) requestWakeup() error {
-	p.requestWakeupCh <- struct{}{}
+func (p *poller) requestWakeup(interval time.Duration) error {
+	p.requestWakeupCh <- interval
 	return <-p.requestedWakeupErrCh
 }
 
@@ -268,14 +321,26 @@ func (p *poller) run(wakeupCh <-chan bool, doneCh <-chan bool) {
 	}
 }
 
+func (p *poller) onBattery() bool {
+	if p.upower == nil {
+		return true
+	}
+	return p.upower.OnBattery()
+}
+
 func (p *poller) step(wakeupCh <-chan bool, doneCh <-chan bool, lockCookie string) string {
 
-	err := p.requestWakeup()
+	interval := p.sched.next(p.onBattery())
+	err := p.requestWakeup(interval)
 	if err != nil {
 		// Don't do this too quickly. Pretend we are just skipping one wakeup
-		time.Sleep(p.times.AlarmInterval)
+		time.Sleep(interval)
 		return lockCookie
 	}
+	p.updateStatus(func(st *Status) {
+		st.Interval = interval
+		st.NextWakeup = time.Now().Add(interval)
+	})
 	p.holdsWakeLock(false)
 	if lockCookie != "" {
 		if err := p.powerd.ClearWakelock(lockCookie); err != nil {
@@ -284,6 +349,9 @@ func (p *poller) step(wakeupCh <-chan bool, doneCh <-chan bool, lockCookie strin
 		lockCookie = ""
 	}
 	<-wakeupCh
+	p.updateStatus(func(st *Status) {
+		st.LastWakeup = time.Now()
+	})
 	lockCookie, err = p.powerd.RequestWakelock("ubuntu push client")
 	if err != nil {
 		p.log.Errorf("RequestWakelock got %v", err)
@@ -330,10 +398,21 @@ func (p *poller) step(wakeupCh <-chan bool, doneCh <-chan bool, lockCookie strin
 			}
 		}
 
-		// XXX check whether something was actually done before waiting
-		p.log.Debugf("sleeping for DoneWait %s", p.times.DoneWait)
-		time.Sleep(p.times.DoneWait)
-		p.log.Debugf("slept")
+		// when the session delivered something since the wakeup more
+		// may be on its way, give it DoneWait to arrive before
+		// counting; otherwise there's nothing to wait for
+		delivered := int(atomic.SwapInt32(&p.delivered, 0))
+		if delivered == 0 {
+			p.log.Debugf("nothing delivered; skipping DoneWait")
+		} else {
+			p.log.Debugf("sleeping for DoneWait %s", p.times.DoneWait)
+			time.Sleep(p.times.DoneWait)
+			p.log.Debugf("slept")
+			delivered += int(atomic.SwapInt32(&p.delivered, 0))
+		}
+		if p.sched.record(delivered) {
+			p.log.Infof("%d notifications on last wakeup; poll interval now %s", delivered, p.sched.interval)
+		}
 	}
 
 	return lockCookie
@@ -52,7 +52,8 @@ type myD struct {
 	clearLockCookie string
 	clearLockErr    error
 	// Poll
-	pollErr error
+	pollErr  error
+	pollHook func()
 	// WatchDones
 	watchDonesCh  <-chan bool
 	watchDonesErr error
@@ -81,10 +82,16 @@ func (m *myD) ClearWakeup(cookie string) error {
 	return nil
 }
 func (m *myD) WatchWakeups() (<-chan bool, error) { return m.watchWakeCh, m.watchWakeErr }
-func (m *myD) Poll() error                        { return m.pollErr }
 func (m *myD) WatchDones() (<-chan bool, error)   { return m.watchDonesCh, m.watchDonesErr }
 func (m *myD) State() session.ClientSessionState  { return m.stateState }
 
+func (m *myD) Poll() error {
+	if m.pollHook != nil {
+		m.pollHook()
+	}
+	return m.pollErr
+}
+
 func (s *PrSuite) SetUpTest(c *C) {
 	s.log = helpers.NewTestLogger(c, "debug")
 	s.myd = &myD{}
@@ -97,7 +104,8 @@ func (s *PrSuite) TestStep(c *C) {
 		powerd:               s.myd,
 		polld:                s.myd,
 		sessionState:         s.myd,
-		requestWakeupCh:      make(chan struct{}),
+		sched:                newScheduler(Times{}),
+		requestWakeupCh:      make(chan time.Duration),
 		requestedWakeupErrCh: make(chan error),
 		holdsWakeLockCh:      make(chan bool),
 		connCh:               make(chan bool),
@@ -122,6 +130,11 @@ func (s *PrSuite) TestStep(c *C) {
 	}
 	// check we cleared the old cookie
 	c.Check(s.myd.clearLockCookie, Equals, "old cookie")
+	// and kept track of the timing
+	st := p.Status()
+	c.Check(st.Interval, Equals, time.Duration(0))
+	c.Check(st.NextWakeup.IsZero(), Equals, false)
+	c.Check(st.LastWakeup.Before(st.NextWakeup), Equals, false)
 }
 
 func (s *PrSuite) TestControl(c *C) {
@@ -131,7 +144,8 @@ func (s *PrSuite) TestControl(c *C) {
 		powerd:               s.myd,
 		polld:                s.myd,
 		sessionState:         s.myd,
-		requestWakeupCh:      make(chan struct{}),
+		sched:                newScheduler(Times{}),
+		requestWakeupCh:      make(chan time.Duration),
 		requestedWakeupErrCh: make(chan error),
 		holdsWakeLockCh:      make(chan bool),
 		connCh:               make(chan bool),
@@ -143,12 +157,12 @@ func (s *PrSuite) TestControl(c *C) {
 
 	// works
 	p.HasConnectivity(true)
-	err := p.requestWakeup()
+	err := p.requestWakeup(0)
 	c.Assert(err, IsNil)
 	c.Check(<-s.myd.watchWakeCh, Equals, true)
 
 	// there's a wakeup already
-	err = p.requestWakeup()
+	err = p.requestWakeup(0)
 	c.Assert(err, IsNil)
 	c.Check(s.myd.watchWakeCh, HasLen, 0)
 
@@ -157,7 +171,7 @@ func (s *PrSuite) TestControl(c *C) {
 	<-filteredWakeUpCh
 
 	p.HasConnectivity(false)
-	err = p.requestWakeup()
+	err = p.requestWakeup(0)
 	c.Assert(err, IsNil)
 	c.Check(s.myd.watchWakeCh, HasLen, 0)
 
@@ -171,3 +185,195 @@ func (s *PrSuite) TestControl(c *C) {
 	c.Check(<-s.myd.watchWakeCh, Equals, false)
 
 }
+
+func (s *PrSuite) TestControlUsesInterval(c *C) {
+	p := &poller{
+		times:                Times{},
+		log:                  s.log,
+		powerd:               s.myd,
+		polld:                s.myd,
+		sessionState:         s.myd,
+		sched:                newScheduler(Times{}),
+		requestWakeupCh:      make(chan time.Duration),
+		requestedWakeupErrCh: make(chan error),
+		holdsWakeLockCh:      make(chan bool),
+		connCh:               make(chan bool),
+	}
+	s.myd.watchWakeCh = make(chan bool, 1)
+	go p.control(make(chan bool), make(chan bool))
+
+	before := time.Now().Truncate(time.Second)
+	c.Assert(p.requestWakeup(42*time.Minute), IsNil)
+	c.Check(s.myd.reqWakeTime.Sub(before) >= 42*time.Minute, Equals, true)
+	c.Check(s.myd.reqWakeTime.Sub(before) <= 42*time.Minute+time.Second, Equals, true)
+}
+
+func (s *PrSuite) stepAdaptive(c *C, onPoll func(p *poller)) *poller {
+	times := Times{
+		AlarmInterval:    time.Second,
+		MinAlarmInterval: time.Second,
+		MaxAlarmInterval: time.Minute,
+		PolldWait:        200 * time.Millisecond,
+		DoneWait:         300 * time.Millisecond,
+	}
+	p := &poller{
+		times:                times,
+		log:                  s.log,
+		powerd:               s.myd,
+		polld:                s.myd,
+		sessionState:         s.myd,
+		sched:                newScheduler(times),
+		requestWakeupCh:      make(chan time.Duration),
+		requestedWakeupErrCh: make(chan error),
+		holdsWakeLockCh:      make(chan bool),
+		connCh:               make(chan bool),
+	}
+	doneCh := make(chan bool, 1)
+	s.myd.pollHook = func() {
+		if onPoll != nil {
+			onPoll(p)
+		}
+		doneCh <- true
+	}
+	// the next empty wakeup backs off
+	p.sched.idle = idleBackoff - 1
+	s.myd.reqLockCookie = "wakelock cookie"
+	s.myd.stateState = session.Running
+	wakeupCh := make(chan bool, 1)
+	s.myd.watchWakeCh = wakeupCh
+	filteredWakeUpCh := make(chan bool)
+	go p.control(wakeupCh, filteredWakeUpCh)
+	// keep waking up until the requested time has passed
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(100 * time.Millisecond):
+				select {
+				case wakeupCh <- true:
+				default:
+				}
+			}
+		}
+	}()
+	ch := make(chan string)
+	go func() { ch <- p.step(filteredWakeUpCh, doneCh, "") }()
+	select {
+	case <-ch:
+	case <-time.After(3 * time.Second):
+		c.Fatal("timeout waiting for step")
+	}
+	return p
+}
+
+func (s *PrSuite) TestStepAdaptiveIdle(c *C) {
+	p := s.stepAdaptive(c, nil)
+	c.Check(p.sched.interval, Equals, 2*time.Second)
+	c.Check(s.log.Captured(), Matches, `(?ms).*nothing delivered; skipping DoneWait.*`)
+	c.Check(s.log.Captured(), Not(Matches), `(?ms).*sleeping for DoneWait.*`)
+	c.Check(s.log.Captured(), Matches, `(?ms).*0 notifications on last wakeup; poll interval now 2s.*`)
+}
+
+func (s *PrSuite) TestStepAdaptiveWaitsWhenSomethingArrived(c *C) {
+	p := s.stepAdaptive(c, func(p *poller) {
+		// the session delivers while polling, and once more
+		// shortly after
+		p.Delivered()
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			p.Delivered()
+		}()
+	})
+	c.Check(s.log.Captured(), Matches, `(?ms).*sleeping for DoneWait.*`)
+	// not an empty wakeup: no backoff, and both counted
+	c.Check(p.sched.interval, Equals, time.Second)
+	c.Check(p.sched.idle, Equals, 0)
+	c.Check(p.delivered, Equals, int32(0))
+}
+
+func (s *PrSuite) TestDelivered(c *C) {
+	p := New(&PollerSetup{Log: s.log}).(*poller)
+	p.Delivered()
+	p.Delivered()
+	c.Check(p.delivered, Equals, int32(2))
+}
+
+type schedSuite struct{}
+
+var _ = Suite(&schedSuite{})
+
+func (s *schedSuite) TestFixed(c *C) {
+	sched := newScheduler(Times{AlarmInterval: 5 * time.Minute})
+	c.Check(sched.adaptive(), Equals, false)
+	for i := 0; i < 2*idleBackoff; i++ {
+		c.Check(sched.record(0), Equals, false)
+	}
+	c.Check(sched.record(10), Equals, false)
+	c.Check(sched.next(true), Equals, 5*time.Minute)
+	c.Check(sched.next(false), Equals, 5*time.Minute)
+}
+
+func (s *schedSuite) TestClampsInitial(c *C) {
+	sched := newScheduler(Times{
+		AlarmInterval:    time.Minute,
+		MinAlarmInterval: 5 * time.Minute,
+		MaxAlarmInterval: time.Hour,
+	})
+	c.Check(sched.next(true), Equals, 5*time.Minute)
+}
+
+func (s *schedSuite) TestBackoff(c *C) {
+	sched := newScheduler(Times{
+		AlarmInterval:    10 * time.Minute,
+		MinAlarmInterval: 5 * time.Minute,
+		MaxAlarmInterval: 30 * time.Minute,
+	})
+	c.Assert(sched.adaptive(), Equals, true)
+	for i := 1; i < idleBackoff; i++ {
+		c.Check(sched.record(0), Equals, false)
+	}
+	c.Check(sched.record(0), Equals, true)
+	c.Check(sched.next(true), Equals, 20*time.Minute)
+	for i := 0; i < idleBackoff; i++ {
+		sched.record(0)
+	}
+	// capped at max
+	c.Check(sched.next(true), Equals, 30*time.Minute)
+	for i := 0; i < idleBackoff; i++ {
+		c.Check(sched.record(0), Equals, false)
+	}
+	c.Check(sched.next(true), Equals, 30*time.Minute)
+}
+
+func (s *schedSuite) TestActivity(c *C) {
+	sched := newScheduler(Times{
+		AlarmInterval:    20 * time.Minute,
+		MinAlarmInterval: 5 * time.Minute,
+		MaxAlarmInterval: time.Hour,
+	})
+	sched.record(0)
+	sched.record(0)
+	// activity resets the idle count, and shortens the interval
+	c.Check(sched.record(1), Equals, true)
+	c.Check(sched.next(true), Equals, 10*time.Minute)
+	sched.record(0)
+	sched.record(0)
+	c.Check(sched.next(true), Equals, 10*time.Minute)
+	sched.record(3)
+	sched.record(3)
+	// capped at min
+	c.Check(sched.next(true), Equals, 5*time.Minute)
+}
+
+func (s *schedSuite) TestOnMains(c *C) {
+	sched := newScheduler(Times{
+		AlarmInterval:    20 * time.Minute,
+		MinAlarmInterval: 5 * time.Minute,
+		MaxAlarmInterval: time.Hour,
+	})
+	c.Check(sched.next(false), Equals, 5*time.Minute)
+	c.Check(sched.next(true), Equals, 20*time.Minute)
+}
@@ -0,0 +1,91 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package poller
+
+import (
+	"time"
+)
+
+// idleBackoff is how many wakeups in a row have to come back empty
+// before the interval is lengthened.
+const idleBackoff = 3
+
+// scheduler decides how long to wait until the next wakeup. With no
+// bounds configured it always answers the fixed interval; otherwise
+// the interval doubles after idleBackoff empty wakeups in a row and
+// halves after every wakeup that delivered something, staying within
+// [min, max]. While on mains power polling is cheap, so it uses min.
+type scheduler struct {
+	min      time.Duration
+	max      time.Duration
+	interval time.Duration
+	idle     int
+}
+
+func newScheduler(times Times) *scheduler {
+	s := &scheduler{
+		min:      times.MinAlarmInterval,
+		max:      times.MaxAlarmInterval,
+		interval: times.AlarmInterval,
+	}
+	if s.adaptive() {
+		s.interval = s.clamp(s.interval)
+	}
+	return s
+}
+
+func (s *scheduler) adaptive() bool {
+	return s.min > 0 && s.max >= s.min
+}
+
+func (s *scheduler) clamp(d time.Duration) time.Duration {
+	if d < s.min {
+		return s.min
+	}
+	if d > s.max {
+		return s.max
+	}
+	return d
+}
+
+// next returns the interval until the next wakeup.
+func (s *scheduler) next(onBattery bool) time.Duration {
+	if s.adaptive() && !onBattery {
+		return s.min
+	}
+	return s.interval
+}
+
+// record updates the schedule with the number of notifications the
+// last wakeup delivered. It returns whether the interval changed.
+func (s *scheduler) record(delivered int) bool {
+	if !s.adaptive() {
+		return false
+	}
+	prev := s.interval
+	if delivered > 0 {
+		s.idle = 0
+		s.interval = s.clamp(s.interval / 2)
+	} else {
+		s.idle++
+		if s.idle >= idleBackoff {
+			s.idle = 0
+			s.interval = s.clamp(s.interval * 2)
+		}
+	}
+	return s.interval != prev
+}
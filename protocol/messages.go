@@ -186,6 +186,9 @@ func (m *NotificationsMsg) Split() bool {
 	var size int
 	for i, notif := range notifs {
 		size += len(notif.Payload) + len(notif.AppId) + len(notif.MsgId) + notificationOverhead
+		if notif.Kind != "" {
+			size += len(notif.Kind) + kindOverhead
+		}
 		if size > maxPayloadSize {
 			m.splitting = len(notifs)
 			m.Notifications = notifs[:i]
@@ -196,6 +199,7 @@ func (m *NotificationsMsg) Split() bool {
 }
 
 var notificationOverhead int
+var kindOverhead int
 
 func init() {
 	buf, err := json.Marshal(Notification{})
@@ -203,12 +207,35 @@ func init() {
 		panic(fmt.Errorf("failed to compute Notification marshal overhead: %v", err))
 	}
 	notificationOverhead = len(buf) - 4 // - 4 for the null from P(ayload)
+	withKind, err := json.Marshal(Notification{Kind: "k"})
+	if err != nil {
+		panic(fmt.Errorf("failed to compute Notification marshal overhead: %v", err))
+	}
+	kindOverhead = len(withKind) - len(buf) - 1 // - 1 for the k
 }
 
+// Kinds of notifications for the client itself rather than for the
+// app they are addressed to.
+const (
+	// KindClear notifications carry a ClearInstruction as payload.
+	KindClear = "clear"
+	// KindBlob notifications carry as payload a reference to the
+	// app's payload, kept apart for being too large to be sent
+	// inline (see package blob).
+	KindBlob = "blob"
+)
+
+// KindsInfo is the ConnectMsg Info key under which the client lists,
+// separated by commas, the notification kinds it understands. Older
+// clients don't list any, and aren't sent notifications of a kind.
+const KindsInfo = "kinds"
+
 // A single unicast notification
 type Notification struct {
 	AppId string `json:"A"`
 	MsgId string `json:"M"`
+	// Kind is empty for notifications whose payload is for the app.
+	Kind string `json:"K,omitempty"`
 	// payload
 	Payload json.RawMessage `json:"P"`
 }
@@ -226,6 +253,40 @@ func ExtractPayloads(notifications []Notification) []json.RawMessage {
 	return payloads
 }
 
+// ClearInstruction asks the client to clear the notifications of
+// the app already presented to the user, matching either the message
+// id or the tag.
+type ClearInstruction struct {
+	MsgId string `json:"msgid,omitempty"`
+	Tag   string `json:"tag,omitempty"`
+}
+
+// ClearPayload builds the payload of a KindClear notification.
+func ClearPayload(instr *ClearInstruction) json.RawMessage {
+	buf, err := json.Marshal(instr)
+	if err != nil {
+		panic(fmt.Errorf("failed to marshal clear instruction: %v", err))
+	}
+	return json.RawMessage(buf)
+}
+
+// ExtractClearInstruction returns the ClearInstruction carried by
+// notif, or nil if notif is not a well-formed KindClear one.
+func ExtractClearInstruction(notif *Notification) *ClearInstruction {
+	if notif.Kind != KindClear {
+		return nil
+	}
+	var instr ClearInstruction
+	err := json.Unmarshal(notif.Payload, &instr)
+	if err != nil {
+		return nil
+	}
+	if instr.MsgId == "" && instr.Tag == "" {
+		return nil
+	}
+	return &instr
+}
+
 // ACKnowledgement message
 type AckMsg struct {
 	Type string `json:"T"`
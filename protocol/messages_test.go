@@ -132,12 +132,39 @@ func (s *messagesSuite) TestExtractPayloads(c *C) {
 	c.Check(ExtractPayloads(ns), DeepEquals, []json.RawMessage{p1, p2})
 }
 
+func (s *messagesSuite) TestClearPayloadRoundTrip(c *C) {
+	payload := ClearPayload(&ClearInstruction{MsgId: "msg1"})
+	c.Check(string(payload), Equals, `{"msgid":"msg1"}`)
+	notif := &Notification{Kind: KindClear, Payload: payload}
+	c.Check(ExtractClearInstruction(notif), DeepEquals, &ClearInstruction{MsgId: "msg1"})
+	notif.Payload = ClearPayload(&ClearInstruction{Tag: "tag1"})
+	c.Check(ExtractClearInstruction(notif), DeepEquals, &ClearInstruction{Tag: "tag1"})
+}
+
+func (s *messagesSuite) TestExtractClearInstructionNotClear(c *C) {
+	// the payload of app notifications is never taken for one
+	c.Check(ExtractClearInstruction(&Notification{Payload: json.RawMessage(`{"msgid":"msg1"}`)}), IsNil)
+	c.Check(ExtractClearInstruction(&Notification{Kind: "other", Payload: json.RawMessage(`{"msgid":"msg1"}`)}), IsNil)
+	c.Check(ExtractClearInstruction(&Notification{Kind: KindClear, Payload: json.RawMessage(`[1]`)}), IsNil)
+	c.Check(ExtractClearInstruction(&Notification{Kind: KindClear, Payload: json.RawMessage(`{}`)}), IsNil)
+}
+
+func (s *messagesSuite) TestNotificationKindMarshalling(c *C) {
+	buf, err := json.Marshal(Notification{AppId: "app1", MsgId: "m1", Payload: json.RawMessage(`{}`)})
+	c.Assert(err, IsNil)
+	c.Check(string(buf), Equals, `{"A":"app1","M":"m1","P":{}}`)
+	buf, err = json.Marshal(Notification{AppId: "app1", MsgId: "m1", Kind: KindClear, Payload: json.RawMessage(`{}`)})
+	c.Assert(err, IsNil)
+	c.Check(string(buf), Equals, `{"A":"app1","M":"m1","K":"clear","P":{}}`)
+	c.Check(kindOverhead, Equals, len(`,"K":""`))
+}
+
 func (s *messagesSuite) TestSplitNotificationsMsgNop(c *C) {
 	n := &NotificationsMsg{
 		Type: "notifications",
 		Notifications: []Notification{
-			Notification{"app1", "msg1", json.RawMessage(`{m:1}`)},
-			Notification{"app1", "msg1", json.RawMessage(`{m:2}`)},
+			Notification{AppId: "app1", MsgId: "msg1", Payload: json.RawMessage(`{m:1}`)},
+			Notification{AppId: "app1", MsgId: "msg1", Payload: json.RawMessage(`{m:2}`)},
 		},
 	}
 	done := n.Split()
@@ -152,9 +179,9 @@ func manyNotifications(c int) []Notification {
 	notifs := make([]Notification, 0, 1)
 	for i := 0; i < c; i++ {
 		notifs = append(notifs, Notification{
-			"app1",
-			fmt.Sprintf("msg%03d", i),
-			json.RawMessage(fmt.Sprintf(payloadFmt2, i)),
+			AppId:   "app1",
+			MsgId:   fmt.Sprintf("msg%03d", i),
+			Payload: json.RawMessage(fmt.Sprintf(payloadFmt2, i)),
 		})
 	}
 	return notifs
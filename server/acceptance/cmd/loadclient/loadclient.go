@@ -0,0 +1,118 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// loadclient command for load and soak testing a server with many
+// simulated devices.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/ubports/ubuntu-push/config"
+	"github.com/ubports/ubuntu-push/server/acceptance"
+	"github.com/ubports/ubuntu-push/server/acceptance/kit"
+	"github.com/ubports/ubuntu-push/server/acceptance/load"
+)
+
+type configuration struct {
+	kit.Configuration
+	Devices       int                       `json:"devices" help:"how many devices to simulate"`
+	DevicePrefix  string                    `json:"device_prefix" help:"prefix for the simulated device ids"`
+	ConnectRate   float64                   `json:"connect_rate" help:"new sessions per second, 0 for as fast as possible"`
+	NotifyRate    float64                   `json:"notify_rate" help:"unicasts per second"`
+	BroadcastRate float64                   `json:"broadcast_rate" help:"broadcasts per second"`
+	Duration      config.ConfigTimeDuration `json:"duration" help:"for how long to send notifications"`
+	Settle        config.ConfigTimeDuration `json:"settle" help:"how long to wait for deliveries afterwards"`
+	AppId         string                    `json:"appid" help:"app id for the unicasts"`
+}
+
+func main() {
+	defaults := map[string]interface{}{
+		"devices":        100,
+		"device_prefix":  "load-",
+		"connect_rate":   100.0,
+		"notify_rate":    10.0,
+		"broadcast_rate": 0.0,
+		"duration":       "1m",
+		"settle":         "10s",
+		"appid":          "com.example.load_load",
+	}
+	for k, v := range kit.Defaults {
+		defaults[k] = v
+	}
+	defaults["reportPings"] = false
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: loadclient [options]\n")
+		flag.PrintDefaults()
+	}
+	cfg := &configuration{}
+	err := config.ReadFilesDefaults(cfg, defaults, "<flags>")
+	if err != nil {
+		log.Fatalf("reading config: %v", err)
+	}
+	if cfg.Addr == ":0" {
+		log.Fatalf("-addr must be given")
+	}
+	cfgDir := filepath.Dir(flag.Lookup("cfg@").Value.String())
+	var apiTLSConfig *tls.Config
+	if cfg.APICertPEMFile != "" || cfg.Insecure {
+		apiTLSConfig, err = kit.MakeTLSConfig("", cfg.Insecure, cfg.APICertPEMFile, cfgDir)
+		if err != nil {
+			log.Fatalf("api tls config: %v", err)
+		}
+	}
+	apiCli := &kit.APIClient{ServerAPIURL: cfg.APIURL}
+	if apiCli.ServerAPIURL == "" {
+		apiCli.ServerAPIURL = cfg.PickByTarget("api",
+			"https://push.ubuntu.com",
+			"https://push.staging.ubuntu.com")
+	}
+	apiCli.SetupClient(apiTLSConfig, false, 16)
+	tlsConfig, err := kit.MakeTLSConfig(cfg.Domain, cfg.Insecure, cfg.CertPEMFile, cfgDir)
+	if err != nil {
+		log.Fatalf("tls config: %v", err)
+	}
+	runner := load.NewRunner(&load.Config{
+		Devices:       cfg.Devices,
+		DevicePrefix:  cfg.DevicePrefix,
+		ConnectRate:   cfg.ConnectRate,
+		NotifyRate:    cfg.NotifyRate,
+		BroadcastRate: cfg.BroadcastRate,
+		Duration:      cfg.Duration.TimeDuration(),
+		Settle:        cfg.Settle.TimeDuration(),
+		AppId:         cfg.AppId,
+		NewSession: func(deviceId string) *acceptance.ClientSession {
+			return &acceptance.ClientSession{
+				ExchangeTimeout: cfg.ExchangeTimeout.TimeDuration(),
+				ServerAddr:      cfg.Addr.HostPort(),
+				DeviceId:        deviceId,
+				Model:           cfg.DeviceModel,
+				ImageChannel:    cfg.ImageChannel,
+				BuildNumber:     cfg.BuildNumber,
+				ReportPings:     cfg.ReportPings,
+				TLSConfig:       tlsConfig,
+			}
+		},
+		API: apiCli,
+	})
+	log.Printf("connecting %d devices to %s", cfg.Devices, cfg.Addr.HostPort())
+	runner.Run().Print(os.Stdout)
+}
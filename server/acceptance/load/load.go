@@ -0,0 +1,345 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package load drives many simulated devices against a push server,
+// sending them notifications at given rates, and reports on how the
+// server coped.
+package load
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ubports/ubuntu-push/server/acceptance"
+	"github.com/ubports/ubuntu-push/server/acceptance/kit"
+	"github.com/ubports/ubuntu-push/server/api"
+)
+
+// Config holds what to run.
+type Config struct {
+	// how many devices to simulate, and their device id prefix
+	Devices      int
+	DevicePrefix string
+	// new sessions per second
+	ConnectRate float64
+	// unicasts and broadcasts per second once connected
+	NotifyRate    float64
+	BroadcastRate float64
+	// for how long to send notifications
+	Duration time.Duration
+	// how long to wait for outstanding deliveries afterwards
+	Settle time.Duration
+	// the app the unicasts are for
+	AppId string
+	// NewSession sets up the session for a device, without dialing
+	NewSession func(deviceId string) *acceptance.ClientSession
+	// API is used to send the notifications
+	API *kit.APIClient
+}
+
+// what the payloads look like; run tells apart the notifications of
+// earlier runs still around on the server
+type loadPayload struct {
+	Run  int64 `json:"run"`
+	Seq  int64 `json:"load"`
+	Sent int64 `json:"sent"`
+}
+
+// a broadcast delivery expected by a device
+type delivery struct {
+	seq      int64
+	deviceId string
+}
+
+// Runner runs the load and tracks what happens.
+type Runner struct {
+	cfg   *Config
+	lock  sync.Mutex
+	now   func() time.Time
+	run   int64
+	seq   int64
+	dials map[string]time.Time
+	// connected devices, in connection order
+	connected []string
+	// unicasts expected by seq, broadcasts by seq and device; true
+	// once delivered
+	unicasts   map[int64]string
+	unicastsIn map[int64]bool
+	broadcasts map[delivery]bool
+	// sending times by seq
+	sent   map[int64]time.Time
+	report Report
+}
+
+// NewRunner builds a Runner for cfg.
+func NewRunner(cfg *Config) *Runner {
+	return &Runner{
+		cfg:        cfg,
+		now:        time.Now,
+		run:        time.Now().UnixNano(),
+		dials:      make(map[string]time.Time),
+		unicasts:   make(map[int64]string),
+		unicastsIn: make(map[int64]bool),
+		broadcasts: make(map[delivery]bool),
+		sent:       make(map[int64]time.Time),
+		report: Report{
+			ServerErrors: make(map[string]int),
+		},
+	}
+}
+
+// Run connects the devices, sends notifications for cfg.Duration,
+// waits cfg.Settle for them to arrive and reports.
+func (r *Runner) Run() *Report {
+	// the sessions are left running, for the process to end
+	events := make(chan string, r.cfg.Devices+1)
+	go func() {
+		for ev := range events {
+			r.handleEvent(ev)
+		}
+	}()
+	r.connect(events)
+	var sends sync.WaitGroup
+	r.drive(&sends)
+	sends.Wait()
+	time.Sleep(r.cfg.Settle)
+	r.lock.Lock()
+	report := r.finish()
+	r.lock.Unlock()
+	return report
+}
+
+// every returns a channel ticking rate times a second, or nil for
+// no rate at all.
+func every(rate float64) <-chan time.Time {
+	if rate <= 0 {
+		return nil
+	}
+	return time.NewTicker(time.Duration(float64(time.Second) / rate)).C
+}
+
+func (r *Runner) connect(events chan<- string) {
+	tick := every(r.cfg.ConnectRate)
+	for i := 0; i < r.cfg.Devices; i++ {
+		if tick != nil {
+			<-tick
+		}
+		deviceId := fmt.Sprintf("%s%d", r.cfg.DevicePrefix, i)
+		sess := r.cfg.NewSession(deviceId)
+		sess.Prefix = deviceId + " "
+		r.lock.Lock()
+		r.report.Devices++
+		r.dials[deviceId] = r.now()
+		r.lock.Unlock()
+		err := sess.Dial()
+		if err != nil {
+			r.sessionError(err)
+			continue
+		}
+		go func() {
+			err := sess.Run(events)
+			if err != nil {
+				r.sessionError(err)
+			}
+		}()
+	}
+}
+
+func (r *Runner) sessionError(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.report.SessionErrors++
+	r.report.LastSessionError = err.Error()
+}
+
+// drive sends notifications at the configured rates for the
+// configured duration.
+func (r *Runner) drive(sends *sync.WaitGroup) {
+	unicastTick := every(r.cfg.NotifyRate)
+	broadcastTick := every(r.cfg.BroadcastRate)
+	stop := time.After(r.cfg.Duration)
+	next := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-unicastTick:
+			r.lock.Lock()
+			if len(r.connected) == 0 {
+				r.lock.Unlock()
+				continue
+			}
+			deviceId := r.connected[next%len(r.connected)]
+			next++
+			seq, payload := r.nextPayload()
+			r.unicasts[seq] = deviceId
+			r.report.Unicasts++
+			r.lock.Unlock()
+			sends.Add(1)
+			go func() {
+				defer sends.Done()
+				r.post("/notify", &api.Unicast{
+					UserId:   deviceId,
+					DeviceId: deviceId,
+					AppId:    r.cfg.AppId,
+					ExpireOn: r.expireOn(),
+					Data:     payload,
+				})
+			}()
+		case <-broadcastTick:
+			r.lock.Lock()
+			seq, payload := r.nextPayload()
+			for _, deviceId := range r.connected {
+				r.broadcasts[delivery{seq, deviceId}] = false
+			}
+			r.report.Broadcasts++
+			r.lock.Unlock()
+			sends.Add(1)
+			go func() {
+				defer sends.Done()
+				r.post("/broadcast", &api.Broadcast{
+					Channel:  "system",
+					ExpireOn: r.expireOn(),
+					Data:     payload,
+				})
+			}()
+		}
+	}
+}
+
+func (r *Runner) expireOn() string {
+	return r.now().Add(r.cfg.Duration + r.cfg.Settle + time.Hour).Format(time.RFC3339)
+}
+
+// nextPayload makes the payload for the next notification; call
+// with the lock held.
+func (r *Runner) nextPayload() (int64, json.RawMessage) {
+	r.seq++
+	now := r.now()
+	r.sent[r.seq] = now
+	b, err := json.Marshal(loadPayload{r.run, r.seq, now.UnixNano()})
+	if err != nil {
+		panic(err)
+	}
+	return r.seq, json.RawMessage(b)
+}
+
+func (r *Runner) post(path string, message interface{}) {
+	res, err := r.cfg.API.PostRequest(path, message)
+	if err == nil {
+		return
+	}
+	label := "transport"
+	if errLabel, ok := res["error"].(string); ok {
+		label = errLabel
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.report.ServerErrors[path+" "+label]++
+}
+
+var (
+	rxUnicastPayload   = regexp.MustCompile(`payload:(\S+);`)
+	rxBroadcastPayload = regexp.MustCompile(`payloads:(.*)$`)
+)
+
+// handleEvent accounts for an event from a session.
+func (r *Runner) handleEvent(ev string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := r.now()
+	parts := strings.SplitN(ev, " ", 3)
+	if len(parts) < 2 {
+		return
+	}
+	deviceId, kind := parts[0], parts[1]
+	switch kind {
+	case "connected":
+		if dialed, ok := r.dials[deviceId]; ok {
+			r.report.connectLatencies = append(r.report.connectLatencies, now.Sub(dialed))
+			delete(r.dials, deviceId)
+			r.connected = append(r.connected, deviceId)
+			r.report.Connected++
+		}
+	case "unicast":
+		for _, m := range rxUnicastPayload.FindAllStringSubmatch(ev, -1) {
+			var p loadPayload
+			if json.Unmarshal([]byte(m[1]), &p) != nil || p.Run != r.run {
+				continue
+			}
+			switch {
+			case r.unicasts[p.Seq] != deviceId:
+				r.report.Unexpected++
+			case r.unicastsIn[p.Seq]:
+				r.report.Duplicates++
+			default:
+				r.unicastsIn[p.Seq] = true
+				r.delivered(p.Seq, now)
+			}
+		}
+	case "broadcast":
+		m := rxBroadcastPayload.FindStringSubmatch(ev)
+		if m == nil {
+			return
+		}
+		var payloads []loadPayload
+		if json.Unmarshal([]byte(m[1]), &payloads) != nil {
+			return
+		}
+		for _, p := range payloads {
+			if p.Run != r.run {
+				continue
+			}
+			d := delivery{p.Seq, deviceId}
+			got, expected := r.broadcasts[d]
+			switch {
+			case !expected:
+				r.report.Unexpected++
+			case got:
+				r.report.Duplicates++
+			default:
+				r.broadcasts[d] = true
+				r.delivered(p.Seq, now)
+			}
+		}
+	case "connwarn", "connbroken":
+		r.report.ServerErrors["session "+kind]++
+	}
+}
+
+func (r *Runner) delivered(seq int64, now time.Time) {
+	r.report.Delivered++
+	r.report.deliveryLatencies = append(r.report.deliveryLatencies, now.Sub(r.sent[seq]))
+}
+
+// finish completes the report; call with the lock held.
+func (r *Runner) finish() *Report {
+	report := r.report
+	report.Expected = len(r.unicasts) + len(r.broadcasts)
+	report.Missed = report.Expected - report.Delivered
+	report.ConnectLatency = computePercentiles(report.connectLatencies)
+	report.DeliveryLatency = computePercentiles(report.deliveryLatencies)
+	errs := make(map[string]int, len(r.report.ServerErrors))
+	for k, v := range r.report.ServerErrors {
+		errs[k] = v
+	}
+	report.ServerErrors = errs
+	return &report
+}
@@ -0,0 +1,148 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package load
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+func TestLoad(t *testing.T) { TestingT(t) }
+
+type loadSuite struct {
+	r   *Runner
+	now time.Time
+}
+
+var _ = Suite(&loadSuite{})
+
+func (s *loadSuite) SetUpTest(c *C) {
+	s.r = NewRunner(&Config{Devices: 2})
+	s.r.run = 42
+	s.now = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.r.now = func() time.Time { return s.now }
+}
+
+func (s *loadSuite) pack(c *C, seq int64, run int64) string {
+	b, err := json.Marshal(loadPayload{run, seq, 0})
+	c.Assert(err, IsNil)
+	return string(b)
+}
+
+func (s *loadSuite) connect(deviceId string) {
+	s.r.dials[deviceId] = s.now
+	s.now = s.now.Add(10 * time.Millisecond)
+	s.r.handleEvent(deviceId + " connected 127.0.0.1:1234")
+}
+
+func (s *loadSuite) TestComputePercentiles(c *C) {
+	c.Check(computePercentiles(nil), Equals, Percentiles{})
+	ds := make([]time.Duration, 100)
+	for i := range ds {
+		ds[i] = time.Duration(100-i) * time.Millisecond
+	}
+	c.Check(computePercentiles(ds), Equals, Percentiles{
+		Count: 100,
+		P50:   50 * time.Millisecond,
+		P90:   90 * time.Millisecond,
+		P99:   99 * time.Millisecond,
+		Max:   100 * time.Millisecond,
+	})
+	p := computePercentiles([]time.Duration{time.Second})
+	c.Check(p.P50, Equals, time.Second)
+	c.Check(p.P99, Equals, time.Second)
+	c.Check(p.String(), Equals, "n=1 p50=1s p90=1s p99=1s max=1s")
+	c.Check(Percentiles{}.String(), Equals, "none")
+}
+
+func (s *loadSuite) TestConnected(c *C) {
+	s.connect("dev-0")
+	// not dialed by us
+	s.r.handleEvent("dev-9 connected 127.0.0.1:1234")
+	c.Check(s.r.connected, DeepEquals, []string{"dev-0"})
+	c.Check(s.r.report.Connected, Equals, 1)
+	c.Check(s.r.report.connectLatencies, DeepEquals, []time.Duration{10 * time.Millisecond})
+}
+
+func (s *loadSuite) TestUnicastAccounting(c *C) {
+	s.connect("dev-0")
+	s.connect("dev-1")
+	seq, _ := s.r.nextPayload()
+	s.r.unicasts[seq] = "dev-0"
+	s.now = s.now.Add(20 * time.Millisecond)
+	ev := fmt.Sprintf("unicast app:app payload:%s;", s.pack(c, seq, 42))
+	s.r.handleEvent("dev-0 " + ev)
+	s.r.handleEvent("dev-0 " + ev)
+	s.r.handleEvent("dev-1 " + ev)
+	// from another run
+	s.r.handleEvent(fmt.Sprintf("dev-0 unicast app:app payload:%s;", s.pack(c, seq, 41)))
+	c.Check(s.r.report.Delivered, Equals, 1)
+	c.Check(s.r.report.Duplicates, Equals, 1)
+	c.Check(s.r.report.Unexpected, Equals, 1)
+	c.Check(s.r.report.deliveryLatencies, DeepEquals, []time.Duration{20 * time.Millisecond})
+}
+
+func (s *loadSuite) TestBroadcastAccounting(c *C) {
+	s.connect("dev-0")
+	seq, _ := s.r.nextPayload()
+	s.r.broadcasts[delivery{seq, "dev-0"}] = false
+	ev := fmt.Sprintf("broadcast chan:0 app: topLevel:1 payloads:[%s,%s]", s.pack(c, seq, 42), s.pack(c, seq, 7))
+	s.r.handleEvent("dev-0 " + ev)
+	s.r.handleEvent("dev-0 " + ev)
+	s.r.handleEvent("dev-1 " + ev)
+	c.Check(s.r.report.Delivered, Equals, 1)
+	c.Check(s.r.report.Duplicates, Equals, 1)
+	c.Check(s.r.report.Unexpected, Equals, 1)
+}
+
+func (s *loadSuite) TestFinishAndPrint(c *C) {
+	s.r.report.Devices = 2
+	s.connect("dev-0")
+	s.connect("dev-1")
+	for i := 0; i < 2; i++ {
+		seq, _ := s.r.nextPayload()
+		s.r.unicasts[seq] = "dev-0"
+	}
+	s.r.report.Unicasts = 2
+	s.r.handleEvent(fmt.Sprintf("dev-0 unicast app:app payload:%s;", s.pack(c, 1, 42)))
+	s.r.handleEvent("dev-1 connbroken BYE")
+	s.r.report.ServerErrors["/notify transport"]++
+	rep := s.r.finish()
+	c.Check(rep.Expected, Equals, 2)
+	c.Check(rep.Missed, Equals, 1)
+	c.Check(rep.ConnectLatency.Count, Equals, 2)
+	// the runner's own report is left alone
+	rep.ServerErrors["x"] = 1
+	c.Check(s.r.report.ServerErrors, HasLen, 2)
+	delete(rep.ServerErrors, "x")
+	var buf bytes.Buffer
+	rep.Print(&buf)
+	c.Check(buf.String(), Equals, `devices:    2 connected of 2, 0 session errors
+connect:    n=2 p50=10ms p90=10ms p99=10ms max=10ms
+sent:       2 unicasts, 0 broadcasts
+deliveries: 1 of 2 expected, 1 missed, 0 duplicates, 0 unexpected
+delivery:   n=1 p50=0s p90=0s p99=0s max=0s
+errors:
+    /notify transport: 1
+    session connbroken: 1
+`)
+}
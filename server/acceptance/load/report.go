@@ -0,0 +1,119 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package load
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Percentiles summarizes a set of latencies.
+type Percentiles struct {
+	Count         int
+	P50, P90, P99 time.Duration
+	Max           time.Duration
+}
+
+type durations []time.Duration
+
+func (ds durations) Len() int           { return len(ds) }
+func (ds durations) Less(i, j int) bool { return ds[i] < ds[j] }
+func (ds durations) Swap(i, j int)      { ds[i], ds[j] = ds[j], ds[i] }
+
+// computePercentiles summarizes ds, which it sorts.
+func computePercentiles(ds []time.Duration) Percentiles {
+	n := len(ds)
+	if n == 0 {
+		return Percentiles{}
+	}
+	sort.Sort(durations(ds))
+	at := func(p int) time.Duration {
+		// nearest rank
+		i := (p*n+99)/100 - 1
+		if i < 0 {
+			i = 0
+		}
+		return ds[i]
+	}
+	return Percentiles{
+		Count: n,
+		P50:   at(50),
+		P90:   at(90),
+		P99:   at(99),
+		Max:   ds[n-1],
+	}
+}
+
+func (p Percentiles) String() string {
+	if p.Count == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("n=%d p50=%v p90=%v p99=%v max=%v", p.Count, p.P50, p.P90, p.P99, p.Max)
+}
+
+// Report is what a run found.
+type Report struct {
+	// sessions
+	Devices          int
+	Connected        int
+	SessionErrors    int
+	LastSessionError string
+	ConnectLatency   Percentiles
+	// notifications sent
+	Unicasts   int
+	Broadcasts int
+	// deliveries, expected per device
+	Expected        int
+	Delivered       int
+	Missed          int
+	Duplicates      int
+	Unexpected      int
+	DeliveryLatency Percentiles
+	// errors from the server, by endpoint and error label, or by
+	// session event
+	ServerErrors map[string]int
+
+	connectLatencies  []time.Duration
+	deliveryLatencies []time.Duration
+}
+
+// Print writes out the report for people.
+func (rep *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "devices:    %d connected of %d, %d session errors\n", rep.Connected, rep.Devices, rep.SessionErrors)
+	if rep.LastSessionError != "" {
+		fmt.Fprintf(w, "            last session error: %s\n", rep.LastSessionError)
+	}
+	fmt.Fprintf(w, "connect:    %v\n", rep.ConnectLatency)
+	fmt.Fprintf(w, "sent:       %d unicasts, %d broadcasts\n", rep.Unicasts, rep.Broadcasts)
+	fmt.Fprintf(w, "deliveries: %d of %d expected, %d missed, %d duplicates, %d unexpected\n", rep.Delivered, rep.Expected, rep.Missed, rep.Duplicates, rep.Unexpected)
+	fmt.Fprintf(w, "delivery:   %v\n", rep.DeliveryLatency)
+	if len(rep.ServerErrors) == 0 {
+		fmt.Fprintf(w, "errors:     none\n")
+		return
+	}
+	labels := make([]string, 0, len(rep.ServerErrors))
+	for label := range rep.ServerErrors {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	fmt.Fprintf(w, "errors:\n")
+	for _, label := range labels {
+		fmt.Fprintf(w, "    %s: %d\n", label, rep.ServerErrors[label])
+	}
+}
@@ -63,6 +63,13 @@ func FillHTTPServerConfig(cfg map[string]interface{}, httpAddr string) {
 		"http_read_timeout":         "1s",
 		"http_write_timeout":        "1s",
 		"max_notifications_per_app": MaxNotificationsPerApplication,
+		"max_payload_size":          0,
+		"app_max_payload_sizes":     map[string]int{},
+		"users":                     map[string]string{},
+		"require_user_auth":         false,
+		"tenants":                   map[string]interface{}{},
+		"log_level":                 "info",
+		"log_format":                "text",
 	})
 }
 
@@ -25,11 +25,13 @@ import (
 	"io"
 	"mime"
 	"net/http"
+	"regexp"
 	"time"
 	"strings"
 
 	"github.com/pborman/uuid"
 
+	"github.com/ubports/ubuntu-push/blob"
 	"github.com/ubports/ubuntu-push/logger"
 	"github.com/ubports/ubuntu-push/protocol"
 	"github.com/ubports/ubuntu-push/server/broker"
@@ -38,6 +40,7 @@ import (
 
 const MaxRequestBodyBytes = 4 * 1024
 const JSONMediaType = "application/json"
+const NDJSONMediaType = "application/x-ndjson"
 const MaxUnicastPayload = 2 * 1024
 
 // APIError represents a API error (both internally and as JSON in a response).
@@ -58,10 +61,12 @@ const (
 	invalidRequest = "invalid-request"
 	unknownChannel = "unknown-channel"
 	unknownToken   = "unknown-token"
+	unknownUser    = "unknown-user"
 	unauthorized   = "unauthorized"
 	unavailable    = "unavailable"
 	internalError  = "internal"
 	tooManyPending = "too-many-pending"
+	unknownBlob    = "unknown-blob"
 )
 
 func (apiErr *APIError) Error() string {
@@ -94,6 +99,42 @@ var (
 		"Wrong content type, should be application/json",
 		nil,
 	}
+	ErrWrongStreamContentType = &APIError{
+		http.StatusUnsupportedMediaType,
+		invalidRequest,
+		"Wrong content type, should be application/x-ndjson",
+		nil,
+	}
+	ErrWrongProtoContentType = &APIError{
+		http.StatusUnsupportedMediaType,
+		invalidRequest,
+		"Wrong content type, should be application/x-protobuf",
+		nil,
+	}
+	ErrUnknownRPCMethod = &APIError{
+		http.StatusNotFound,
+		invalidRequest,
+		"Unknown RPC method",
+		nil,
+	}
+	ErrMalformedProtoMessage = &APIError{
+		http.StatusBadRequest,
+		invalidRequest,
+		"Malformed protobuf message",
+		nil,
+	}
+	ErrLineTooLarge = &APIError{
+		http.StatusRequestEntityTooLarge,
+		invalidRequest,
+		"Line too large",
+		nil,
+	}
+	ErrTooManyStreamLines = &APIError{
+		http.StatusRequestEntityTooLarge,
+		invalidRequest,
+		"Too many lines for one HTTP/1.x request, send them again from this line on",
+		nil,
+	}
 	ErrWrongRequestMethod = &APIError{
 		http.StatusMethodNotAllowed,
 		invalidRequest,
@@ -124,6 +165,12 @@ var (
 		"Missing id field",
 		nil,
 	}
+	ErrMissingTags = &APIError{
+		http.StatusBadRequest,
+		invalidRequest,
+		"Missing tags field",
+		nil,
+	}
 	ErrMissingData = &APIError{
 		http.StatusBadRequest,
 		invalidRequest,
@@ -148,6 +195,36 @@ var (
 		"Past expiration date",
 		nil,
 	}
+	ErrInvalidDeliverAfter = &APIError{
+		http.StatusBadRequest,
+		invalidRequest,
+		"Invalid delivery date",
+		nil,
+	}
+	ErrDeliverAfterExpiration = &APIError{
+		http.StatusBadRequest,
+		invalidRequest,
+		"Delivery date after expiration date",
+		nil,
+	}
+	ErrMsgIdOrReplaceTag = &APIError{
+		http.StatusBadRequest,
+		invalidRequest,
+		"Exactly one of msgid and replace_tag must be given",
+		nil,
+	}
+	ErrChannelAndAppId = &APIError{
+		http.StatusBadRequest,
+		invalidRequest,
+		"Only one of channel and appid can be given",
+		nil,
+	}
+	ErrInvalidAppId = &APIError{
+		http.StatusBadRequest,
+		invalidRequest,
+		"Invalid appid",
+		nil,
+	}
 	ErrUnknownChannel = &APIError{
 		http.StatusBadRequest,
 		unknownChannel,
@@ -160,6 +237,18 @@ var (
 		"Unknown token",
 		nil,
 	}
+	ErrUnknownUser = &APIError{
+		http.StatusBadRequest,
+		unknownUser,
+		"No devices registered for user",
+		nil,
+	}
+	ErrOnlyUserAndAppId = &APIError{
+		http.StatusBadRequest,
+		invalidRequest,
+		"Only userid and appid can address a user's devices",
+		nil,
+	}
 	ErrUnknown = &APIError{
 		http.StatusInternalServerError,
 		internalError,
@@ -178,6 +267,24 @@ var (
 		"Could not store notification",
 		nil,
 	}
+	ErrCouldNotCancelNotification = &APIError{
+		http.StatusServiceUnavailable,
+		unavailable,
+		"Could not cancel notification",
+		nil,
+	}
+	ErrCouldNotQueryStatus = &APIError{
+		http.StatusServiceUnavailable,
+		unavailable,
+		"Could not query status",
+		nil,
+	}
+	ErrCouldNotDismissNotification = &APIError{
+		http.StatusServiceUnavailable,
+		unavailable,
+		"Could not dismiss notification",
+		nil,
+	}
 	ErrCouldNotMakeToken = &APIError{
 		http.StatusServiceUnavailable,
 		unavailable,
@@ -208,6 +315,18 @@ var (
 		"Too many pending notifications for this application",
 		nil,
 	}
+	ErrUnknownTenant = &APIError{
+		http.StatusUnauthorized,
+		unauthorized,
+		"Unknown API key or host",
+		nil,
+	}
+	ErrUnknownBlob = &APIError{
+		http.StatusNotFound,
+		unknownBlob,
+		"Unknown or expired blob",
+		nil,
+	}
 )
 
 func apiErrorWithExtra(apiErr *APIError, extra interface{}) *APIError {
@@ -232,17 +351,52 @@ type Unicast struct {
 	AppId    string          `json:"appid"`
 	ExpireOn string          `json:"expire_on"`
 	Data     json.RawMessage `json:"data"`
+	// hold back delivery until then
+	DeliverAfter string `json:"deliver_after,omitempty"`
 	// clear all pending messages for appid
 	ClearPending bool `json:"clear_pending,omitempty"`
 	// replace pending messages with the same replace_tag
 	ReplaceTag string `json:"replace_tag,omitempty"`
 }
 
+// Cancel request JSON object, addressing still pending or already
+// delivered unicast notifications either by message id or by
+// replace_tag.
+type Cancel struct {
+	Token      string `json:"token"`
+	UserId     string `json:"userid"`   // not part of the official API
+	DeviceId   string `json:"deviceid"` // not part of the official API
+	AppId      string `json:"appid"`
+	MsgId      string `json:"msgid,omitempty"`
+	ReplaceTag string `json:"replace_tag,omitempty"`
+}
+
+// StatusQuery request JSON object, asking which unicast
+// notifications for an app are still pending.
+type StatusQuery struct {
+	Token    string `json:"token"`
+	UserId   string `json:"userid"`   // not part of the official API
+	DeviceId string `json:"deviceid"` // not part of the official API
+	AppId    string `json:"appid"`
+}
+
+// Dismissal request JSON object, for a device to report that the
+// user dealt with the notifications of an app with the given tags.
+type Dismissal struct {
+	DeviceId string   `json:"deviceid"`
+	AppId    string   `json:"appid"`
+	Tags     []string `json:"tags"`
+}
+
 // Broadcast request JSON object.
 type Broadcast struct {
-	Channel  string          `json:"channel"`
+	Channel string `json:"channel"`
+	// broadcast to the app-scoped channel of appid instead
+	AppId    string          `json:"appid,omitempty"`
 	ExpireOn string          `json:"expire_on"`
 	Data     json.RawMessage `json:"data"`
+	// hold back delivery until then
+	DeliverAfter string `json:"deliver_after,omitempty"`
 }
 
 // RespondError writes back a JSON error response for a APIError.
@@ -315,7 +469,42 @@ func checkCastCommon(data json.RawMessage, expireOn string) (time.Time, *APIErro
 	return expire, nil
 }
 
+// checkDeliverAfter parses an optional delivery date, which needs to
+// be before the expiration.
+func checkDeliverAfter(deliverAfter string, expire time.Time) (time.Time, *APIError) {
+	if deliverAfter == "" {
+		return zeroTime, nil
+	}
+	deliver, err := time.Parse(time.RFC3339, deliverAfter)
+	if err != nil {
+		return zeroTime, ErrInvalidDeliverAfter
+	}
+	if !deliver.Before(expire) {
+		return zeroTime, ErrDeliverAfterExpiration
+	}
+	return deliver, nil
+}
+
+// application ids as the client parses them, see the click package:
+// a click application id with optional version, or a legacy one
+// prefixed with _
+var rxClickAppId = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+_[a-zA-Z0-9+.-]+(?:_[0-9][a-zA-Z0-9.+:~-]*)?$`)
+var rxLegacyAppId = regexp.MustCompile(`^_[^./][^/]*$`)
+
+func validAppId(appId string) bool {
+	if strings.HasPrefix(appId, "_") {
+		return rxLegacyAppId.MatchString(appId)
+	}
+	return rxClickAppId.MatchString(appId)
+}
+
 func checkBroadcast(bcast *Broadcast) (time.Time, *APIError) {
+	if bcast.AppId != "" && bcast.Channel != "" {
+		return zeroTime, ErrChannelAndAppId
+	}
+	if bcast.AppId != "" && !validAppId(bcast.AppId) {
+		return zeroTime, ErrInvalidAppId
+	}
 	return checkCastCommon(bcast.Data, bcast.ExpireOn)
 }
 
@@ -329,11 +518,103 @@ type StoreAccess interface {
 	GetMaxNotificationsPerApplication() int
 }
 
+// LargePayloadAccess is optionally implemented by a StoreAccess to
+// accept unicast payloads larger than MaxUnicastPayload; those are
+// kept apart in a blob store and delivered as a reference to fetch
+// them from under BlobPathPrefix.
+type LargePayloadAccess interface {
+	// GetMaxPayloadSize gets the largest payload accepted for appId.
+	GetMaxPayloadSize(appId string) int
+	// GetLargestPayloadSize gets the largest payload accepted for
+	// any application.
+	GetLargestPayloadSize() int
+	// GetBlobStore gets the store keeping the large payloads.
+	GetBlobStore() store.BlobStore
+}
+
+// UserAuthenticator is optionally implemented by a StoreAccess to
+// tell which user the credentials a device registers with belong to,
+// so that the device can be notified through /notify/user.
+type UserAuthenticator interface {
+	// AuthenticateUser returns the id of the user the Authorization
+	// header value authorization carries the credentials of. It
+	// fails with store.ErrUnauthorized if they are not valid.
+	AuthenticateUser(authorization string) (userId string, err error)
+	// AuthenticationRequired says whether devices can only
+	// register with credentials AuthenticateUser accepts; if not,
+	// those without are registered on behalf of no user.
+	AuthenticationRequired() bool
+}
+
 // context holds the interfaces to delegate to serving requests
 type context struct {
-	storage StoreAccess
-	broker  broker.BrokerSending
-	logger  logger.Logger
+	storage   StoreAccess
+	broker    broker.BrokerSending
+	logger    logger.Logger
+	scheduler *broker.Scheduler
+	// the Authorization header of the request being served
+	authorization string
+}
+
+// authenticatedUser returns the user the request being served carries
+// the credentials of, or "" if there is no way to check them or, when
+// authentication isn't required, it carries no valid ones.
+func (ctx *context) authenticatedUser() (string, *APIError) {
+	ua, ok := ctx.storage.(UserAuthenticator)
+	if !ok {
+		return "", nil
+	}
+	if ctx.authorization == "" {
+		if ua.AuthenticationRequired() {
+			ctx.logger.Debugf("no user credentials")
+			return "", ErrUnauthorized
+		}
+		return "", nil
+	}
+	userId, err := ua.AuthenticateUser(ctx.authorization)
+	switch err {
+	case nil:
+		return userId, nil
+	case store.ErrUnauthorized:
+		if !ua.AuthenticationRequired() {
+			// maybe meant for someone else; carry on without
+			ctx.logger.Debugf("ignoring unrecognised user credentials")
+			return "", nil
+		}
+		ctx.logger.Debugf("could not authenticate user")
+		return "", ErrUnauthorized
+	default:
+		ctx.logger.Errorf("could not authenticate user: %v", err)
+		return "", ErrUnknown
+	}
+}
+
+func (ctx *context) largePayloads() LargePayloadAccess {
+	lpa, _ := ctx.storage.(LargePayloadAccess)
+	return lpa
+}
+
+// maxPayloadSize returns the largest unicast payload accepted for appId.
+func (ctx *context) maxPayloadSize(appId string) int {
+	if lpa := ctx.largePayloads(); lpa != nil && lpa.GetMaxPayloadSize(appId) > MaxUnicastPayload {
+		return lpa.GetMaxPayloadSize(appId)
+	}
+	return MaxUnicastPayload
+}
+
+// largestPayloadSize returns the largest unicast payload accepted for
+// any application.
+func (ctx *context) largestPayloadSize() int {
+	if lpa := ctx.largePayloads(); lpa != nil && lpa.GetLargestPayloadSize() > MaxUnicastPayload {
+		return lpa.GetLargestPayloadSize()
+	}
+	return MaxUnicastPayload
+}
+
+// maxBodySize returns how large request bodies can be, leaving room
+// for the largest payload accepted.
+func (ctx *context) maxBodySize() int64 {
+	return MaxRequestBodyBytes + int64(ctx.largestPayloadSize()-MaxUnicastPayload)
 }
 
 func (ctx *context) getStore(w http.ResponseWriter, request *http.Request) (store.PendingStore, *APIError) {
@@ -357,8 +638,31 @@ type JSONPostHandler struct {
 	doHandle       func(ctx *context, sto store.PendingStore, parsedBodyObj interface{}) (map[string]interface{}, *APIError)
 }
 
-func (h *JSONPostHandler) prepare(w http.ResponseWriter, request *http.Request) (interface{}, store.PendingStore, *APIError) {
-	body, apiErr := ReadBody(request, MaxRequestBodyBytes)
+// RequestIdHeader is the header carrying the id correlating the log
+// entries about a request; one is generated if the client sent none.
+const RequestIdHeader = "X-Request-Id"
+
+var generateRequestId = uuid.New
+
+// forRequest returns the context for serving request, logging with
+// its request id, which is also sent back.
+func (base *context) forRequest(w http.ResponseWriter, request *http.Request) *context {
+	reqId := request.Header.Get(RequestIdHeader)
+	if reqId == "" {
+		reqId = generateRequestId()
+	}
+	w.Header().Set(RequestIdHeader, reqId)
+	var ctx context
+	if base != nil {
+		ctx = *base
+	}
+	ctx.logger = logger.With(ctx.logger, logger.Fields{logger.FieldRequest: reqId})
+	ctx.authorization = request.Header.Get("Authorization")
+	return &ctx
+}
+
+func (h *JSONPostHandler) prepare(ctx *context, w http.ResponseWriter, request *http.Request) (interface{}, store.PendingStore, *APIError) {
+	body, apiErr := ReadBody(request, ctx.maxBodySize())
 	if apiErr != nil {
 		return nil, nil, apiErr
 	}
@@ -369,7 +673,7 @@ func (h *JSONPostHandler) prepare(w http.ResponseWriter, request *http.Request)
 		return nil, nil, ErrMalformedJSONObject
 	}
 
-	sto, apiErr := h.getStore(w, request)
+	sto, apiErr := ctx.getStore(w, request)
 	if apiErr != nil {
 		return nil, nil, apiErr
 	}
@@ -384,13 +688,14 @@ func (h *JSONPostHandler) ServeHTTP(writer http.ResponseWriter, request *http.Re
 		}
 	}()
 
-	parsedBodyObj, sto, apiErr := h.prepare(writer, request)
+	ctx := h.forRequest(writer, request)
+	parsedBodyObj, sto, apiErr := h.prepare(ctx, writer, request)
 	if apiErr != nil {
 		return
 	}
 	defer sto.Close()
 
-	res, apiErr := h.doHandle(h.context, sto, parsedBodyObj)
+	res, apiErr := h.doHandle(ctx, sto, parsedBodyObj)
 	if apiErr != nil {
 		return
 	}
@@ -414,34 +719,53 @@ func doBroadcast(ctx *context, sto store.PendingStore, parsedBodyObj interface{}
 	if apiErr != nil {
 		return nil, apiErr
 	}
-	chanId, err := sto.GetInternalChannelId(bcast.Channel)
-	if err != nil {
-		switch err {
-		case store.ErrUnknownChannel:
-			return nil, ErrUnknownChannel
-		default:
-			return nil, ErrUnknown
+	deliverAfter, apiErr := checkDeliverAfter(bcast.DeliverAfter, expire)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	var chanId store.InternalChannelId
+	var err error
+	if bcast.AppId != "" {
+		chanId = store.AppBroadcastInternalChannelId(bcast.AppId)
+	} else {
+		chanId, err = sto.GetInternalChannelId(bcast.Channel)
+		if err != nil {
+			switch err {
+			case store.ErrUnknownChannel:
+				return nil, ErrUnknownChannel
+			default:
+				return nil, ErrUnknown
+			}
 		}
 	}
-	err = sto.AppendToChannel(chanId, bcast.Data, expire)
+	meta := store.Metadata{
+		Expiration:   expire,
+		DeliverAfter: deliverAfter,
+	}
+	err = sto.AppendToBroadcastChannel(chanId, bcast.AppId, bcast.Data, meta)
 	if err != nil {
 		ctx.logger.Errorf("could not store notification: %v", err)
 		return nil, ErrCouldNotStoreNotification
 	}
 
-	ctx.broker.Broadcast(chanId)
-	ctx.logger.Infof("broadcast: %v %v %v", chanId, bcast.Data, expire)
+	if deliverAfter.IsZero() {
+		ctx.broker.Broadcast(chanId)
+	} else {
+		ctx.scheduler.BroadcastAt(deliverAfter, chanId)
+	}
+	// payloads are opaque and possibly sealed, don't log them
+	ctx.logger.Infof("broadcast: %v %v %d bytes %v", chanId, bcast.AppId, len(bcast.Data), expire)
 	return nil, nil
 }
 
-func checkUnicast(ucast *Unicast) (time.Time, *APIError) {
+func checkUnicast(ucast *Unicast, maxPayload int) (time.Time, *APIError) {
 	if ucast.AppId == "" {
 		return zeroTime, ErrMissingIdField
 	}
 	if ucast.Token == "" && (ucast.UserId == "" || ucast.DeviceId == "") {
 		return zeroTime, ErrMissingIdField
 	}
-	if len(ucast.Data) > MaxUnicastPayload {
+	if len(ucast.Data) > maxPayload {
 		return zeroTime, ErrDataTooLarge
 	}
 	return checkCastCommon(ucast.Data, ucast.ExpireOn)
@@ -452,97 +776,476 @@ var generateMsgId = func() string {
 	return base64.StdEncoding.EncodeToString(uuid.NewUUID())
 }
 
+// resolveUnicastChannel finds the app id and unicast channel addressed
+// by a token or else by a user id, device id pair for appId.
+func resolveUnicastChannel(ctx *context, sto store.PendingStore, what, token, appId, userId, deviceId string) (string, store.InternalChannelId, *APIError) {
+	if token != "" {
+		//Extract app Id from token rather than using the supplied one. This supports multiple apps using the same push GW
+		decoded, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			ctx.logger.Errorf("could not decode token:v", err)
+			return "", "", ErrUnknownToken
+		}
+		appId = strings.Split(string(decoded), ":")[0]
+		ctx.logger.Infof("App id extracted from token: %v", appId)
+	}
+	chanId, err := sto.GetInternalChannelIdFromToken(token, appId, userId, deviceId)
+	if err != nil {
+		switch err {
+		case store.ErrUnknownToken:
+			ctx.logger.Debugf("%s: %v %v unknown", what, appId, token)
+			return "", "", ErrUnknownToken
+		case store.ErrUnauthorized:
+			ctx.logger.Debugf("%s: %v %v unauthorized", what, appId, token)
+			return "", "", ErrUnauthorized
+		default:
+			ctx.logger.Errorf("could not resolve token: %v", err)
+			return "", "", ErrCouldNotResolveToken
+		}
+	}
+	ctx.logger.Infof("%s: %v %v -> %v", what, appId, token, chanId)
+	return appId, chanId, nil
+}
+
 func doUnicast(ctx *context, sto store.PendingStore, parsedBodyObj interface{}) (map[string]interface{}, *APIError) {
 	ucast := parsedBodyObj.(*Unicast)
-	expire, apiErr := checkUnicast(ucast)
+	expire, apiErr := checkUnicast(ucast, ctx.largestPayloadSize())
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	deliverAfter, apiErr := checkDeliverAfter(ucast.DeliverAfter, expire)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	appId, chanId, apiErr := resolveUnicastChannel(ctx, sto, "notify", ucast.Token, ucast.AppId, ucast.UserId, ucast.DeviceId)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if len(ucast.Data) > ctx.maxPayloadSize(appId) {
+		return nil, ErrDataTooLarge
+	}
+	msgId, apiErr := unicastToChannel(ctx, sto, ucast, appId, chanId, expire, deliverAfter)
 	if apiErr != nil {
 		return nil, apiErr
 	}
-	//Extract app Id from token rather than using the supplied one. This supports multiple apps using the same push GW
-	decoded, err := base64.StdEncoding.DecodeString(ucast.Token)
+	return map[string]interface{}{"msgid": msgId}, nil
+}
+
+// BlobPathPrefix is under where the payloads kept apart are served.
+const BlobPathPrefix = "/blob/"
+
+// putLargePayload returns data as is if it fits inline, and
+// otherwise keeps it apart in the blob store until expire, returning
+// the reference to send instead, of KindBlob, and the id of the blob.
+func putLargePayload(ctx *context, data json.RawMessage, expire time.Time) (json.RawMessage, string, string, *APIError) {
+	if len(data) <= MaxUnicastPayload {
+		return data, "", "", nil
+	}
+	blobId, err := ctx.largePayloads().GetBlobStore().PutBlob(data, expire)
 	if err != nil {
-		ctx.logger.Errorf("could not decode token:v", err)
-		return nil, ErrUnknownToken
+		ctx.logger.Errorf("could not store blob: %v", err)
+		return nil, "", "", ErrCouldNotStoreNotification
 	}
-	token := string(decoded)
-	appId := strings.Split(token, ":")[0]
-	ctx.logger.Infof("App id extracted from token: %v", appId)
-	chanId, err := sto.GetInternalChannelIdFromToken(ucast.Token, appId, ucast.UserId, ucast.DeviceId)
+	// relative to the API root
+	ref, err := blob.MakeRef(BlobPathPrefix[1:]+blobId, data)
 	if err != nil {
-		switch err {
-		case store.ErrUnknownToken:
-			ctx.logger.Debugf("notify: %v %v unknown", appId, ucast.Token)
-			return nil, ErrUnknownToken
-		case store.ErrUnauthorized:
-			ctx.logger.Debugf("notify: %v %v unauthorized", appId, ucast.Token)
-			return nil, ErrUnauthorized
-		default:
-			ctx.logger.Errorf("could not resolve token: %v", err)
-			return nil, ErrCouldNotResolveToken
+		panic(fmt.Errorf("couldn't marshal our own blob reference: %v", err))
+	}
+	return ref, protocol.KindBlob, blobId, nil
+}
+
+// dropBlob drops the payload kept apart with blobId.
+func (ctx *context) dropBlob(blobId string) {
+	err := ctx.largePayloads().GetBlobStore().DropBlob(blobId)
+	if err != nil {
+		ctx.logger.Errorf("could not drop blob: %v", err)
+	}
+}
+
+// dropBlobs drops the payloads of the notifications that were kept
+// apart, once the notifications are gone.
+func (ctx *context) dropBlobs(notifs []protocol.Notification) {
+	for i := range notifs {
+		ref := blob.ExtractRef(&notifs[i])
+		if ref == nil || ctx.largePayloads() == nil {
+			continue
 		}
+		ctx.dropBlob(strings.TrimPrefix(ref.URL, BlobPathPrefix[1:]))
 	}
-	ctx.logger.Infof("notify: %v %v -> %v", appId, ucast.Token, chanId)
+}
 
+// unicastToChannel stores the unicast notification for appId in the
+// channel chanId, making room as asked, and gets it delivered.
+func unicastToChannel(ctx *context, sto store.PendingStore, ucast *Unicast, appId string, chanId store.InternalChannelId, expire, deliverAfter time.Time) (string, *APIError) {
 	_, notifs, meta, err := sto.GetChannelUnfiltered(chanId)
 	if err != nil {
 		ctx.logger.Errorf("could not peek at notifications: %v", err)
-		return nil, ErrCouldNotStoreNotification
+		return "", ErrCouldNotStoreNotification
 	}
 	expired := 0
 	replaceable := 0
 	forApp := 0
 	replaceTag := ucast.ReplaceTag
 	scrubCriteria := []string(nil)
+	// what scrubbing will drop
+	var scrubbed, replaced, ofApp []protocol.Notification
 	now := time.Now()
 	var last *protocol.Notification
 	for i, notif := range notifs {
 		if meta[i].Before(now) {
 			expired++
+			scrubbed = append(scrubbed, notif)
 			continue
 		}
 		if notif.AppId == appId {
+			ofApp = append(ofApp, notif)
 			if replaceTag != "" && replaceTag == meta[i].ReplaceTag {
 				// this we will scrub
 				replaceable++
+				replaced = append(replaced, notif)
+				continue
+			}
+			if notif.Kind == protocol.KindClear {
+				// ours, not the app's
 				continue
 			}
 			forApp++
+			last = &notifs[i]
 		}
-		last = &notif
 	}
 	if ucast.ClearPending {
 		scrubCriteria = []string{appId}
+		scrubbed = append(scrubbed, ofApp...)
 	} else if forApp >= ctx.storage.GetMaxNotificationsPerApplication() {
 		ctx.logger.Debugf("notify: %v %v too many pending", appId, chanId)
-		return nil, apiErrorWithExtra(ErrTooManyPendingNotifications,
+		return "", apiErrorWithExtra(ErrTooManyPendingNotifications,
 			&last.Payload)
 	} else if replaceable > 0 {
 		scrubCriteria = []string{appId, replaceTag}
+		scrubbed = append(scrubbed, replaced...)
 	}
 	if expired > 0 || scrubCriteria != nil {
 		err := sto.Scrub(chanId, scrubCriteria...)
 		if err != nil {
 			ctx.logger.Errorf("could not scrub channel: %v", err)
-			return nil, ErrCouldNotStoreNotification
+			return "", ErrCouldNotStoreNotification
 		}
+		ctx.dropBlobs(scrubbed)
+	}
+
+	// only now that the channel takes it
+	data, kind, blobId, apiErr := putLargePayload(ctx, ucast.Data, expire)
+	if apiErr != nil {
+		return "", apiErr
 	}
 
 	msgId := generateMsgId()
 
 	meta1 := store.Metadata{
-		Expiration: expire,
-		ReplaceTag: ucast.ReplaceTag,
+		Expiration:   expire,
+		ReplaceTag:   ucast.ReplaceTag,
+		DeliverAfter: deliverAfter,
+		Kind:         kind,
 	}
-	err = sto.AppendToUnicastChannel(chanId, appId, ucast.Data, msgId, meta1)
+	err = sto.AppendToUnicastChannel(chanId, appId, data, msgId, meta1)
 	if err != nil {
 		ctx.logger.Errorf("could not store notification: %v", err)
-		return nil, ErrCouldNotStoreNotification
+		if blobId != "" {
+			ctx.dropBlob(blobId)
+		}
+		return "", ErrCouldNotStoreNotification
 	}
 
-	go ctx.broker.Unicast(chanId)
+	if deliverAfter.IsZero() {
+		go ctx.broker.Unicast(chanId)
+	} else {
+		ctx.scheduler.UnicastAt(deliverAfter, chanId)
+	}
 
-	ctx.logger.Debugf("notify: ok %v %v id:%v clear:%v replace:%v expired:%v", appId, chanId, msgId, ucast.ClearPending, replaceable, expired)
-	return nil, nil
+	msgLog := logger.With(ctx.logger, logger.Fields{
+		logger.FieldMsgId: msgId,
+		logger.FieldAppId: appId,
+	})
+	msgLog.Debugf("notify: ok %v %v id:%v clear:%v replace:%v expired:%v deliver-after:%v", appId, chanId, msgId, ucast.ClearPending, replaceable, expired, ucast.DeliverAfter)
+	return msgId, nil
+}
+
+func checkUserUnicast(ucast *Unicast, maxPayload int) (time.Time, *APIError) {
+	if ucast.AppId == "" || ucast.UserId == "" {
+		return zeroTime, ErrMissingIdField
+	}
+	if ucast.Token != "" || ucast.DeviceId != "" {
+		return zeroTime, ErrOnlyUserAndAppId
+	}
+	if len(ucast.Data) > maxPayload {
+		return zeroTime, ErrDataTooLarge
+	}
+	return checkCastCommon(ucast.Data, ucast.ExpireOn)
+}
+
+// doUserUnicast sends the notification to each of the devices the
+// user registered appId on, reporting how it went for each.
+func doUserUnicast(ctx *context, sto store.PendingStore, parsedBodyObj interface{}) (map[string]interface{}, *APIError) {
+	ucast := parsedBodyObj.(*Unicast)
+	expire, apiErr := checkUserUnicast(ucast, ctx.maxPayloadSize(ucast.AppId))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	deliverAfter, apiErr := checkDeliverAfter(ucast.DeliverAfter, expire)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	chans, err := sto.GetUserChannels(ucast.UserId, ucast.AppId)
+	if err != nil {
+		ctx.logger.Errorf("could not get user devices: %v", err)
+		return nil, ErrCouldNotResolveToken
+	}
+	if len(chans) == 0 {
+		ctx.logger.Debugf("notify user: %v %v no devices", ucast.AppId, ucast.UserId)
+		return nil, ErrUnknownUser
+	}
+	devices := make(map[string]interface{}, len(chans))
+	for deviceId, chanId := range chans {
+		msgId, apiErr := unicastToChannel(ctx, sto, ucast, ucast.AppId, chanId, expire, deliverAfter)
+		if apiErr != nil {
+			devices[deviceId] = apiErr
+		} else {
+			devices[deviceId] = map[string]interface{}{"msgid": msgId}
+		}
+	}
+	ctx.logger.Infof("notify user: %v %v %d devices", ucast.AppId, ucast.UserId, len(chans))
+	return map[string]interface{}{"devices": devices}, nil
+}
+
+// clearInstructionLifetime is for how long an instruction to clear
+// already delivered notifications waits for the device.
+var clearInstructionLifetime = 7 * 24 * time.Hour
+
+func checkCancel(cancel *Cancel) *APIError {
+	if cancel.AppId == "" {
+		return ErrMissingIdField
+	}
+	if cancel.Token == "" && (cancel.UserId == "" || cancel.DeviceId == "") {
+		return ErrMissingIdField
+	}
+	if (cancel.MsgId == "") == (cancel.ReplaceTag == "") {
+		return ErrMsgIdOrReplaceTag
+	}
+	return nil
+}
+
+func doCancel(ctx *context, sto store.PendingStore, parsedBodyObj interface{}) (map[string]interface{}, *APIError) {
+	cancel := parsedBodyObj.(*Cancel)
+	apiErr := checkCancel(cancel)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	appId, chanId, apiErr := resolveUnicastChannel(ctx, sto, "cancel", cancel.Token, cancel.AppId, cancel.UserId, cancel.DeviceId)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	_, notifs, meta, err := sto.GetChannelUnfiltered(chanId)
+	if err != nil {
+		ctx.logger.Errorf("could not peek at notifications: %v", err)
+		return nil, ErrCouldNotCancelNotification
+	}
+	var pending []protocol.Notification
+	for i, notif := range notifs {
+		if notif.AppId != appId {
+			continue
+		}
+		if cancel.MsgId != "" && notif.MsgId == cancel.MsgId {
+			pending = append(pending, notif)
+		} else if cancel.ReplaceTag != "" && meta[i].ReplaceTag == cancel.ReplaceTag {
+			pending = append(pending, notif)
+		}
+	}
+	if len(pending) > 0 {
+		if cancel.MsgId != "" {
+			err = sto.DropByMsgId(chanId, pending)
+		} else {
+			err = sto.Scrub(chanId, appId, cancel.ReplaceTag)
+		}
+		if err != nil {
+			ctx.logger.Errorf("could not drop notifications: %v", err)
+			return nil, ErrCouldNotCancelNotification
+		}
+		ctx.dropBlobs(pending)
+	}
+
+	// a message found pending was never delivered, while with a tag
+	// earlier notifications could have been delivered regardless;
+	// otherwise the message might have been delivered if it was sent
+	// at all
+	cleared := cancel.ReplaceTag != ""
+	if cancel.MsgId != "" && len(pending) == 0 {
+		cleared, err = sto.KnownMsgId(chanId, appId, cancel.MsgId)
+		if err != nil {
+			ctx.logger.Errorf("could not look up message id: %v", err)
+			return nil, ErrCouldNotCancelNotification
+		}
+	}
+	if cleared {
+		instr := &protocol.ClearInstruction{
+			MsgId: cancel.MsgId,
+			Tag:   cancel.ReplaceTag,
+		}
+		meta1 := store.Metadata{
+			Expiration: time.Now().Add(clearInstructionLifetime),
+			Kind:       protocol.KindClear,
+		}
+		err = sto.AppendToUnicastChannel(chanId, appId, protocol.ClearPayload(instr), generateMsgId(), meta1)
+		if err != nil {
+			ctx.logger.Errorf("could not store clear instruction: %v", err)
+			return nil, ErrCouldNotCancelNotification
+		}
+		go ctx.broker.Unicast(chanId)
+	}
+
+	ctx.logger.Debugf("cancel: ok %v %v id:%v tag:%v dropped:%v cleared:%v", appId, chanId, cancel.MsgId, cancel.ReplaceTag, len(pending), cleared)
+	return map[string]interface{}{
+		"dropped": len(pending),
+		"cleared": cleared,
+	}, nil
+}
+
+func checkDismissal(dismissal *Dismissal) *APIError {
+	if dismissal.DeviceId == "" || dismissal.AppId == "" {
+		return ErrMissingIdField
+	}
+	if len(dismissal.Tags) == 0 {
+		return ErrMissingTags
+	}
+	for _, tag := range dismissal.Tags {
+		if tag == "" {
+			return ErrMissingTags
+		}
+	}
+	return nil
+}
+
+// doDismiss instructs the other devices of the users of the reporting
+// device to clear the notifications it dismissed.
+func doDismiss(ctx *context, sto store.PendingStore, parsedBodyObj interface{}) (map[string]interface{}, *APIError) {
+	dismissal := parsedBodyObj.(*Dismissal)
+	apiErr := checkDismissal(dismissal)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	// the user comes only from credentials the server can check
+	userId, apiErr := ctx.authenticatedUser()
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if userId == "" {
+		// no other devices we know of
+		return map[string]interface{}{"devices": 0}, nil
+	}
+	chans, err := sto.GetUserChannels(userId, dismissal.AppId)
+	if err != nil {
+		ctx.logger.Errorf("could not get user devices: %v", err)
+		return nil, ErrCouldNotDismissNotification
+	}
+	if _, ok := chans[dismissal.DeviceId]; !ok {
+		ctx.logger.Debugf("dismiss: %v is not a device of %v", dismissal.DeviceId, userId)
+		return nil, ErrUnauthorized
+	}
+	peers := make(map[string]store.InternalChannelId)
+	for deviceId, chanId := range chans {
+		if deviceId != dismissal.DeviceId {
+			peers[deviceId] = chanId
+		}
+	}
+	meta1 := store.Metadata{
+		Expiration: time.Now().Add(clearInstructionLifetime),
+		Kind:       protocol.KindClear,
+	}
+	for _, chanId := range peers {
+		for _, tag := range dismissal.Tags {
+			instr := &protocol.ClearInstruction{Tag: tag}
+			err = sto.AppendToUnicastChannel(chanId, dismissal.AppId, protocol.ClearPayload(instr), generateMsgId(), meta1)
+			if err != nil {
+				ctx.logger.Errorf("could not store clear instruction: %v", err)
+				return nil, ErrCouldNotDismissNotification
+			}
+		}
+		go ctx.broker.Unicast(chanId)
+	}
+	ctx.logger.Debugf("dismiss: ok %v %v tags:%v devices:%d", dismissal.AppId, dismissal.DeviceId, dismissal.Tags, len(peers))
+	return map[string]interface{}{"devices": len(peers)}, nil
+}
+
+func checkStatusQuery(query *StatusQuery) *APIError {
+	if query.AppId == "" {
+		return ErrMissingIdField
+	}
+	if query.Token == "" && (query.UserId == "" || query.DeviceId == "") {
+		return ErrMissingIdField
+	}
+	return nil
+}
+
+func doStatus(ctx *context, sto store.PendingStore, parsedBodyObj interface{}) (map[string]interface{}, *APIError) {
+	query := parsedBodyObj.(*StatusQuery)
+	apiErr := checkStatusQuery(query)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	appId, chanId, apiErr := resolveUnicastChannel(ctx, sto, "status", query.Token, query.AppId, query.UserId, query.DeviceId)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	_, notifs, meta, err := sto.GetChannelUnfiltered(chanId)
+	if err != nil {
+		ctx.logger.Errorf("could not peek at notifications: %v", err)
+		return nil, ErrCouldNotQueryStatus
+	}
+	now := time.Now()
+	pending := []string{}
+	for i, notif := range notifs {
+		if notif.AppId != appId || meta[i].Before(now) {
+			continue
+		}
+		if notif.Kind == protocol.KindClear {
+			// ours, not the app's
+			continue
+		}
+		pending = append(pending, notif.MsgId)
+	}
+	return map[string]interface{}{"pending": pending}, nil
+}
+
+// blobHandler serves the payloads kept apart, for the clients to fetch
+// them by reference.
+func blobHandler(ctx *context) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := ctx.forRequest(writer, request)
+		if request.Method != "GET" {
+			RespondError(writer, ErrWrongRequestMethodGET)
+			return
+		}
+		lpa := ctx.largePayloads()
+		if lpa == nil {
+			RespondError(writer, ErrUnknownBlob)
+			return
+		}
+		blobId := strings.TrimPrefix(request.URL.Path, BlobPathPrefix)
+		data, err := lpa.GetBlobStore().GetBlob(blobId)
+		switch err {
+		case nil:
+		case store.ErrUnknownBlob:
+			ctx.logger.Debugf("blob: %v unknown", blobId)
+			RespondError(writer, ErrUnknownBlob)
+			return
+		default:
+			ctx.logger.Errorf("could not get blob: %v", err)
+			RespondError(writer, ErrStoreUnavailable)
+			return
+		}
+		writer.Header().Set("Content-Type", JSONMediaType)
+		writer.Write(data)
+	})
 }
 
 func checkRegister(reg *Registration) *APIError {
@@ -558,11 +1261,23 @@ func doRegister(ctx *context, sto store.PendingStore, parsedBodyObj interface{})
 	if apiErr != nil {
 		return nil, apiErr
 	}
+	// the user comes only from credentials the server can check
+	userId, apiErr := ctx.authenticatedUser()
+	if apiErr != nil {
+		return nil, apiErr
+	}
 	token, err := sto.Register(reg.DeviceId, reg.AppId)
 	if err != nil {
 		ctx.logger.Errorf("could not make a token: %v", err)
 		return nil, ErrCouldNotMakeToken
 	}
+	if userId != "" {
+		err = sto.AddUserDevice(userId, reg.DeviceId, reg.AppId)
+		if err != nil {
+			ctx.logger.Errorf("could not add device to user: %v", err)
+			return nil, ErrCouldNotMakeToken
+		}
+	}
 	return map[string]interface{}{"token": token}, nil
 }
 
@@ -580,33 +1295,214 @@ func doUnregister(ctx *context, sto store.PendingStore, parsedBodyObj interface{
 	return nil, nil
 }
 
-// MakeHandlersMux makes a handler that dispatches for the various API endpoints.
-func MakeHandlersMux(storage StoreAccess, broker broker.BrokerSending, logger logger.Logger) *http.ServeMux {
-	ctx := &context{
-		storage: storage,
-		broker:  broker,
-		logger:  logger,
+// endpoint describes one of the API endpoints, both for serving it
+// and for the OpenAPI document.
+type endpoint struct {
+	path    string
+	summary string
+	// stream endpoints take and answer newline-delimited JSON
+	stream         bool
+	parsingBodyObj func() interface{}
+	doHandle       func(ctx *context, sto store.PendingStore, parsedBodyObj interface{}) (map[string]interface{}, *APIError)
+	// reply is of the type of successful responses
+	reply interface{}
+	// errors are the errors particular to the endpoint
+	errors []*APIError
+}
+
+func (e *endpoint) handler(ctx *context) http.Handler {
+	if e.stream {
+		return &StreamHandler{ctx, e.parsingBodyObj, e.doHandle}
 	}
-	mux := http.NewServeMux()
-	mux.Handle("/broadcast", &JSONPostHandler{
-		context:        ctx,
+	return &JSONPostHandler{ctx, e.parsingBodyObj, e.doHandle}
+}
+
+// the errors any JSON POST or stream endpoint can answer; the store
+// for the request, or the tenants in front, turn away unknown tenants
+var (
+	commonErrors = []*APIError{
+		ErrWrongRequestMethod,
+		ErrNoContentLengthProvided,
+		ErrRequestBodyEmpty,
+		ErrRequestBodyTooLarge,
+		ErrWrongContentType,
+		ErrCouldNotReadBody,
+		ErrMalformedJSONObject,
+		ErrUnknownTenant,
+		ErrStoreUnavailable,
+		ErrUnknown,
+	}
+	commonStreamErrors = []*APIError{
+		ErrWrongRequestMethod,
+		ErrWrongStreamContentType,
+		ErrUnknownTenant,
+		ErrStoreUnavailable,
+		ErrUnknown,
+	}
+)
+
+var endpoints = []*endpoint{
+	{
+		path:           "/broadcast",
+		summary:        "Broadcast a notification to a channel",
 		parsingBodyObj: func() interface{} { return &Broadcast{} },
 		doHandle:       doBroadcast,
-	})
-	mux.Handle("/notify", &JSONPostHandler{
-		context:        ctx,
+		reply:          &okReply{},
+		errors: []*APIError{
+			ErrChannelAndAppId,
+			ErrInvalidAppId,
+			ErrMissingData,
+			ErrInvalidExpiration,
+			ErrPastExpiration,
+			ErrInvalidDeliverAfter,
+			ErrDeliverAfterExpiration,
+			ErrUnknownChannel,
+			ErrCouldNotStoreNotification,
+		},
+	},
+	{
+		path:           "/notify",
+		summary:        "Send a notification to a device",
 		parsingBodyObj: func() interface{} { return &Unicast{} },
 		doHandle:       doUnicast,
-	})
-	mux.Handle("/register", &JSONPostHandler{
-		context:        ctx,
+		reply:          &unicastReply{},
+		errors: []*APIError{
+			ErrMissingIdField,
+			ErrDataTooLarge,
+			ErrMissingData,
+			ErrInvalidExpiration,
+			ErrPastExpiration,
+			ErrInvalidDeliverAfter,
+			ErrDeliverAfterExpiration,
+			ErrUnknownToken,
+			ErrUnauthorized,
+			ErrCouldNotResolveToken,
+			ErrTooManyPendingNotifications,
+			ErrCouldNotStoreNotification,
+		},
+	},
+	{
+		path:           "/notify/user",
+		summary:        "Send a notification to all the devices of a user",
+		parsingBodyObj: func() interface{} { return &Unicast{} },
+		doHandle:       doUserUnicast,
+		reply:          &userUnicastReply{},
+		errors: []*APIError{
+			ErrMissingIdField,
+			ErrOnlyUserAndAppId,
+			ErrDataTooLarge,
+			ErrMissingData,
+			ErrInvalidExpiration,
+			ErrPastExpiration,
+			ErrInvalidDeliverAfter,
+			ErrDeliverAfterExpiration,
+			ErrCouldNotResolveToken,
+			ErrUnknownUser,
+			ErrCouldNotStoreNotification,
+		},
+	},
+	{
+		path:           "/notify/stream",
+		summary:        "Send notifications to devices, one per line",
+		stream:         true,
+		parsingBodyObj: func() interface{} { return &Unicast{} },
+		doHandle:       doUnicast,
+		reply:          &streamResult{},
+	},
+	{
+		path:           "/notify/status",
+		summary:        "List the notifications still pending for a device",
+		parsingBodyObj: func() interface{} { return &StatusQuery{} },
+		doHandle:       doStatus,
+		reply:          &statusReply{},
+		errors: []*APIError{
+			ErrMissingIdField,
+			ErrUnknownToken,
+			ErrUnauthorized,
+			ErrCouldNotResolveToken,
+			ErrCouldNotQueryStatus,
+		},
+	},
+	{
+		path:           "/notify/cancel",
+		summary:        "Take back notifications sent to a device",
+		parsingBodyObj: func() interface{} { return &Cancel{} },
+		doHandle:       doCancel,
+		reply:          &cancelReply{},
+		errors: []*APIError{
+			ErrMissingIdField,
+			ErrMsgIdOrReplaceTag,
+			ErrUnknownToken,
+			ErrUnauthorized,
+			ErrCouldNotResolveToken,
+			ErrCouldNotCancelNotification,
+		},
+	},
+	{
+		path:           "/dismiss",
+		summary:        "Report notifications dismissed on a device",
+		parsingBodyObj: func() interface{} { return &Dismissal{} },
+		doHandle:       doDismiss,
+		reply:          &dismissReply{},
+		errors: []*APIError{
+			ErrMissingIdField,
+			ErrMissingTags,
+			ErrUnauthorized,
+			ErrCouldNotDismissNotification,
+		},
+	},
+	{
+		path:           "/register",
+		summary:        "Register an app on a device, getting its token",
 		parsingBodyObj: func() interface{} { return &Registration{} },
 		doHandle:       doRegister,
-	})
-	mux.Handle("/unregister", &JSONPostHandler{
-		context:        ctx,
+		reply:          &registerReply{},
+		errors: []*APIError{
+			ErrMissingIdField,
+			ErrUnauthorized,
+			ErrCouldNotMakeToken,
+			ErrUnknown,
+		},
+	},
+	{
+		path:           "/unregister",
+		summary:        "Unregister an app from a device",
 		parsingBodyObj: func() interface{} { return &Registration{} },
 		doHandle:       doUnregister,
-	})
+		reply:          &okReply{},
+		errors: []*APIError{
+			ErrMissingIdField,
+			ErrCouldNotRemoveToken,
+		},
+	},
+}
+
+// HandlersMux dispatches for the various API endpoints. It holds back
+// the deliveries of notifications not yet due until Stop is called.
+type HandlersMux struct {
+	*http.ServeMux
+	scheduler *broker.Scheduler
+}
+
+// Stop drops the deliveries of notifications not yet due.
+func (mux *HandlersMux) Stop() {
+	mux.scheduler.Stop()
+}
+
+// MakeHandlersMux makes a handler that dispatches for the various API endpoints.
+func MakeHandlersMux(storage StoreAccess, sending broker.BrokerSending, logger logger.Logger) *HandlersMux {
+	ctx := &context{
+		storage:   storage,
+		broker:    sending,
+		logger:    logger,
+		scheduler: broker.NewScheduler(sending),
+	}
+	mux := &HandlersMux{http.NewServeMux(), ctx.scheduler}
+	for _, e := range endpoints {
+		mux.Handle(e.path, e.handler(ctx))
+	}
+	mux.Handle(RPCPathPrefix, &RPCHandler{ctx})
+	mux.Handle(BlobPathPrefix, blobHandler(ctx))
+	mux.Handle(OpenAPIPath, openAPIHandler(endpoints))
 	return mux
 }
@@ -31,7 +31,10 @@ import (
 
 	. "launchpad.net/gocheck"
 
+	"github.com/ubports/ubuntu-push/blob"
+	"github.com/ubports/ubuntu-push/logger"
 	"github.com/ubports/ubuntu-push/protocol"
+	"github.com/ubports/ubuntu-push/server/broker"
 	"github.com/ubports/ubuntu-push/server/store"
 	help "github.com/ubports/ubuntu-push/testing"
 )
@@ -102,6 +105,63 @@ func (tsa testStoreAccess) GetMaxNotificationsPerApplication() int {
 	return 4
 }
 
+// testLargePayloadAccess accepts large payloads for the apps in
+// maxPayloadSizes.
+type testLargePayloadAccess struct {
+	testStoreAccess
+	maxPayloadSizes map[string]int
+	blobs           store.BlobStore
+}
+
+func (tlpa *testLargePayloadAccess) GetMaxPayloadSize(appId string) int {
+	return tlpa.maxPayloadSizes[appId]
+}
+
+func (tlpa *testLargePayloadAccess) GetLargestPayloadSize() int {
+	largest := 0
+	for _, size := range tlpa.maxPayloadSizes {
+		if size > largest {
+			largest = size
+		}
+	}
+	return largest
+}
+
+func (tlpa *testLargePayloadAccess) GetBlobStore() store.BlobStore {
+	return tlpa.blobs
+}
+
+type failingBlobStore struct{}
+
+func (failingBlobStore) PutBlob([]byte, time.Time) (string, error) {
+	return "", errors.New("fail")
+}
+
+func (failingBlobStore) GetBlob(string) ([]byte, error) {
+	return nil, errors.New("fail")
+}
+
+func (failingBlobStore) DropBlob(string) error {
+	return errors.New("fail")
+}
+
+// recordingBlobStore notes the id of the last blob put.
+type recordingBlobStore struct {
+	*store.InMemoryBlobStore
+	last string
+}
+
+func (rbs *recordingBlobStore) PutBlob(data []byte, expiration time.Time) (string, error) {
+	blobId, err := rbs.InMemoryBlobStore.PutBlob(data, expiration)
+	rbs.last = blobId
+	return blobId, err
+}
+
+// makePayload makes a JSON object payload of size bytes.
+func makePayload(size int) json.RawMessage {
+	return json.RawMessage(fmt.Sprintf(`{"a":"%s"}`, strings.Repeat("x", size-8)))
+}
+
 func (s *handlersSuite) TestGetStore(c *C) {
 	ctx := &context{storage: testStoreAccess(func(w http.ResponseWriter, r *http.Request) (store.PendingStore, error) {
 		return nil, ErrStoreUnavailable
@@ -154,6 +214,53 @@ func (s *handlersSuite) TestCheckCastBroadcastAndCommon(c *C) {
 	}
 	_, err = checkBroadcast(broadcast)
 	c.Check(err, Equals, ErrPastExpiration)
+
+	broadcast = &Broadcast{
+		Channel:  "system",
+		AppId:    "app1",
+		ExpireOn: future,
+		Data:     payload,
+	}
+	_, err = checkBroadcast(broadcast)
+	c.Check(err, Equals, ErrChannelAndAppId)
+
+	for _, appId := range []string{"com.example.test_app", "com.example.test_app_1.0", "_legacy"} {
+		broadcast = &Broadcast{
+			AppId:    appId,
+			ExpireOn: future,
+			Data:     payload,
+		}
+		_, err = checkBroadcast(broadcast)
+		c.Check(err, IsNil, Commentf("%s", appId))
+	}
+	for _, appId := range []string{"app1", "com.example.test", "_", "_.hidden", "_a/b", "Com.example_app"} {
+		broadcast = &Broadcast{
+			AppId:    appId,
+			ExpireOn: future,
+			Data:     payload,
+		}
+		_, err = checkBroadcast(broadcast)
+		c.Check(err, Equals, ErrInvalidAppId, Commentf("%s", appId))
+	}
+}
+
+func (s *handlersSuite) TestCheckDeliverAfter(c *C) {
+	expire := time.Now().Add(4 * time.Hour)
+	deliver, err := checkDeliverAfter("", expire)
+	c.Check(err, IsNil)
+	c.Check(deliver.IsZero(), Equals, true)
+
+	in1Hour := time.Now().Add(time.Hour).Format(time.RFC3339)
+	deliver, err = checkDeliverAfter(in1Hour, expire)
+	c.Check(err, IsNil)
+	c.Check(deliver.Format(time.RFC3339), Equals, in1Hour)
+
+	_, err = checkDeliverAfter("12:00", expire)
+	c.Check(err, Equals, ErrInvalidDeliverAfter)
+
+	in5Hours := time.Now().Add(5 * time.Hour).Format(time.RFC3339)
+	_, err = checkDeliverAfter(in5Hours, expire)
+	c.Check(err, Equals, ErrDeliverAfterExpiration)
 }
 
 type checkBrokerSending struct {
@@ -185,7 +292,7 @@ func (cbsend *checkBrokerSending) Unicast(chanIds ...store.InternalChannelId) {
 func (s *handlersSuite) TestDoBroadcast(c *C) {
 	sto := store.NewInMemoryPendingStore()
 	bsend := &checkBrokerSending{store: sto}
-	ctx := &context{nil, bsend, nil}
+	ctx := &context{broker: bsend}
 	payload := json.RawMessage(`{"a": 1}`)
 	res, apiErr := doBroadcast(ctx, sto, &Broadcast{
 		Channel:  "system",
@@ -200,6 +307,50 @@ func (s *handlersSuite) TestDoBroadcast(c *C) {
 	c.Check(bsend.notifications, DeepEquals, help.Ns(payload))
 }
 
+func (s *handlersSuite) TestDoBroadcastToApp(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	bsend := &checkBrokerSending{store: sto}
+	ctx := &context{broker: bsend, logger: s.testlog}
+	payload := json.RawMessage(`{"a": 1}`)
+	res, apiErr := doBroadcast(ctx, sto, &Broadcast{
+		AppId:    "com.example.test_app",
+		ExpireOn: future,
+		Data:     payload,
+	})
+	c.Assert(apiErr, IsNil)
+	c.Assert(res, IsNil)
+	c.Check(bsend.err, IsNil)
+	c.Check(bsend.chanId, Equals, store.AppBroadcastInternalChannelId("com.example.test_app"))
+	c.Check(bsend.top, Equals, int64(1))
+	c.Check(bsend.notifications, DeepEquals, []protocol.Notification{
+		protocol.Notification{AppId: "com.example.test_app", Payload: payload},
+	})
+}
+
+func (s *handlersSuite) TestDoBroadcastDeliverAfter(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	bsend := &checkBrokerSending{store: sto}
+	scheduler := broker.NewScheduler(bsend)
+	defer scheduler.Stop()
+	ctx := &context{broker: bsend, logger: s.testlog, scheduler: scheduler}
+	payload := json.RawMessage(`{"a": 1}`)
+	res, apiErr := doBroadcast(ctx, sto, &Broadcast{
+		Channel:      "system",
+		ExpireOn:     future,
+		DeliverAfter: time.Now().Add(time.Hour).Format(time.RFC3339),
+		Data:         payload,
+	})
+	c.Assert(apiErr, IsNil)
+	c.Assert(res, IsNil)
+	// held back
+	c.Check(bsend.chanId, Equals, store.InternalChannelId(""))
+	c.Check(scheduler.Pending(), Equals, 1)
+	top, notifs, err := sto.GetChannelSnapshot(store.SystemInternalChannelId)
+	c.Assert(err, IsNil)
+	c.Check(top, Equals, int64(0))
+	c.Check(notifs, HasLen, 0)
+}
+
 func (s *handlersSuite) TestDoBroadcastUnknownChannel(c *C) {
 	sto := store.NewInMemoryPendingStore()
 	_, apiErr := doBroadcast(nil, sto, &Broadcast{
@@ -225,6 +376,16 @@ func (isto *interceptInMemoryPendingStore) Unregister(appId, deviceId string) er
 	return isto.intercept("Unregister", err)
 }
 
+func (isto *interceptInMemoryPendingStore) AddUserDevice(userId, deviceId, appId string) error {
+	err := isto.InMemoryPendingStore.AddUserDevice(userId, deviceId, appId)
+	return isto.intercept("AddUserDevice", err)
+}
+
+func (isto *interceptInMemoryPendingStore) GetUserChannels(userId, appId string) (map[string]store.InternalChannelId, error) {
+	chans, err := isto.InMemoryPendingStore.GetUserChannels(userId, appId)
+	return chans, isto.intercept("GetUserChannels", err)
+}
+
 func (isto *interceptInMemoryPendingStore) GetInternalChannelIdFromToken(token, appId, userId, deviceId string) (store.InternalChannelId, error) {
 	chanId, err := isto.InMemoryPendingStore.GetInternalChannelIdFromToken(token, appId, userId, deviceId)
 	return chanId, isto.intercept("GetInternalChannelIdFromToken", err)
@@ -240,6 +401,11 @@ func (isto *interceptInMemoryPendingStore) AppendToChannel(chanId store.Internal
 	return isto.intercept("AppendToChannel", err)
 }
 
+func (isto *interceptInMemoryPendingStore) AppendToBroadcastChannel(chanId store.InternalChannelId, appId string, payload json.RawMessage, meta store.Metadata) error {
+	err := isto.InMemoryPendingStore.AppendToBroadcastChannel(chanId, appId, payload, meta)
+	return isto.intercept("AppendToBroadcastChannel", err)
+}
+
 func (isto *interceptInMemoryPendingStore) AppendToUnicastChannel(chanId store.InternalChannelId, appId string, payload json.RawMessage, msgId string, meta store.Metadata) error {
 	err := isto.InMemoryPendingStore.AppendToUnicastChannel(chanId, appId, payload, msgId, meta)
 	return isto.intercept("AppendToUnicastChannel", err)
@@ -274,7 +440,7 @@ func (s *handlersSuite) TestDoBroadcastCouldNotStoreNotification(c *C) {
 	sto := &interceptInMemoryPendingStore{
 		store.NewInMemoryPendingStore(),
 		func(meth string, err error) error {
-			if meth == "AppendToChannel" {
+			if meth == "AppendToBroadcastChannel" {
 				return errors.New("fail")
 			}
 			return err
@@ -290,6 +456,26 @@ func (s *handlersSuite) TestDoBroadcastCouldNotStoreNotification(c *C) {
 	c.Check(s.testlog.Captured(), Equals, "ERROR could not store notification: fail\n")
 }
 
+func (s *handlersSuite) TestDoBroadcastToAppCouldNotStoreNotification(c *C) {
+	sto := &interceptInMemoryPendingStore{
+		store.NewInMemoryPendingStore(),
+		func(meth string, err error) error {
+			if meth == "AppendToBroadcastChannel" {
+				return errors.New("fail")
+			}
+			return err
+		},
+	}
+	ctx := &context{logger: s.testlog}
+	_, apiErr := doBroadcast(ctx, sto, &Broadcast{
+		AppId:    "com.example.test_app",
+		ExpireOn: future,
+		Data:     json.RawMessage(`{"a": 1}`),
+	})
+	c.Check(apiErr, Equals, ErrCouldNotStoreNotification)
+	c.Check(s.testlog.Captured(), Equals, "ERROR could not store notification: fail\n")
+}
+
 func (s *handlersSuite) TestCheckUnicast(c *C) {
 	payload := json.RawMessage(`{"foo":"bar"}`)
 	unicast := func() *Unicast {
@@ -302,7 +488,7 @@ func (s *handlersSuite) TestCheckUnicast(c *C) {
 		}
 	}
 	u := unicast()
-	expire, apiErr := checkUnicast(u)
+	expire, apiErr := checkUnicast(u, MaxUnicastPayload)
 	c.Assert(apiErr, IsNil)
 	c.Check(expire.Format(time.RFC3339), Equals, future)
 
@@ -310,38 +496,38 @@ func (s *handlersSuite) TestCheckUnicast(c *C) {
 	u.UserId = ""
 	u.DeviceId = ""
 	u.Token = "TOKEN"
-	expire, apiErr = checkUnicast(u)
+	expire, apiErr = checkUnicast(u, MaxUnicastPayload)
 	c.Assert(apiErr, IsNil)
 	c.Check(expire.Format(time.RFC3339), Equals, future)
 
 	u = unicast()
 	u.UserId = ""
-	expire, apiErr = checkUnicast(u)
+	expire, apiErr = checkUnicast(u, MaxUnicastPayload)
 	c.Check(apiErr, Equals, ErrMissingIdField)
 
 	u = unicast()
 	u.AppId = ""
-	expire, apiErr = checkUnicast(u)
+	expire, apiErr = checkUnicast(u, MaxUnicastPayload)
 	c.Check(apiErr, Equals, ErrMissingIdField)
 
 	u = unicast()
 	u.DeviceId = ""
-	expire, apiErr = checkUnicast(u)
+	expire, apiErr = checkUnicast(u, MaxUnicastPayload)
 	c.Check(apiErr, Equals, ErrMissingIdField)
 
 	u = unicast()
 	u.Data = json.RawMessage(nil)
-	expire, apiErr = checkUnicast(u)
+	expire, apiErr = checkUnicast(u, MaxUnicastPayload)
 	c.Check(apiErr, Equals, ErrMissingData)
 
 	u = unicast()
 	u.Data = json.RawMessage(`{"a":"` + strings.Repeat("x", 2040) + `"}`)
-	expire, apiErr = checkUnicast(u)
+	expire, apiErr = checkUnicast(u, MaxUnicastPayload)
 	c.Check(apiErr, IsNil)
 
 	u = unicast()
 	u.Data = json.RawMessage(`{"a":"` + strings.Repeat("x", 2041) + `"}`)
-	expire, apiErr = checkUnicast(u)
+	expire, apiErr = checkUnicast(u, MaxUnicastPayload)
 	c.Check(apiErr, Equals, ErrDataTooLarge)
 }
 
@@ -362,7 +548,7 @@ func (s *handlersSuite) TestDoUnicast(c *C) {
 	}
 	sto := store.NewInMemoryPendingStore()
 	bsend := &checkBrokerSending{store: sto}
-	ctx := &context{testStoreAccess(nil), bsend, s.testlog}
+	ctx := &context{storage: testStoreAccess(nil), broker: bsend, logger: s.testlog}
 	payload := json.RawMessage(`{"a": 1}`)
 	res, apiErr := doUnicast(ctx, sto, &Unicast{
 		UserId:   "user1",
@@ -372,7 +558,7 @@ func (s *handlersSuite) TestDoUnicast(c *C) {
 		Data:     payload,
 	})
 	c.Assert(apiErr, IsNil)
-	c.Check(res, IsNil)
+	c.Check(res, DeepEquals, map[string]interface{}{"msgid": "MSG-ID"})
 	c.Check(bsend.err, IsNil)
 	c.Check(bsend.chanId, Equals, store.UnicastInternalChannelId("user1", "DEV1"))
 	c.Check(bsend.top, Equals, int64(0))
@@ -385,9 +571,68 @@ func (s *handlersSuite) TestDoUnicast(c *C) {
 	})
 }
 
+func (s *handlersSuite) TestDoUnicastDeliverAfter(c *C) {
+	prevGenMsgId := generateMsgId
+	defer func() {
+		generateMsgId = prevGenMsgId
+	}()
+	generateMsgId = func() string {
+		return "MSG-ID"
+	}
+	sto := store.NewInMemoryPendingStore()
+	token, err := sto.Register("DEV1", "app1")
+	c.Assert(err, IsNil)
+	bsend := &checkBrokerSending{store: sto}
+	scheduler := broker.NewScheduler(bsend)
+	defer scheduler.Stop()
+	ctx := &context{storage: testStoreAccess(nil), broker: bsend, logger: s.testlog, scheduler: scheduler}
+	payload := json.RawMessage(`{"a": 1}`)
+	deliverAfter := time.Now().Add(time.Hour).Format(time.RFC3339)
+	res, apiErr := doUnicast(ctx, sto, &Unicast{
+		Token:        token,
+		AppId:        "app1",
+		ExpireOn:     future,
+		DeliverAfter: deliverAfter,
+		Data:         payload,
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(res, DeepEquals, map[string]interface{}{"msgid": "MSG-ID"})
+	// held back
+	c.Check(bsend.chanId, Equals, store.InternalChannelId(""))
+	c.Check(scheduler.Pending(), Equals, 1)
+	chanId := store.UnicastInternalChannelId("DEV1", "DEV1")
+	_, notifs, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Check(notifs, HasLen, 0)
+	_, notifs, meta, err := sto.GetChannelUnfiltered(chanId)
+	c.Assert(err, IsNil)
+	c.Check(notifs, DeepEquals, []protocol.Notification{
+		protocol.Notification{
+			AppId:   "app1",
+			MsgId:   "MSG-ID",
+			Payload: payload,
+		},
+	})
+	c.Check(meta[0].DeliverAfter.Format(time.RFC3339), Equals, deliverAfter)
+}
+
+func (s *handlersSuite) TestDoUnicastDeliverAfterExpiration(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	ctx := &context{storage: testStoreAccess(nil), logger: s.testlog}
+	_, apiErr := doUnicast(ctx, sto, &Unicast{
+		UserId:       "user1",
+		DeviceId:     "DEV1",
+		AppId:        "app1",
+		ExpireOn:     future,
+		DeliverAfter: time.Now().Add(5 * time.Hour).Format(time.RFC3339),
+		Data:         json.RawMessage(`{"a": 1}`),
+	})
+	c.Check(apiErr, Equals, ErrDeliverAfterExpiration)
+}
+
 func (s *handlersSuite) TestDoUnicastMissingIdField(c *C) {
 	sto := store.NewInMemoryPendingStore()
-	_, apiErr := doUnicast(nil, sto, &Unicast{
+	_, apiErr := doUnicast(&context{}, sto, &Unicast{
 		ExpireOn: future,
 		Data:     json.RawMessage(`{"a": 1}`),
 	})
@@ -468,6 +713,35 @@ func (s *handlersSuite) TestDoUnicastTooManyNotifications(c *C) {
 	c.Check(s.testlog.Captured(), Equals, "")
 }
 
+func (s *handlersSuite) TestDoUnicastClearInstructionsDontCount(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	chanId := store.UnicastInternalChannelId("user1", "DEV1")
+
+	expire := store.Metadata{Expiration: time.Now().Add(4 * time.Hour)}
+	clear := store.Metadata{Expiration: time.Now().Add(4 * time.Hour), Kind: protocol.KindClear}
+	sto.AppendToUnicastChannel(chanId, "app1", json.RawMessage(`{"o":1}`), "m1", expire)
+	sto.AppendToUnicastChannel(chanId, "app1", json.RawMessage(`{"o":2}`), "m2", expire)
+	sto.AppendToUnicastChannel(chanId, "app1", json.RawMessage(`{"o":3}`), "m3", expire)
+	for _, msgId := range []string{"c1", "c2", "c3"} {
+		instr := &protocol.ClearInstruction{Tag: msgId}
+		sto.AppendToUnicastChannel(chanId, "app1", protocol.ClearPayload(instr), msgId, clear)
+	}
+
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 1)}
+	ctx := &context{storage: testStoreAccess(nil), broker: bsend, logger: s.testlog}
+	_, apiErr := doUnicast(ctx, sto, &Unicast{
+		UserId:   "user1",
+		DeviceId: "DEV1",
+		AppId:    "app1",
+		ExpireOn: future,
+		Data:     json.RawMessage(`{"a": 1}`),
+	})
+	c.Assert(apiErr, IsNil)
+	_, notifs, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Check(notifs, HasLen, 7)
+}
+
 func (s *handlersSuite) TestDoUnicastWithScrub(c *C) {
 	prevGenMsgId := generateMsgId
 	defer func() {
@@ -487,7 +761,7 @@ func (s *handlersSuite) TestDoUnicastWithScrub(c *C) {
 	sto.AppendToUnicastChannel(chanId, "app1", n, "m4", expire)
 
 	bsend := &checkBrokerSending{store: sto}
-	ctx := &context{testStoreAccess(nil), bsend, s.testlog}
+	ctx := &context{storage: testStoreAccess(nil), broker: bsend, logger: s.testlog}
 	payload := json.RawMessage(`{"a": 1}`)
 	res, apiErr := doUnicast(ctx, sto, &Unicast{
 		UserId:   "user1",
@@ -497,7 +771,7 @@ func (s *handlersSuite) TestDoUnicastWithScrub(c *C) {
 		Data:     payload,
 	})
 	c.Assert(apiErr, IsNil)
-	c.Check(res, IsNil)
+	c.Check(res, DeepEquals, map[string]interface{}{"msgid": "MSG-ID"})
 	c.Check(bsend.err, IsNil)
 	c.Check(bsend.chanId, Equals, store.UnicastInternalChannelId("user1", "DEV1"))
 	c.Check(bsend.top, Equals, int64(0))
@@ -528,7 +802,7 @@ func (s *handlersSuite) TestDoUnicastWithReplaceTag(c *C) {
 	sto.AppendToUnicastChannel(chanId, "app1", n, "m1", expire)
 
 	bsend := &checkBrokerSending{store: sto}
-	ctx := &context{testStoreAccess(nil), bsend, s.testlog}
+	ctx := &context{storage: testStoreAccess(nil), broker: bsend, logger: s.testlog}
 	payload := json.RawMessage(`{"a": 1}`)
 	res, apiErr := doUnicast(ctx, sto, &Unicast{
 		UserId:     "user1",
@@ -539,7 +813,7 @@ func (s *handlersSuite) TestDoUnicastWithReplaceTag(c *C) {
 		Data:       payload,
 	})
 	c.Assert(apiErr, IsNil)
-	c.Check(res, IsNil)
+	c.Check(res, DeepEquals, map[string]interface{}{"msgid": "MSG-ID-1"})
 	c.Check(bsend.err, IsNil)
 	c.Check(bsend.chanId, Equals, store.UnicastInternalChannelId("user1", "DEV1"))
 	c.Check(bsend.top, Equals, int64(0))
@@ -567,7 +841,7 @@ func (s *handlersSuite) TestDoUnicastWithReplaceTag(c *C) {
 		Data:       payload2,
 	})
 	c.Assert(apiErr, IsNil)
-	c.Check(res, IsNil)
+	c.Check(res, DeepEquals, map[string]interface{}{"msgid": "MSG-ID-2"})
 	c.Check(bsend.err, IsNil)
 	c.Check(bsend.chanId, Equals, store.UnicastInternalChannelId("user1", "DEV1"))
 	c.Check(bsend.top, Equals, int64(0))
@@ -603,7 +877,7 @@ func (s *handlersSuite) TestDoUnicastWithScrubError(c *C) {
 	sto.AppendToUnicastChannel(chanId, "app1", n, "m3", old)
 	sto.AppendToUnicastChannel(chanId, "app1", n, "m4", expire)
 
-	ctx := &context{testStoreAccess(nil), nil, s.testlog}
+	ctx := &context{storage: testStoreAccess(nil), logger: s.testlog}
 	payload := json.RawMessage(`{"a": 1}`)
 	_, apiErr := doUnicast(ctx, sto, &Unicast{
 		UserId:   "user1",
@@ -634,7 +908,7 @@ func (s *handlersSuite) TestDoUnicastClearPending(c *C) {
 	sto.AppendToUnicastChannel(chanId, "app1", n, "m4", expire)
 
 	bsend := &checkBrokerSending{store: sto}
-	ctx := &context{testStoreAccess(nil), bsend, s.testlog}
+	ctx := &context{storage: testStoreAccess(nil), broker: bsend, logger: s.testlog}
 	payload := json.RawMessage(`{"a": 1}`)
 	res, apiErr := doUnicast(ctx, sto, &Unicast{
 		UserId:       "user1",
@@ -645,7 +919,7 @@ func (s *handlersSuite) TestDoUnicastClearPending(c *C) {
 		ClearPending: true,
 	})
 	c.Assert(apiErr, IsNil)
-	c.Check(res, IsNil)
+	c.Check(res, DeepEquals, map[string]interface{}{"msgid": "MSG-ID"})
 	c.Check(bsend.err, IsNil)
 	c.Check(bsend.chanId, Equals, store.UnicastInternalChannelId("user1", "DEV1"))
 	c.Check(bsend.top, Equals, int64(0))
@@ -690,72 +964,297 @@ func (s *handlersSuite) TestDoUnicastFromTokenFailures(c *C) {
 	c.Check(s.testlog.Captured(), Equals, "")
 }
 
-func newPostRequest(path string, message interface{}, server *httptest.Server) *http.Request {
-	packedMessage, err := json.Marshal(message)
-	if err != nil {
-		panic(err)
-	}
-	reader := bytes.NewReader(packedMessage)
-
-	url := server.URL + path
-	request, _ := http.NewRequest("POST", url, reader)
-	request.ContentLength = int64(reader.Len())
-	request.Header.Set("Content-Type", "application/json")
-
-	return request
+func (s *handlersSuite) TestCheckCancel(c *C) {
+	c.Check(checkCancel(&Cancel{}), Equals, ErrMissingIdField)
+	c.Check(checkCancel(&Cancel{AppId: "app1", UserId: "user1", MsgId: "m1"}), Equals, ErrMissingIdField)
+	c.Check(checkCancel(&Cancel{AppId: "app1", Token: "tok"}), Equals, ErrMsgIdOrReplaceTag)
+	c.Check(checkCancel(&Cancel{AppId: "app1", Token: "tok", MsgId: "m1", ReplaceTag: "t1"}), Equals, ErrMsgIdOrReplaceTag)
+	c.Check(checkCancel(&Cancel{AppId: "app1", Token: "tok", MsgId: "m1"}), IsNil)
+	c.Check(checkCancel(&Cancel{AppId: "app1", UserId: "user1", DeviceId: "DEV1", ReplaceTag: "t1"}), IsNil)
 }
 
-func getResponseBody(response *http.Response) ([]byte, error) {
-	defer response.Body.Close()
-	return ioutil.ReadAll(response.Body)
-}
+func (s *handlersSuite) TestDoCancelPendingByMsgId(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	chanId := store.UnicastInternalChannelId("user1", "DEV1")
+	meta := store.Metadata{Expiration: time.Now().Add(time.Hour)}
+	n1 := json.RawMessage(`{"a":1}`)
+	n2 := json.RawMessage(`{"a":2}`)
+	sto.AppendToUnicastChannel(chanId, "app1", n1, "m1", meta)
+	sto.AppendToUnicastChannel(chanId, "app1", n2, "m2", meta)
 
-func checkError(c *C, response *http.Response, apiErr *APIError) {
-	c.Check(response.StatusCode, Equals, apiErr.StatusCode)
-	c.Check(response.Header.Get("Content-Type"), Equals, "application/json")
-	error := &APIError{StatusCode: response.StatusCode}
-	body, err := getResponseBody(response)
-	c.Assert(err, IsNil)
-	err = json.Unmarshal(body, error)
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 1)}
+	ctx := &context{storage: testStoreAccess(nil), broker: bsend, logger: s.testlog}
+	res, apiErr := doCancel(ctx, sto, &Cancel{
+		UserId:   "user1",
+		DeviceId: "DEV1",
+		AppId:    "app1",
+		MsgId:    "m1",
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(res, DeepEquals, map[string]interface{}{
+		"dropped": 1,
+		"cleared": false,
+	})
+	_, notifs, err := sto.GetChannelSnapshot(chanId)
 	c.Assert(err, IsNil)
-	c.Check(error, DeepEquals, apiErr)
+	c.Check(notifs, DeepEquals, []protocol.Notification{
+		protocol.Notification{AppId: "app1", MsgId: "m2", Payload: n2},
+	})
+	c.Check(len(bsend.chanId), Equals, 0)
 }
 
-type testBrokerSending struct {
-	chanId chan store.InternalChannelId
-}
+func (s *handlersSuite) TestDoCancelDeliveredByMsgId(c *C) {
+	prevGenMsgId := generateMsgId
+	defer func() {
+		generateMsgId = prevGenMsgId
+	}()
+	generateMsgId = func() string {
+		return "MSG-ID"
+	}
+	sto := store.NewInMemoryPendingStore()
+	chanId := store.UnicastInternalChannelId("user1", "DEV1")
+	n1 := protocol.Notification{AppId: "app1", MsgId: "m1", Payload: json.RawMessage(`{"a":1}`)}
+	sto.AppendToUnicastChannel(chanId, "app1", n1.Payload, "m1", store.Metadata{Expiration: time.Now().Add(time.Hour)})
+	// delivered
+	sto.DropByMsgId(chanId, []protocol.Notification{n1})
 
-func (bsend testBrokerSending) Broadcast(chanId store.InternalChannelId) {
-	bsend.chanId <- chanId
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 1)}
+	ctx := &context{storage: testStoreAccess(nil), broker: bsend, logger: s.testlog}
+	res, apiErr := doCancel(ctx, sto, &Cancel{
+		UserId:   "user1",
+		DeviceId: "DEV1",
+		AppId:    "app1",
+		MsgId:    "m1",
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(res, DeepEquals, map[string]interface{}{
+		"dropped": 0,
+		"cleared": true,
+	})
+	c.Check(<-bsend.chanId, Equals, chanId)
+	_, notifs, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Check(notifs, DeepEquals, []protocol.Notification{
+		protocol.Notification{
+			AppId:   "app1",
+			MsgId:   "MSG-ID",
+			Kind:    protocol.KindClear,
+			Payload: json.RawMessage(`{"msgid":"m1"}`),
+		},
+	})
 }
 
-func (bsend testBrokerSending) Unicast(chanIds ...store.InternalChannelId) {
-	// for now
-	if len(chanIds) != 1 {
-		panic("not expecting many chan ids for now")
+func (s *handlersSuite) TestDoCancelUnknownMsgId(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	chanId := store.UnicastInternalChannelId("user1", "DEV1")
+	// sent for another app
+	sto.AppendToUnicastChannel(chanId, "app2", json.RawMessage(`{"a":1}`), "m1", store.Metadata{Expiration: time.Now().Add(time.Hour)})
+
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 1)}
+	ctx := &context{storage: testStoreAccess(nil), broker: bsend, logger: s.testlog}
+	for _, msgId := range []string{"m1", "m2"} {
+		res, apiErr := doCancel(ctx, sto, &Cancel{
+			UserId:   "user1",
+			DeviceId: "DEV1",
+			AppId:    "app1",
+			MsgId:    msgId,
+		})
+		c.Assert(apiErr, IsNil)
+		c.Check(res, DeepEquals, map[string]interface{}{
+			"dropped": 0,
+			"cleared": false,
+		})
 	}
-	bsend.chanId <- chanIds[0]
+	c.Check(len(bsend.chanId), Equals, 0)
+	_, notifs, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Check(notifs, HasLen, 1)
 }
 
-func (s *handlersSuite) TestRespondsToBasicSystemBroadcast(c *C) {
+func (s *handlersSuite) TestDoCancelByReplaceTag(c *C) {
+	prevGenMsgId := generateMsgId
+	defer func() {
+		generateMsgId = prevGenMsgId
+	}()
+	generateMsgId = func() string {
+		return "MSG-ID"
+	}
 	sto := store.NewInMemoryPendingStore()
-	storage := testStoreAccess(func(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
-		return sto, nil
-	})
-	bsend := testBrokerSending{make(chan store.InternalChannelId, 1)}
-	testServer := httptest.NewServer(MakeHandlersMux(storage, bsend, nil))
-	defer testServer.Close()
-
-	payload := json.RawMessage(`{"foo":"bar"}`)
-
-	request := newPostRequest("/broadcast", &Broadcast{
-		Channel:  "system",
-		ExpireOn: future,
-		Data:     payload,
-	}, testServer)
-
-	response, err := s.client.Do(request)
-	c.Assert(err, IsNil)
+	chanId := store.UnicastInternalChannelId("user1", "DEV1")
+	later := time.Now().Add(time.Hour)
+	n1 := json.RawMessage(`{"a":1}`)
+	n2 := json.RawMessage(`{"a":2}`)
+	sto.AppendToUnicastChannel(chanId, "app1", n1, "m1", store.Metadata{Expiration: later, ReplaceTag: "t1"})
+	sto.AppendToUnicastChannel(chanId, "app1", n2, "m2", store.Metadata{Expiration: later})
+
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 1)}
+	ctx := &context{storage: testStoreAccess(nil), broker: bsend, logger: s.testlog}
+	res, apiErr := doCancel(ctx, sto, &Cancel{
+		UserId:     "user1",
+		DeviceId:   "DEV1",
+		AppId:      "app1",
+		ReplaceTag: "t1",
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(res, DeepEquals, map[string]interface{}{
+		"dropped": 1,
+		"cleared": true,
+	})
+	c.Check(<-bsend.chanId, Equals, chanId)
+	_, notifs, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Check(notifs, DeepEquals, []protocol.Notification{
+		protocol.Notification{AppId: "app1", MsgId: "m2", Payload: n2},
+		protocol.Notification{
+			AppId:   "app1",
+			MsgId:   "MSG-ID",
+			Kind:    protocol.KindClear,
+			Payload: json.RawMessage(`{"tag":"t1"}`),
+		},
+	})
+}
+
+func (s *handlersSuite) TestDoCancelCouldNotPeekAtNotifications(c *C) {
+	sto := &interceptInMemoryPendingStore{
+		store.NewInMemoryPendingStore(),
+		func(meth string, err error) error {
+			if meth == "GetChannelUnfiltered" {
+				return errors.New("fail")
+			}
+			return err
+		},
+	}
+	ctx := &context{storage: testStoreAccess(nil), logger: s.testlog}
+	_, apiErr := doCancel(ctx, sto, &Cancel{
+		UserId:   "user1",
+		DeviceId: "DEV1",
+		AppId:    "app1",
+		MsgId:    "m1",
+	})
+	c.Check(apiErr, Equals, ErrCouldNotCancelNotification)
+	c.Check(s.testlog.Captured(), Equals, "ERROR could not peek at notifications: fail\n")
+}
+
+func (s *handlersSuite) TestDoStatus(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	chanId := store.UnicastInternalChannelId("user1", "DEV1")
+	meta := store.Metadata{Expiration: time.Now().Add(time.Hour)}
+	expired := store.Metadata{Expiration: time.Now().Add(-time.Hour)}
+	sto.AppendToUnicastChannel(chanId, "app1", json.RawMessage(`{}`), "m1", meta)
+	sto.AppendToUnicastChannel(chanId, "app2", json.RawMessage(`{}`), "m2", meta)
+	sto.AppendToUnicastChannel(chanId, "app1", json.RawMessage(`{}`), "m3", expired)
+	sto.AppendToUnicastChannel(chanId, "app1", json.RawMessage(`{}`), "m4", meta)
+	clear := meta
+	clear.Kind = protocol.KindClear
+	sto.AppendToUnicastChannel(chanId, "app1", json.RawMessage(`{"msgid":"m0"}`), "m5", clear)
+	byRef := meta
+	byRef.Kind = protocol.KindBlob
+	sto.AppendToUnicastChannel(chanId, "app1", json.RawMessage(`{"url":"blob/b1"}`), "m6", byRef)
+
+	ctx := &context{storage: testStoreAccess(nil), logger: s.testlog}
+	query := &StatusQuery{UserId: "user1", DeviceId: "DEV1", AppId: "app1"}
+	res, apiErr := doStatus(ctx, sto, query)
+	c.Assert(apiErr, IsNil)
+	// the clear instruction is not the app's
+	c.Check(res, DeepEquals, map[string]interface{}{
+		"pending": []string{"m1", "m4", "m6"},
+	})
+	query.AppId = "app3"
+	res, apiErr = doStatus(ctx, sto, query)
+	c.Assert(apiErr, IsNil)
+	c.Check(res, DeepEquals, map[string]interface{}{
+		"pending": []string{},
+	})
+	_, apiErr = doStatus(ctx, sto, &StatusQuery{UserId: "user1", AppId: "app1"})
+	c.Check(apiErr, Equals, ErrMissingIdField)
+}
+
+func (s *handlersSuite) TestDoStatusCouldNotPeekAtNotifications(c *C) {
+	sto := &interceptInMemoryPendingStore{
+		store.NewInMemoryPendingStore(),
+		func(meth string, err error) error {
+			if meth == "GetChannelUnfiltered" {
+				return errors.New("fail")
+			}
+			return err
+		},
+	}
+	ctx := &context{storage: testStoreAccess(nil), logger: s.testlog}
+	_, apiErr := doStatus(ctx, sto, &StatusQuery{
+		UserId:   "user1",
+		DeviceId: "DEV1",
+		AppId:    "app1",
+	})
+	c.Check(apiErr, Equals, ErrCouldNotQueryStatus)
+	c.Check(s.testlog.Captured(), Equals, "ERROR could not peek at notifications: fail\n")
+}
+
+func newPostRequest(path string, message interface{}, server *httptest.Server) *http.Request {
+	packedMessage, err := json.Marshal(message)
+	if err != nil {
+		panic(err)
+	}
+	reader := bytes.NewReader(packedMessage)
+
+	url := server.URL + path
+	request, _ := http.NewRequest("POST", url, reader)
+	request.ContentLength = int64(reader.Len())
+	request.Header.Set("Content-Type", "application/json")
+
+	return request
+}
+
+func getResponseBody(response *http.Response) ([]byte, error) {
+	defer response.Body.Close()
+	return ioutil.ReadAll(response.Body)
+}
+
+func checkError(c *C, response *http.Response, apiErr *APIError) {
+	c.Check(response.StatusCode, Equals, apiErr.StatusCode)
+	c.Check(response.Header.Get("Content-Type"), Equals, "application/json")
+	error := &APIError{StatusCode: response.StatusCode}
+	body, err := getResponseBody(response)
+	c.Assert(err, IsNil)
+	err = json.Unmarshal(body, error)
+	c.Assert(err, IsNil)
+	c.Check(error, DeepEquals, apiErr)
+}
+
+type testBrokerSending struct {
+	chanId chan store.InternalChannelId
+}
+
+func (bsend testBrokerSending) Broadcast(chanId store.InternalChannelId) {
+	bsend.chanId <- chanId
+}
+
+func (bsend testBrokerSending) Unicast(chanIds ...store.InternalChannelId) {
+	// for now
+	if len(chanIds) != 1 {
+		panic("not expecting many chan ids for now")
+	}
+	bsend.chanId <- chanIds[0]
+}
+
+func (s *handlersSuite) TestRespondsToBasicSystemBroadcast(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	storage := testStoreAccess(func(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
+		return sto, nil
+	})
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 1)}
+	testServer := httptest.NewServer(MakeHandlersMux(storage, bsend, nil))
+	defer testServer.Close()
+
+	payload := json.RawMessage(`{"foo":"bar"}`)
+
+	request := newPostRequest("/broadcast", &Broadcast{
+		Channel:  "system",
+		ExpireOn: future,
+		Data:     payload,
+	}, testServer)
+
+	response, err := s.client.Do(request)
+	c.Assert(err, IsNil)
 
 	c.Check(response.StatusCode, Equals, http.StatusOK)
 	c.Check(response.Header.Get("Content-Type"), Equals, "application/json")
@@ -772,6 +1271,31 @@ func (s *handlersSuite) TestRespondsToBasicSystemBroadcast(c *C) {
 	c.Check(<-bsend.chanId, Equals, store.SystemInternalChannelId)
 }
 
+func (s *handlersSuite) TestHandlersMuxStop(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	storage := testStoreAccess(func(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
+		return sto, nil
+	})
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 1)}
+	mux := MakeHandlersMux(storage, bsend, s.testlog)
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	request := newPostRequest("/broadcast", &Broadcast{
+		Channel:      "system",
+		ExpireOn:     future,
+		DeliverAfter: time.Now().Add(time.Hour).Format(time.RFC3339),
+		Data:         json.RawMessage(`{"foo":"bar"}`),
+	}, testServer)
+	response, err := s.client.Do(request)
+	c.Assert(err, IsNil)
+	c.Check(response.StatusCode, Equals, http.StatusOK)
+	c.Check(mux.scheduler.Pending(), Equals, 1)
+
+	mux.Stop()
+	c.Check(mux.scheduler.Pending(), Equals, 0)
+}
+
 func (s *handlersSuite) TestStoreUnavailable(c *C) {
 	storage := testStoreAccess(func(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
 		return nil, ErrStoreUnavailable
@@ -792,6 +1316,46 @@ func (s *handlersSuite) TestStoreUnavailable(c *C) {
 	checkError(c, response, ErrStoreUnavailable)
 }
 
+func (s *handlersSuite) TestRequestId(c *C) {
+	prevGenerateRequestId := generateRequestId
+	defer func() {
+		generateRequestId = prevGenerateRequestId
+	}()
+	generateRequestId = func() string {
+		return "REQ-ID"
+	}
+	storage := testStoreAccess(func(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
+		return nil, errors.New("boom")
+	})
+	buf := &bytes.Buffer{}
+	jsonLog := logger.NewJSONLogger(buf, "error", "api")
+	testServer := httptest.NewServer(MakeHandlersMux(storage, nil, jsonLog))
+	defer testServer.Close()
+
+	request := newPostRequest("/register", &Registration{
+		DeviceId: "dev3",
+		AppId:    "app2",
+	}, testServer)
+	response, err := s.client.Do(request)
+	c.Assert(err, IsNil)
+	checkError(c, response, ErrUnknown)
+	c.Check(response.Header.Get(RequestIdHeader), Equals, "REQ-ID")
+	c.Check(buf.String(), Matches, `\{.*"msg":"failed to get store: boom".*"request":"REQ-ID".*\}\n`)
+
+	// the client's own id is used if given
+	buf.Reset()
+	request = newPostRequest("/register", &Registration{
+		DeviceId: "dev3",
+		AppId:    "app2",
+	}, testServer)
+	request.Header.Set(RequestIdHeader, "CLIENT-REQ")
+	response, err = s.client.Do(request)
+	c.Assert(err, IsNil)
+	checkError(c, response, ErrUnknown)
+	c.Check(response.Header.Get(RequestIdHeader), Equals, "CLIENT-REQ")
+	c.Check(buf.String(), Matches, `.*"request":"CLIENT-REQ".*\n`)
+}
+
 func (s *handlersSuite) TestFromBroadcastError(c *C) {
 	sto := store.NewInMemoryPendingStore()
 	storage := testStoreAccess(func(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
@@ -817,7 +1381,7 @@ func (s *handlersSuite) TestMissingData(c *C) {
 	storage := testStoreAccess(func(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
 		return store.NewInMemoryPendingStore(), nil
 	})
-	ctx := &context{storage, nil, nil}
+	ctx := &context{storage: storage}
 	testServer := httptest.NewServer(&JSONPostHandler{
 		context:        ctx,
 		parsingBodyObj: func() interface{} { return &Broadcast{} },
@@ -842,7 +1406,7 @@ func (s *handlersSuite) TestCannotBroadcastMalformedData(c *C) {
 	storage := testStoreAccess(func(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
 		return store.NewInMemoryPendingStore(), nil
 	})
-	ctx := &context{storage, nil, nil}
+	ctx := &context{storage: storage}
 	testServer := httptest.NewServer(&JSONPostHandler{
 		context:        ctx,
 		parsingBodyObj: func() interface{} { return &Broadcast{} },
@@ -1115,6 +1679,703 @@ func (s *handlersSuite) TestRespondsToRegisterAndUnicast(c *C) {
 	c.Check(notifications, HasLen, 1)
 }
 
+// testUserAuthenticator authenticates the users in users, by the
+// authorization they present.
+type testUserAuthenticator struct {
+	testStoreAccess
+	users    map[string]string
+	required bool
+}
+
+func (tua *testUserAuthenticator) AuthenticateUser(authorization string) (string, error) {
+	userId, ok := tua.users[authorization]
+	if !ok {
+		return "", store.ErrUnauthorized
+	}
+	return userId, nil
+}
+
+func (tua *testUserAuthenticator) AuthenticationRequired() bool {
+	return tua.required
+}
+
+func (s *handlersSuite) TestDoRegisterWithUser(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	ctx := &context{
+		logger:        s.testlog,
+		storage:       &testUserAuthenticator{users: map[string]string{"auth1": "user1"}},
+		authorization: "auth1",
+	}
+	res, apiErr := doRegister(ctx, sto, &Registration{
+		DeviceId: "DEV1",
+		AppId:    "app1",
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(res["token"], NotNil)
+	chans, err := sto.GetUserChannels("user1", "app1")
+	c.Assert(err, IsNil)
+	c.Check(chans, DeepEquals, map[string]store.InternalChannelId{
+		"DEV1": store.UnicastInternalChannelId("DEV1", "DEV1"),
+	})
+}
+
+func (s *handlersSuite) TestDoRegisterWithoutAuthenticator(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	ctx := &context{
+		logger:        s.testlog,
+		storage:       testStoreAccess(nil),
+		authorization: "auth1",
+	}
+	res, apiErr := doRegister(ctx, sto, &Registration{
+		DeviceId: "DEV1",
+		AppId:    "app1",
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(res["token"], NotNil)
+	chans, err := sto.GetUserChannels("auth1", "app1")
+	c.Assert(err, IsNil)
+	c.Check(chans, HasLen, 0)
+}
+
+func (s *handlersSuite) TestDoRegisterUnauthorized(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	ctx := &context{
+		logger:        s.testlog,
+		storage:       &testUserAuthenticator{users: map[string]string{"auth1": "user1"}, required: true},
+		authorization: "auth2",
+	}
+	_, apiErr := doRegister(ctx, sto, &Registration{
+		DeviceId: "DEV1",
+		AppId:    "app1",
+	})
+	c.Check(apiErr, Equals, ErrUnauthorized)
+	// nor without any credentials
+	ctx.authorization = ""
+	_, apiErr = doRegister(ctx, sto, &Registration{
+		DeviceId: "DEV1",
+		AppId:    "app1",
+	})
+	c.Check(apiErr, Equals, ErrUnauthorized)
+}
+
+func (s *handlersSuite) TestDoRegisterUnrecognisedNotRequired(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	ctx := &context{
+		logger:        s.testlog,
+		storage:       &testUserAuthenticator{users: map[string]string{"auth1": "user1"}},
+		authorization: "auth2",
+	}
+	res, apiErr := doRegister(ctx, sto, &Registration{
+		DeviceId: "DEV1",
+		AppId:    "app1",
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(res["token"], NotNil)
+	// on behalf of no user
+	chans, err := sto.GetUserChannels("user1", "app1")
+	c.Assert(err, IsNil)
+	c.Check(chans, HasLen, 0)
+}
+
+func (s *handlersSuite) TestDoRegisterCouldNotAddUserDevice(c *C) {
+	sto := &interceptInMemoryPendingStore{
+		store.NewInMemoryPendingStore(),
+		func(meth string, err error) error {
+			if meth == "AddUserDevice" {
+				return errors.New("fail")
+			}
+			return err
+		},
+	}
+	ctx := &context{
+		logger:        s.testlog,
+		storage:       &testUserAuthenticator{users: map[string]string{"auth1": "user1"}},
+		authorization: "auth1",
+	}
+	_, apiErr := doRegister(ctx, sto, &Registration{
+		DeviceId: "DEV1",
+		AppId:    "app1",
+	})
+	c.Check(apiErr, Equals, ErrCouldNotMakeToken)
+	c.Check(s.testlog.Captured(), Equals, "ERROR could not add device to user: fail\n")
+}
+
+func (s *handlersSuite) TestRespondsToRegisterWithUser(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	storage := &testUserAuthenticator{
+		testStoreAccess(func(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
+			return sto, nil
+		}),
+		map[string]string{"auth1": "user1"},
+		true,
+	}
+	testServer := httptest.NewServer(MakeHandlersMux(storage, nil, s.testlog))
+	defer testServer.Close()
+
+	// a user in the body is not believed
+	request := newPostRequest("/register", map[string]string{
+		"deviceid": "dev1",
+		"appid":    "app1",
+		"userid":   "user2",
+	}, testServer)
+	request.Header.Set("Authorization", "auth1")
+	response, err := s.client.Do(request)
+	c.Assert(err, IsNil)
+	c.Check(response.StatusCode, Equals, http.StatusOK)
+	response.Body.Close()
+	chans, err := sto.GetUserChannels("user1", "app1")
+	c.Assert(err, IsNil)
+	c.Check(chans, HasLen, 1)
+	chans, err = sto.GetUserChannels("user2", "app1")
+	c.Assert(err, IsNil)
+	c.Check(chans, HasLen, 0)
+
+	request = newPostRequest("/register", &Registration{
+		DeviceId: "dev2",
+		AppId:    "app1",
+	}, testServer)
+	request.Header.Set("Authorization", "bogus")
+	response, err = s.client.Do(request)
+	c.Assert(err, IsNil)
+	c.Check(response.StatusCode, Equals, http.StatusUnauthorized)
+	response.Body.Close()
+}
+
+func (s *handlersSuite) TestCheckUserUnicast(c *C) {
+	userUnicast := func() *Unicast {
+		return &Unicast{
+			UserId:   "user1",
+			AppId:    "app1",
+			ExpireOn: future,
+			Data:     json.RawMessage(`{"a": 1}`),
+		}
+	}
+	_, apiErr := checkUserUnicast(userUnicast(), MaxUnicastPayload)
+	c.Check(apiErr, IsNil)
+
+	u := userUnicast()
+	u.UserId = ""
+	_, apiErr = checkUserUnicast(u, MaxUnicastPayload)
+	c.Check(apiErr, Equals, ErrMissingIdField)
+
+	u = userUnicast()
+	u.AppId = ""
+	_, apiErr = checkUserUnicast(u, MaxUnicastPayload)
+	c.Check(apiErr, Equals, ErrMissingIdField)
+
+	u = userUnicast()
+	u.DeviceId = "DEV1"
+	_, apiErr = checkUserUnicast(u, MaxUnicastPayload)
+	c.Check(apiErr, Equals, ErrOnlyUserAndAppId)
+
+	u = userUnicast()
+	u.Token = "tok"
+	_, apiErr = checkUserUnicast(u, MaxUnicastPayload)
+	c.Check(apiErr, Equals, ErrOnlyUserAndAppId)
+
+	u = userUnicast()
+	u.Data = json.RawMessage(fmt.Sprintf(`{"a": "%s"}`, strings.Repeat("x", MaxUnicastPayload)))
+	_, apiErr = checkUserUnicast(u, MaxUnicastPayload)
+	c.Check(apiErr, Equals, ErrDataTooLarge)
+}
+
+func (s *handlersSuite) TestDoUserUnicast(c *C) {
+	prevGenMsgId := generateMsgId
+	defer func() {
+		generateMsgId = prevGenMsgId
+	}()
+	generateMsgId = func() string {
+		return "MSG-ID"
+	}
+	sto := store.NewInMemoryPendingStore()
+	c.Assert(sto.AddUserDevice("user1", "DEV1", "app1"), IsNil)
+	c.Assert(sto.AddUserDevice("user1", "DEV2", "app1"), IsNil)
+	// DEV2 is full
+	full := store.UnicastInternalChannelId("DEV2", "DEV2")
+	expire := store.Metadata{Expiration: time.Now().Add(4 * time.Hour)}
+	for i := 0; i < 4; i++ {
+		sto.AppendToUnicastChannel(full, "app1", json.RawMessage(`{"o":1}`), fmt.Sprintf("m%d", i), expire)
+	}
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 2)}
+	ctx := &context{storage: testStoreAccess(nil), broker: bsend, logger: s.testlog}
+	payload := json.RawMessage(`{"a": 1}`)
+	res, apiErr := doUserUnicast(ctx, sto, &Unicast{
+		UserId:   "user1",
+		AppId:    "app1",
+		ExpireOn: future,
+		Data:     payload,
+	})
+	c.Assert(apiErr, IsNil)
+	devices := res["devices"].(map[string]interface{})
+	c.Check(devices, HasLen, 2)
+	c.Check(devices["DEV1"], DeepEquals, map[string]interface{}{"msgid": "MSG-ID"})
+	devErr, ok := devices["DEV2"].(*APIError)
+	c.Assert(ok, Equals, true)
+	c.Check(devErr.ErrorLabel, Equals, tooManyPending)
+
+	chanId := store.UnicastInternalChannelId("DEV1", "DEV1")
+	c.Check(<-bsend.chanId, Equals, chanId)
+	_, notifications, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Check(notifications, DeepEquals, []protocol.Notification{
+		protocol.Notification{
+			AppId:   "app1",
+			MsgId:   "MSG-ID",
+			Payload: payload,
+		},
+	})
+}
+
+func (s *handlersSuite) TestDoUserUnicastUnknownUser(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	c.Assert(sto.AddUserDevice("user1", "DEV1", "app2"), IsNil)
+	ctx := &context{storage: testStoreAccess(nil), logger: s.testlog}
+	_, apiErr := doUserUnicast(ctx, sto, &Unicast{
+		UserId:   "user1",
+		AppId:    "app1",
+		ExpireOn: future,
+		Data:     json.RawMessage(`{"a": 1}`),
+	})
+	c.Check(apiErr, Equals, ErrUnknownUser)
+}
+
+func (s *handlersSuite) TestDoUnicastLargePayload(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 1)}
+	blobs := store.NewInMemoryBlobStore()
+	storage := &testLargePayloadAccess{maxPayloadSizes: map[string]int{"app1": 8192}, blobs: blobs}
+	ctx := &context{storage: storage, broker: bsend, logger: s.testlog}
+	payload := makePayload(3000)
+	_, apiErr := doUnicast(ctx, sto, &Unicast{
+		UserId:   "user1",
+		DeviceId: "DEV1",
+		AppId:    "app1",
+		ExpireOn: future,
+		Data:     payload,
+	})
+	c.Assert(apiErr, IsNil)
+	chanId := store.UnicastInternalChannelId("user1", "DEV1")
+	c.Check(<-bsend.chanId, Equals, chanId)
+	_, notifications, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Assert(notifications, HasLen, 1)
+	// the payload is sent by reference
+	c.Check(notifications[0].Kind, Equals, protocol.KindBlob)
+	ref := blob.ExtractRef(&notifications[0])
+	c.Assert(ref, NotNil)
+	c.Check(ref.URL, Matches, "blob/[0-9a-f]{32}")
+	data, err := blobs.GetBlob(strings.TrimPrefix(ref.URL, "blob/"))
+	c.Assert(err, IsNil)
+	c.Check(ref.Check(data), IsNil)
+	c.Check(string(data), Equals, string(payload))
+}
+
+func (s *handlersSuite) TestDoUnicastLargePayloadDropsBlobs(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 10)}
+	blobs := &recordingBlobStore{InMemoryBlobStore: store.NewInMemoryBlobStore()}
+	storage := &testLargePayloadAccess{testStoreAccess(nil), map[string]int{"app1": 8192}, blobs}
+	ctx := &context{storage: storage, broker: bsend, logger: s.testlog}
+	chanId := store.UnicastInternalChannelId("user1", "DEV1")
+	notify := func(sto store.PendingStore, ucast *Unicast) (string, *APIError) {
+		ucast.UserId = "user1"
+		ucast.DeviceId = "DEV1"
+		ucast.AppId = "app1"
+		ucast.ExpireOn = future
+		ucast.Data = makePayload(3000)
+		res, apiErr := doUnicast(ctx, sto, ucast)
+		if apiErr != nil {
+			return "", apiErr
+		}
+		_, notifications, err := sto.GetChannelSnapshot(chanId)
+		c.Assert(err, IsNil)
+		ref := blob.ExtractRef(&notifications[len(notifications)-1])
+		c.Assert(ref, NotNil)
+		c.Check(res["msgid"], Equals, notifications[len(notifications)-1].MsgId)
+		return strings.TrimPrefix(ref.URL, "blob/"), nil
+	}
+	kept := func(blobId string) bool {
+		_, err := blobs.GetBlob(blobId)
+		return err == nil
+	}
+
+	// replacing drops the replaced blob
+	blob1, apiErr := notify(sto, &Unicast{ReplaceTag: "t"})
+	c.Assert(apiErr, IsNil)
+	blob2, apiErr := notify(sto, &Unicast{ReplaceTag: "t"})
+	c.Assert(apiErr, IsNil)
+	c.Check(kept(blob1), Equals, false)
+	c.Check(kept(blob2), Equals, true)
+	// as does clearing
+	blob3, apiErr := notify(sto, &Unicast{ClearPending: true})
+	c.Assert(apiErr, IsNil)
+	c.Check(kept(blob2), Equals, false)
+	c.Check(kept(blob3), Equals, true)
+	// and cancelling
+	_, apiErr = doCancel(ctx, sto, &Cancel{UserId: "user1", DeviceId: "DEV1", AppId: "app1", ReplaceTag: "none"})
+	c.Assert(apiErr, IsNil)
+	c.Check(kept(blob3), Equals, true)
+	_, notifications, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	_, apiErr = doCancel(ctx, sto, &Cancel{UserId: "user1", DeviceId: "DEV1", AppId: "app1", MsgId: notifications[0].MsgId})
+	c.Assert(apiErr, IsNil)
+	c.Check(kept(blob3), Equals, false)
+
+	// a notification the channel doesn't take leaves no blob behind
+	failing := &interceptInMemoryPendingStore{
+		sto,
+		func(meth string, err error) error {
+			if meth == "AppendToUnicastChannel" {
+				return errors.New("fail")
+			}
+			return err
+		},
+	}
+	_, apiErr = notify(failing, &Unicast{})
+	c.Check(apiErr, Equals, ErrCouldNotStoreNotification)
+	c.Check(blobs.last, Not(Equals), blob3)
+	c.Check(kept(blobs.last), Equals, false)
+}
+
+func (s *handlersSuite) TestDoUnicastLargePayloadLimits(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	storage := &testLargePayloadAccess{
+		maxPayloadSizes: map[string]int{"app1": 8192, "app2": 4096},
+		blobs:           store.NewInMemoryBlobStore(),
+	}
+	ctx := &context{storage: storage, logger: s.testlog}
+	for _, t := range []struct {
+		appId string
+		size  int
+	}{
+		// beyond what any app is allowed
+		{"app1", 8193},
+		// beyond what app2 is allowed
+		{"app2", 5000},
+		// app3 is allowed nothing larger than usual
+		{"app3", MaxUnicastPayload + 1},
+	} {
+		_, apiErr := doUnicast(ctx, sto, &Unicast{
+			UserId:   "user1",
+			DeviceId: "DEV1",
+			AppId:    t.appId,
+			ExpireOn: future,
+			Data:     makePayload(t.size),
+		})
+		c.Check(apiErr, Equals, ErrDataTooLarge, Commentf("%v", t))
+	}
+}
+
+func (s *handlersSuite) TestDoUnicastLargePayloadCouldNotStoreBlob(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	storage := &testLargePayloadAccess{maxPayloadSizes: map[string]int{"app1": 8192}, blobs: failingBlobStore{}}
+	ctx := &context{storage: storage, logger: s.testlog}
+	_, apiErr := doUnicast(ctx, sto, &Unicast{
+		UserId:   "user1",
+		DeviceId: "DEV1",
+		AppId:    "app1",
+		ExpireOn: future,
+		Data:     makePayload(3000),
+	})
+	c.Check(apiErr, Equals, ErrCouldNotStoreNotification)
+	c.Check(s.testlog.Captured(), Matches, "(?s).*ERROR could not store blob: fail\n")
+}
+
+func (s *handlersSuite) TestDoUserUnicastLargePayload(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	c.Assert(sto.AddUserDevice("user1", "DEV1", "app1"), IsNil)
+	c.Assert(sto.AddUserDevice("user1", "DEV2", "app1"), IsNil)
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 2)}
+	storage := &testLargePayloadAccess{maxPayloadSizes: map[string]int{"app1": 8192}, blobs: store.NewInMemoryBlobStore()}
+	ctx := &context{storage: storage, broker: bsend, logger: s.testlog}
+	_, apiErr := doUserUnicast(ctx, sto, &Unicast{
+		UserId:   "user1",
+		AppId:    "app1",
+		ExpireOn: future,
+		Data:     makePayload(3000),
+	})
+	c.Assert(apiErr, IsNil)
+	var urls []string
+	for _, dev := range []string{"DEV1", "DEV2"} {
+		_, notifications, err := sto.GetChannelSnapshot(store.UnicastInternalChannelId(dev, dev))
+		c.Assert(err, IsNil)
+		c.Assert(notifications, HasLen, 1)
+		ref := blob.ExtractRef(&notifications[0])
+		c.Assert(ref, NotNil)
+		urls = append(urls, ref.URL)
+	}
+	// each device has its own, to be dropped with its notification
+	c.Check(urls[0], Not(Equals), urls[1])
+}
+
+func (s *handlersSuite) TestRespondsBlob(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	storage := &testLargePayloadAccess{
+		testStoreAccess(func(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
+			return sto, nil
+		}),
+		map[string]int{"app1": 8192},
+		store.NewInMemoryBlobStore(),
+	}
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 1)}
+	testServer := httptest.NewServer(MakeHandlersMux(storage, bsend, s.testlog))
+	defer testServer.Close()
+
+	payload := makePayload(6000)
+	request := newPostRequest("/notify", &Unicast{
+		UserId:   "user1",
+		DeviceId: "dev1",
+		AppId:    "app1",
+		ExpireOn: future,
+		Data:     payload,
+	}, testServer)
+	response, err := s.client.Do(request)
+	c.Assert(err, IsNil)
+	c.Check(response.StatusCode, Equals, http.StatusOK)
+	chanId := store.UnicastInternalChannelId("user1", "dev1")
+	c.Check(<-bsend.chanId, Equals, chanId)
+	_, notifications, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Assert(notifications, HasLen, 1)
+	ref := blob.ExtractRef(&notifications[0])
+	c.Assert(ref, NotNil)
+
+	response, err = s.client.Get(testServer.URL + "/" + ref.URL)
+	c.Assert(err, IsNil)
+	c.Check(response.StatusCode, Equals, http.StatusOK)
+	c.Check(response.Header.Get("Content-Type"), Equals, "application/json")
+	body, err := getResponseBody(response)
+	c.Assert(err, IsNil)
+	c.Check(ref.Check(body), IsNil)
+
+	response, err = s.client.Get(testServer.URL + "/blob/garbage")
+	c.Assert(err, IsNil)
+	checkError(c, response, ErrUnknownBlob)
+
+	response, err = s.client.Post(testServer.URL+"/"+ref.URL, "application/json", nil)
+	c.Assert(err, IsNil)
+	checkError(c, response, ErrWrongRequestMethodGET)
+}
+
+func (s *handlersSuite) TestRespondsBlobNoLargePayloads(c *C) {
+	testServer := httptest.NewServer(MakeHandlersMux(testStoreAccess(nil), nil, s.testlog))
+	defer testServer.Close()
+
+	response, err := s.client.Get(testServer.URL + "/blob/garbage")
+	c.Assert(err, IsNil)
+	checkError(c, response, ErrUnknownBlob)
+}
+
+func (s *handlersSuite) TestRespondsToRegisterAndUserUnicast(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	storage := &testUserAuthenticator{
+		testStoreAccess(func(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
+			return sto, nil
+		}),
+		map[string]string{"auth1": "user1"},
+		false,
+	}
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 2)}
+	testServer := httptest.NewServer(MakeHandlersMux(storage, bsend, s.testlog))
+	defer testServer.Close()
+
+	for _, dev := range []string{"dev1", "dev2"} {
+		request := newPostRequest("/register", &Registration{
+			DeviceId: dev,
+			AppId:    "app2",
+		}, testServer)
+		request.Header.Set("Authorization", "auth1")
+		response, err := s.client.Do(request)
+		c.Assert(err, IsNil)
+		c.Check(response.StatusCode, Equals, http.StatusOK)
+		response.Body.Close()
+	}
+
+	request := newPostRequest("/notify/user", &Unicast{
+		UserId:   "user1",
+		AppId:    "app2",
+		ExpireOn: future,
+		Data:     json.RawMessage(`{"foo":"bar"}`),
+	}, testServer)
+	response, err := s.client.Do(request)
+	c.Assert(err, IsNil)
+	c.Check(response.StatusCode, Equals, http.StatusOK)
+	body, err := getResponseBody(response)
+	c.Assert(err, IsNil)
+	var res struct {
+		Devices map[string]map[string]string `json:"devices"`
+	}
+	c.Assert(json.Unmarshal(body, &res), IsNil)
+	c.Check(res.Devices, HasLen, 2)
+	c.Check(res.Devices["dev1"]["msgid"], Not(Equals), "")
+	c.Check(res.Devices["dev2"]["msgid"], Not(Equals), "")
+
+	got := map[store.InternalChannelId]bool{<-bsend.chanId: true, <-bsend.chanId: true}
+	c.Check(got, DeepEquals, map[store.InternalChannelId]bool{
+		store.UnicastInternalChannelId("dev1", "dev1"): true,
+		store.UnicastInternalChannelId("dev2", "dev2"): true,
+	})
+}
+
+func (s *handlersSuite) TestCheckDismissal(c *C) {
+	c.Check(checkDismissal(&Dismissal{DeviceId: "DEV1", AppId: "app1", Tags: []string{"a"}}), IsNil)
+	c.Check(checkDismissal(&Dismissal{AppId: "app1", Tags: []string{"a"}}), Equals, ErrMissingIdField)
+	c.Check(checkDismissal(&Dismissal{DeviceId: "DEV1", Tags: []string{"a"}}), Equals, ErrMissingIdField)
+	c.Check(checkDismissal(&Dismissal{DeviceId: "DEV1", AppId: "app1"}), Equals, ErrMissingTags)
+	c.Check(checkDismissal(&Dismissal{DeviceId: "DEV1", AppId: "app1", Tags: []string{"a", ""}}), Equals, ErrMissingTags)
+}
+
+// userCtx is a context for requests with the credentials of user1,
+// whose devices are DEV1 and DEV2.
+func (s *handlersSuite) userCtx(bsend testBrokerSending) *context {
+	return &context{
+		storage:       &testUserAuthenticator{users: map[string]string{"auth1": "user1", "auth3": "user3"}},
+		broker:        bsend,
+		logger:        s.testlog,
+		authorization: "auth1",
+	}
+}
+
+func (s *handlersSuite) TestDoDismiss(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	c.Assert(sto.AddUserDevice("user1", "DEV1", "app1"), IsNil)
+	c.Assert(sto.AddUserDevice("user1", "DEV2", "app1"), IsNil)
+	c.Assert(sto.AddUserDevice("user1", "DEV3", "app2"), IsNil)
+	c.Assert(sto.AddUserDevice("user2", "DEV4", "app1"), IsNil)
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 1)}
+	res, apiErr := doDismiss(s.userCtx(bsend), sto, &Dismissal{
+		DeviceId: "DEV1",
+		AppId:    "app1",
+		Tags:     []string{"a", "b"},
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(res, DeepEquals, map[string]interface{}{"devices": 1})
+
+	chanId := store.UnicastInternalChannelId("DEV2", "DEV2")
+	c.Check(<-bsend.chanId, Equals, chanId)
+	_, notifs, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Assert(notifs, HasLen, 2)
+	for i, tag := range []string{"a", "b"} {
+		c.Check(notifs[i].AppId, Equals, "app1")
+		c.Check(protocol.ExtractClearInstruction(&notifs[i]), DeepEquals, &protocol.ClearInstruction{Tag: tag})
+	}
+	// nothing for the reporting device itself, nor other users'
+	for _, dev := range []string{"DEV1", "DEV4"} {
+		_, notifs, err = sto.GetChannelSnapshot(store.UnicastInternalChannelId(dev, dev))
+		c.Assert(err, IsNil)
+		c.Check(notifs, HasLen, 0)
+	}
+}
+
+func (s *handlersSuite) TestDoDismissNoUser(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	c.Assert(sto.AddUserDevice("user1", "DEV1", "app1"), IsNil)
+	c.Assert(sto.AddUserDevice("user1", "DEV2", "app1"), IsNil)
+	// without credentials there are no other devices to tell
+	ctx := s.userCtx(testBrokerSending{})
+	ctx.authorization = ""
+	res, apiErr := doDismiss(ctx, sto, &Dismissal{
+		DeviceId: "DEV1",
+		AppId:    "app1",
+		Tags:     []string{"a"},
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(res, DeepEquals, map[string]interface{}{"devices": 0})
+	_, notifs, err := sto.GetChannelSnapshot(store.UnicastInternalChannelId("DEV2", "DEV2"))
+	c.Assert(err, IsNil)
+	c.Check(notifs, HasLen, 0)
+}
+
+func (s *handlersSuite) TestDoDismissUnauthorized(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	c.Assert(sto.AddUserDevice("user1", "DEV1", "app1"), IsNil)
+	c.Assert(sto.AddUserDevice("user1", "DEV2", "app1"), IsNil)
+	dismissal := &Dismissal{
+		DeviceId: "DEV1",
+		AppId:    "app1",
+		Tags:     []string{"a"},
+	}
+	// not the credentials of the device's user
+	ctx := s.userCtx(testBrokerSending{})
+	ctx.authorization = "auth3"
+	_, apiErr := doDismiss(ctx, sto, dismissal)
+	c.Check(apiErr, Equals, ErrUnauthorized)
+	// unrecognised ones, when they're required
+	ctx = s.userCtx(testBrokerSending{})
+	ctx.storage.(*testUserAuthenticator).required = true
+	ctx.authorization = "bogus"
+	_, apiErr = doDismiss(ctx, sto, dismissal)
+	c.Check(apiErr, Equals, ErrUnauthorized)
+	_, notifs, err := sto.GetChannelSnapshot(store.UnicastInternalChannelId("DEV2", "DEV2"))
+	c.Assert(err, IsNil)
+	c.Check(notifs, HasLen, 0)
+}
+
+func (s *handlersSuite) TestDoDismissErrors(c *C) {
+	for _, meth := range []string{"GetUserChannels", "AppendToUnicastChannel"} {
+		s.testlog.ResetCapture()
+		sto := &interceptInMemoryPendingStore{
+			store.NewInMemoryPendingStore(),
+			func(m string, err error) error {
+				if m == meth {
+					return errors.New("fail")
+				}
+				return err
+			},
+		}
+		c.Assert(sto.AddUserDevice("user1", "DEV1", "app1"), IsNil)
+		c.Assert(sto.AddUserDevice("user1", "DEV2", "app1"), IsNil)
+		_, apiErr := doDismiss(s.userCtx(testBrokerSending{}), sto, &Dismissal{
+			DeviceId: "DEV1",
+			AppId:    "app1",
+			Tags:     []string{"a"},
+		})
+		c.Check(apiErr, Equals, ErrCouldNotDismissNotification, Commentf(meth))
+		c.Check(s.testlog.Captured(), Matches, "ERROR .*: fail\n", Commentf(meth))
+	}
+}
+
+func (s *handlersSuite) TestRespondsToDismiss(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	storage := &testUserAuthenticator{
+		testStoreAccess(func(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
+			return sto, nil
+		}),
+		map[string]string{"auth1": "user1"},
+		false,
+	}
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 1)}
+	testServer := httptest.NewServer(MakeHandlersMux(storage, bsend, s.testlog))
+	defer testServer.Close()
+
+	for _, dev := range []string{"dev1", "dev2"} {
+		request := newPostRequest("/register", &Registration{
+			DeviceId: dev,
+			AppId:    "app2",
+		}, testServer)
+		request.Header.Set("Authorization", "auth1")
+		response, err := s.client.Do(request)
+		c.Assert(err, IsNil)
+		c.Check(response.StatusCode, Equals, http.StatusOK)
+		response.Body.Close()
+	}
+
+	request := newPostRequest("/dismiss", &Dismissal{
+		DeviceId: "dev1",
+		AppId:    "app2",
+		Tags:     []string{"tag1"},
+	}, testServer)
+	request.Header.Set("Authorization", "auth1")
+	response, err := s.client.Do(request)
+	c.Assert(err, IsNil)
+	c.Check(response.StatusCode, Equals, http.StatusOK)
+	body, err := getResponseBody(response)
+	c.Assert(err, IsNil)
+	c.Check(string(body), Equals, `{"devices":1,"ok":true}`)
+	c.Check(<-bsend.chanId, Equals, store.UnicastInternalChannelId("dev2", "dev2"))
+}
+
 func (s *handlersSuite) TestRespondsToUnregister(c *C) {
 	yay := make(chan bool, 1)
 	sto := &interceptInMemoryPendingStore{
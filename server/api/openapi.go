@@ -0,0 +1,278 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OpenAPIPath is where the OpenAPI document describing the API is
+// served.
+const OpenAPIPath = "/openapi.json"
+
+// The shapes of the successful responses, for the OpenAPI document.
+
+type okReply struct {
+	Ok bool `json:"ok"`
+}
+
+type unicastReply struct {
+	Ok    bool   `json:"ok"`
+	MsgId string `json:"msgid"`
+}
+
+type deviceResult struct {
+	MsgId   string          `json:"msgid,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Extra   json.RawMessage `json:"extra,omitempty"`
+}
+
+type userUnicastReply struct {
+	Ok bool `json:"ok"`
+	// by device id
+	Devices map[string]deviceResult `json:"devices"`
+}
+
+type streamResult struct {
+	Line    int             `json:"line"`
+	Ok      bool            `json:"ok"`
+	MsgId   string          `json:"msgid,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Extra   json.RawMessage `json:"extra,omitempty"`
+}
+
+type statusReply struct {
+	Ok      bool     `json:"ok"`
+	Pending []string `json:"pending"`
+}
+
+type cancelReply struct {
+	Ok      bool `json:"ok"`
+	Dropped int  `json:"dropped"`
+	Cleared bool `json:"cleared"`
+}
+
+type dismissReply struct {
+	Ok      bool `json:"ok"`
+	Devices int  `json:"devices"`
+}
+
+type registerReply struct {
+	Ok    bool   `json:"ok"`
+	Token string `json:"token"`
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+
+// jsonSchema makes the JSON schema of values of type t as marshalled
+// by encoding/json.
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	if t == rawMessageType {
+		// any JSON value
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Slice:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": jsonSchema(t.Elem()),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": jsonSchema(t.Elem()),
+		}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = jsonSchema(f.Type)
+		}
+		return map[string]interface{}{
+			"type":       "object",
+			"properties": props,
+		}
+	}
+	panic(fmt.Errorf("no JSON schema for %v", t))
+}
+
+func jsonContent(mediaType string, v interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		mediaType: map[string]interface{}{
+			"schema": jsonSchema(reflect.TypeOf(v)),
+		},
+	}
+}
+
+// errorResponses describes by status code the error responses
+// answering with errs.
+func errorResponses(errs []*APIError) map[string]interface{} {
+	labels := make(map[int][]string)
+	messages := make(map[int][]string)
+	for _, apiErr := range errs {
+		code := apiErr.StatusCode
+		messages[code] = append(messages[code], apiErr.Message)
+		found := false
+		for _, label := range labels[code] {
+			if label == apiErr.ErrorLabel {
+				found = true
+				break
+			}
+		}
+		if !found {
+			labels[code] = append(labels[code], apiErr.ErrorLabel)
+		}
+	}
+	responses := make(map[string]interface{}, len(labels))
+	for code, codeLabels := range labels {
+		sort.Strings(codeLabels)
+		schema := jsonSchema(reflect.TypeOf(APIError{}))
+		schema["properties"].(map[string]interface{})["error"] = map[string]interface{}{
+			"type": "string",
+			"enum": codeLabels,
+		}
+		schema["required"] = []string{"error", "message"}
+		responses[strconv.Itoa(code)] = map[string]interface{}{
+			"description": strings.Join(messages[code], "; "),
+			"content": map[string]interface{}{
+				JSONMediaType: map[string]interface{}{"schema": schema},
+			},
+		}
+	}
+	return responses
+}
+
+// openAPIDocument makes the OpenAPI document describing eps.
+func openAPIDocument(eps []*endpoint) map[string]interface{} {
+	paths := make(map[string]interface{}, len(eps)+2)
+	for _, e := range eps {
+		mediaType := JSONMediaType
+		errs := commonErrors
+		if e.stream {
+			mediaType = NDJSONMediaType
+			errs = commonStreamErrors
+		}
+		responses := errorResponses(append(append([]*APIError(nil), errs...), e.errors...))
+		responses["200"] = map[string]interface{}{
+			"description": "Success",
+			"content":     jsonContent(mediaType, e.reply),
+		}
+		paths[e.path] = map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": e.summary,
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content":  jsonContent(mediaType, e.parsingBodyObj()),
+				},
+				"responses": responses,
+			},
+		}
+	}
+	responses := errorResponses([]*APIError{
+		ErrWrongRequestMethodGET,
+		ErrUnknownBlob,
+		ErrStoreUnavailable,
+	})
+	responses["200"] = map[string]interface{}{
+		"description": "The payload kept apart",
+		"content": map[string]interface{}{
+			JSONMediaType: map[string]interface{}{
+				"schema": map[string]interface{}{},
+			},
+		},
+	}
+	paths[BlobPathPrefix+"{id}"] = map[string]interface{}{
+		"get": map[string]interface{}{
+			"summary": "Fetch a payload delivered by reference",
+			"parameters": []interface{}{
+				map[string]interface{}{
+					"name":     "id",
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]interface{}{"type": "string"},
+				},
+			},
+			"responses": responses,
+		},
+	}
+	responses = errorResponses([]*APIError{ErrWrongRequestMethodGET})
+	responses["200"] = map[string]interface{}{
+		"description": "Success",
+		"content": map[string]interface{}{
+			JSONMediaType: map[string]interface{}{
+				"schema": map[string]interface{}{"type": "object"},
+			},
+		},
+	}
+	paths[OpenAPIPath] = map[string]interface{}{
+		"get": map[string]interface{}{
+			"summary":   "This document",
+			"responses": responses,
+		},
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Ubuntu Push server API",
+			"description": "The protobuf alternative served under " + RPCPathPrefix + " is described by push.proto instead.",
+			"version":     "1",
+		},
+		"paths": paths,
+	}
+}
+
+// openAPIHandler serves the OpenAPI document describing eps.
+func openAPIHandler(eps []*endpoint) http.Handler {
+	doc, err := json.Marshal(openAPIDocument(eps))
+	if err != nil {
+		panic(fmt.Errorf("couldn't marshal the OpenAPI document: %v", err))
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != "GET" {
+			RespondError(writer, ErrWrongRequestMethodGET)
+			return
+		}
+		writer.Header().Set("Content-Type", JSONMediaType)
+		writer.Write(doc)
+	})
+}
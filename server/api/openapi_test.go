@@ -0,0 +1,549 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/ubports/ubuntu-push/server/store"
+	help "github.com/ubports/ubuntu-push/testing"
+)
+
+type openAPISuite struct {
+	testlog *help.TestLogger
+}
+
+var _ = Suite(&openAPISuite{})
+
+func (s *openAPISuite) SetUpTest(c *C) {
+	s.testlog = help.NewTestLogger(c, "error")
+}
+
+// a conformance case is a request to one of the endpoints of the mux
+type conformanceCase struct {
+	// request body, the documented method and media type are used
+	body string
+	// tweaks the request
+	prepare func(request *http.Request)
+	// makes StoreForRequest fail
+	storeErr error
+	// makes the named store method fail
+	fail map[string]error
+	// sets up the store
+	setup func(sto store.PendingStore)
+	// replaces the blob store, which otherwise holds testBlobs
+	blobs store.BlobStore
+}
+
+// a blob store holding fixed blobs
+type mapBlobStore map[string][]byte
+
+func (mbs mapBlobStore) PutBlob([]byte, time.Time) (string, error) {
+	return "", errors.New("read-only")
+}
+
+func (mbs mapBlobStore) DropBlob(string) error {
+	return errors.New("read-only")
+}
+
+func (mbs mapBlobStore) GetBlob(blobId string) ([]byte, error) {
+	data, ok := mbs[blobId]
+	if !ok {
+		return nil, store.ErrUnknownBlob
+	}
+	return data, nil
+}
+
+var testBlobs = mapBlobStore{"blob1": []byte(`{"a":1}`)}
+
+// conformanceStorage also authenticates user1 by "auth1".
+type conformanceStorage struct {
+	*testLargePayloadAccess
+}
+
+func (cs conformanceStorage) AuthenticateUser(authorization string) (string, error) {
+	if authorization != "auth1" {
+		return "", store.ErrUnauthorized
+	}
+	return "user1", nil
+}
+
+func (cs conformanceStorage) AuthenticationRequired() bool {
+	return true
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("broken")
+}
+
+// the cases for the errors any endpoint can answer, by status and
+// label
+var commonConformanceCases = map[string]*conformanceCase{
+	"405 invalid-request": {
+		prepare: func(request *http.Request) {
+			if request.Method == "GET" {
+				request.Method = "POST"
+			} else {
+				request.Method = "GET"
+			}
+		},
+	},
+	"411 invalid-request": {
+		body:    "{}",
+		prepare: func(request *http.Request) { request.ContentLength = -1 },
+	},
+	"413 invalid-request": {
+		body: `{"data":"` + strings.Repeat("x", MaxRequestBodyBytes) + `"}`,
+	},
+	"415 invalid-request": {
+		body:    "{}",
+		prepare: func(request *http.Request) { request.Header.Set("Content-Type", "text/plain") },
+	},
+	"400 io-error": {
+		prepare: func(request *http.Request) {
+			request.Body = ioutil.NopCloser(failingReader{})
+			request.ContentLength = 10
+		},
+	},
+	"400 invalid-request": {
+		body: "{",
+	},
+	"401 unauthorized": {
+		body:     "{}",
+		storeErr: ErrUnknownTenant,
+	},
+	"503 unavailable": {
+		body:     "{}",
+		storeErr: ErrStoreUnavailable,
+	},
+	"500 internal": {
+		body:     "{}",
+		storeErr: errors.New("boom"),
+	},
+}
+
+var future2 = time.Now().Add(4 * time.Hour).Format(time.RFC3339)
+
+// the cases for the errors particular to an endpoint, by path, status
+// and label
+var conformanceCases = map[string]*conformanceCase{
+	"/broadcast 400 unknown-channel": {
+		body: `{"channel":"nope","expire_on":"` + future2 + `","data":{}}`,
+	},
+	"/notify 400 unknown-token": {
+		body: `{"token":"garbage","appid":"app1","expire_on":"` + future2 + `","data":{}}`,
+	},
+	"/notify 401 unauthorized": {
+		body: `{"userid":"user1","deviceid":"dev1","appid":"app1","expire_on":"` + future2 + `","data":{}}`,
+		fail: map[string]error{"GetInternalChannelIdFromToken": store.ErrUnauthorized},
+	},
+	"/notify 413 too-many-pending": {
+		body: `{"userid":"user1","deviceid":"dev1","appid":"app1","expire_on":"` + future2 + `","data":{}}`,
+		setup: func(sto store.PendingStore) {
+			chanId := store.UnicastInternalChannelId("user1", "dev1")
+			meta := store.Metadata{Expiration: time.Now().Add(time.Hour)}
+			for i := 0; i < 4; i++ {
+				sto.AppendToUnicastChannel(chanId, "app1", json.RawMessage(`{}`), fmt.Sprintf("m%d", i), meta)
+			}
+		},
+	},
+	"/notify/user 400 unknown-user": {
+		body: `{"userid":"user1","appid":"app1","expire_on":"` + future2 + `","data":{}}`,
+	},
+	"/notify/status 400 unknown-token": {
+		body: `{"token":"garbage","appid":"app1"}`,
+	},
+	"/notify/status 401 unauthorized": {
+		body: `{"userid":"user1","deviceid":"dev1","appid":"app1"}`,
+		fail: map[string]error{"GetInternalChannelIdFromToken": store.ErrUnauthorized},
+	},
+	"/notify/cancel 400 unknown-token": {
+		body: `{"token":"garbage","appid":"app1","msgid":"m1"}`,
+	},
+	"/notify/cancel 401 unauthorized": {
+		body: `{"userid":"user1","deviceid":"dev1","appid":"app1","msgid":"m1"}`,
+		fail: map[string]error{"GetInternalChannelIdFromToken": store.ErrUnauthorized},
+	},
+	"/dismiss 401 unauthorized": {
+		body:    `{"deviceid":"dev1","appid":"app1","tags":["t1"]}`,
+		prepare: func(request *http.Request) { request.Header.Set("Authorization", "bogus") },
+	},
+	"/register 401 unauthorized": {
+		body:    `{"deviceid":"dev1","appid":"app1"}`,
+		prepare: func(request *http.Request) { request.Header.Set("Authorization", "bogus") },
+	},
+	"/blob/{id} 404 unknown-blob": {
+		blobs: mapBlobStore{},
+	},
+	"/blob/{id} 503 unavailable": {
+		blobs: failingBlobStore{},
+	},
+}
+
+// the successful cases, by path
+var conformanceOkCases = map[string]*conformanceCase{
+	"/broadcast": {
+		body: `{"channel":"system","expire_on":"` + future2 + `","data":{}}`,
+	},
+	"/notify": {
+		body: `{"userid":"user1","deviceid":"dev1","appid":"app1","expire_on":"` + future2 + `","data":{}}`,
+	},
+	"/notify/user": {
+		body: `{"userid":"user1","appid":"app1","expire_on":"` + future2 + `","data":{}}`,
+		setup: func(sto store.PendingStore) {
+			sto.AddUserDevice("user1", "dev1", "app1")
+		},
+	},
+	"/notify/stream": {
+		body: `{"userid":"user1","deviceid":"dev1","appid":"app1","expire_on":"` + future2 + `","data":{}}` + "\n" + `{}`,
+	},
+	"/notify/status": {
+		body: `{"userid":"user1","deviceid":"dev1","appid":"app1"}`,
+	},
+	"/notify/cancel": {
+		body: `{"userid":"user1","deviceid":"dev1","appid":"app1","msgid":"m1"}`,
+	},
+	"/dismiss": {
+		body: `{"deviceid":"dev1","appid":"app1","tags":["t1"]}`,
+		setup: func(sto store.PendingStore) {
+			sto.AddUserDevice("user1", "dev1", "app1")
+		},
+		prepare: func(request *http.Request) { request.Header.Set("Authorization", "auth1") },
+	},
+	"/register": {
+		body:    `{"deviceid":"dev1","appid":"app1"}`,
+		prepare: func(request *http.Request) { request.Header.Set("Authorization", "auth1") },
+	},
+	"/unregister": {
+		body: `{"deviceid":"dev1","appid":"app1"}`,
+	},
+	"/blob/{id}": {},
+	OpenAPIPath:  {},
+}
+
+func (s *openAPISuite) serve(c *C, method, path, mediaType string, cc *conformanceCase) *httptest.ResponseRecorder {
+	sto := &interceptInMemoryPendingStore{
+		store.NewInMemoryPendingStore(),
+		func(meth string, err error) error {
+			if failErr, ok := cc.fail[meth]; ok {
+				return failErr
+			}
+			return err
+		},
+	}
+	if cc.setup != nil {
+		cc.setup(sto)
+	}
+	blobs := cc.blobs
+	if blobs == nil {
+		blobs = testBlobs
+	}
+	storage := conformanceStorage{&testLargePayloadAccess{
+		testStoreAccess(func(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
+			if cc.storeErr != nil {
+				return nil, cc.storeErr
+			}
+			return sto, nil
+		}),
+		nil,
+		blobs,
+	}}
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 10)}
+	mux := MakeHandlersMux(storage, bsend, s.testlog)
+	path = strings.Replace(path, "{id}", "blob1", 1)
+	request, err := http.NewRequest(method, "http://push"+path, strings.NewReader(cc.body))
+	c.Assert(err, IsNil)
+	request.Header.Set("Content-Type", mediaType)
+	if cc.prepare != nil {
+		cc.prepare(request)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, request)
+	return rec
+}
+
+func (s *openAPISuite) getDocument(c *C) map[string]interface{} {
+	rec := s.serve(c, "GET", OpenAPIPath, "", &conformanceCase{})
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.Header().Get("Content-Type"), Equals, JSONMediaType)
+	var doc map[string]interface{}
+	err := json.Unmarshal(rec.Body.Bytes(), &doc)
+	c.Assert(err, IsNil)
+	return doc
+}
+
+// obj gets the JSON object at the path of keys in v.
+func obj(v interface{}, keys ...string) map[string]interface{} {
+	for _, k := range keys {
+		v = v.(map[string]interface{})[k]
+	}
+	return v.(map[string]interface{})
+}
+
+func keys(m map[string]interface{}) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (s *openAPISuite) TestDocument(c *C) {
+	doc := s.getDocument(c)
+	c.Check(doc["openapi"], Equals, "3.0.3")
+	paths := obj(doc, "paths")
+	c.Check(keys(paths), DeepEquals, []string{
+		"/blob/{id}",
+		"/broadcast",
+		"/dismiss",
+		"/notify",
+		"/notify/cancel",
+		"/notify/status",
+		"/notify/stream",
+		"/notify/user",
+		OpenAPIPath,
+		"/register",
+		"/unregister",
+	})
+	// the request schemas are made from the handler types
+	props := obj(paths, "/notify", "post", "requestBody", "content", JSONMediaType, "schema", "properties")
+	c.Check(keys(props), DeepEquals, []string{
+		"appid", "clear_pending", "data", "deliver_after", "deviceid",
+		"expire_on", "replace_tag", "token", "userid",
+	})
+	c.Check(props["data"], DeepEquals, map[string]interface{}{})
+	props = obj(paths, "/dismiss", "post", "requestBody", "content", JSONMediaType, "schema", "properties")
+	c.Check(props["tags"], DeepEquals, map[string]interface{}{
+		"type":  "array",
+		"items": map[string]interface{}{"type": "string"},
+	})
+	// errors sharing status are described together
+	resp400 := obj(paths, "/notify", "post", "responses", "400")
+	c.Check(resp400["description"], Matches, ".*Missing id field.*Unknown token.*")
+	c.Check(obj(resp400, "content", JSONMediaType, "schema", "properties", "error")["enum"], DeepEquals, []interface{}{
+		"invalid-request", "io-error", "unknown-token",
+	})
+
+	rec := s.serve(c, "POST", OpenAPIPath, JSONMediaType, &conformanceCase{body: "{}"})
+	c.Check(rec.Code, Equals, http.StatusMethodNotAllowed)
+}
+
+func (s *openAPISuite) TestConformance(c *C) {
+	doc := s.getDocument(c)
+	used := make(map[string]bool)
+	for path, item := range obj(doc, "paths") {
+		for method, op := range item.(map[string]interface{}) {
+			method = strings.ToUpper(method)
+			mediaType := JSONMediaType
+			if reqBody, ok := op.(map[string]interface{})["requestBody"]; ok {
+				mediaType = keys(obj(reqBody, "content"))[0]
+			}
+			for status, resp := range obj(op, "responses") {
+				content := obj(resp, "content")
+				schema := obj(content, keys(content)[0], "schema")
+				if status == "200" {
+					cc := conformanceOkCases[path]
+					if cc == nil {
+						c.Errorf("no conformance case for %s %s", path, status)
+						continue
+					}
+					rec := s.serve(c, method, path, mediaType, cc)
+					c.Check(rec.Code, Equals, http.StatusOK, Commentf("%s %s", path, rec.Body))
+					s.checkOk(c, path, schema, rec.Body.String())
+					continue
+				}
+				for _, label := range obj(schema, "properties", "error")["enum"].([]interface{}) {
+					what := fmt.Sprintf("%s %s", status, label)
+					cc := conformanceCases[path+" "+what]
+					if cc != nil {
+						used[path+" "+what] = true
+					} else {
+						cc = commonConformanceCases[what]
+					}
+					if cc == nil {
+						c.Errorf("no conformance case for %s %s", path, what)
+						continue
+					}
+					rec := s.serve(c, method, path, mediaType, cc)
+					var apiErr APIError
+					err := json.Unmarshal(rec.Body.Bytes(), &apiErr)
+					c.Assert(err, IsNil, Commentf("%s %s: %q", path, what, rec.Body))
+					c.Check(fmt.Sprintf("%d %s", rec.Code, apiErr.ErrorLabel), Equals, what, Commentf("%s: %s", path, apiErr.Message))
+				}
+			}
+		}
+	}
+	for what := range conformanceCases {
+		c.Check(used[what], Equals, true, Commentf("%s not documented", what))
+	}
+}
+
+// checkOk checks that the properties of the successful response body
+// are documented; stream endpoints answer a result per line.
+func (s *openAPISuite) checkOk(c *C, path string, schema map[string]interface{}, body string) {
+	documented, ok := schema["properties"].(map[string]interface{})
+	if !ok {
+		// not described any further
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		var res map[string]interface{}
+		err := json.Unmarshal([]byte(line), &res)
+		c.Assert(err, IsNil, Commentf("%s: %q", path, line))
+		for k := range res {
+			_, ok := documented[k]
+			c.Check(ok, Equals, true, Commentf("%s: %s not documented", path, k))
+		}
+	}
+}
+
+// apiErrorsReachable parses the package and finds, by variable name,
+// the messages of the *APIErrors that the named functions, given as
+// Type.Method for methods, or what they call refer to. Calls through
+// a method name are followed to all the methods of that name.
+func apiErrorsReachable(c *C, roots ...string) map[string]string {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	c.Assert(err, IsNil)
+	funcs := make(map[string]*ast.FuncDecl)
+	byName := make(map[string][]string)
+	apiErrs := make(map[string]string)
+	for _, f := range pkgs["api"].Files {
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				key := d.Name.Name
+				if d.Recv != nil {
+					recv := d.Recv.List[0].Type
+					if star, ok := recv.(*ast.StarExpr); ok {
+						recv = star.X
+					}
+					key = recv.(*ast.Ident).Name + "." + key
+				}
+				funcs[key] = d
+				byName[d.Name.Name] = append(byName[d.Name.Name], key)
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					vs, ok := spec.(*ast.ValueSpec)
+					if !ok {
+						continue
+					}
+					for i, v := range vs.Values {
+						u, ok := v.(*ast.UnaryExpr)
+						if !ok {
+							continue
+						}
+						lit, ok := u.X.(*ast.CompositeLit)
+						if !ok || len(lit.Elts) < 3 {
+							continue
+						}
+						if id, ok := lit.Type.(*ast.Ident); !ok || id.Name != "APIError" {
+							continue
+						}
+						msg, err := strconv.Unquote(lit.Elts[2].(*ast.BasicLit).Value)
+						c.Assert(err, IsNil)
+						apiErrs[vs.Names[i].Name] = msg
+					}
+				}
+			}
+		}
+	}
+	found := make(map[string]string)
+	seen := make(map[string]bool)
+	var follow func(key string)
+	follow = func(key string) {
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		ast.Inspect(funcs[key].Body, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok {
+				if msg, ok := apiErrs[id.Name]; ok {
+					found[id.Name] = msg
+				}
+				for _, key := range byName[id.Name] {
+					follow(key)
+				}
+			}
+			return true
+		})
+	}
+	for _, root := range roots {
+		c.Assert(funcs[root], NotNil, Commentf("no %s", root))
+		follow(root)
+	}
+	return found
+}
+
+// the errors endpoints report within successful responses, by path
+var errorsInResults = map[string][]string{
+	// for each device
+	"/notify/user": {"ErrTooManyPendingNotifications"},
+	// for each line
+	"/notify/stream": {"ErrLineTooLarge", "ErrMalformedJSONObject", "ErrTooManyStreamLines"},
+}
+
+func (s *openAPISuite) TestEndpointErrorsListed(c *C) {
+	for _, e := range endpoints {
+		var found map[string]string
+		listed := make(map[string]bool)
+		if e.stream {
+			found = apiErrorsReachable(c, "StreamHandler.ServeHTTP")
+			for _, apiErr := range commonStreamErrors {
+				listed[apiErr.Message] = true
+			}
+		} else {
+			doHandle := runtime.FuncForPC(reflect.ValueOf(e.doHandle).Pointer()).Name()
+			found = apiErrorsReachable(c, "JSONPostHandler.ServeHTTP", doHandle[strings.LastIndex(doHandle, ".")+1:])
+			for _, apiErr := range commonErrors {
+				listed[apiErr.Message] = true
+			}
+		}
+		for _, apiErr := range e.errors {
+			listed[apiErr.Message] = true
+		}
+		for _, name := range errorsInResults[e.path] {
+			c.Check(found[name], Not(Equals), "", Commentf("%s doesn't report %s", e.path, name))
+			delete(found, name)
+		}
+		for name, msg := range found {
+			c.Check(listed[msg], Equals, true, Commentf("%s can answer %s", e.path, name))
+		}
+	}
+}
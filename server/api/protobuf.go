@@ -0,0 +1,210 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+// Just enough of the protobuf binary format for the flat messages of
+// push.proto, driven by struct tags giving the field numbers, as in
+//
+//     Token string `proto:"1"`
+//
+// Supported field types are string, []byte, bool, int64 and []string.
+// As in proto3 fields with default values are not encoded.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var (
+	errProtoTruncated = errors.New("protobuf: truncated message")
+	errProtoOverflow  = errors.New("protobuf: varint overflow")
+)
+
+var byteSliceType = reflect.TypeOf([]byte(nil))
+
+// protoField gets the field number of the i-th field of struct type t,
+// or 0 if the field is not to be encoded.
+func protoField(t reflect.Type, i int) int {
+	num, err := strconv.Atoi(t.Field(i).Tag.Get("proto"))
+	if err != nil || num <= 0 {
+		return 0
+	}
+	return num
+}
+
+func appendKey(b []byte, num int, wire uint64) []byte {
+	return appendVarint(b, uint64(num)<<3|wire)
+}
+
+func appendVarint(b []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	return append(b, buf[:n]...)
+}
+
+func appendBytes(b []byte, num int, data []byte) []byte {
+	b = appendKey(b, num, wireBytes)
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// MarshalProto encodes v, a pointer to a struct tagged as described
+// above, in the protobuf binary format.
+func MarshalProto(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v).Elem()
+	t := rv.Type()
+	var b []byte
+	for i := 0; i < t.NumField(); i++ {
+		num := protoField(t, i)
+		if num == 0 {
+			continue
+		}
+		f := rv.Field(i)
+		switch {
+		case f.Kind() == reflect.String:
+			if f.Len() != 0 {
+				b = appendBytes(b, num, []byte(f.String()))
+			}
+		case f.Type() == byteSliceType:
+			if f.Len() != 0 {
+				b = appendBytes(b, num, f.Bytes())
+			}
+		case f.Kind() == reflect.Bool:
+			if f.Bool() {
+				b = appendKey(b, num, wireVarint)
+				b = appendVarint(b, 1)
+			}
+		case f.Kind() == reflect.Int64:
+			if f.Int() != 0 {
+				b = appendKey(b, num, wireVarint)
+				b = appendVarint(b, uint64(f.Int()))
+			}
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String:
+			for j := 0; j < f.Len(); j++ {
+				b = appendBytes(b, num, []byte(f.Index(j).String()))
+			}
+		default:
+			return nil, fmt.Errorf("protobuf: unsupported field type %v", f.Type())
+		}
+	}
+	return b, nil
+}
+
+func consumeVarint(b []byte) (uint64, []byte, error) {
+	x, n := binary.Uvarint(b)
+	if n == 0 {
+		return 0, nil, errProtoTruncated
+	}
+	if n < 0 {
+		return 0, nil, errProtoOverflow
+	}
+	return x, b[n:], nil
+}
+
+// consumeValue consumes a value of the given wire type, returning it
+// either as a varint or as bytes.
+func consumeValue(b []byte, wire uint64) (x uint64, data []byte, rest []byte, err error) {
+	switch wire {
+	case wireVarint:
+		x, rest, err = consumeVarint(b)
+		return x, nil, rest, err
+	case wireBytes:
+		var l uint64
+		l, b, err = consumeVarint(b)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if l > uint64(len(b)) {
+			return 0, nil, nil, errProtoTruncated
+		}
+		return 0, b[:l], b[l:], nil
+	case wireFixed64:
+		if len(b) < 8 {
+			return 0, nil, nil, errProtoTruncated
+		}
+		return binary.LittleEndian.Uint64(b), nil, b[8:], nil
+	case wireFixed32:
+		if len(b) < 4 {
+			return 0, nil, nil, errProtoTruncated
+		}
+		return uint64(binary.LittleEndian.Uint32(b)), nil, b[4:], nil
+	}
+	return 0, nil, nil, fmt.Errorf("protobuf: unsupported wire type %d", wire)
+}
+
+// UnmarshalProto decodes the protobuf binary encoded b into v, a
+// pointer to a struct tagged as described above. Unknown fields are
+// skipped.
+func UnmarshalProto(b []byte, v interface{}) error {
+	rv := reflect.ValueOf(v).Elem()
+	t := rv.Type()
+	fields := make(map[int]reflect.Value, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if num := protoField(t, i); num != 0 {
+			fields[num] = rv.Field(i)
+		}
+	}
+	for len(b) != 0 {
+		key, rest, err := consumeVarint(b)
+		if err != nil {
+			return err
+		}
+		num, wire := int(key>>3), key&7
+		x, data, rest, err := consumeValue(rest, wire)
+		if err != nil {
+			return err
+		}
+		b = rest
+		f, ok := fields[num]
+		if !ok {
+			continue
+		}
+		var want uint64 = wireBytes
+		if f.Kind() == reflect.Bool || f.Kind() == reflect.Int64 {
+			want = wireVarint
+		}
+		if wire != want {
+			return fmt.Errorf("protobuf: wrong wire type %d for field %d", wire, num)
+		}
+		switch {
+		case f.Kind() == reflect.String:
+			f.SetString(string(data))
+		case f.Type() == byteSliceType:
+			f.SetBytes(append([]byte(nil), data...))
+		case f.Kind() == reflect.Bool:
+			f.SetBool(x != 0)
+		case f.Kind() == reflect.Int64:
+			f.SetInt(int64(x))
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String:
+			f.Set(reflect.Append(f, reflect.ValueOf(string(data))))
+		default:
+			return fmt.Errorf("protobuf: unsupported field type %v", f.Type())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"strings"
+
+	. "launchpad.net/gocheck"
+)
+
+type protobufSuite struct{}
+
+var _ = Suite(&protobufSuite{})
+
+type protoTest struct {
+	Name    string   `proto:"1"`
+	Count   int64    `proto:"2"`
+	Flag    bool     `proto:"3"`
+	Blob    []byte   `proto:"4"`
+	Tags    []string `proto:"5"`
+	ignored string
+}
+
+func (s *protobufSuite) TestMarshalKnownEncodings(c *C) {
+	// the examples from the protobuf encoding documentation
+	b, err := MarshalProto(&protoTest{Count: 150})
+	c.Assert(err, IsNil)
+	c.Check(b, DeepEquals, []byte{0x10, 0x96, 0x01})
+	b, err = MarshalProto(&protoTest{Name: "testing"})
+	c.Assert(err, IsNil)
+	c.Check(b, DeepEquals, []byte{0x0a, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'})
+	// default values are not encoded
+	b, err = MarshalProto(&protoTest{ignored: "x"})
+	c.Assert(err, IsNil)
+	c.Check(b, HasLen, 0)
+}
+
+func (s *protobufSuite) TestRoundTrip(c *C) {
+	msg := &protoTest{
+		Name:  "name",
+		Count: -1,
+		Flag:  true,
+		Blob:  []byte{0, 1, 2},
+		Tags:  []string{"a", "", "c"},
+	}
+	b, err := MarshalProto(msg)
+	c.Assert(err, IsNil)
+	var got protoTest
+	c.Assert(UnmarshalProto(b, &got), IsNil)
+	c.Check(&got, DeepEquals, msg)
+}
+
+func (s *protobufSuite) TestUnmarshalSkipsUnknownFields(c *C) {
+	b := []byte{
+		0x30, 0x01, // 6: varint
+		0x39, 1, 2, 3, 4, 5, 6, 7, 8, // 7: fixed64
+		0x45, 1, 2, 3, 4, // 8: fixed32
+		0x4a, 0x01, 'x', // 9: bytes
+		0x0a, 0x01, 'n', // 1: name
+	}
+	var got protoTest
+	c.Assert(UnmarshalProto(b, &got), IsNil)
+	c.Check(got, DeepEquals, protoTest{Name: "n"})
+}
+
+func (s *protobufSuite) TestUnmarshalErrors(c *C) {
+	var got protoTest
+	for _, b := range [][]byte{
+		{0x0a},             // missing length
+		{0x0a, 0x05, 'x'},  // truncated bytes
+		{0x10, 0x96},       // truncated varint
+		{0x39, 1, 2},       // truncated fixed64
+		{0x0b},             // unsupported wire type
+		{0x08, 0x01},       // wrong wire type for a string
+		{0x12, 0x01, 0x01}, // wrong wire type for an int
+	} {
+		c.Check(UnmarshalProto(b, &got), NotNil, Commentf("%x", b))
+	}
+}
+
+func (s *protobufSuite) TestMarshalUnsupported(c *C) {
+	_, err := MarshalProto(&struct {
+		F float64 `proto:"1"`
+	}{1})
+	c.Check(err, ErrorMatches, "protobuf: unsupported field type float64")
+}
+
+// golden encodings of push.proto messages, as written by
+//
+//	protoc --encode=ubuntu_push.<Message> push.proto < message.txt
+//
+// laid out field by field.
+var (
+	goldenData = `{"x":"` + strings.Repeat("a", 142) + `"}`
+
+	goldenNotifyRequest = []byte("" +
+		"\x0a\x03tok" + // 1: token
+		"\x1a\x04dev1" + // 3: deviceid
+		"\x22\x13com.example.app_app" + // 4: appid
+		"\x2a\x142016-01-01T00:00:00Z" + // 5: expire_on
+		"\x32\x96\x01" + goldenData + // 6: data, a two byte length
+		"\x40\x01" + // 8: clear_pending
+		"\x4a\x03tag") // 9: replace_tag
+	goldenStatusReply = []byte("" +
+		"\x0a\x02m1" + // 1: pending
+		"\x0a\x00" + // 1: pending, an empty element is still there
+		"\x0a\x02m3") // 1: pending
+	goldenError = []byte("" +
+		"\x0a\x0dunknown-token" + // 1: error
+		"\x12\x0eUnknown token." + // 2: message
+		"\x1a\x02{}") // 3: extra
+)
+
+func (s *protobufSuite) TestGoldenEncodings(c *C) {
+	for _, t := range []struct {
+		msg    interface{}
+		empty  interface{}
+		golden []byte
+	}{
+		{&NotifyRequest{
+			Token:        "tok",
+			DeviceId:     "dev1",
+			AppId:        "com.example.app_app",
+			ExpireOn:     "2016-01-01T00:00:00Z",
+			Data:         goldenData,
+			ClearPending: true,
+			ReplaceTag:   "tag",
+		}, &NotifyRequest{}, goldenNotifyRequest},
+		{&StatusReply{
+			Pending: []string{"m1", "", "m3"},
+		}, &StatusReply{}, goldenStatusReply},
+		{&RPCError{
+			Error:   "unknown-token",
+			Message: "Unknown token.",
+			Extra:   "{}",
+		}, &RPCError{}, goldenError},
+	} {
+		b, err := MarshalProto(t.msg)
+		c.Assert(err, IsNil)
+		c.Check(b, DeepEquals, t.golden, Commentf("%T", t.msg))
+		c.Assert(UnmarshalProto(t.golden, t.empty), IsNil)
+		c.Check(t.empty, DeepEquals, t.msg)
+	}
+}
+
+func (s *protobufSuite) TestUnmarshalAnyFieldOrder(c *C) {
+	// parsers must take the fields in whatever order they come
+	b := []byte("" +
+		"\x4a\x03tag" + // 9: replace_tag
+		"\x0a\x03tok") // 1: token
+	var got NotifyRequest
+	c.Assert(UnmarshalProto(b, &got), IsNil)
+	c.Check(got, DeepEquals, NotifyRequest{Token: "tok", ReplaceTag: "tag"})
+}
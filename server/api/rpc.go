@@ -0,0 +1,290 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/ubports/ubuntu-push/server/store"
+)
+
+const ProtobufMediaType = "application/x-protobuf"
+
+// RPCPathPrefix is the path prefix of the protobuf over HTTP service
+// described by push.proto, a method is called by POSTing its request
+// message to RPCPathPrefix + method name.
+const RPCPathPrefix = "/rpc/"
+
+// The messages of push.proto. Data fields carry JSON text.
+
+type BroadcastRequest struct {
+	Channel      string `proto:"1"`
+	AppId        string `proto:"2"`
+	ExpireOn     string `proto:"3"`
+	Data         string `proto:"4"`
+	DeliverAfter string `proto:"5"`
+}
+
+type BroadcastReply struct{}
+
+type NotifyRequest struct {
+	Token        string `proto:"1"`
+	UserId       string `proto:"2"`
+	DeviceId     string `proto:"3"`
+	AppId        string `proto:"4"`
+	ExpireOn     string `proto:"5"`
+	Data         string `proto:"6"`
+	DeliverAfter string `proto:"7"`
+	ClearPending bool   `proto:"8"`
+	ReplaceTag   string `proto:"9"`
+}
+
+type NotifyReply struct {
+	MsgId string `proto:"1"`
+}
+
+type RegisterRequest struct {
+	DeviceId string `proto:"1"`
+	AppId    string `proto:"2"`
+}
+
+type RegisterReply struct {
+	Token string `proto:"1"`
+}
+
+type UnregisterRequest struct {
+	DeviceId string `proto:"1"`
+	AppId    string `proto:"2"`
+}
+
+type UnregisterReply struct{}
+
+type StatusRequest struct {
+	Token    string `proto:"1"`
+	UserId   string `proto:"2"`
+	DeviceId string `proto:"3"`
+	AppId    string `proto:"4"`
+}
+
+type StatusReply struct {
+	Pending []string `proto:"1"`
+}
+
+// RPCError is the message of error responses, which carry the http
+// status code of the corresponding APIError.
+type RPCError struct {
+	Error   string `proto:"1"`
+	Message string `proto:"2"`
+	Extra   string `proto:"3"`
+}
+
+// rpcData checks that data is JSON text, as for the JSON API.
+func rpcData(data string) (json.RawMessage, *APIError) {
+	if data == "" {
+		return nil, nil
+	}
+	var raw json.RawMessage
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return nil, ErrMalformedJSONObject
+	}
+	return raw, nil
+}
+
+// rpcMethod maps a method onto the handling shared with the JSON API.
+type rpcMethod struct {
+	newRequest func() interface{}
+	handle     func(ctx *context, sto store.PendingStore, req interface{}) (interface{}, *APIError)
+}
+
+var rpcMethods = map[string]*rpcMethod{
+	"Broadcast": {
+		func() interface{} { return &BroadcastRequest{} },
+		func(ctx *context, sto store.PendingStore, req interface{}) (interface{}, *APIError) {
+			r := req.(*BroadcastRequest)
+			data, apiErr := rpcData(r.Data)
+			if apiErr != nil {
+				return nil, apiErr
+			}
+			_, apiErr = doBroadcast(ctx, sto, &Broadcast{
+				Channel:      r.Channel,
+				AppId:        r.AppId,
+				ExpireOn:     r.ExpireOn,
+				Data:         data,
+				DeliverAfter: r.DeliverAfter,
+			})
+			return &BroadcastReply{}, apiErr
+		},
+	},
+	"Notify": {
+		func() interface{} { return &NotifyRequest{} },
+		func(ctx *context, sto store.PendingStore, req interface{}) (interface{}, *APIError) {
+			r := req.(*NotifyRequest)
+			data, apiErr := rpcData(r.Data)
+			if apiErr != nil {
+				return nil, apiErr
+			}
+			res, apiErr := doUnicast(ctx, sto, &Unicast{
+				Token:        r.Token,
+				UserId:       r.UserId,
+				DeviceId:     r.DeviceId,
+				AppId:        r.AppId,
+				ExpireOn:     r.ExpireOn,
+				Data:         data,
+				DeliverAfter: r.DeliverAfter,
+				ClearPending: r.ClearPending,
+				ReplaceTag:   r.ReplaceTag,
+			})
+			if apiErr != nil {
+				return nil, apiErr
+			}
+			return &NotifyReply{MsgId: res["msgid"].(string)}, nil
+		},
+	},
+	"Register": {
+		func() interface{} { return &RegisterRequest{} },
+		func(ctx *context, sto store.PendingStore, req interface{}) (interface{}, *APIError) {
+			r := req.(*RegisterRequest)
+			res, apiErr := doRegister(ctx, sto, &Registration{
+				DeviceId: r.DeviceId,
+				AppId:    r.AppId,
+			})
+			if apiErr != nil {
+				return nil, apiErr
+			}
+			return &RegisterReply{Token: res["token"].(string)}, nil
+		},
+	},
+	"Unregister": {
+		func() interface{} { return &UnregisterRequest{} },
+		func(ctx *context, sto store.PendingStore, req interface{}) (interface{}, *APIError) {
+			r := req.(*UnregisterRequest)
+			_, apiErr := doUnregister(ctx, sto, &Registration{
+				DeviceId: r.DeviceId,
+				AppId:    r.AppId,
+			})
+			return &UnregisterReply{}, apiErr
+		},
+	},
+	"Status": {
+		func() interface{} { return &StatusRequest{} },
+		func(ctx *context, sto store.PendingStore, req interface{}) (interface{}, *APIError) {
+			r := req.(*StatusRequest)
+			res, apiErr := doStatus(ctx, sto, &StatusQuery{
+				Token:    r.Token,
+				UserId:   r.UserId,
+				DeviceId: r.DeviceId,
+				AppId:    r.AppId,
+			})
+			if apiErr != nil {
+				return nil, apiErr
+			}
+			return &StatusReply{Pending: res["pending"].([]string)}, nil
+		},
+	},
+}
+
+// RPCHandler serves the protobuf over HTTP alternative to the JSON
+// API, validating and handling requests the same way.
+type RPCHandler struct {
+	*context
+}
+
+// RespondRPCError writes back a protobuf error response for a APIError.
+func RespondRPCError(writer http.ResponseWriter, apiErr *APIError) {
+	wireError, err := MarshalProto(&RPCError{
+		Error:   apiErr.ErrorLabel,
+		Message: apiErr.Message,
+		Extra:   string(apiErr.Extra),
+	})
+	if err != nil {
+		panic(fmt.Errorf("couldn't marshal our own errors: %v", err))
+	}
+	writer.Header().Set("Content-Type", ProtobufMediaType)
+	writer.WriteHeader(apiErr.StatusCode)
+	writer.Write(wireError)
+}
+
+func readProtoBody(request *http.Request, maxBodySize int64) ([]byte, *APIError) {
+	if request.Method != "POST" {
+		return nil, ErrWrongRequestMethod
+	}
+	// protobuf clients may well stream their requests, so unlike
+	// the JSON API a missing Content-Length is fine here
+	if request.ContentLength > maxBodySize {
+		return nil, ErrRequestBodyTooLarge
+	}
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil || mediaType != ProtobufMediaType {
+		return nil, ErrWrongProtoContentType
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(request.Body, maxBodySize+1))
+	if err != nil {
+		return nil, ErrCouldNotReadBody
+	}
+	if int64(len(body)) > maxBodySize {
+		return nil, ErrRequestBodyTooLarge
+	}
+	// an empty body is fine, it's an all-defaults message
+	return body, nil
+}
+
+func (h *RPCHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	var apiErr *APIError
+	defer func() {
+		if apiErr != nil {
+			RespondRPCError(writer, apiErr)
+		}
+	}()
+
+	ctx := h.forRequest(writer, request)
+	method := rpcMethods[strings.TrimPrefix(request.URL.Path, RPCPathPrefix)]
+	if method == nil {
+		apiErr = ErrUnknownRPCMethod
+		return
+	}
+	body, apiErr := readProtoBody(request, ctx.maxBodySize())
+	if apiErr != nil {
+		return
+	}
+	req := method.newRequest()
+	if err := UnmarshalProto(body, req); err != nil {
+		apiErr = ErrMalformedProtoMessage
+		return
+	}
+	sto, apiErr := ctx.getStore(writer, request)
+	if apiErr != nil {
+		return
+	}
+	defer sto.Close()
+
+	reply, apiErr := method.handle(ctx, sto, req)
+	if apiErr != nil {
+		return
+	}
+	resp, err := MarshalProto(reply)
+	if err != nil {
+		panic(fmt.Errorf("couldn't marshal our own response: %v", err))
+	}
+	writer.Header().Set("Content-Type", ProtobufMediaType)
+	writer.Write(resp)
+}
@@ -0,0 +1,206 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/ubports/ubuntu-push/server/store"
+	help "github.com/ubports/ubuntu-push/testing"
+)
+
+type rpcSuite struct {
+	sto        *store.InMemoryPendingStore
+	storeErr   error
+	bsend      testBrokerSending
+	testServer *httptest.Server
+	testlog    *help.TestLogger
+}
+
+var _ = Suite(&rpcSuite{})
+
+func (s *rpcSuite) SetUpTest(c *C) {
+	s.testlog = help.NewTestLogger(c, "error")
+	s.sto = store.NewInMemoryPendingStore()
+	s.storeErr = nil
+	storage := testStoreAccess(func(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
+		if s.storeErr != nil {
+			return nil, s.storeErr
+		}
+		return s.sto, nil
+	})
+	s.bsend = testBrokerSending{make(chan store.InternalChannelId, 10)}
+	s.testServer = httptest.NewServer(MakeHandlersMux(storage, s.bsend, s.testlog))
+}
+
+func (s *rpcSuite) TearDownTest(c *C) {
+	s.testServer.Close()
+}
+
+func (s *rpcSuite) postRaw(c *C, method, contentType string, body []byte) *http.Response {
+	resp, err := http.Post(s.testServer.URL+RPCPathPrefix+method, contentType, bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	return resp
+}
+
+// postStreamed posts body chunked, i.e. without a Content-Length.
+func (s *rpcSuite) postStreamed(c *C, method string, body []byte) *http.Response {
+	// a plain io.Reader hides the size from net/http
+	resp, err := http.Post(s.testServer.URL+RPCPathPrefix+method, ProtobufMediaType, io.MultiReader(bytes.NewReader(body)))
+	c.Assert(err, IsNil)
+	return resp
+}
+
+// call calls method, decoding either the reply into reply or the error,
+// which is returned.
+func (s *rpcSuite) call(c *C, method string, req, reply interface{}) (int, *RPCError) {
+	body, err := MarshalProto(req)
+	c.Assert(err, IsNil)
+	resp := s.postRaw(c, method, ProtobufMediaType, body)
+	c.Check(resp.Header.Get("Content-Type"), Equals, ProtobufMediaType)
+	respBody, err := getResponseBody(resp)
+	c.Assert(err, IsNil)
+	if resp.StatusCode != http.StatusOK {
+		rpcErr := &RPCError{}
+		c.Assert(UnmarshalProto(respBody, rpcErr), IsNil)
+		return resp.StatusCode, rpcErr
+	}
+	c.Assert(UnmarshalProto(respBody, reply), IsNil)
+	return resp.StatusCode, nil
+}
+
+func checkRPCError(c *C, status int, rpcErr *RPCError, apiErr *APIError) {
+	c.Check(status, Equals, apiErr.StatusCode)
+	c.Assert(rpcErr, NotNil)
+	c.Check(rpcErr.Error, Equals, apiErr.ErrorLabel)
+	c.Check(rpcErr.Message, Equals, apiErr.Message)
+}
+
+func (s *rpcSuite) TestRegisterNotifyStatusUnregister(c *C) {
+	var regReply RegisterReply
+	_, rpcErr := s.call(c, "Register", &RegisterRequest{DeviceId: "dev1", AppId: "app1"}, &regReply)
+	c.Assert(rpcErr, IsNil)
+	c.Check(regReply.Token, Not(Equals), "")
+
+	var notifyReply NotifyReply
+	_, rpcErr = s.call(c, "Notify", &NotifyRequest{
+		Token:    regReply.Token,
+		AppId:    "app1",
+		ExpireOn: future,
+		Data:     `{"foo":"bar"}`,
+	}, &notifyReply)
+	c.Assert(rpcErr, IsNil)
+	c.Check(notifyReply.MsgId, Not(Equals), "")
+	c.Check(<-s.bsend.chanId, Equals, store.UnicastInternalChannelId("dev1", "dev1"))
+
+	var statusReply StatusReply
+	_, rpcErr = s.call(c, "Status", &StatusRequest{Token: regReply.Token, AppId: "app1"}, &statusReply)
+	c.Assert(rpcErr, IsNil)
+	c.Check(statusReply.Pending, DeepEquals, []string{notifyReply.MsgId})
+
+	status, rpcErr := s.call(c, "Status", &StatusRequest{Token: "garbage", AppId: "app1"}, &statusReply)
+	checkRPCError(c, status, rpcErr, ErrUnknownToken)
+
+	_, rpcErr = s.call(c, "Unregister", &UnregisterRequest{DeviceId: "dev1", AppId: "app1"}, &UnregisterReply{})
+	c.Assert(rpcErr, IsNil)
+}
+
+func (s *rpcSuite) TestStreamedRequest(c *C) {
+	body, err := MarshalProto(&RegisterRequest{DeviceId: "dev1", AppId: "app1"})
+	c.Assert(err, IsNil)
+	resp := s.postStreamed(c, "Register", body)
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	respBody, err := getResponseBody(resp)
+	c.Assert(err, IsNil)
+	var regReply RegisterReply
+	c.Assert(UnmarshalProto(respBody, &regReply), IsNil)
+	c.Check(regReply.Token, Not(Equals), "")
+}
+
+func (s *rpcSuite) TestBroadcast(c *C) {
+	_, rpcErr := s.call(c, "Broadcast", &BroadcastRequest{
+		Channel:  "system",
+		ExpireOn: future,
+		Data:     `{"n":42}`,
+	}, &BroadcastReply{})
+	c.Assert(rpcErr, IsNil)
+	c.Check(<-s.bsend.chanId, Equals, store.SystemInternalChannelId)
+	top, _, err := s.sto.GetChannelSnapshot(store.SystemInternalChannelId)
+	c.Assert(err, IsNil)
+	c.Check(top, Equals, int64(1))
+}
+
+func (s *rpcSuite) TestSharedValidation(c *C) {
+	status, rpcErr := s.call(c, "Notify", &NotifyRequest{
+		UserId:   "user1",
+		DeviceId: "dev1",
+		ExpireOn: future,
+		Data:     `{}`,
+	}, &NotifyReply{})
+	checkRPCError(c, status, rpcErr, ErrMissingIdField)
+	status, rpcErr = s.call(c, "Notify", &NotifyRequest{
+		UserId:   "user1",
+		DeviceId: "dev1",
+		AppId:    "app1",
+		ExpireOn: future,
+		Data:     `{"foo":`,
+	}, &NotifyReply{})
+	checkRPCError(c, status, rpcErr, ErrMalformedJSONObject)
+	status, rpcErr = s.call(c, "Broadcast", &BroadcastRequest{
+		Channel:  "system",
+		ExpireOn: future,
+	}, &BroadcastReply{})
+	checkRPCError(c, status, rpcErr, ErrMissingData)
+	status, rpcErr = s.call(c, "Register", &RegisterRequest{AppId: "app1"}, &RegisterReply{})
+	checkRPCError(c, status, rpcErr, ErrMissingIdField)
+}
+
+func (s *rpcSuite) TestStoreUnavailable(c *C) {
+	s.storeErr = ErrStoreUnavailable
+	status, rpcErr := s.call(c, "Register", &RegisterRequest{DeviceId: "dev1", AppId: "app1"}, &RegisterReply{})
+	checkRPCError(c, status, rpcErr, ErrStoreUnavailable)
+
+	s.storeErr = errors.New("boom")
+	status, rpcErr = s.call(c, "Register", &RegisterRequest{DeviceId: "dev1", AppId: "app1"}, &RegisterReply{})
+	checkRPCError(c, status, rpcErr, ErrUnknown)
+	c.Check(s.testlog.Captured(), Equals, "ERROR failed to get store: boom\n")
+}
+
+func (s *rpcSuite) TestBadRequests(c *C) {
+	checkResp := func(resp *http.Response, apiErr *APIError) {
+		body, err := getResponseBody(resp)
+		c.Assert(err, IsNil)
+		rpcErr := &RPCError{}
+		c.Assert(UnmarshalProto(body, rpcErr), IsNil)
+		checkRPCError(c, resp.StatusCode, rpcErr, apiErr)
+	}
+	checkResp(s.postRaw(c, "Frobnicate", ProtobufMediaType, nil), ErrUnknownRPCMethod)
+	checkResp(s.postRaw(c, "Register", JSONMediaType, []byte("{}")), ErrWrongProtoContentType)
+	checkResp(s.postRaw(c, "Register", ProtobufMediaType, []byte{0x0a, 0x05}), ErrMalformedProtoMessage)
+	checkResp(s.postRaw(c, "Register", ProtobufMediaType, make([]byte, MaxRequestBodyBytes+1)), ErrRequestBodyTooLarge)
+	// without a Content-Length the size is only known once read
+	checkResp(s.postStreamed(c, "Register", make([]byte, MaxRequestBodyBytes+1)), ErrRequestBodyTooLarge)
+	resp, err := http.Get(s.testServer.URL + RPCPathPrefix + "Register")
+	c.Assert(err, IsNil)
+	checkResp(resp, ErrWrongRequestMethod)
+}
@@ -0,0 +1,208 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/ubports/ubuntu-push/server/store"
+)
+
+// StreamHandler is able to handle POST requests with a body of
+// newline-delimited JSON objects, each one at most as long as a
+// request body can be and handled on its own, answering with a
+// newline-delimited JSON result for each of them.
+//
+// Results are written back as the lines get handled when the request
+// came over HTTP/2; the HTTP/1.x server can't interleave reading the
+// request with writing the response, so there they are held back
+// until the request body is read through, or until maxHeldStreamResults
+// worth of them are, when the rest of the request is left unhandled.
+//
+// Each line gets streamLineTimeout to arrive and its result as long to
+// be written, instead of the server timeouts for the whole request.
+type StreamHandler struct {
+	*context
+	parsingBodyObj func() interface{}
+	doHandle       func(ctx *context, sto store.PendingStore, parsedBodyObj interface{}) (map[string]interface{}, *APIError)
+}
+
+var (
+	// how long to wait for each line, and for writing each result
+	streamLineTimeout = 30 * time.Second
+	// how much of the results to hold back over HTTP/1.x
+	maxHeldStreamResults = 256 * 1024
+)
+
+// deadlineSetter is implemented by the response writers of the
+// HTTP/1.x and HTTP/2 servers, to move the deadlines of the request.
+type deadlineSetter interface {
+	SetReadDeadline(deadline time.Time) error
+	SetWriteDeadline(deadline time.Time) error
+}
+
+func checkRequestAsStream(request *http.Request) *APIError {
+	if request.Method != "POST" {
+		return ErrWrongRequestMethod
+	}
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil || mediaType != NDJSONMediaType {
+		return ErrWrongStreamContentType
+	}
+	return nil
+}
+
+// readLine reads the next line from r, skipping what doesn't fit
+// r's buffer and reporting the line as too long then.
+func readLine(r *bufio.Reader) (line []byte, tooLong bool, err error) {
+	line, err = r.ReadSlice('\n')
+	for err == bufio.ErrBufferFull {
+		tooLong = true
+		_, err = r.ReadSlice('\n')
+	}
+	return line, tooLong, err
+}
+
+// handleLine handles one line of the stream, returning its result.
+func (h *StreamHandler) handleLine(ctx *context, sto store.PendingStore, line []byte, tooLong bool) map[string]interface{} {
+	var res map[string]interface{}
+	apiErr := ErrLineTooLarge
+	if !tooLong {
+		parsedBodyObj := h.parsingBodyObj()
+		if err := json.Unmarshal(line, parsedBodyObj); err != nil {
+			apiErr = ErrMalformedJSONObject
+		} else {
+			res, apiErr = h.doHandle(ctx, sto, parsedBodyObj)
+		}
+	}
+	return lineResult(res, apiErr)
+}
+
+// lineResult completes res as the result of a line, failed with apiErr
+// if that's not nil.
+func lineResult(res map[string]interface{}, apiErr *APIError) map[string]interface{} {
+	if res == nil {
+		res = make(map[string]interface{})
+	}
+	if apiErr != nil {
+		res["ok"] = false
+		res["error"] = apiErr.ErrorLabel
+		res["message"] = apiErr.Message
+		if apiErr.Extra != nil {
+			res["extra"] = apiErr.Extra
+		}
+	} else {
+		res["ok"] = true
+	}
+	return res
+}
+
+func (h *StreamHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := h.forRequest(writer, request)
+	if apiErr := checkRequestAsStream(request); apiErr != nil {
+		RespondError(writer, apiErr)
+		return
+	}
+	sto, apiErr := ctx.getStore(writer, request)
+	if apiErr != nil {
+		RespondError(writer, apiErr)
+		return
+	}
+	defer sto.Close()
+
+	writer.Header().Set("Content-Type", NDJSONMediaType)
+	var out io.Writer = writer
+	var held *bytes.Buffer
+	flusher, _ := writer.(http.Flusher)
+	if request.ProtoMajor < 2 {
+		held = new(bytes.Buffer)
+		out = held
+		flusher = nil
+	}
+	deadlines, _ := writer.(deadlineSetter)
+	extendDeadlines := func() {
+		if deadlines == nil {
+			return
+		}
+		deadline := time.Now().Add(streamLineTimeout)
+		if err := deadlines.SetReadDeadline(deadline); err != nil {
+			ctx.logger.Debugf("stream: could not extend read deadline: %v", err)
+		}
+		if err := deadlines.SetWriteDeadline(deadline); err != nil {
+			ctx.logger.Debugf("stream: could not extend write deadline: %v", err)
+		}
+	}
+	writeResult := func(res map[string]interface{}) bool {
+		resp, err := json.Marshal(res)
+		if err != nil {
+			panic(fmt.Errorf("couldn't marshal our own response: %v", err))
+		}
+		if _, err := out.Write(append(resp, '\n')); err != nil {
+			ctx.logger.Debugf("stream: could not write result of line %v: %v", res["line"], err)
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+
+	r := bufio.NewReaderSize(request.Body, int(ctx.maxBodySize())+1)
+	lineNo := 0
+	for {
+		extendDeadlines()
+		if held != nil && held.Len() >= maxHeldStreamResults {
+			if _, err := r.Peek(1); err == nil {
+				// tell from which line on to send again
+				res := lineResult(nil, ErrTooManyStreamLines)
+				res["line"] = lineNo + 1
+				writeResult(res)
+			}
+			break
+		}
+		line, tooLong, err := readLine(r)
+		if err != nil && err != io.EOF {
+			ctx.logger.Errorf("stream: could not read line %d: %v", lineNo+1, err)
+			break
+		}
+		if len(line) != 0 {
+			lineNo++
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) != 0 || tooLong {
+			res := h.handleLine(ctx, sto, line, tooLong)
+			res["line"] = lineNo
+			if !writeResult(res) {
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if held != nil {
+		extendDeadlines()
+		writer.Write(held.Bytes())
+	}
+}
@@ -0,0 +1,239 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	. "launchpad.net/gocheck"
+
+	"github.com/ubports/ubuntu-push/server/store"
+	help "github.com/ubports/ubuntu-push/testing"
+)
+
+type streamSuite struct {
+	sto        *store.InMemoryPendingStore
+	bsend      testBrokerSending
+	testServer *httptest.Server
+	testlog    *help.TestLogger
+}
+
+var _ = Suite(&streamSuite{})
+
+func (s *streamSuite) SetUpTest(c *C) {
+	s.testlog = help.NewTestLogger(c, "error")
+	s.sto = store.NewInMemoryPendingStore()
+	storage := testStoreAccess(func(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
+		return s.sto, nil
+	})
+	s.bsend = testBrokerSending{make(chan store.InternalChannelId, 10)}
+	s.testServer = httptest.NewUnstartedServer(MakeHandlersMux(storage, s.bsend, s.testlog))
+}
+
+func (s *streamSuite) TearDownTest(c *C) {
+	s.testServer.Close()
+}
+
+func ucastLine(deviceId string) string {
+	return fmt.Sprintf(`{"userid":"user1","deviceid":"%s","appid":"app1","expire_on":"%s","data":{"n":1}}`, deviceId, future)
+}
+
+func (s *streamSuite) post(c *C, cli *http.Client, body io.Reader) *http.Response {
+	request, err := http.NewRequest("POST", s.testServer.URL+"/notify/stream", body)
+	c.Assert(err, IsNil)
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := cli.Do(request)
+	c.Assert(err, IsNil)
+	return resp
+}
+
+func readResults(c *C, resp *http.Response) []map[string]interface{} {
+	body, err := getResponseBody(resp)
+	c.Assert(err, IsNil)
+	var res []map[string]interface{}
+	for _, line := range strings.SplitAfter(string(body), "\n") {
+		if line == "" {
+			continue
+		}
+		c.Assert(strings.HasSuffix(line, "\n"), Equals, true)
+		var r map[string]interface{}
+		c.Assert(json.Unmarshal([]byte(line), &r), IsNil)
+		res = append(res, r)
+	}
+	return res
+}
+
+func (s *streamSuite) TestStreamUnicasts(c *C) {
+	s.testServer.Start()
+	body := strings.Join([]string{
+		ucastLine("dev1"),
+		"",
+		`{"userid":`,
+		ucastLine("dev2"),
+		`{"appid":"app1","expire_on":"` + future + `","data":{}}`,
+	}, "\n")
+	resp := s.post(c, http.DefaultClient, strings.NewReader(body))
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(resp.Header.Get("Content-Type"), Equals, "application/x-ndjson")
+	res := readResults(c, resp)
+	c.Assert(res, HasLen, 4)
+	c.Check(res[0]["line"], Equals, float64(1))
+	c.Check(res[0]["ok"], Equals, true)
+	c.Check(res[0]["msgid"], Matches, ".+")
+	c.Check(res[1], DeepEquals, map[string]interface{}{
+		"line":    float64(3),
+		"ok":      false,
+		"error":   "invalid-request",
+		"message": "Malformed JSON Object",
+	})
+	c.Check(res[2]["line"], Equals, float64(4))
+	c.Check(res[2]["ok"], Equals, true)
+	c.Check(res[3]["line"], Equals, float64(5))
+	c.Check(res[3]["ok"], Equals, false)
+	c.Check(res[3]["error"], Equals, ErrMissingIdField.ErrorLabel)
+
+	for _, dev := range []string{"dev1", "dev2"} {
+		chanId := store.UnicastInternalChannelId("user1", dev)
+		c.Check(<-s.bsend.chanId, Not(Equals), store.InternalChannelId(""))
+		_, notifications, err := s.sto.GetChannelSnapshot(chanId)
+		c.Assert(err, IsNil)
+		c.Check(notifications, HasLen, 1)
+	}
+}
+
+func (s *streamSuite) TestStreamLineTooLarge(c *C) {
+	s.testServer.Start()
+	body := strings.Repeat("x", MaxRequestBodyBytes+10) + "\n" + ucastLine("dev1") + "\n"
+	resp := s.post(c, http.DefaultClient, strings.NewReader(body))
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	res := readResults(c, resp)
+	c.Assert(res, HasLen, 2)
+	c.Check(res[0]["line"], Equals, float64(1))
+	c.Check(res[0]["message"], Equals, ErrLineTooLarge.Message)
+	c.Check(res[1]["line"], Equals, float64(2))
+	c.Check(res[1]["ok"], Equals, true)
+}
+
+func (s *streamSuite) TestStreamOutlivesRequestTimeouts(c *C) {
+	s.testServer.Config.ReadTimeout = 200 * time.Millisecond
+	s.testServer.Config.WriteTimeout = 200 * time.Millisecond
+	s.testServer.Start()
+	bodyR, bodyW := io.Pipe()
+	go func() {
+		for _, dev := range []string{"dev1", "dev2", "dev3"} {
+			io.WriteString(bodyW, ucastLine(dev)+"\n")
+			time.Sleep(150 * time.Millisecond)
+		}
+		bodyW.Close()
+	}()
+	resp := s.post(c, http.DefaultClient, bodyR)
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	res := readResults(c, resp)
+	c.Assert(res, HasLen, 3)
+	for i, r := range res {
+		c.Check(r["line"], Equals, float64(i+1))
+		c.Check(r["ok"], Equals, true)
+	}
+}
+
+func (s *streamSuite) TestStreamHeldResultsCapped(c *C) {
+	defer func(max int) { maxHeldStreamResults = max }(maxHeldStreamResults)
+	maxHeldStreamResults = 1
+	s.testServer.Start()
+	body := ucastLine("dev1") + "\n" + ucastLine("dev2") + "\n"
+	resp := s.post(c, http.DefaultClient, strings.NewReader(body))
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	res := readResults(c, resp)
+	c.Assert(res, HasLen, 2)
+	c.Check(res[0]["line"], Equals, float64(1))
+	c.Check(res[0]["ok"], Equals, true)
+	c.Check(res[1], DeepEquals, map[string]interface{}{
+		"line":    float64(2),
+		"ok":      false,
+		"error":   "invalid-request",
+		"message": ErrTooManyStreamLines.Message,
+	})
+	// the second line was left alone
+	c.Check(s.bsend.chanId, HasLen, 1)
+
+	// nothing to tell when there's nothing left
+	resp = s.post(c, http.DefaultClient, strings.NewReader(ucastLine("dev3")+"\n"))
+	res = readResults(c, resp)
+	c.Assert(res, HasLen, 1)
+	c.Check(res[0]["ok"], Equals, true)
+}
+
+func (s *streamSuite) TestStreamBadRequests(c *C) {
+	s.testServer.Start()
+	request, err := http.NewRequest("POST", s.testServer.URL+"/notify/stream", strings.NewReader(ucastLine("dev1")))
+	c.Assert(err, IsNil)
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(request)
+	c.Assert(err, IsNil)
+	checkError(c, resp, ErrWrongStreamContentType)
+
+	resp, err = http.Get(s.testServer.URL + "/notify/stream")
+	c.Assert(err, IsNil)
+	checkError(c, resp, ErrWrongRequestMethod)
+}
+
+func (s *streamSuite) TestStreamInterleavedOverHTTP2(c *C) {
+	err := http2.ConfigureServer(s.testServer.Config, nil)
+	c.Assert(err, IsNil)
+	s.testServer.TLS = s.testServer.Config.TLSConfig
+	s.testServer.StartTLS()
+	cli := &http.Client{Transport: &http2.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	bodyR, bodyW := io.Pipe()
+	defer bodyW.Close()
+	go io.WriteString(bodyW, ucastLine("dev1")+"\n")
+	resp := s.post(c, cli, bodyR)
+	defer resp.Body.Close()
+	c.Check(resp.ProtoMajor, Equals, 2)
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	r := bufio.NewReader(resp.Body)
+	// the result comes back while the request is still going on
+	var res map[string]interface{}
+	line, err := r.ReadBytes('\n')
+	c.Assert(err, IsNil)
+	c.Assert(json.Unmarshal(line, &res), IsNil)
+	c.Check(res["line"], Equals, float64(1))
+	c.Check(res["ok"], Equals, true)
+
+	go func() {
+		io.WriteString(bodyW, ucastLine("dev2")+"\n")
+		bodyW.Close()
+	}()
+	line, err = r.ReadBytes('\n')
+	c.Assert(err, IsNil)
+	c.Assert(json.Unmarshal(line, &res), IsNil)
+	c.Check(res["line"], Equals, float64(2))
+	c.Check(res["ok"], Equals, true)
+	_, err = r.ReadBytes('\n')
+	c.Check(err, Equals, io.EOF)
+}
@@ -21,6 +21,7 @@ package broker
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/ubports/ubuntu-push/protocol"
 	"github.com/ubports/ubuntu-push/server/store"
@@ -86,6 +87,22 @@ func GetInfoInt(msg *protocol.ConnectMsg, name string, defaultVal int) (int, err
 	return int(n), nil
 }
 
+// GetInfoKinds helps retrieving the notification kinds the client
+// understands out of a protocol.ConnectMsg.Info.
+func GetInfoKinds(msg *protocol.ConnectMsg) (map[string]bool, error) {
+	s, err := GetInfoString(msg, protocol.KindsInfo, "")
+	if err != nil {
+		return nil, err
+	}
+	kinds := make(map[string]bool)
+	for _, kind := range strings.Split(s, ",") {
+		if kind != "" {
+			kinds[kind] = true
+		}
+	}
+	return kinds, nil
+}
+
 // BrokerSession holds broker session state.
 type BrokerSession interface {
 	// SessionChannel returns the session control channel
@@ -97,6 +114,9 @@ type BrokerSession interface {
 	DeviceImageModel() string
 	// DeviceImageChannel returns the device system image channel.
 	DeviceImageChannel() string
+	// AcceptsKind says whether the client understands notifications
+	// of kind; all of them understand those of no kind.
+	AcceptsKind(kind string) bool
 	// Levels returns the current channel levels for the session
 	Levels() LevelsMap
 	// ExchangeScratchArea returns the scratch area for exchanges.
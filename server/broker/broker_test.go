@@ -66,3 +66,19 @@ func (s *brokerSuite) TestGetInfoInt(c *C) {
 	v, err = GetInfoInt(connectMsg, "bar", -1)
 	c.Check(err, Equals, ErrUnexpectedValue)
 }
+
+func (s *brokerSuite) TestGetInfoKinds(c *C) {
+	connectMsg := &protocol.ConnectMsg{}
+	kinds, err := GetInfoKinds(connectMsg)
+	c.Check(err, IsNil)
+	c.Check(kinds, HasLen, 0)
+
+	connectMsg.Info = map[string]interface{}{"kinds": "clear,,blob"}
+	kinds, err = GetInfoKinds(connectMsg)
+	c.Check(err, IsNil)
+	c.Check(kinds, DeepEquals, map[string]bool{"clear": true, "blob": true})
+
+	connectMsg.Info["kinds"] = 1
+	_, err = GetInfoKinds(connectMsg)
+	c.Check(err, Equals, ErrUnexpectedValue)
+}
@@ -19,6 +19,7 @@ package broker
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/ubports/ubuntu-push/protocol"
@@ -45,6 +46,8 @@ type BroadcastExchange struct {
 	TopLevel      int64
 	Notifications []protocol.Notification
 	Decoded       []map[string]interface{}
+	// AppId is set for app-scoped broadcast channels
+	AppId string
 	BaseExchange
 }
 
@@ -61,6 +64,10 @@ func (sbe *BroadcastExchange) Init() {
 			decoded[i] = nil
 		}
 	}
+	// notifications in an app-scoped channel are all for the same app
+	if n := len(sbe.Notifications); n > 0 {
+		sbe.AppId = sbe.Notifications[n-1].AppId
+	}
 }
 
 func filterByLevel(clientLevel, topLevel int64, notifs []protocol.Notification) []protocol.Notification {
@@ -106,7 +113,7 @@ func (sbe *BroadcastExchange) Prepare(sess BrokerSession) (outMessage protocol.S
 
 	scratchArea := sess.ExchangeScratchArea()
 	scratchArea.broadcastMsg.Reset()
-	// xxx need an AppId as well, later
+	scratchArea.broadcastMsg.AppId = sbe.AppId
 	scratchArea.broadcastMsg.ChanId = store.InternalChannelIdToHex(sbe.ChanId)
 	scratchArea.broadcastMsg.TopLevel = sbe.TopLevel
 	scratchArea.broadcastMsg.Payloads = payloads
@@ -153,12 +160,44 @@ type UnicastExchange struct {
 // check interface already here
 var _ Exchange = (*UnicastExchange)(nil)
 
+// kindFilter splits notifs into those sess can be sent and the
+// clear instructions it wouldn't understand, which are moot for it.
+// Notifications of other kinds it doesn't understand are held back
+// in case the client gets updated before they expire.
+func kindFilter(sess BrokerSession, notifs []protocol.Notification) (send, moot []protocol.Notification) {
+	for i, notif := range notifs {
+		if sess.AcceptsKind(notif.Kind) {
+			if send != nil {
+				send = append(send, notif)
+			}
+			continue
+		}
+		if send == nil {
+			send = append(make([]protocol.Notification, 0, len(notifs)), notifs[:i]...)
+		}
+		if notif.Kind == protocol.KindClear {
+			moot = append(moot, notif)
+		}
+	}
+	if send == nil {
+		return notifs, nil
+	}
+	return send, moot
+}
+
 // Prepare session for a NOTIFICATIONS.
 func (sue *UnicastExchange) Prepare(sess BrokerSession) (outMessage protocol.SplittableMsg, inMessage interface{}, err error) {
 	_, notifs, err := sess.Get(sue.ChanId, sue.CachedOk)
 	if err != nil {
 		return nil, nil, err
 	}
+	notifs, moot := kindFilter(sess, notifs)
+	if len(moot) != 0 {
+		err := sess.DropByMsgId(sue.ChanId, moot)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 	if len(notifs) == 0 {
 		return nil, nil, ErrNop
 	}
@@ -181,10 +220,27 @@ func (sue *UnicastExchange) Acked(sess BrokerSession, done bool) error {
 	return nil
 }
 
+// Notifications returns the notifications sent to sess in the
+// current round of the exchange, those acknowledged by Acked.
+func (sue *UnicastExchange) Notifications(sess BrokerSession) []protocol.Notification {
+	return sess.ExchangeScratchArea().notificationsMsg.Notifications
+}
+
 // FeedPending feeds exchanges covering pending notifications into the session.
 func FeedPending(sess BrokerSession) error {
-	// find relevant channels, for now only system
+	// find relevant channels: system and the app-scoped broadcast
+	// channels the client has levels for
 	channels := []store.InternalChannelId{store.SystemInternalChannelId}
+	appChannels := make([]string, 0, len(sess.Levels()))
+	for chanId := range sess.Levels() {
+		if chanId != store.SystemInternalChannelId && chanId.BroadcastChannel() {
+			appChannels = append(appChannels, string(chanId))
+		}
+	}
+	sort.Strings(appChannels)
+	for _, chanId := range appChannels {
+		channels = append(channels, store.InternalChannelId(chanId))
+	}
 	for _, chanId := range channels {
 		topLevel, notifications, err := sess.Get(chanId, true)
 		if err != nil {
@@ -84,6 +84,36 @@ func (s *exchangesSuite) TestBroadcastExchange(c *C) {
 	c.Check(sess.LevelsMap[store.SystemInternalChannelId], Equals, int64(3))
 }
 
+func (s *exchangesSuite) TestBroadcastExchangeAppChannel(c *C) {
+	sess := &testing.TestBrokerSession{
+		LevelsMap:    broker.LevelsMap(map[store.InternalChannelId]int64{}),
+		Model:        "m1",
+		ImageChannel: "img1",
+	}
+	chanId := store.InternalChannelId("Bf1c9bf7096084cb2a154979ce00c7f50")
+	exchg := &broker.BroadcastExchange{
+		ChanId:   chanId,
+		TopLevel: 2,
+		Notifications: []protocol.Notification{
+			{AppId: "app1", Payload: json.RawMessage(`{"a":1}`)},
+			{AppId: "app1", Payload: json.RawMessage(`{"a":2}`)},
+		},
+	}
+	exchg.Init()
+	c.Check(exchg.AppId, Equals, "app1")
+	outMsg, inMsg, err := exchg.Prepare(sess)
+	c.Assert(err, IsNil)
+	// check
+	marshalled, err := json.Marshal(outMsg)
+	c.Assert(err, IsNil)
+	c.Check(string(marshalled), Equals, `{"T":"broadcast","AppId":"app1","ChanId":"f1c9bf7096084cb2a154979ce00c7f50","TopLevel":2,"Payloads":[{"a":1},{"a":2}]}`)
+	err = json.Unmarshal([]byte(`{"T":"ack"}`), inMsg)
+	c.Assert(err, IsNil)
+	err = exchg.Acked(sess, true)
+	c.Assert(err, IsNil)
+	c.Check(sess.LevelsMap[chanId], Equals, int64(2))
+}
+
 func (s *exchangesSuite) TestBroadcastExchangeEmpty(c *C) {
 	sess := &testing.TestBrokerSession{
 		LevelsMap:    broker.LevelsMap(map[store.InternalChannelId]int64{}),
@@ -310,6 +340,70 @@ func (s *exchangesSuite) TestUnicastExchange(c *C) {
 	c.Check(<-dropped, DeepEquals, notifs)
 }
 
+func (s *exchangesSuite) TestUnicastExchangeKinds(c *C) {
+	chanId1 := store.UnicastInternalChannelId("u1", "d1")
+	plain := protocol.Notification{MsgId: "msg1", AppId: "app1", Payload: json.RawMessage(`{"m":1}`)}
+	clear := protocol.Notification{MsgId: "msg2", AppId: "app1", Kind: protocol.KindClear, Payload: json.RawMessage(`{"msgid":"msg0"}`)}
+	future := protocol.Notification{MsgId: "msg3", AppId: "app1", Kind: "future", Payload: json.RawMessage(`{}`)}
+	notifs := []protocol.Notification{clear, plain, future}
+	var dropped [][]protocol.Notification
+	sess := &testing.TestBrokerSession{
+		DoGet: func(chanId store.InternalChannelId, cachedOk bool) (int64, []protocol.Notification, error) {
+			return 0, notifs, nil
+		},
+		DoDropByMsgId: func(chanId store.InternalChannelId, targets []protocol.Notification) error {
+			c.Check(chanId, Equals, chanId1)
+			dropped = append(dropped, targets)
+			return nil
+		},
+	}
+	// an older client gets none of a kind; the clear instruction is
+	// dropped, the other held back
+	exchg := &broker.UnicastExchange{ChanId: chanId1}
+	outMsg, _, err := exchg.Prepare(sess)
+	c.Assert(err, IsNil)
+	c.Check(outMsg.(*protocol.NotificationsMsg).Notifications, DeepEquals, []protocol.Notification{plain})
+	c.Check(dropped, DeepEquals, [][]protocol.Notification{{clear}})
+	c.Check(notifs, DeepEquals, []protocol.Notification{clear, plain, future})
+
+	// one that understands them gets them all
+	dropped = nil
+	sess.Kinds = map[string]bool{protocol.KindClear: true, "future": true}
+	outMsg, _, err = exchg.Prepare(sess)
+	c.Assert(err, IsNil)
+	c.Check(outMsg.(*protocol.NotificationsMsg).Notifications, DeepEquals, notifs)
+	c.Check(dropped, HasLen, 0)
+
+	// nothing left to send
+	sess.Kinds = nil
+	notifs = []protocol.Notification{future}
+	_, _, err = exchg.Prepare(sess)
+	c.Check(err, Equals, broker.ErrNop)
+}
+
+func (s *exchangesSuite) TestUnicastExchangeHoldsBackRefs(c *C) {
+	byRef := protocol.Notification{MsgId: "msg1", AppId: "app1", Kind: protocol.KindBlob, Payload: json.RawMessage(`{"url":"blob/b1"}`)}
+	sess := &testing.TestBrokerSession{
+		DoGet: func(chanId store.InternalChannelId, cachedOk bool) (int64, []protocol.Notification, error) {
+			return 0, []protocol.Notification{byRef}, nil
+		},
+		DoDropByMsgId: func(chanId store.InternalChannelId, targets []protocol.Notification) error {
+			c.Errorf("dropped %v", targets)
+			return nil
+		},
+	}
+	// a client that can't fetch the payload doesn't get the
+	// reference, which is kept for when it can
+	exchg := &broker.UnicastExchange{}
+	_, _, err := exchg.Prepare(sess)
+	c.Check(err, Equals, broker.ErrNop)
+
+	sess.Kinds = map[string]bool{protocol.KindBlob: true}
+	outMsg, _, err := exchg.Prepare(sess)
+	c.Assert(err, IsNil)
+	c.Check(outMsg.(*protocol.NotificationsMsg).Notifications, DeepEquals, []protocol.Notification{byRef})
+}
+
 func (s *exchangesSuite) TestUnicastExchangeAckMismatch(c *C) {
 	notifs := []protocol.Notification{protocol.Notification{}}
 	dropped := make(chan []protocol.Notification, 2)
@@ -409,6 +503,45 @@ func (s *exchangesSuite) TestFeedPending(c *C) {
 	})
 }
 
+func (s *exchangesSuite) TestFeedPendingAppChannels(c *C) {
+	bcast1 := protocol.Notification{AppId: "app1", Payload: json.RawMessage(`{"m": "M"}`)}
+	chanId1 := store.AppBroadcastInternalChannelId("app1")
+	chanId2 := store.AppBroadcastInternalChannelId("app2")
+	sess := &testing.TestBrokerSession{
+		LevelsMap: map[store.InternalChannelId]int64{
+			store.SystemInternalChannelId: 1,
+			chanId1:                       0,
+			chanId2:                       3,
+		},
+		Exchanges: make(chan broker.Exchange, 5),
+		DoGet: func(chanId store.InternalChannelId, cachedOk bool) (int64, []protocol.Notification, error) {
+			switch chanId {
+			case store.SystemInternalChannelId:
+				return 1, nil, nil
+			case chanId1:
+				return 1, []protocol.Notification{bcast1}, nil
+			case chanId2:
+				return 3, nil, nil
+			default:
+				return 0, nil, nil
+			}
+		},
+	}
+	err := broker.FeedPending(sess)
+	c.Assert(err, IsNil)
+	c.Assert(len(sess.Exchanges), Equals, 2)
+	exchg1 := <-sess.Exchanges
+	c.Check(exchg1, DeepEquals, &broker.BroadcastExchange{
+		ChanId:        chanId1,
+		TopLevel:      1,
+		Notifications: []protocol.Notification{bcast1},
+		Decoded:       []map[string]interface{}{{"m": "M"}},
+		AppId:         "app1",
+	})
+	exchg2 := <-sess.Exchanges
+	c.Check(exchg2, FitsTypeOf, &broker.UnicastExchange{})
+}
+
 func (s *exchangesSuite) TestFeedPendingSystemChanNop(c *C) {
 	bcast1 := json.RawMessage(`{"m": "M"}`)
 	sess := &testing.TestBrokerSession{
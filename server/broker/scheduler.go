@@ -0,0 +1,90 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ubports/ubuntu-push/server/store"
+)
+
+// Scheduler holds back delivery requests to a BrokerSending until
+// they fall due.
+type Scheduler struct {
+	sending BrokerSending
+	lock    sync.Mutex
+	timers  map[*time.Timer]bool
+}
+
+// NewScheduler makes a new Scheduler requesting deliveries from sending.
+func NewScheduler(sending BrokerSending) *Scheduler {
+	return &Scheduler{
+		sending: sending,
+		timers:  make(map[*time.Timer]bool),
+	}
+}
+
+// at runs f once when falls due, right away if it already has.
+func (s *Scheduler) at(when time.Time, f func()) {
+	d := when.Sub(time.Now())
+	if d <= 0 {
+		go f()
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		s.lock.Lock()
+		delete(s.timers, timer)
+		s.lock.Unlock()
+		f()
+	})
+	s.timers[timer] = true
+}
+
+// BroadcastAt requests the broadcast for a channel at when.
+func (s *Scheduler) BroadcastAt(when time.Time, chanId store.InternalChannelId) {
+	s.at(when, func() {
+		s.sending.Broadcast(chanId)
+	})
+}
+
+// UnicastAt requests unicast for the channels at when.
+func (s *Scheduler) UnicastAt(when time.Time, chanIds ...store.InternalChannelId) {
+	s.at(when, func() {
+		s.sending.Unicast(chanIds...)
+	})
+}
+
+// Pending returns the number of requests not yet due.
+func (s *Scheduler) Pending() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.timers)
+}
+
+// Stop drops all the requests not yet due.
+func (s *Scheduler) Stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for timer := range s.timers {
+		timer.Stop()
+	}
+	s.timers = make(map[*time.Timer]bool)
+}
@@ -0,0 +1,82 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package broker
+
+import (
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/ubports/ubuntu-push/server/store"
+)
+
+type schedulerSuite struct{}
+
+var _ = Suite(&schedulerSuite{})
+
+type recordingSending struct {
+	ch chan string
+}
+
+func (rs *recordingSending) Broadcast(chanId store.InternalChannelId) {
+	rs.ch <- "broadcast " + string(chanId)
+}
+
+func (rs *recordingSending) Unicast(chanIds ...store.InternalChannelId) {
+	for _, chanId := range chanIds {
+		rs.ch <- "unicast " + string(chanId)
+	}
+}
+
+func (s *schedulerSuite) TestPastIsImmediate(c *C) {
+	rs := &recordingSending{make(chan string, 5)}
+	sched := NewScheduler(rs)
+	sched.BroadcastAt(time.Now().Add(-time.Minute), store.SystemInternalChannelId)
+	c.Check(<-rs.ch, Equals, "broadcast 0")
+	sched.UnicastAt(time.Time{}, "Ua:b")
+	c.Check(<-rs.ch, Equals, "unicast Ua:b")
+	c.Check(sched.Pending(), Equals, 0)
+}
+
+func (s *schedulerSuite) TestFutureWaits(c *C) {
+	rs := &recordingSending{make(chan string, 5)}
+	sched := NewScheduler(rs)
+	sched.UnicastAt(time.Now().Add(50*time.Millisecond), "Ua:b", "Uc:d")
+	c.Check(sched.Pending(), Equals, 1)
+	select {
+	case <-rs.ch:
+		c.Fatalf("should not have been delivered yet")
+	case <-time.After(10 * time.Millisecond):
+	}
+	c.Check(<-rs.ch, Equals, "unicast Ua:b")
+	c.Check(<-rs.ch, Equals, "unicast Uc:d")
+	c.Check(sched.Pending(), Equals, 0)
+}
+
+func (s *schedulerSuite) TestStop(c *C) {
+	rs := &recordingSending{make(chan string, 5)}
+	sched := NewScheduler(rs)
+	sched.BroadcastAt(time.Now().Add(20*time.Millisecond), store.SystemInternalChannelId)
+	c.Check(sched.Pending(), Equals, 1)
+	sched.Stop()
+	c.Check(sched.Pending(), Equals, 0)
+	select {
+	case <-rs.ch:
+		c.Fatalf("should have been dropped")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
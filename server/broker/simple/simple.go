@@ -53,6 +53,7 @@ type simpleBrokerSession struct {
 	deviceId     string
 	model        string
 	imageChannel string
+	kinds        map[string]bool
 	done         chan bool
 	exchanges    chan broker.Exchange
 	levels       broker.LevelsMap
@@ -89,6 +90,10 @@ func (sess *simpleBrokerSession) DeviceImageChannel() string {
 	return sess.imageChannel
 }
 
+func (sess *simpleBrokerSession) AcceptsKind(kind string) bool {
+	return kind == "" || sess.kinds[kind]
+}
+
 func (sess *simpleBrokerSession) Levels() broker.LevelsMap {
 	return sess.levels
 }
@@ -173,19 +178,44 @@ func (b *SimpleBroker) Register(connect *protocol.ConnectMsg, track broker.Sessi
 	if err != nil {
 		return nil, err
 	}
+	kinds, err := broker.GetInfoKinds(connect)
+	if err != nil {
+		return nil, err
+	}
+	apps, err := b.sto.GetDeviceApps(connect.DeviceId)
+	if err != nil {
+		b.logger.Errorf("unsuccessful, get registered apps for %v: %v", connect.DeviceId, err)
+	}
+	registered := make(map[store.InternalChannelId]bool, len(apps))
+	for _, appId := range apps {
+		registered[store.AppBroadcastInternalChannelId(appId)] = true
+	}
 	levels := map[store.InternalChannelId]int64{}
 	for hexId, v := range connect.Levels {
 		id, err := store.HexToInternalChannelId(hexId)
 		if err != nil {
 			return nil, &broker.ErrAbort{err.Error()}
 		}
+		if id != store.SystemInternalChannelId && !registered[id] {
+			// only the broadcasts of apps registered on the
+			// device are for it
+			continue
+		}
 		levels[id] = v
 	}
+	// the client has no levels yet for the app broadcast channels of
+	// apps registered since it last got pending broadcasts
+	for id := range registered {
+		if _, ok := levels[id]; !ok {
+			levels[id] = 0
+		}
+	}
 	sess := &simpleBrokerSession{
 		broker:       b,
 		deviceId:     connect.DeviceId,
 		model:        model,
 		imageChannel: imageChannel,
+		kinds:        kinds,
 		done:         make(chan bool),
 		exchanges:    make(chan broker.Exchange, b.sessionQueueSize),
 		levels:       levels,
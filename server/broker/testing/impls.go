@@ -28,6 +28,7 @@ type TestBrokerSession struct {
 	DeviceId     string
 	Model        string
 	ImageChannel string
+	Kinds        map[string]bool
 	Exchanges    chan broker.Exchange
 	LevelsMap    broker.LevelsMap
 	exchgScratch broker.ExchangesScratchArea
@@ -48,6 +49,10 @@ func (tbs *TestBrokerSession) DeviceImageChannel() string {
 	return tbs.ImageChannel
 }
 
+func (tbs *TestBrokerSession) AcceptsKind(kind string) bool {
+	return kind == "" || tbs.Kinds[kind]
+}
+
 func (tbs *TestBrokerSession) SessionChannel() <-chan broker.Exchange {
 	return tbs.Exchanges
 }
@@ -92,6 +92,7 @@ func (s *CommonBrokerSuite) TestRegistration(c *C) {
 		Info: map[string]interface{}{
 			"device":  "model",
 			"channel": "daily",
+			"kinds":   "clear,future",
 		},
 	}, s.MakeTracker("s1"))
 	c.Assert(err, IsNil)
@@ -99,6 +100,9 @@ func (s *CommonBrokerSuite) TestRegistration(c *C) {
 	c.Assert(sess.DeviceIdentifier(), Equals, "dev-1")
 	c.Check(sess.DeviceImageModel(), Equals, "model")
 	c.Check(sess.DeviceImageChannel(), Equals, "daily")
+	c.Check(sess.AcceptsKind(""), Equals, true)
+	c.Check(sess.AcceptsKind(protocol.KindClear), Equals, true)
+	c.Check(sess.AcceptsKind(protocol.KindBlob), Equals, false)
 	c.Assert(sess.ExchangeScratchArea(), Not(IsNil))
 	c.Check(sess.Levels(), DeepEquals, broker.LevelsMap(map[store.InternalChannelId]int64{
 		store.SystemInternalChannelId: 5,
@@ -133,6 +137,10 @@ func (s *CommonBrokerSuite) TestRegistrationInfoErrors(c *C) {
 	info["channel"] = -1
 	_, err = b.Register(&protocol.ConnectMsg{Type: "connect", Info: info}, s.MakeTracker("s2"))
 	c.Check(err, Equals, broker.ErrUnexpectedValue)
+	info["channel"] = "c"
+	info["kinds"] = -1
+	_, err = b.Register(&protocol.ConnectMsg{Type: "connect", Info: info}, s.MakeTracker("s3"))
+	c.Check(err, Equals, broker.ErrUnexpectedValue)
 }
 
 func (s *CommonBrokerSuite) TestRegistrationFeedPending(c *C) {
@@ -148,6 +156,60 @@ func (s *CommonBrokerSuite) TestRegistrationFeedPending(c *C) {
 	c.Check(len(sess.SessionChannel()), Equals, 2)
 }
 
+func (s *CommonBrokerSuite) TestRegistrationFeedPendingRegisteredApps(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	_, err := sto.Register("dev-1", "app1")
+	c.Assert(err, IsNil)
+	chanId := store.AppBroadcastInternalChannelId("app1")
+	muchLater := store.Metadata{Expiration: time.Now().Add(10 * time.Minute)}
+	err = sto.AppendToBroadcastChannel(chanId, "app1", json.RawMessage(`{"m": "M"}`), muchLater)
+	c.Assert(err, IsNil)
+	b := s.MakeBroker(sto, testBrokerConfig, s.testlog)
+	b.Start()
+	defer b.Stop()
+	// the device has no levels yet for the app's broadcast channel
+	sess, err := b.Register(&protocol.ConnectMsg{Type: "connect", DeviceId: "dev-1"}, s.MakeTracker("s1"))
+	c.Assert(err, IsNil)
+	c.Check(sess.Levels()[chanId], Equals, int64(0))
+	c.Assert(len(sess.SessionChannel()), Equals, 2)
+	exchg := s.RevealBroadcastExchange(<-sess.SessionChannel())
+	c.Check(exchg.ChanId, Equals, chanId)
+	c.Check(exchg.AppId, Equals, "app1")
+}
+
+func (s *CommonBrokerSuite) TestRegistrationUnregisteredAppLevels(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	_, err := sto.Register("dev-1", "app1")
+	c.Assert(err, IsNil)
+	chanId1 := store.AppBroadcastInternalChannelId("app1")
+	chanId2 := store.AppBroadcastInternalChannelId("app2")
+	muchLater := store.Metadata{Expiration: time.Now().Add(10 * time.Minute)}
+	err = sto.AppendToBroadcastChannel(chanId2, "app2", json.RawMessage(`{"m": "M"}`), muchLater)
+	c.Assert(err, IsNil)
+	b := s.MakeBroker(sto, testBrokerConfig, s.testlog)
+	b.Start()
+	defer b.Stop()
+	// levels for apps not registered on the device are ignored
+	sess, err := b.Register(&protocol.ConnectMsg{
+		Type:     "connect",
+		DeviceId: "dev-1",
+		Levels: map[string]int64{
+			"0":                                   0,
+			store.InternalChannelIdToHex(chanId1): 3,
+			store.InternalChannelIdToHex(chanId2): 0,
+		},
+	}, s.MakeTracker("s1"))
+	c.Assert(err, IsNil)
+	c.Check(sess.Levels(), DeepEquals, broker.LevelsMap(map[store.InternalChannelId]int64{
+		store.SystemInternalChannelId: 0,
+		chanId1:                       3,
+	}))
+	c.Assert(len(sess.SessionChannel()), Equals, 2)
+	exchg := s.RevealBroadcastExchange(<-sess.SessionChannel())
+	c.Check(exchg.ChanId, Equals, chanId1)
+	c.Check(s.RevealUnicastExchange(<-sess.SessionChannel()), NotNil)
+}
+
 func (s *CommonBrokerSuite) TestRegistrationFeedPendingError(c *C) {
 	sto := &testFailingStore{}
 	b := s.MakeBroker(sto, testBrokerConfig, s.testlog)
@@ -308,6 +370,34 @@ func (s *CommonBrokerSuite) TestUnicast(c *C) {
 	}
 }
 
+func (s *CommonBrokerSuite) TestUnicastKinds(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	chanId := store.UnicastInternalChannelId("dev1", "dev1")
+	muchLater := store.Metadata{Expiration: time.Now().Add(10 * time.Minute)}
+	sto.AppendToUnicastChannel(chanId, "app1", json.RawMessage(`{"m": "M1"}`), "msg1", muchLater)
+	clearMeta := muchLater
+	clearMeta.Kind = protocol.KindClear
+	sto.AppendToUnicastChannel(chanId, "app1", protocol.ClearPayload(&protocol.ClearInstruction{MsgId: "msg0"}), "msg2", clearMeta)
+	b := s.MakeBroker(sto, testBrokerConfig, s.testlog)
+	b.Start()
+	defer b.Stop()
+	// an older client, listing no kinds
+	sess, err := b.Register(&protocol.ConnectMsg{Type: "connect", DeviceId: "dev1"}, s.MakeTracker("s1"))
+	c.Assert(err, IsNil)
+	c.Assert(len(sess.SessionChannel()), Equals, 1)
+	outMsg, _, err := (<-sess.SessionChannel()).Prepare(sess)
+	c.Assert(err, IsNil)
+	notifs := outMsg.(*protocol.NotificationsMsg).Notifications
+	c.Assert(notifs, HasLen, 1)
+	c.Check(notifs[0].MsgId, Equals, "msg1")
+	c.Check(notifs[0].Kind, Equals, "")
+	// the clear instruction is gone
+	_, notifs, err = sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Assert(notifs, HasLen, 1)
+	c.Check(notifs[0].MsgId, Equals, "msg1")
+}
+
 func (s *CommonBrokerSuite) TestGetAndDrop(c *C) {
 	sto := store.NewInMemoryPendingStore()
 	notification1 := json.RawMessage(`{"m": "M1"}`)
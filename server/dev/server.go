@@ -20,10 +20,13 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/ubports/ubuntu-push/config"
@@ -35,6 +38,7 @@ import (
 	"github.com/ubports/ubuntu-push/server/session"
 	"github.com/ubports/ubuntu-push/server/statistics"
 	"github.com/ubports/ubuntu-push/server/store"
+	"github.com/ubports/ubuntu-push/server/tenant"
 )
 
 type configuration struct {
@@ -50,11 +54,37 @@ type configuration struct {
 	DeliveryDomain string `json:"delivery_domain"`
 	// max notifications per application
 	MaxNotificationsPerApplication int `json:"max_notifications_per_app"`
+	// largest payload accepted, payloads larger than
+	// api.MaxUnicastPayload are delivered by reference
+	MaxPayloadSize int `json:"max_payload_size"`
+	// largest payload accepted per application, overriding
+	// max_payload_size
+	AppMaxPayloadSizes map[string]int `json:"app_max_payload_sizes"`
+	// the users devices register on behalf of, by the
+	// Authorization header value they present
+	Users map[string]string `json:"users"`
+	// whether devices can only register presenting credentials in
+	// users
+	RequireUserAuth bool `json:"require_user_auth"`
+	// the tenants hosted, by name, each with their own store,
+	// limits and statistics, the limits they leave out being the
+	// ones above; if there are none everything goes to one tenant
+	// using delivery_domain
+	Tenants map[string]tenant.Config `json:"tenants"`
+	// the log level (one of "debug", "info", "error")
+	LogLevel logger.ConfigLogLevel `json:"log_level"`
+	// the logging format (one of "text", "json")
+	LogFormat logger.ConfigLogFormat `json:"log_format"`
 }
 
 type Storage struct {
 	sto                            store.PendingStore
 	maxNotificationsPerApplication int
+	maxPayloadSize                 int
+	appMaxPayloadSizes             map[string]int
+	blobs                          store.BlobStore
+	users                          map[string]string
+	requireUserAuth                bool
 }
 
 func (storage *Storage) StoreForRequest(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
@@ -65,6 +95,56 @@ func (storage *Storage) GetMaxNotificationsPerApplication() int {
 	return storage.maxNotificationsPerApplication
 }
 
+func (storage *Storage) GetMaxPayloadSize(appId string) int {
+	if size, ok := storage.appMaxPayloadSizes[appId]; ok {
+		return size
+	}
+	return storage.maxPayloadSize
+}
+
+func (storage *Storage) GetLargestPayloadSize() int {
+	largest := storage.maxPayloadSize
+	for _, size := range storage.appMaxPayloadSizes {
+		if size > largest {
+			largest = size
+		}
+	}
+	return largest
+}
+
+func (storage *Storage) GetBlobStore() store.BlobStore {
+	return storage.blobs
+}
+
+func (storage *Storage) AuthenticateUser(authorization string) (string, error) {
+	userId, ok := storage.users[authorization]
+	if !ok {
+		return "", store.ErrUnauthorized
+	}
+	return userId, nil
+}
+
+func (storage *Storage) AuthenticationRequired() bool {
+	return storage.requireUserAuth
+}
+
+// checkLimits checks the limits configured for the server and its
+// tenants are usable.
+func (cfg *configuration) checkLimits() error {
+	if cfg.MaxNotificationsPerApplication <= 0 {
+		return errors.New("max_notifications_per_app must be positive")
+	}
+	for name, tcfg := range cfg.Tenants {
+		if tcfg.MaxNotificationsPerApplication < 0 {
+			return fmt.Errorf("tenant %s: max_notifications_per_app can't be negative", name)
+		}
+		if tcfg.MaxPayloadSize < 0 {
+			return fmt.Errorf("tenant %s: max_payload_size can't be negative", name)
+		}
+	}
+	return nil
+}
+
 func main() {
 	cfgFpaths := os.Args[1:]
 	cfg := &configuration{}
@@ -72,36 +152,112 @@ func main() {
 	if err != nil {
 		server.BootLogFatalf("reading config: %v", err)
 	}
-	err = cfg.DevicesParsedConfig.LoadPEMs(filepath.Dir(cfgFpaths[len(cfgFpaths)-1]))
+	err = cfg.checkLimits()
 	if err != nil {
 		server.BootLogFatalf("reading config: %v", err)
 	}
-	logger := logger.NewSimpleLogger(os.Stderr, "info")
-	// Setup statistics
-	currentStats := statistics.NewStatistics(logger)
-	// setup a pending store and start the broker
-	sto := store.NewInMemoryPendingStore()
-	broker := simple.NewSimpleBroker(sto, cfg, logger, currentStats)
-	broker.Start()
-	defer broker.Stop()
-	// serve the http api
-	storage := &Storage{
-		sto:                            sto,
-		maxNotificationsPerApplication: cfg.MaxNotificationsPerApplication,
+	err = cfg.DevicesParsedConfig.LoadPEMs(filepath.Dir(cfgFpaths[len(cfgFpaths)-1]))
+	if err != nil {
+		server.BootLogFatalf("reading config: %v", err)
 	}
+	logger := logger.NewLogger(os.Stderr, cfg.LogLevel.Level(), cfg.LogFormat.Format(), "server")
 	lst, err := net.Listen("tcp", cfg.Addr())
 	if err != nil {
 		server.BootLogFatalf("start device listening: %v", err)
 	}
-	mux := api.MakeHandlersMux(storage, broker, logger)
+	// setup the tenants
+	var tenants []*tenant.Tenant
+	var fallback *tenant.Tenant
+	if len(cfg.Tenants) == 0 {
+		fallback = newTenant("", tenant.Config{
+			DeliveryDomain: cfg.DeliveryDomain,
+		}, cfg, lst.Addr().String(), logger)
+	}
+	names := make([]string, 0, len(cfg.Tenants))
+	for name := range cfg.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tenants = append(tenants, newTenant(name, cfg.Tenants[name], cfg, lst.Addr().String(), logger))
+	}
+	dispatch, err := tenant.New(tenants, fallback)
+	if err != nil {
+		server.BootLogFatalf("reading config: %v", err)
+	}
+	defer dispatch.Stop()
+	handler := api.PanicTo500Handler(dispatch, logger)
+	go server.HTTPServeRunner(nil, handler, &cfg.HTTPServeParsedConfig, cfg.DevicesParsedConfig.TLSServerConfig())()
+	// listen for device connections
+	resource := &listener.NopSessionResourceManager{}
+	server.DevicesRunner(lst, serveDevice(dispatch, cfg, logger), logger, resource, &cfg.DevicesParsedConfig)()
+}
+
+// for tests
+var runSession = session.Session
+
+// serveDevice returns a function serving device connections with the
+// broker of the tenant they are for, closing those for none.
+func serveDevice(dispatch *tenant.Tenants, cfg *configuration, log logger.Logger) func(net.Conn) error {
+	return func(conn net.Conn) error {
+		t, err := dispatch.ForConn(conn, cfg.ExchangeTimeout())
+		if err != nil {
+			conn.Close()
+			log.Debugf("device connection from %v: %v", conn.RemoteAddr(), err)
+			return err
+		}
+		track := session.NewTracker(log)
+		return runSession(conn, t.Broker, cfg, track)
+	}
+}
+
+// newStorage makes the storage for a tenant, with the limits of the
+// server where the tenant doesn't set its own.
+func newStorage(tcfg tenant.Config, cfg *configuration) *Storage {
+	storage := &Storage{
+		sto:                            store.NewInMemoryPendingStore(),
+		maxNotificationsPerApplication: tcfg.MaxNotificationsPerApplication,
+		maxPayloadSize:                 tcfg.MaxPayloadSize,
+		appMaxPayloadSizes:             tcfg.AppMaxPayloadSizes,
+		blobs:                          store.NewInMemoryBlobStore(),
+		users:                          cfg.Users,
+		requireUserAuth:                cfg.RequireUserAuth,
+	}
+	if storage.maxNotificationsPerApplication == 0 {
+		storage.maxNotificationsPerApplication = cfg.MaxNotificationsPerApplication
+	}
+	if storage.maxPayloadSize == 0 {
+		storage.maxPayloadSize = cfg.MaxPayloadSize
+	}
+	if storage.appMaxPayloadSizes == nil {
+		storage.appMaxPayloadSizes = cfg.AppMaxPayloadSizes
+	}
+	return storage
+}
+
+// newTenant sets up a tenant with its own pending store, broker and
+// statistics, serving the http api including /delivery-hosts and
+// /stats.
+func newTenant(name string, tcfg tenant.Config, cfg *configuration, deviceAddr string, log logger.Logger) *tenant.Tenant {
+	if name != "" {
+		log = logger.With(log, logger.Fields{logger.FieldTenant: name})
+	}
+	// Setup statistics
+	currentStats := statistics.NewStatistics(log)
+	// setup a pending store and start the broker
+	storage := newStorage(tcfg, cfg)
+	broker := simple.NewSimpleBroker(storage.sto, cfg, log, currentStats)
+	broker.Start()
+	// serve the http api
+	mux := api.MakeHandlersMux(storage, broker, log)
 	// & /delivery-hosts
 	mux.HandleFunc("/delivery-hosts", func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Content-Type", "application/json")
 		enc := json.NewEncoder(w)
 		enc.Encode(map[string]interface{}{
-			"hosts":  []string{lst.Addr().String()},
-			"domain": cfg.DeliveryDomain,
+			"hosts":  []string{deviceAddr},
+			"domain": tcfg.DeliveryDomain,
 		})
 	})
 	// /stats
@@ -142,12 +298,14 @@ func main() {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Write(*statsJSON)
 	})
-	handler := api.PanicTo500Handler(mux, logger)
-	go server.HTTPServeRunner(nil, handler, &cfg.HTTPServeParsedConfig, cfg.DevicesParsedConfig.TLSServerConfig())()
-	// listen for device connections
-	resource := &listener.NopSessionResourceManager{}
-	server.DevicesRunner(lst, func(conn net.Conn) error {
-		track := session.NewTracker(logger)
-		return session.Session(conn, broker, cfg, track)
-	}, logger, resource, &cfg.DevicesParsedConfig)()
+	return &tenant.Tenant{
+		Name:    name,
+		Config:  tcfg,
+		Broker:  broker,
+		Handler: mux,
+		Stop: func() {
+			mux.Stop()
+			broker.Stop()
+		},
+	}
 }
@@ -0,0 +1,203 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/ubports/ubuntu-push/server/broker"
+	"github.com/ubports/ubuntu-push/server/session"
+	"github.com/ubports/ubuntu-push/server/tenant"
+	help "github.com/ubports/ubuntu-push/testing"
+)
+
+func TestDev(t *testing.T) { TestingT(t) }
+
+type devSuite struct {
+	cfg     *configuration
+	testlog *help.TestLogger
+}
+
+var _ = Suite(&devSuite{})
+
+const testConfig = `{
+	"exchange_timeout": "5s",
+	"session_queue_size": 10,
+	"broker_queue_size": 100,
+	"max_notifications_per_app": 25,
+	"max_payload_size": 65536,
+	"app_max_payload_sizes": {},
+	"tenants": {}
+}`
+
+func (s *devSuite) SetUpTest(c *C) {
+	s.testlog = help.NewTestLogger(c, "error")
+	s.cfg = &configuration{}
+	err := json.Unmarshal([]byte(testConfig), s.cfg)
+	c.Assert(err, IsNil)
+}
+
+func (s *devSuite) TestCheckLimits(c *C) {
+	c.Check(s.cfg.checkLimits(), IsNil)
+	s.cfg.Tenants = map[string]tenant.Config{"acme": {MaxNotificationsPerApplication: -1}}
+	c.Check(s.cfg.checkLimits(), ErrorMatches, "tenant acme: max_notifications_per_app can't be negative")
+	s.cfg.Tenants = map[string]tenant.Config{"acme": {MaxPayloadSize: -1}}
+	c.Check(s.cfg.checkLimits(), ErrorMatches, "tenant acme: max_payload_size can't be negative")
+	s.cfg.MaxNotificationsPerApplication = 0
+	c.Check(s.cfg.checkLimits(), ErrorMatches, "max_notifications_per_app must be positive")
+}
+
+func (s *devSuite) TestNewStorage(c *C) {
+	s.cfg.AppMaxPayloadSizes = map[string]int{"app1": 8192}
+	// the server's limits
+	storage := newStorage(tenant.Config{}, s.cfg)
+	c.Check(storage.GetMaxNotificationsPerApplication(), Equals, 25)
+	c.Check(storage.GetMaxPayloadSize("app1"), Equals, 8192)
+	c.Check(storage.GetMaxPayloadSize("app2"), Equals, 65536)
+	// the tenant's own
+	storage = newStorage(tenant.Config{
+		MaxNotificationsPerApplication: 5,
+		MaxPayloadSize:                 4096,
+		AppMaxPayloadSizes:             map[string]int{"app2": 16384},
+	}, s.cfg)
+	c.Check(storage.GetMaxNotificationsPerApplication(), Equals, 5)
+	c.Check(storage.GetMaxPayloadSize("app1"), Equals, 4096)
+	c.Check(storage.GetMaxPayloadSize("app2"), Equals, 16384)
+	c.Check(storage.GetLargestPayloadSize(), Equals, 16384)
+}
+
+func (s *devSuite) TestNewTenant(c *C) {
+	s.cfg.MaxNotificationsPerApplication = 2
+	t := newTenant("acme", tenant.Config{DeliveryDomain: "push-delivery.acme.example"}, s.cfg, "127.0.0.1:9090", s.testlog)
+	defer t.Stop()
+	c.Check(t.Name, Equals, "acme")
+
+	rec := httptest.NewRecorder()
+	t.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/delivery-hosts", nil))
+	c.Check(rec.Code, Equals, http.StatusOK)
+	var hosts map[string]interface{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &hosts), IsNil)
+	c.Check(hosts, DeepEquals, map[string]interface{}{
+		"hosts":  []interface{}{"127.0.0.1:9090"},
+		"domain": "push-delivery.acme.example",
+	})
+
+	// the server's limit applies
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	body := `{"userid":"user1","deviceid":"dev1","appid":"app1","expire_on":"` + future + `","data":{}}`
+	codes := make([]int, 3)
+	for i := range codes {
+		request := httptest.NewRequest("POST", "/notify", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		rec = httptest.NewRecorder()
+		t.Handler.ServeHTTP(rec, request)
+		codes[i] = rec.Code
+	}
+	c.Check(codes, DeepEquals, []int{http.StatusOK, http.StatusOK, http.StatusRequestEntityTooLarge})
+
+	rec = httptest.NewRecorder()
+	t.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	c.Check(rec.Code, Equals, http.StatusUnauthorized)
+}
+
+type testBroker struct {
+	broker.Broker
+	name string
+}
+
+func dispatchTo(c *C, fallback *tenant.Tenant) *tenant.Tenants {
+	acme := &tenant.Tenant{
+		Name:   "acme",
+		Config: tenant.Config{DeliveryDomain: "push-delivery.acme.example"},
+		Broker: &testBroker{name: "acme"},
+	}
+	dispatch, err := tenant.New([]*tenant.Tenant{acme}, fallback)
+	c.Assert(err, IsNil)
+	return dispatch
+}
+
+// sessionsWith records the brokers sessions are run with.
+func sessionsWith(brokers *[]string) func() {
+	orig := runSession
+	runSession = func(conn net.Conn, brkr broker.Broker, cfg session.SessionConfig, track session.SessionTracker) error {
+		*brokers = append(*brokers, brkr.(*testBroker).name)
+		return nil
+	}
+	return func() { runSession = orig }
+}
+
+func (s *devSuite) TestServeDeviceFallback(c *C) {
+	var brokers []string
+	defer sessionsWith(&brokers)()
+	fallback := &tenant.Tenant{Broker: &testBroker{name: "fallback"}}
+	serve := serveDevice(dispatchTo(c, fallback), s.cfg, s.testlog)
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	defer conn2.Close()
+	c.Check(serve(conn1), IsNil)
+	c.Check(brokers, DeepEquals, []string{"fallback"})
+}
+
+func (s *devSuite) TestServeDeviceUnknownDomain(c *C) {
+	var brokers []string
+	defer sessionsWith(&brokers)()
+	serve := serveDevice(dispatchTo(c, nil), s.cfg, s.testlog)
+	conn1, conn2 := net.Pipe()
+	defer conn2.Close()
+	c.Check(serve(conn1), Equals, tenant.ErrUnknownDomain)
+	c.Check(brokers, HasLen, 0)
+	// closed
+	_, err := conn2.Write([]byte("x"))
+	c.Check(err, Equals, io.ErrClosedPipe)
+}
+
+func (s *devSuite) TestServeDeviceByDomain(c *C) {
+	var brokers []string
+	defer sessionsWith(&brokers)()
+	cert, err := tls.LoadX509KeyPair("../acceptance/ssl/testing.cert", "../acceptance/ssl/testing.key")
+	c.Assert(err, IsNil)
+	lst, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	c.Assert(err, IsNil)
+	defer lst.Close()
+	go func() {
+		conn, err := tls.Dial("tcp", lst.Addr().String(), &tls.Config{
+			ServerName:         "push-delivery.acme.example",
+			InsecureSkipVerify: true,
+		})
+		if err == nil {
+			defer conn.Close()
+			// wait for the server to be done
+			conn.Read(make([]byte, 1))
+		}
+	}()
+	conn, err := lst.Accept()
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	serve := serveDevice(dispatchTo(c, nil), s.cfg, s.testlog)
+	c.Check(serve(conn), IsNil)
+	c.Check(brokers, DeepEquals, []string{"acme"})
+}
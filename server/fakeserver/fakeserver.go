@@ -0,0 +1,513 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package fakeserver provides a push server to embed in tests. It
+// keeps everything in memory, serves devices and the http api
+// (including /delivery-hosts) on local ports, and can be told to
+// misbehave.
+package fakeserver
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/ubports/ubuntu-push/logger"
+	"github.com/ubports/ubuntu-push/protocol"
+	"github.com/ubports/ubuntu-push/server/api"
+	"github.com/ubports/ubuntu-push/server/broker"
+	"github.com/ubports/ubuntu-push/server/broker/simple"
+	"github.com/ubports/ubuntu-push/server/session"
+	"github.com/ubports/ubuntu-push/server/store"
+	"github.com/ubports/ubuntu-push/testing/faults"
+)
+
+// Config holds what can be set up of a Server; the zero value is
+// fine.
+type Config struct {
+	// how often sessions ping devices, 10 minutes if zero
+	PingInterval time.Duration
+	// how long sessions wait for devices, 5 seconds if zero
+	ExchangeTimeout time.Duration
+	// the domain of the device listener certificate, push-delivery
+	// if empty
+	Domain string
+	// how many notifications an app can have pending for a device,
+	// 25 if zero
+	MaxNotificationsPerApp int
+	// the largest payload accepted, payloads larger than
+	// api.MaxUnicastPayload are delivered by reference;
+	// api.MaxUnicastPayload if zero
+	MaxPayloadSize int
+	// the users devices register on behalf of, by the
+	// Authorization header value they present
+	Users map[string]string
+	// whether devices can only register presenting credentials in
+	// Users
+	RequireUserAuth bool
+	// where to log, nowhere if nil
+	Logger logger.Logger
+}
+
+// sessionConfig implements session.SessionConfig.
+type sessionConfig struct {
+	pingInterval    time.Duration
+	exchangeTimeout time.Duration
+}
+
+func (cfg *sessionConfig) PingInterval() time.Duration {
+	return cfg.pingInterval
+}
+
+func (cfg *sessionConfig) ExchangeTimeout() time.Duration {
+	return cfg.exchangeTimeout
+}
+
+// brokerConfig implements broker.BrokerConfig.
+type brokerConfig struct{}
+
+func (brokerConfig) SessionQueueSize() uint { return 10 }
+func (brokerConfig) BrokerQueueSize() uint  { return 100 }
+
+// Server is a fake push server.
+type Server struct {
+	// URL of the http api, e.g. for registration_url
+	URL string
+	// DeviceAddr is the host:port devices connect to
+	DeviceAddr string
+	// Domain the device listener certificate is for
+	Domain string
+	// CertPEM is the device listener certificate, for clients to
+	// trust, e.g. as cert_pem_file
+	CertPEM []byte
+	// Store holds the pending notifications
+	Store *store.InMemoryPendingStore
+
+	log       logger.Logger
+	cfg       *sessionConfig
+	maxPerApp int
+	maxSize   int
+	users     map[string]string
+	reqAuth   bool
+	blobs     *store.InMemoryBlobStore
+	broker    *simple.SimpleBroker
+	mux       *api.HandlersMux
+	http      *httptest.Server
+	listener  net.Listener
+	wg        sync.WaitGroup
+
+	lock         sync.Mutex
+	closing      bool
+	conns        map[net.Conn]bool
+	sessions     map[string]broker.BrokerSession
+	connected    *sync.Cond
+	rejectAuth   bool
+	connAckDelay time.Duration
+	failures     map[string]*api.APIError
+}
+
+// New starts a Server.
+func New(cfg *Config) (*Server, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	s := &Server{
+		Domain:    cfg.Domain,
+		Store:     store.NewInMemoryPendingStore(),
+		log:       cfg.Logger,
+		cfg:       &sessionConfig{cfg.PingInterval, cfg.ExchangeTimeout},
+		maxPerApp: cfg.MaxNotificationsPerApp,
+		maxSize:   cfg.MaxPayloadSize,
+		users:     cfg.Users,
+		reqAuth:   cfg.RequireUserAuth,
+		blobs:     store.NewInMemoryBlobStore(),
+		conns:     make(map[net.Conn]bool),
+		sessions:  make(map[string]broker.BrokerSession),
+		failures:  make(map[string]*api.APIError),
+	}
+	s.connected = sync.NewCond(&s.lock)
+	if s.Domain == "" {
+		s.Domain = "push-delivery"
+	}
+	if s.log == nil {
+		s.log = logger.NewSimpleLogger(ioutil.Discard, "error")
+	}
+	if s.maxPerApp == 0 {
+		s.maxPerApp = 25
+	}
+	if s.cfg.pingInterval == 0 {
+		s.cfg.pingInterval = 10 * time.Minute
+	}
+	if s.cfg.exchangeTimeout == 0 {
+		s.cfg.exchangeTimeout = 5 * time.Second
+	}
+	cert, err := s.makeCert()
+	if err != nil {
+		return nil, err
+	}
+	s.listener, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.DeviceAddr = s.listener.Addr().String()
+	s.broker = simple.NewSimpleBroker(s.Store, brokerConfig{}, s.log, nil)
+	s.broker.Start()
+	s.http = httptest.NewServer(s.handler())
+	s.URL = s.http.URL
+	s.wg.Add(1)
+	go s.acceptDevices()
+	return s, nil
+}
+
+// makeCert makes a self-signed certificate for Domain, valid for a
+// day.
+func (s *Server) makeCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{Organization: []string{"Fake Push"}, CommonName: s.Domain},
+		DNSNames:              []string{s.Domain},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	s.CertPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Close stops the Server, disconnecting all devices.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.lock.Lock()
+	s.closing = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	sessions := make([]broker.BrokerSession, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.lock.Unlock()
+	// sessions waiting to ping would not notice otherwise
+	for _, sess := range sessions {
+		sess.Feed(nil)
+	}
+	s.wg.Wait()
+	s.http.Close()
+	s.mux.Stop()
+	s.broker.Stop()
+}
+
+// DeliveryHostsURL returns the url of the server /delivery-hosts,
+// usable as the client addr.
+func (s *Server) DeliveryHostsURL() string {
+	return s.URL + "/delivery-hosts"
+}
+
+func (s *Server) acceptDevices() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.conns[conn] = true
+		delay := s.connAckDelay
+		s.lock.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			var wrapped net.Conn = conn
+			if delay > 0 {
+				wrapped = faults.NewConn(conn, &faults.Fault{
+					Match:  faults.OfType("connack"),
+					Action: faults.Delay(delay),
+				})
+			}
+			session.Session(wrapped, (*trackingBroker)(s), s.cfg, session.NewTracker(s.log))
+			s.lock.Lock()
+			delete(s.conns, conn)
+			s.lock.Unlock()
+		}()
+	}
+}
+
+// trackingBroker keeps track of the registered sessions, or rejects
+// them.
+type trackingBroker Server
+
+func (b *trackingBroker) Register(connect *protocol.ConnectMsg, track broker.SessionTracker) (broker.BrokerSession, error) {
+	s := (*Server)(b)
+	s.lock.Lock()
+	reject := s.rejectAuth
+	s.lock.Unlock()
+	if reject {
+		return nil, &broker.ErrAbort{"unauthorized"}
+	}
+	sess, err := s.broker.Register(connect, track)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closing {
+		s.broker.Unregister(sess)
+		return nil, &broker.ErrAbort{"closing"}
+	}
+	s.sessions[connect.DeviceId] = sess
+	s.connected.Broadcast()
+	return sess, nil
+}
+
+func (b *trackingBroker) Unregister(sess broker.BrokerSession) {
+	s := (*Server)(b)
+	s.lock.Lock()
+	deviceId := sess.DeviceIdentifier()
+	if s.sessions[deviceId] == sess {
+		delete(s.sessions, deviceId)
+	}
+	s.lock.Unlock()
+	s.broker.Unregister(sess)
+}
+
+// WaitForDevice waits up to timeout for the device to be connected,
+// returning whether it is.
+func (s *Server) WaitForDevice(deviceId string, timeout time.Duration) bool {
+	timer := time.AfterFunc(timeout, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.connected.Broadcast()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.sessions[deviceId] == nil {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		s.connected.Wait()
+	}
+	return true
+}
+
+// BreakConnection has the server send CONNBROKEN with reason to the
+// device, ending its session; it returns whether the device was
+// connected.
+func (s *Server) BreakConnection(deviceId, reason string) bool {
+	s.lock.Lock()
+	sess := s.sessions[deviceId]
+	s.lock.Unlock()
+	if sess == nil {
+		return false
+	}
+	sess.Feed(&broker.ConnMetaExchange{
+		Msg: &protocol.ConnBrokenMsg{Type: "connbroken", Reason: reason},
+	})
+	return true
+}
+
+// RejectAuth sets whether /register and /unregister requests and
+// device connections are rejected as unauthorized.
+func (s *Server) RejectAuth(reject bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rejectAuth = reject
+}
+
+// SetConnAckDelay has the server wait for d before acknowledging
+// connections from devices with CONNACK.
+func (s *Server) SetConnAckDelay(d time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.connAckDelay = d
+}
+
+// FailRequests has requests to the http api path fail with apiErr,
+// e.g. api.ErrStoreUnavailable for a 503; nil stops that.
+func (s *Server) FailRequests(path string, apiErr *api.APIError) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if apiErr == nil {
+		delete(s.failures, path)
+	} else {
+		s.failures[path] = apiErr
+	}
+}
+
+// Notify sends a unicast notification through the http api,
+// returning its msg id.
+func (s *Server) Notify(deviceId, appId string, data json.RawMessage) (string, error) {
+	body, err := json.Marshal(&api.Unicast{
+		UserId:   deviceId,
+		DeviceId: deviceId,
+		AppId:    appId,
+		ExpireOn: time.Now().Add(time.Hour).Format(time.RFC3339),
+		Data:     data,
+	})
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.Post(s.URL+"/notify", api.JSONMediaType, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		MsgId string `json:"msgid"`
+		Error string `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("notify: %d %s", resp.StatusCode, res.Error)
+	}
+	return res.MsgId, nil
+}
+
+// NotifyUser sends a unicast notification to all of the devices of
+// userId through the http api, returning the msg id for each device.
+func (s *Server) NotifyUser(userId, appId string, data json.RawMessage) (map[string]string, error) {
+	body, err := json.Marshal(&api.Unicast{
+		UserId:   userId,
+		AppId:    appId,
+		ExpireOn: time.Now().Add(time.Hour).Format(time.RFC3339),
+		Data:     data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(s.URL+"/notify/user", api.JSONMediaType, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Devices map[string]struct {
+			MsgId string `json:"msgid"`
+		} `json:"devices"`
+		Error string `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("notify user: %d %s", resp.StatusCode, res.Error)
+	}
+	msgIds := make(map[string]string, len(res.Devices))
+	for deviceId, dev := range res.Devices {
+		msgIds[deviceId] = dev.MsgId
+	}
+	return msgIds, nil
+}
+
+// StoreForRequest implements api.StoreAccess.
+func (s *Server) StoreForRequest(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
+	return s.Store, nil
+}
+
+// GetMaxNotificationsPerApplication implements api.StoreAccess.
+func (s *Server) GetMaxNotificationsPerApplication() int {
+	return s.maxPerApp
+}
+
+// GetMaxPayloadSize implements api.LargePayloadAccess.
+func (s *Server) GetMaxPayloadSize(appId string) int {
+	return s.maxSize
+}
+
+// GetLargestPayloadSize implements api.LargePayloadAccess.
+func (s *Server) GetLargestPayloadSize() int {
+	return s.maxSize
+}
+
+// GetBlobStore implements api.LargePayloadAccess.
+func (s *Server) GetBlobStore() store.BlobStore {
+	return s.blobs
+}
+
+// AuthenticateUser implements api.UserAuthenticator.
+func (s *Server) AuthenticateUser(authorization string) (string, error) {
+	userId, ok := s.users[authorization]
+	if !ok {
+		return "", store.ErrUnauthorized
+	}
+	return userId, nil
+}
+
+// AuthenticationRequired implements api.UserAuthenticator.
+func (s *Server) AuthenticationRequired() bool {
+	return s.reqAuth
+}
+
+func (s *Server) handler() http.Handler {
+	mux := api.MakeHandlersMux(s, s.broker, s.log)
+	s.mux = mux
+	mux.HandleFunc("/delivery-hosts", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"hosts":  []string{s.DeviceAddr},
+			"domain": s.Domain,
+		})
+	})
+	misbehaving := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.lock.Lock()
+		apiErr := s.failures[req.URL.Path]
+		if apiErr == nil && s.rejectAuth && (req.URL.Path == "/register" || req.URL.Path == "/unregister") {
+			apiErr = api.ErrUnauthorized
+		}
+		s.lock.Unlock()
+		if apiErr != nil {
+			api.RespondError(w, apiErr)
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+	return api.PanicTo500Handler(misbehaving, s.log)
+}
@@ -0,0 +1,215 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package fakeserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/ubports/ubuntu-push/blob"
+	"github.com/ubports/ubuntu-push/server/acceptance"
+	"github.com/ubports/ubuntu-push/server/api"
+	"github.com/ubports/ubuntu-push/server/store"
+)
+
+func TestFakeServer(t *testing.T) { TestingT(t) }
+
+type fakeServerSuite struct {
+	srv *Server
+}
+
+var _ = Suite(&fakeServerSuite{})
+
+func (s *fakeServerSuite) SetUpTest(c *C) {
+	srv, err := New(nil)
+	c.Assert(err, IsNil)
+	s.srv = srv
+}
+
+func (s *fakeServerSuite) TearDownTest(c *C) {
+	s.srv.Close()
+}
+
+// device starts a session for deviceId against the server.
+func (s *fakeServerSuite) device(c *C, deviceId string) (<-chan string, <-chan error) {
+	cp := x509.NewCertPool()
+	c.Assert(cp.AppendCertsFromPEM(s.srv.CertPEM), Equals, true)
+	sess := &acceptance.ClientSession{
+		DeviceId:        deviceId,
+		ServerAddr:      s.srv.DeviceAddr,
+		ExchangeTimeout: 5 * time.Second,
+		BuildNumber:     -1,
+		TLSConfig:       &tls.Config{RootCAs: cp, ServerName: s.srv.Domain},
+	}
+	c.Assert(sess.Dial(), IsNil)
+	events := make(chan string, 10)
+	errCh := make(chan error, 1)
+	go func() { errCh <- sess.Run(events) }()
+	return events, errCh
+}
+
+func nextEvent(c *C, events <-chan string, errCh <-chan error) string {
+	select {
+	case ev := <-events:
+		return ev
+	case err := <-errCh:
+		return "error: " + err.Error()
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for event")
+	}
+	return ""
+}
+
+func (s *fakeServerSuite) TestDeliveryHosts(c *C) {
+	resp, err := http.Get(s.srv.DeliveryHostsURL())
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	var hosts struct {
+		Hosts  []string
+		Domain string
+	}
+	c.Assert(json.NewDecoder(resp.Body).Decode(&hosts), IsNil)
+	c.Check(hosts.Hosts, DeepEquals, []string{s.srv.DeviceAddr})
+	c.Check(hosts.Domain, Equals, "push-delivery")
+}
+
+func (s *fakeServerSuite) TestNotify(c *C) {
+	events, errCh := s.device(c, "DEV1")
+	c.Check(nextEvent(c, events, errCh), Matches, "connected .*")
+	c.Assert(s.srv.WaitForDevice("DEV1", 5*time.Second), Equals, true)
+	msgId, err := s.srv.Notify("DEV1", "com.example.app_app", json.RawMessage(`{"m":1}`))
+	c.Assert(err, IsNil)
+	c.Check(msgId, Not(Equals), "")
+	c.Check(nextEvent(c, events, errCh), Equals, `unicast app:com.example.app_app payload:{"m":1};`)
+}
+
+func (s *fakeServerSuite) TestWaitForDeviceTimesOut(c *C) {
+	c.Check(s.srv.WaitForDevice("DEV1", 10*time.Millisecond), Equals, false)
+}
+
+func (s *fakeServerSuite) TestBreakConnection(c *C) {
+	c.Check(s.srv.BreakConnection("DEV1", "BYE"), Equals, false)
+	events, errCh := s.device(c, "DEV1")
+	c.Check(nextEvent(c, events, errCh), Matches, "connected .*")
+	c.Assert(s.srv.WaitForDevice("DEV1", 5*time.Second), Equals, true)
+	c.Check(s.srv.BreakConnection("DEV1", "BYE"), Equals, true)
+	c.Check(nextEvent(c, events, errCh), Equals, "connbroken BYE")
+}
+
+func (s *fakeServerSuite) TestRejectAuth(c *C) {
+	s.srv.RejectAuth(true)
+	resp, err := http.Post(s.srv.URL+"/register", api.JSONMediaType, strings.NewReader(`{"deviceid":"DEV1","appid":"com.example.app_app"}`))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, http.StatusUnauthorized)
+	events, errCh := s.device(c, "DEV1")
+	// CONNACK comes before registration
+	c.Check(nextEvent(c, events, errCh), Matches, "connected .*")
+	c.Check(nextEvent(c, events, errCh), Matches, "error: .*EOF")
+	s.srv.RejectAuth(false)
+	events, errCh = s.device(c, "DEV1")
+	c.Check(nextEvent(c, events, errCh), Matches, "connected .*")
+}
+
+func (s *fakeServerSuite) TestConnAckDelay(c *C) {
+	s.srv.SetConnAckDelay(100 * time.Millisecond)
+	t0 := time.Now()
+	events, errCh := s.device(c, "DEV1")
+	c.Check(nextEvent(c, events, errCh), Matches, "connected .*")
+	c.Check(time.Since(t0) >= 100*time.Millisecond, Equals, true)
+}
+
+func (s *fakeServerSuite) TestFailRequests(c *C) {
+	s.srv.FailRequests("/notify", api.ErrStoreUnavailable)
+	_, err := s.srv.Notify("DEV1", "com.example.app_app", json.RawMessage(`{"m":1}`))
+	c.Check(err, ErrorMatches, "notify: 503 unavailable")
+	s.srv.FailRequests("/notify", nil)
+	_, err = s.srv.Notify("DEV1", "com.example.app_app", json.RawMessage(`{"m":1}`))
+	c.Check(err, IsNil)
+}
+
+func (s *fakeServerSuite) TestMaxPayloadSize(c *C) {
+	big := json.RawMessage(`{"m":"` + strings.Repeat("x", api.MaxUnicastPayload) + `"}`)
+	_, err := s.srv.Notify("DEV1", "com.example.app_app", big)
+	c.Check(err, ErrorMatches, "notify: 400 invalid-request")
+
+	srv, err := New(&Config{MaxPayloadSize: 8192})
+	c.Assert(err, IsNil)
+	defer srv.Close()
+	_, err = srv.Notify("DEV1", "com.example.app_app", big)
+	c.Assert(err, IsNil)
+	_, notifications, err := srv.Store.GetChannelSnapshot(store.UnicastInternalChannelId("DEV1", "DEV1"))
+	c.Assert(err, IsNil)
+	c.Assert(notifications, HasLen, 1)
+	ref := blob.ExtractRef(&notifications[0])
+	c.Assert(ref, NotNil)
+	resp, err := http.Get(srv.URL + "/" + ref.URL)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Check(ref.Check(data), IsNil)
+}
+
+func (s *fakeServerSuite) TestNotifyUser(c *C) {
+	srv, err := New(&Config{Users: map[string]string{"auth1": "user1"}, RequireUserAuth: true})
+	c.Assert(err, IsNil)
+	defer srv.Close()
+	register := func(auth string) int {
+		req, err := http.NewRequest("POST", srv.URL+"/register", strings.NewReader(`{"deviceid":"DEV1","appid":"com.example.app_app"}`))
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Type", api.JSONMediaType)
+		req.Header.Set("Authorization", auth)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	c.Check(register("bogus"), Equals, http.StatusUnauthorized)
+	_, err = srv.NotifyUser("user1", "com.example.app_app", json.RawMessage(`{"m":1}`))
+	c.Check(err, ErrorMatches, "notify user: 400 unknown-user")
+	c.Check(register("auth1"), Equals, http.StatusOK)
+	msgIds, err := srv.NotifyUser("user1", "com.example.app_app", json.RawMessage(`{"m":1}`))
+	c.Assert(err, IsNil)
+	c.Check(msgIds, HasLen, 1)
+	c.Check(msgIds["DEV1"], Not(Equals), "")
+}
+
+func (s *fakeServerSuite) TestRegisterUnrecognisedNotRequired(c *C) {
+	srv, err := New(&Config{Users: map[string]string{"auth1": "user1"}})
+	c.Assert(err, IsNil)
+	defer srv.Close()
+	req, err := http.NewRequest("POST", srv.URL+"/register", strings.NewReader(`{"deviceid":"DEV1","appid":"com.example.app_app"}`))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", api.JSONMediaType)
+	req.Header.Set("Authorization", "bogus")
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	// but on behalf of no user
+	_, err = srv.NotifyUser("user1", "com.example.app_app", json.RawMessage(`{"m":1}`))
+	c.Check(err, ErrorMatches, "notify user: 400 unknown-user")
+}
@@ -20,6 +20,8 @@ import (
 	"crypto/tls"
 	"net"
 	"net/http"
+
+	"golang.org/x/net/http2"
 	"golang.org/x/net/netutil"
 
 	"github.com/ubports/ubuntu-push/config"
@@ -34,7 +36,9 @@ type HTTPServeParsedConfig struct {
 
 // HTTPServeRunner returns a function to serve HTTP requests.
 // If httpLst is not nil it will be used as the underlying listener.
-// If tlsCfg is not nit server over TLS with the config.
+// If tlsCfg is not nit server over TLS with the config, offering
+// HTTP/2 to the clients that negotiate it (tlsCfg gets set up for that),
+// so that senders can multiplex many requests over few connections.
 func HTTPServeRunner(httpLst net.Listener, h http.Handler, parsedCfg *HTTPServeParsedConfig, tlsCfg *tls.Config) func() {
 	if httpLst == nil {
 		var err error
@@ -51,8 +55,15 @@ func HTTPServeRunner(httpLst net.Listener, h http.Handler, parsedCfg *HTTPServeP
 		WriteTimeout: parsedCfg.ParsedHTTPWriteTimeout.TimeDuration(),
 	}
 	if tlsCfg != nil {
-		httpLst = tls.NewListener(httpLst, tlsCfg)
+		srv.TLSConfig = tlsCfg
+		err := http2.ConfigureServer(srv, nil)
+		if err != nil {
+			BootLogFatalf("configuring http/2: %v", err)
+		}
+		// limit below TLS: net/http needs to see the *tls.Conn to
+		// hand over HTTP/2 connections
 		httpLst = netutil.LimitListener(httpLst, 1000)
+		httpLst = tls.NewListener(httpLst, srv.TLSConfig)
 	}
 	return func() {
 		err := srv.Serve(httpLst)
@@ -17,13 +17,19 @@
 package server
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
 	"time"
 
+	"golang.org/x/net/http2"
 	. "launchpad.net/gocheck"
 
 	"github.com/ubports/ubuntu-push/config"
@@ -181,3 +187,60 @@ func (s *runnerSuite) TestHTTPServeRunnerTLS(c *C) {
 	s.lst.Close()
 	c.Check(<-errCh, Matches, "accepting http connections:.*closed.*")
 }
+
+// selfSignedTLSServerConfig makes a tls server config with a throwaway
+// ECDSA certificate.
+func selfSignedTLSServerConfig(c *C) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+func (s *runnerSuite) TestHTTPServeRunnerHTTP2(c *C) {
+	errCh := make(chan interface{}, 1)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s\n", r.Proto)
+	})
+	runner := HTTPServeRunner(nil, h, &testHTTPServeParsedConfig, selfSignedTLSServerConfig(c))
+	c.Assert(s.lst, Not(IsNil))
+	defer s.lst.Close()
+	go func() {
+		defer func() {
+			errCh <- recover()
+		}()
+		runner()
+	}()
+	tlsCliCfg := &tls.Config{InsecureSkipVerify: true}
+	url := fmt.Sprintf("https://%s/", s.lst.Addr())
+	get := func(cli *http.Client) string {
+		resp, err := cli.Get(url)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, 200)
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return string(body)
+	}
+	// negotiated
+	cli2 := &http.Client{Transport: &http2.Transport{TLSClientConfig: tlsCliCfg}}
+	c.Check(get(cli2), Equals, "HTTP/2.0\n")
+	// HTTP/1.1 still served
+	tlsCliCfg1 := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}}
+	cli1 := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCliCfg1}}
+	c.Check(get(cli1), Equals, "HTTP/1.1\n")
+	s.lst.Close()
+	c.Check(<-errCh, Matches, "accepting http connections:.*closed.*")
+}
@@ -22,6 +22,7 @@ import (
 	"net"
 	"time"
 
+	"github.com/ubports/ubuntu-push/logger"
 	"github.com/ubports/ubuntu-push/protocol"
 	"github.com/ubports/ubuntu-push/server/broker"
 )
@@ -168,6 +169,9 @@ Loop:
 				if err != nil {
 					return err
 				}
+				if ucast, ok := exchg.(*broker.UnicastExchange); ok {
+					l.trackAcked(ucast.Notifications(l.sess))
+				}
 				if done {
 					break
 				}
@@ -176,6 +180,17 @@ Loop:
 	}
 }
 
+// trackAcked logs the acknowledged unicast notifications, for tracing
+// them from submission to the device.
+func (l *loop) trackAcked(notifs []protocol.Notification) {
+	for _, notif := range notifs {
+		logger.With(l.track, logger.Fields{
+			logger.FieldMsgId: notif.MsgId,
+			logger.FieldAppId: notif.AppId,
+		}).Debugf("session(%s) acked %s for %s", l.track.SessionId(), notif.MsgId, notif.AppId)
+	}
+}
+
 // sessionLoop manages the exchanges of the protocol session.
 func sessionLoop(proto protocol.Protocol, sess broker.BrokerSession, cfg SessionConfig, track SessionTracker) error {
 	pingInterval := cfg.PingInterval()
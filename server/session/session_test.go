@@ -31,8 +31,11 @@ import (
 
 	"github.com/ubports/ubuntu-push/protocol"
 	"github.com/ubports/ubuntu-push/server/broker"
+	"github.com/ubports/ubuntu-push/server/broker/simple"
 	"github.com/ubports/ubuntu-push/server/broker/testing"
+	"github.com/ubports/ubuntu-push/server/store"
 	helpers "github.com/ubports/ubuntu-push/testing"
+	"github.com/ubports/ubuntu-push/testing/faults"
 )
 
 func TestSession(t *stdtesting.T) { TestingT(t) }
@@ -813,3 +816,103 @@ func (s *sessionSuite) TestSessionWireTimeout2(c *C) {
 	c.Check(remSrv.deadlineKind, DeepEquals, []string{"read", "both"})
 	cli.Close()
 }
+
+var cfgFaults = &testSessionConfig{
+	pingInterval:    100 * time.Millisecond,
+	exchangeTimeout: 200 * time.Millisecond,
+}
+
+// deviceConnection runs one connection of device DEV against Session,
+// with the faults scripted for each side injected; it returns the
+// msg ids of the notifications received before the first ping.
+func (s *sessionSuite) deviceConnection(c *C, brkr broker.Broker, srvScript, cliScript *faults.Script) []string {
+	errCh := make(chan error, 1)
+	srv, cli, lst := serverClientWire()
+	defer lst.Close()
+	go func() {
+		errCh <- Session(srvScript.Wrap(srv), brkr, cfgFaults, NewTracker(s.testlog))
+	}()
+	defer func() {
+		cli.Close()
+		<-errCh
+	}()
+	cli.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.WriteString(cli, "\x00")
+	c.Assert(err, IsNil)
+	proto := protocol.NewProtocol0(cliScript.Wrap(cli))
+	err = proto.WriteMessage(protocol.ConnectMsg{Type: "connect", DeviceId: "DEV"})
+	c.Assert(err, IsNil)
+	var connAck protocol.ConnAckMsg
+	if proto.ReadMessage(&connAck) != nil {
+		return nil
+	}
+	got := []string{}
+	for {
+		var msg protocol.NotificationsMsg
+		if proto.ReadMessage(&msg) != nil {
+			return got
+		}
+		switch msg.Type {
+		case "notifications":
+			for _, notif := range msg.Notifications {
+				got = append(got, notif.MsgId)
+			}
+			proto.WriteMessage(protocol.AckMsg{"ack"})
+		case "ping":
+			proto.WriteMessage(protocol.PingPongMsg{Type: "pong"})
+			return got
+		}
+	}
+}
+
+func (s *sessionSuite) TestSessionFaultsNoNotificationLostOrDuplicated(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	chanId := store.UnicastInternalChannelId("DEV", "DEV")
+	expire := store.Metadata{Expiration: time.Now().Add(time.Hour)}
+	for _, msgId := range []string{"m1", "m2", "m3"} {
+		payload := json.RawMessage(`{"m":"` + msgId + `"}`)
+		err := sto.AppendToUnicastChannel(chanId, "com.example.app_app", payload, msgId, expire)
+		c.Assert(err, IsNil)
+	}
+	brkr := simple.NewSimpleBroker(sto, &testing.TestBrokerConfig{10, 5}, s.testlog, nil)
+	brkr.Start()
+	defer brkr.Stop()
+	srvScript := faults.NewScript(
+		nil,
+		// the server goes away mid-frame
+		[]*faults.Fault{{Match: faults.OfType("notifications"), Action: faults.Cut(20)}},
+		// slow server
+		[]*faults.Fault{
+			{Match: faults.OfType("connack"), Action: faults.Delay(20 * time.Millisecond)},
+			{Match: faults.OfType("notifications"), Action: faults.Split(3, time.Millisecond)},
+		},
+		[]*faults.Fault{{Match: faults.OfType("notifications"), Action: faults.Delay(10 * time.Millisecond)}},
+	)
+	cliScript := faults.NewScript(
+		// garbage on the wire
+		[]*faults.Fault{{Match: faults.OfType("connect"), Action: faults.CorruptLength(5)}},
+		nil,
+		// the ack gets lost
+		[]*faults.Fault{{Match: faults.OfType("ack"), Action: faults.Drop()}},
+		// the ack trickles in
+		[]*faults.Fault{{Match: faults.OfType("ack"), Action: faults.Split(2, time.Millisecond)}},
+	)
+	var received [][]string
+	for i := 0; i < 5; i++ {
+		received = append(received, s.deviceConnection(c, brkr, srvScript, cliScript))
+	}
+	c.Check(received, DeepEquals, [][]string{
+		// no connection
+		nil,
+		// the frame never arrived whole
+		{},
+		// not acked, so sent again
+		{"m1", "m2", "m3"},
+		{"m1", "m2", "m3"},
+		// acked, nothing more
+		{},
+	})
+	_, pending, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Check(pending, HasLen, 0)
+}
@@ -53,20 +53,27 @@ type tracker struct {
 	sessionId string
 }
 
-func NewTracker(logger logger.Logger) SessionTracker {
-	return &tracker{Logger: logger}
+func NewTracker(lg logger.Logger) SessionTracker {
+	return &tracker{Logger: lg}
 }
 
 func (trk *tracker) Start(conn WithRemoteAddr) {
 	trk.sessionId = fmt.Sprintf("%x", time.Now().UnixNano()-sessionsEpoch)
+	trk.Logger = logger.With(trk.Logger, logger.Fields{logger.FieldSession: trk.sessionId})
 	trk.Debugf("session(%s) connected %v", trk.sessionId, conn.RemoteAddr())
 }
 
+// WithFields lets entries about the session carry further fields.
+func (trk *tracker) WithFields(fields logger.Fields) logger.Logger {
+	return logger.With(trk.Logger, fields)
+}
+
 func (trk *tracker) SessionId() string {
 	return trk.sessionId
 }
 
 func (trk *tracker) Registered(sess broker.BrokerSession) {
+	trk.Logger = logger.With(trk.Logger, logger.Fields{logger.FieldDevice: sess.DeviceIdentifier()})
 	trk.Infof("session(%s) registered %v", trk.sessionId, sess.DeviceIdentifier())
 }
 
@@ -17,11 +17,14 @@
 package session
 
 import (
+	"bytes"
 	"fmt"
 	"net"
+	"strings"
 
 	. "launchpad.net/gocheck"
 
+	"github.com/ubports/ubuntu-push/logger"
 	"github.com/ubports/ubuntu-push/server/broker"
 	"github.com/ubports/ubuntu-push/server/broker/testing"
 	helpers "github.com/ubports/ubuntu-push/testing"
@@ -66,3 +69,17 @@ func (s *trackerSuite) TestSessionTrackEnd(c *C) {
 	regExpected := fmt.Sprintf(`.*connected.*\nDEBUG session\(%s\) ended with: session aborted \(\)\n`, track.SessionId())
 	c.Check(s.testlog.Captured(), Matches, regExpected)
 }
+
+func (s *trackerSuite) TestSessionTrackFields(c *C) {
+	buf := &bytes.Buffer{}
+	track := NewTracker(logger.NewJSONLogger(buf, "debug", "server"))
+	track.Start(&testRemoteAddrable{})
+	track.Registered(&testing.TestBrokerSession{DeviceId: "DEV-ID"})
+	logger.With(track, logger.Fields{logger.FieldMsgId: "MSG-ID"}).Debugf("acked")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	c.Assert(lines, HasLen, 3)
+	sessionField := fmt.Sprintf(`"session":"%s"`, track.SessionId())
+	c.Check(lines[0], Matches, `.*`+sessionField+`.*`)
+	c.Check(lines[1], Matches, `.*"device":"DEV-ID".*`+sessionField+`.*`)
+	c.Check(lines[2], Matches, `.*"device":"DEV-ID".*"msgid":"MSG-ID".*`+sessionField+`.*`)
+}
@@ -0,0 +1,96 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrUnknownBlob = errors.New("unknown blob")
+
+// BlobStore keeps the notification payloads too large to be sent
+// inline, for clients to fetch them.
+type BlobStore interface {
+	// PutBlob stores data until expiration, returning its id.
+	PutBlob(data []byte, expiration time.Time) (string, error)
+	// GetBlob returns the data stored with blobId, or
+	// ErrUnknownBlob if there is none or it expired.
+	GetBlob(blobId string) ([]byte, error)
+	// DropBlob drops the data stored with blobId, if any.
+	DropBlob(blobId string) error
+}
+
+type blob struct {
+	data       []byte
+	expiration time.Time
+}
+
+// InMemoryBlobStore is a basic in-memory blob store.
+type InMemoryBlobStore struct {
+	lock  sync.Mutex
+	blobs map[string]blob
+}
+
+// NewInMemoryBlobStore returns a new InMemoryBlobStore.
+func NewInMemoryBlobStore() *InMemoryBlobStore {
+	return &InMemoryBlobStore{
+		blobs: make(map[string]blob),
+	}
+}
+
+func (sto *InMemoryBlobStore) PutBlob(data []byte, expiration time.Time) (string, error) {
+	var rnd [16]byte
+	_, err := rand.Read(rnd[:])
+	if err != nil {
+		return "", err
+	}
+	blobId := hex.EncodeToString(rnd[:])
+	now := time.Now()
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	for id, b := range sto.blobs {
+		if now.After(b.expiration) {
+			delete(sto.blobs, id)
+		}
+	}
+	sto.blobs[blobId] = blob{data, expiration}
+	return blobId, nil
+}
+
+func (sto *InMemoryBlobStore) GetBlob(blobId string) ([]byte, error) {
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	b, ok := sto.blobs[blobId]
+	if !ok || time.Now().After(b.expiration) {
+		return nil, ErrUnknownBlob
+	}
+	return b.data, nil
+}
+
+func (sto *InMemoryBlobStore) DropBlob(blobId string) error {
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	delete(sto.blobs, blobId)
+	return nil
+}
+
+// sanity check we implement the interface
+var _ BlobStore = (*InMemoryBlobStore)(nil)
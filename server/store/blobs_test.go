@@ -0,0 +1,72 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package store
+
+import (
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type blobsSuite struct{}
+
+var _ = Suite(&blobsSuite{})
+
+func (s *blobsSuite) TestPutGetBlob(c *C) {
+	sto := NewInMemoryBlobStore()
+	id1, err := sto.PutBlob([]byte(`{"a":1}`), time.Now().Add(time.Minute))
+	c.Assert(err, IsNil)
+	id2, err := sto.PutBlob([]byte(`{"a":2}`), time.Now().Add(time.Minute))
+	c.Assert(err, IsNil)
+	c.Check(id1, HasLen, 32)
+	c.Check(id1, Not(Equals), id2)
+	data, err := sto.GetBlob(id1)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, `{"a":1}`)
+	data, err = sto.GetBlob(id2)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, `{"a":2}`)
+}
+
+func (s *blobsSuite) TestGetBlobUnknown(c *C) {
+	sto := NewInMemoryBlobStore()
+	_, err := sto.GetBlob("garbage")
+	c.Check(err, Equals, ErrUnknownBlob)
+}
+
+func (s *blobsSuite) TestDropBlob(c *C) {
+	sto := NewInMemoryBlobStore()
+	id1, err := sto.PutBlob([]byte(`{}`), time.Now().Add(time.Minute))
+	c.Assert(err, IsNil)
+	c.Check(sto.DropBlob(id1), IsNil)
+	_, err = sto.GetBlob(id1)
+	c.Check(err, Equals, ErrUnknownBlob)
+	// dropping what isn't there is fine
+	c.Check(sto.DropBlob(id1), IsNil)
+}
+
+func (s *blobsSuite) TestGetBlobExpired(c *C) {
+	sto := NewInMemoryBlobStore()
+	id1, err := sto.PutBlob([]byte(`{}`), time.Now().Add(-time.Minute))
+	c.Assert(err, IsNil)
+	_, err = sto.GetBlob(id1)
+	c.Check(err, Equals, ErrUnknownBlob)
+	// expired blobs are dropped when others are put
+	_, err = sto.PutBlob([]byte(`{}`), time.Now().Add(time.Minute))
+	c.Assert(err, IsNil)
+	c.Check(sto.blobs, HasLen, 1)
+}
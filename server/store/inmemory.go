@@ -20,6 +20,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -32,30 +33,114 @@ type channel struct {
 	topLevel      int64
 	notifications []protocol.Notification
 	meta          []Metadata
+	// the app notifications ever appended, by message id
+	issued map[string]issuedMsg
+}
+
+// issuedMsg records an app notification appended to a unicast channel
+// until it is unlikely to still be presented
+type issuedMsg struct {
+	appId string
+	until time.Time
+}
+
+// IssuedMsgIdRetention is for how long after it is due a message id
+// is still known, see KnownMsgId.
+var IssuedMsgIdRetention = 30 * 24 * time.Hour
+
+// a user's devices are kept per application
+type userApp struct {
+	userId string
+	appId  string
 }
 
 // InMemoryPendingStore is a basic in-memory pending notification store.
 type InMemoryPendingStore struct {
 	lock  sync.Mutex
 	store map[InternalChannelId]*channel
+	users map[userApp]map[string]bool
+	apps  map[string]map[string]bool
 }
 
 // NewInMemoryPendingStore returns a new InMemoryStore.
 func NewInMemoryPendingStore() *InMemoryPendingStore {
 	return &InMemoryPendingStore{
 		store: make(map[InternalChannelId]*channel),
+		users: make(map[userApp]map[string]bool),
+		apps:  make(map[string]map[string]bool),
 	}
 }
 
 func (sto *InMemoryPendingStore) Register(deviceId, appId string) (string, error) {
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	apps := sto.apps[deviceId]
+	if apps == nil {
+		apps = make(map[string]bool)
+		sto.apps[deviceId] = apps
+	}
+	apps[appId] = true
 	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s::%s", appId, deviceId))), nil
 }
 
 func (sto *InMemoryPendingStore) Unregister(deviceId, appId string) error {
-	// do nothing, tokens here are computed deterministically and not stored
+	// tokens here are computed deterministically and not stored
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	if apps := sto.apps[deviceId]; apps != nil {
+		delete(apps, appId)
+		if len(apps) == 0 {
+			delete(sto.apps, deviceId)
+		}
+	}
+	for ua, devices := range sto.users {
+		if ua.appId != appId {
+			continue
+		}
+		delete(devices, deviceId)
+		if len(devices) == 0 {
+			delete(sto.users, ua)
+		}
+	}
 	return nil
 }
 
+func (sto *InMemoryPendingStore) AddUserDevice(userId, deviceId, appId string) error {
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	ua := userApp{userId, appId}
+	devices := sto.users[ua]
+	if devices == nil {
+		devices = make(map[string]bool)
+		sto.users[ua] = devices
+	}
+	devices[deviceId] = true
+	return nil
+}
+
+func (sto *InMemoryPendingStore) GetDeviceApps(deviceId string) ([]string, error) {
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	apps := make([]string, 0, len(sto.apps[deviceId]))
+	for appId := range sto.apps[deviceId] {
+		apps = append(apps, appId)
+	}
+	sort.Strings(apps)
+	return apps, nil
+}
+
+func (sto *InMemoryPendingStore) GetUserChannels(userId, appId string) (map[string]InternalChannelId, error) {
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	devices := sto.users[userApp{userId, appId}]
+	res := make(map[string]InternalChannelId, len(devices))
+	for deviceId := range devices {
+		// the same channel registration tokens resolve to
+		res[deviceId] = UnicastInternalChannelId(deviceId, deviceId)
+	}
+	return res, nil
+}
+
 func (sto *InMemoryPendingStore) GetInternalChannelIdFromToken(token, appId, userId, deviceId string) (InternalChannelId, error) {
 	if token != "" && appId != "" {
 		decoded, err := base64.StdEncoding.DecodeString(token)
@@ -82,6 +167,62 @@ func (sto *InMemoryPendingStore) GetInternalChannelId(name string) (InternalChan
 	return InternalChannelId(""), ErrUnknownChannel
 }
 
+// byDeliverAfter sorts notification indexes by delivery date
+type byDeliverAfter struct {
+	idxs []int
+	meta []Metadata
+}
+
+func (b byDeliverAfter) Len() int {
+	return len(b.idxs)
+}
+
+func (b byDeliverAfter) Less(i, j int) bool {
+	return b.meta[b.idxs[i]].DeliverAfter.Before(b.meta[b.idxs[j]].DeliverAfter)
+}
+
+func (b byDeliverAfter) Swap(i, j int) {
+	b.idxs[i], b.idxs[j] = b.idxs[j], b.idxs[i]
+}
+
+// promoteDue moves the broadcast notifications that fell due since
+// being scheduled to the end of the channel, only then counting them
+// in the top level, so that client levels stay consistent.
+func (ch *channel) promoteDue(now time.Time) {
+	n := len(ch.notifications)
+	var due []int
+	for i := range ch.meta {
+		if !ch.meta[i].DeliverAfter.IsZero() && ch.meta[i].Due(now) {
+			due = append(due, i)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+	sort.Stable(byDeliverAfter{due, ch.meta})
+	isDue := make(map[int]bool, len(due))
+	for _, i := range due {
+		isDue[i] = true
+	}
+	notifs := make([]protocol.Notification, 0, n)
+	meta := make([]Metadata, 0, n)
+	for i := range ch.notifications {
+		if !isDue[i] {
+			notifs = append(notifs, ch.notifications[i])
+			meta = append(meta, ch.meta[i])
+		}
+	}
+	for _, i := range due {
+		meta1 := ch.meta[i]
+		meta1.DeliverAfter = time.Time{}
+		notifs = append(notifs, ch.notifications[i])
+		meta = append(meta, meta1)
+	}
+	ch.notifications = notifs
+	ch.meta = meta
+	ch.topLevel += int64(len(due))
+}
+
 func (sto *InMemoryPendingStore) appendToChannel(chanId InternalChannelId, newNotification protocol.Notification, inc int64, meta1 Metadata) error {
 	sto.lock.Lock()
 	defer sto.lock.Unlock()
@@ -89,6 +230,14 @@ func (sto *InMemoryPendingStore) appendToChannel(chanId InternalChannelId, newNo
 	if prev == nil {
 		prev = &channel{}
 	}
+	now := time.Now()
+	if inc != 0 {
+		prev.promoteDue(now)
+	}
+	if !meta1.Due(now) {
+		// counted in the top level once due, see promoteDue
+		inc = 0
+	}
 	prev.topLevel += inc
 	prev.notifications = append(prev.notifications, newNotification)
 	prev.meta = append(prev.meta, meta1)
@@ -97,9 +246,16 @@ func (sto *InMemoryPendingStore) appendToChannel(chanId InternalChannelId, newNo
 }
 
 func (sto *InMemoryPendingStore) AppendToChannel(chanId InternalChannelId, notificationPayload json.RawMessage, expiration time.Time) error {
-	newNotification := protocol.Notification{Payload: notificationPayload}
 	meta1 := Metadata{Expiration: expiration}
-	return sto.appendToChannel(chanId, newNotification, 1, meta1)
+	return sto.AppendToBroadcastChannel(chanId, "", notificationPayload, meta1)
+}
+
+func (sto *InMemoryPendingStore) AppendToBroadcastChannel(chanId InternalChannelId, appId string, notificationPayload json.RawMessage, meta Metadata) error {
+	newNotification := protocol.Notification{
+		Payload: notificationPayload,
+		AppId:   appId,
+	}
+	return sto.appendToChannel(chanId, newNotification, 1, meta)
 }
 
 func (sto *InMemoryPendingStore) AppendToUnicastChannel(chanId InternalChannelId, appId string, notificationPayload json.RawMessage, msgId string, meta Metadata) error {
@@ -107,8 +263,41 @@ func (sto *InMemoryPendingStore) AppendToUnicastChannel(chanId InternalChannelId
 		Payload: notificationPayload,
 		AppId:   appId,
 		MsgId:   msgId,
+		Kind:    meta.Kind,
+	}
+	err := sto.appendToChannel(chanId, newNotification, 0, meta)
+	if err != nil || meta.Kind == protocol.KindClear {
+		return err
+	}
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	channel := sto.store[chanId]
+	now := time.Now()
+	if channel.issued == nil {
+		channel.issued = make(map[string]issuedMsg)
+	}
+	for id, issued := range channel.issued {
+		if issued.until.Before(now) {
+			delete(channel.issued, id)
+		}
+	}
+	due := meta.DeliverAfter
+	if due.Before(now) {
+		due = now
 	}
-	return sto.appendToChannel(chanId, newNotification, 0, meta)
+	channel.issued[msgId] = issuedMsg{appId, due.Add(IssuedMsgIdRetention)}
+	return nil
+}
+
+func (sto *InMemoryPendingStore) KnownMsgId(chanId InternalChannelId, appId, msgId string) (bool, error) {
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	channel, ok := sto.store[chanId]
+	if !ok {
+		return false, nil
+	}
+	issued, ok := channel.issued[msgId]
+	return ok && issued.appId == appId && !issued.until.Before(time.Now()), nil
 }
 
 func (sto *InMemoryPendingStore) getChannelUnfiltered(chanId InternalChannelId) (*channel, []protocol.Notification, []Metadata) {
@@ -116,6 +305,9 @@ func (sto *InMemoryPendingStore) getChannelUnfiltered(chanId InternalChannelId)
 	if !ok {
 		return nil, nil, nil
 	}
+	if chanId.BroadcastChannel() {
+		channel.promoteDue(time.Now())
+	}
 	n := len(channel.notifications)
 	res := make([]protocol.Notification, n)
 	meta := make([]Metadata, n)
@@ -139,7 +331,7 @@ func (sto *InMemoryPendingStore) GetChannelSnapshot(chanId InternalChannelId) (i
 	if res == nil {
 		return 0, nil, nil
 	}
-	res = FilterOutObsolete(res, meta)
+	res = FilterDeliverable(res, meta)
 	return topLevel, res, nil
 }
 
@@ -48,6 +48,70 @@ func (s *inMemorySuite) TestUnregister(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *inMemorySuite) TestGetDeviceApps(c *C) {
+	sto := NewInMemoryPendingStore()
+
+	apps, err := sto.GetDeviceApps("DEV1")
+	c.Assert(err, IsNil)
+	c.Check(apps, HasLen, 0)
+
+	_, err = sto.Register("DEV1", "app2")
+	c.Assert(err, IsNil)
+	_, err = sto.Register("DEV1", "app1")
+	c.Assert(err, IsNil)
+	_, err = sto.Register("DEV2", "app3")
+	c.Assert(err, IsNil)
+	apps, err = sto.GetDeviceApps("DEV1")
+	c.Assert(err, IsNil)
+	c.Check(apps, DeepEquals, []string{"app1", "app2"})
+
+	c.Assert(sto.Unregister("DEV1", "app2"), IsNil)
+	apps, err = sto.GetDeviceApps("DEV1")
+	c.Assert(err, IsNil)
+	c.Check(apps, DeepEquals, []string{"app1"})
+	c.Assert(sto.Unregister("DEV1", "app1"), IsNil)
+	apps, err = sto.GetDeviceApps("DEV1")
+	c.Assert(err, IsNil)
+	c.Check(apps, HasLen, 0)
+}
+
+func (s *inMemorySuite) TestUserDevices(c *C) {
+	sto := NewInMemoryPendingStore()
+
+	chans, err := sto.GetUserChannels("user1", "app1")
+	c.Assert(err, IsNil)
+	c.Check(chans, HasLen, 0)
+
+	c.Assert(sto.AddUserDevice("user1", "DEV1", "app1"), IsNil)
+	c.Assert(sto.AddUserDevice("user1", "DEV2", "app1"), IsNil)
+	c.Assert(sto.AddUserDevice("user1", "DEV2", "app1"), IsNil)
+	c.Assert(sto.AddUserDevice("user1", "DEV3", "app2"), IsNil)
+	c.Assert(sto.AddUserDevice("user2", "DEV4", "app1"), IsNil)
+
+	chans, err = sto.GetUserChannels("user1", "app1")
+	c.Assert(err, IsNil)
+	c.Check(chans, DeepEquals, map[string]InternalChannelId{
+		"DEV1": UnicastInternalChannelId("DEV1", "DEV1"),
+		"DEV2": UnicastInternalChannelId("DEV2", "DEV2"),
+	})
+	// the channels are the ones tokens resolve to
+	tok, err := sto.Register("DEV1", "app1")
+	c.Assert(err, IsNil)
+	chanId, err := sto.GetInternalChannelIdFromToken(tok, "app1", "", "")
+	c.Assert(err, IsNil)
+	c.Check(chans["DEV1"], Equals, chanId)
+
+	// unregistering forgets the device for that app only
+	c.Assert(sto.Unregister("DEV2", "app1"), IsNil)
+	c.Assert(sto.Unregister("DEV3", "app1"), IsNil)
+	chans, err = sto.GetUserChannels("user1", "app1")
+	c.Assert(err, IsNil)
+	c.Check(chans, HasLen, 1)
+	chans, err = sto.GetUserChannels("user1", "app2")
+	c.Assert(err, IsNil)
+	c.Check(chans, HasLen, 1)
+}
+
 func (s *inMemorySuite) TestGetInternalChannelIdFromToken(c *C) {
 	sto := NewInMemoryPendingStore()
 
@@ -150,6 +214,162 @@ func (s *inMemorySuite) TestAppendToUnicastChannelAndGetChannelSnapshot(c *C) {
 	c.Check(top, Equals, int64(0))
 }
 
+func (s *inMemorySuite) TestAppendToBroadcastChannelAndGetChannelSnapshot(c *C) {
+	sto := NewInMemoryPendingStore()
+
+	chanId := AppBroadcastInternalChannelId("app1")
+	notification1 := json.RawMessage(`{"a":1}`)
+	notification2 := json.RawMessage(`{"a":2}`)
+
+	muchLater := time.Now().Add(time.Minute)
+
+	err := sto.AppendToBroadcastChannel(chanId, "app1", notification1, Metadata{Expiration: muchLater})
+	c.Assert(err, IsNil)
+	err = sto.AppendToBroadcastChannel(chanId, "app1", notification2, Metadata{Expiration: muchLater})
+	c.Assert(err, IsNil)
+	top, res, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Check(top, Equals, int64(2))
+	c.Check(res, DeepEquals, []protocol.Notification{
+		protocol.Notification{Payload: notification1, AppId: "app1"},
+		protocol.Notification{Payload: notification2, AppId: "app1"},
+	})
+}
+
+func (s *inMemorySuite) TestScheduledBroadcastHeldBackUntilDue(c *C) {
+	sto := NewInMemoryPendingStore()
+
+	notification1 := json.RawMessage(`{"a":1}`)
+	notification2 := json.RawMessage(`{"a":2}`)
+	notification3 := json.RawMessage(`{"a":3}`)
+
+	muchLater := time.Now().Add(time.Minute)
+	soon := time.Now().Add(50 * time.Millisecond)
+
+	err := sto.AppendToBroadcastChannel(SystemInternalChannelId, "", notification1, Metadata{Expiration: muchLater, DeliverAfter: soon})
+	c.Assert(err, IsNil)
+	err = sto.AppendToChannel(SystemInternalChannelId, notification2, muchLater)
+	c.Assert(err, IsNil)
+	top, res, err := sto.GetChannelSnapshot(SystemInternalChannelId)
+	c.Assert(err, IsNil)
+	c.Check(top, Equals, int64(1))
+	c.Check(res, DeepEquals, help.Ns(notification2))
+
+	time.Sleep(100 * time.Millisecond)
+	err = sto.AppendToChannel(SystemInternalChannelId, notification3, muchLater)
+	c.Assert(err, IsNil)
+	top, res, err = sto.GetChannelSnapshot(SystemInternalChannelId)
+	c.Assert(err, IsNil)
+	c.Check(top, Equals, int64(3))
+	c.Check(res, DeepEquals, help.Ns(notification2, notification1, notification3))
+}
+
+func (s *inMemorySuite) TestScheduledUnicastHiddenFromSnapshot(c *C) {
+	sto := NewInMemoryPendingStore()
+	chanId := UnicastInternalChannelId("user", "dev")
+
+	notification1 := json.RawMessage(`{"a":1}`)
+	muchLater := time.Now().Add(time.Minute)
+	n := protocol.Notification{Payload: notification1, AppId: "app1", MsgId: "m1"}
+
+	err := sto.AppendToUnicastChannel(chanId, "app1", notification1, "m1", Metadata{Expiration: muchLater, DeliverAfter: time.Now().Add(30 * time.Second)})
+	c.Assert(err, IsNil)
+	_, res, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Check(res, HasLen, 0)
+	_, res, meta, err := sto.GetChannelUnfiltered(chanId)
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, []protocol.Notification{n})
+	c.Check(meta[0].Due(time.Now()), Equals, false)
+	c.Check(meta[0].Due(time.Now().Add(time.Minute)), Equals, true)
+}
+
+func (s *inMemorySuite) TestKnownMsgId(c *C) {
+	sto := NewInMemoryPendingStore()
+	chanId := UnicastInternalChannelId("user", "dev")
+	muchLater := Metadata{Expiration: time.Now().Add(time.Minute)}
+
+	known, err := sto.KnownMsgId(chanId, "app1", "m1")
+	c.Assert(err, IsNil)
+	c.Check(known, Equals, false)
+
+	n1 := protocol.Notification{Payload: json.RawMessage(`{"a":1}`), AppId: "app1", MsgId: "m1"}
+	c.Assert(sto.AppendToUnicastChannel(chanId, "app1", n1.Payload, "m1", muchLater), IsNil)
+	clear := muchLater
+	clear.Kind = protocol.KindClear
+	c.Assert(sto.AppendToUnicastChannel(chanId, "app1", json.RawMessage(`{"msgid":"m1"}`), "m2", clear), IsNil)
+	// still known once delivered
+	c.Assert(sto.DropByMsgId(chanId, []protocol.Notification{n1}), IsNil)
+
+	known, err = sto.KnownMsgId(chanId, "app1", "m1")
+	c.Assert(err, IsNil)
+	c.Check(known, Equals, true)
+	known, err = sto.KnownMsgId(chanId, "app2", "m1")
+	c.Assert(err, IsNil)
+	c.Check(known, Equals, false)
+	// clear instructions for the client itself are not recorded
+	known, err = sto.KnownMsgId(chanId, "app1", "m2")
+	c.Assert(err, IsNil)
+	c.Check(known, Equals, false)
+	// messages sent by reference are the app's
+	byRef := muchLater
+	byRef.Kind = protocol.KindBlob
+	c.Assert(sto.AppendToUnicastChannel(chanId, "app1", json.RawMessage(`{"url":"blob/b1"}`), "m3", byRef), IsNil)
+	known, err = sto.KnownMsgId(chanId, "app1", "m3")
+	c.Assert(err, IsNil)
+	c.Check(known, Equals, true)
+	_, res, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, []protocol.Notification{
+		{Payload: json.RawMessage(`{"msgid":"m1"}`), AppId: "app1", MsgId: "m2", Kind: protocol.KindClear},
+		{Payload: json.RawMessage(`{"url":"blob/b1"}`), AppId: "app1", MsgId: "m3", Kind: protocol.KindBlob},
+	})
+}
+
+func (s *inMemorySuite) TestKnownMsgIdRetention(c *C) {
+	prevRetention := IssuedMsgIdRetention
+	defer func() {
+		IssuedMsgIdRetention = prevRetention
+	}()
+	IssuedMsgIdRetention = -time.Second
+	sto := NewInMemoryPendingStore()
+	chanId := UnicastInternalChannelId("user", "dev")
+	muchLater := Metadata{Expiration: time.Now().Add(time.Minute)}
+
+	c.Assert(sto.AppendToUnicastChannel(chanId, "app1", json.RawMessage(`{}`), "m1", muchLater), IsNil)
+	known, err := sto.KnownMsgId(chanId, "app1", "m1")
+	c.Assert(err, IsNil)
+	c.Check(known, Equals, false)
+	c.Assert(sto.AppendToUnicastChannel(chanId, "app1", json.RawMessage(`{}`), "m2", muchLater), IsNil)
+	// forgotten
+	c.Check(sto.store[chanId].issued, HasLen, 1)
+}
+
+func (s *inMemorySuite) TestReplaceTagNotYetDueDoesNotSupersede(c *C) {
+	sto := NewInMemoryPendingStore()
+	chanId := UnicastInternalChannelId("user", "dev")
+
+	notification1 := json.RawMessage(`{"a":1}`)
+	notification2 := json.RawMessage(`{"a":2}`)
+	muchLater := time.Now().Add(time.Minute)
+	n1 := protocol.Notification{Payload: notification1, AppId: "app1", MsgId: "m1"}
+	n2 := protocol.Notification{Payload: notification2, AppId: "app1", MsgId: "m2"}
+
+	err := sto.AppendToUnicastChannel(chanId, "app1", notification1, "m1", Metadata{Expiration: muchLater, ReplaceTag: "u1"})
+	c.Assert(err, IsNil)
+	err = sto.AppendToUnicastChannel(chanId, "app1", notification2, "m2", Metadata{Expiration: muchLater, ReplaceTag: "u1", DeliverAfter: time.Now().Add(30 * time.Second)})
+	c.Assert(err, IsNil)
+	// the due one is still delivered
+	_, res, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, []protocol.Notification{n1})
+	// and scrubbing keeps both
+	c.Assert(sto.Scrub(chanId), IsNil)
+	_, res, _, err = sto.GetChannelUnfiltered(chanId)
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, []protocol.Notification{n1, n2})
+}
+
 func (s *inMemorySuite) TestAppendToChannelAndGetChannelUnfiltered(c *C) {
 	sto := NewInMemoryPendingStore()
 
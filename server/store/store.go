@@ -18,6 +18,7 @@
 package store
 
 import (
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -93,6 +94,15 @@ func HexToInternalChannelId(hexRepr string) (InternalChannelId, error) {
 	return InternalChannelId(s), nil
 }
 
+// AppBroadcastInternalChannelId builds the id of the broadcast channel
+// scoped to the application appId. It is derived deterministically
+// from appId so that it round-trips through the hex representation
+// clients use for levels.
+func AppBroadcastInternalChannelId(appId string) InternalChannelId {
+	h := sha256.Sum256([]byte(appId))
+	return InternalChannelId("B" + hex.EncodeToString(h[:16]))
+}
+
 // UnicastInternalChannelId builds a channel id for the userId, deviceId pair.
 func UnicastInternalChannelId(userId, deviceId string) InternalChannelId {
 	return InternalChannelId(fmt.Sprintf("U%s:%s", userId, deviceId))
@@ -102,7 +112,12 @@ func UnicastInternalChannelId(userId, deviceId string) InternalChannelId {
 type Metadata struct {
 	Expiration time.Time
 	ReplaceTag string
-	Obsolete   bool
+	// DeliverAfter, if set, holds back delivery until then
+	DeliverAfter time.Time
+	// Kind, if set, is the protocol.Notification Kind of a
+	// notification for the client itself
+	Kind     string
+	Obsolete bool
 }
 
 // Before checks whether the expiration date in the metadata is before ref.
@@ -110,25 +125,49 @@ func (m *Metadata) Before(ref time.Time) bool {
 	return m.Expiration.Before(ref)
 }
 
+// Due checks whether the notification can be delivered at ref.
+func (m *Metadata) Due(ref time.Time) bool {
+	return !m.DeliverAfter.After(ref)
+}
+
 // PendingStore let store notifications into channels.
 type PendingStore interface {
 	// Register returns a token for a device id, application id pair.
 	Register(deviceId, appId string) (token string, err error)
-	// Unregister forgets the token for a device id, application id pair.
+	// Unregister forgets the token for a device id, application id
+	// pair, and the device for any user it was added to for appId.
 	Unregister(deviceId, appId string) error
+	// GetDeviceApps returns the applications deviceId is registered
+	// for.
+	GetDeviceApps(deviceId string) ([]string, error)
+	// AddUserDevice adds a device registered for appId to the
+	// devices of userId.
+	AddUserDevice(userId, deviceId, appId string) error
+	// GetUserChannels returns the unicast channels of the devices of
+	// userId registered for appId, by device id.
+	GetUserChannels(userId, appId string) (map[string]InternalChannelId, error)
 	// GetInternalChannelId returns the internal store id for a channel
 	// given the name.
 	GetInternalChannelId(name string) (InternalChannelId, error)
 	// AppendToChannel appends a notification to the channel.
 	AppendToChannel(chanId InternalChannelId, notification json.RawMessage, expiration time.Time) error
+	// AppendToBroadcastChannel appends a notification with metadata
+	// to the broadcast channel, appId addresses app-scoped channels
+	// and is otherwise empty.
+	AppendToBroadcastChannel(chanId InternalChannelId, appId string, notification json.RawMessage, meta Metadata) error
 	// GetInternalChannelIdFromToken returns the matching internal store
 	// id for a channel given a registered token and application id or
 	// directly a device id, user id pair.
 	GetInternalChannelIdFromToken(token, appId, userId, deviceId string) (InternalChannelId, error)
 	// AppendToUnicastChannel appends a notification to the unicast channel.
 	AppendToUnicastChannel(chanId InternalChannelId, appId string, notification json.RawMessage, msgId string, meta Metadata) error
+	// KnownMsgId checks whether an app notification with msgId was
+	// appended to the unicast channel for appId, recently enough
+	// that it could still be presented.
+	KnownMsgId(chanId InternalChannelId, appId, msgId string) (bool, error)
 	// GetChannelSnapshot gets all the current notifications and
-	// current top level in the channel.
+	// current top level in the channel. Notifications not yet due
+	// for delivery are left out.
 	GetChannelSnapshot(chanId InternalChannelId) (topLevel int64, notifications []protocol.Notification, err error)
 	// GetChannelUnfiltered gets all the stored notifications with
 	// metadata and current top level in the channel.
@@ -186,7 +225,8 @@ type tagKey struct {
 
 // FilterOutObsolete filters out expired notifications and superseded
 // notifications sharing a replace tag based on paired meta
-// information.
+// information. Only notifications already due supersede earlier
+// ones.
 func FilterOutObsolete(notifications []protocol.Notification, meta []Metadata) []protocol.Notification {
 	now := time.Now()
 	seenTags := make(map[tagKey]bool, 10)
@@ -203,7 +243,7 @@ func FilterOutObsolete(notifications []protocol.Notification, meta []Metadata) [
 			if seen {
 				meta[j].Obsolete = true
 				continue
-			} else {
+			} else if meta[j].Due(now) {
 				seenTags[key] = true
 			}
 		}
@@ -219,3 +259,25 @@ func FilterOutObsolete(notifications []protocol.Notification, meta []Metadata) [
 	}
 	return res
 }
+
+// FilterDeliverable filters out obsolete notifications, see
+// FilterOutObsolete, and the ones not yet due for delivery based on
+// paired meta information.
+func FilterDeliverable(notifications []protocol.Notification, meta []Metadata) []protocol.Notification {
+	now := time.Now()
+	fresh := FilterOutObsolete(notifications, meta)
+	res := make([]protocol.Notification, 0, len(fresh))
+	i := 0
+	for j := range meta {
+		if meta[j].Obsolete {
+			continue
+		}
+		notif := fresh[i]
+		i++
+		if !meta[j].Due(now) {
+			continue
+		}
+		res = append(res, notif)
+	}
+	return res
+}
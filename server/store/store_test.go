@@ -67,6 +67,19 @@ func (s *storeSuite) TestUnicastInternalChannelId(c *C) {
 	c.Check(func() { SystemInternalChannelId.UnicastUserAndDevice() }, PanicMatches, "UnicastUserAndDevice is for unicast channels")
 }
 
+func (s *storeSuite) TestAppBroadcastInternalChannelId(c *C) {
+	chanId := AppBroadcastInternalChannelId("com.example.app_app")
+	c.Check(chanId.BroadcastChannel(), Equals, true)
+	c.Check(chanId.UnicastChannel(), Equals, false)
+	c.Check(chanId, Not(Equals), SystemInternalChannelId)
+	c.Check(AppBroadcastInternalChannelId("com.example.app_app"), Equals, chanId)
+	c.Check(AppBroadcastInternalChannelId("com.example.other_app"), Not(Equals), chanId)
+	// round-trips through the hex repr
+	back, err := HexToInternalChannelId(InternalChannelIdToHex(chanId))
+	c.Check(err, IsNil)
+	c.Check(back, Equals, chanId)
+}
+
 func (s *storeSuite) TestFilterOutByMsgId(c *C) {
 	orig := []protocol.Notification{
 		protocol.Notification{MsgId: "a"},
@@ -0,0 +1,186 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package tenant lets one server host several tenants, each with its
+// own pending store, broker, limits and statistics. API requests are
+// told apart by API key or else by hostname, device connections by
+// the delivery domain they ask for.
+package tenant
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ubports/ubuntu-push/server/api"
+	"github.com/ubports/ubuntu-push/server/broker"
+)
+
+// APIKeyHeader carries the API key identifying the tenant of a
+// request.
+const APIKeyHeader = "X-Push-Api-Key"
+
+var ErrUnknownDomain = errors.New("unknown delivery domain")
+
+// Config holds the configuration of a tenant.
+type Config struct {
+	// API keys identifying the tenant's requests
+	APIKeys []string `json:"api_keys"`
+	// hostnames the API is served on for the tenant
+	Hosts []string `json:"hosts"`
+	// the domain the tenant's devices connect to
+	DeliveryDomain string `json:"delivery_domain"`
+	// max notifications per application, the server's if 0
+	MaxNotificationsPerApplication int `json:"max_notifications_per_app"`
+	// largest payload accepted, the server's if 0
+	MaxPayloadSize int `json:"max_payload_size"`
+	// largest payload accepted per application, the server's if
+	// not set
+	AppMaxPayloadSizes map[string]int `json:"app_max_payload_sizes"`
+}
+
+// Tenant is one of the tenants hosted.
+type Tenant struct {
+	Name string
+	Config
+	// Broker serves the sessions of the tenant's devices.
+	Broker broker.Broker
+	// Handler serves the API requests for the tenant.
+	Handler http.Handler
+	// Stop, if set, stops serving the tenant.
+	Stop func()
+}
+
+// Tenants tells the tenants apart.
+type Tenants struct {
+	tenants  []*Tenant
+	byKey    map[string]*Tenant
+	byHost   map[string]*Tenant
+	byDomain map[string]*Tenant
+	fallback *Tenant
+}
+
+// New returns the Tenants for tenants; what isn't for any of them in
+// particular goes to fallback, or is rejected if fallback is nil.
+func New(tenants []*Tenant, fallback *Tenant) (*Tenants, error) {
+	ts := &Tenants{
+		byKey:    make(map[string]*Tenant),
+		byHost:   make(map[string]*Tenant),
+		byDomain: make(map[string]*Tenant),
+		fallback: fallback,
+	}
+	ts.tenants = append(ts.tenants, tenants...)
+	if fallback != nil {
+		ts.tenants = append(ts.tenants, fallback)
+	}
+	for _, t := range tenants {
+		for _, key := range t.APIKeys {
+			if other, ok := ts.byKey[key]; ok {
+				return nil, fmt.Errorf("tenant %s: api key already used by tenant %s", t.Name, other.Name)
+			}
+			ts.byKey[key] = t
+		}
+		for _, host := range t.Hosts {
+			host = strings.ToLower(host)
+			if other, ok := ts.byHost[host]; ok {
+				return nil, fmt.Errorf("tenant %s: host %s already used by tenant %s", t.Name, host, other.Name)
+			}
+			ts.byHost[host] = t
+		}
+		if t.DeliveryDomain != "" {
+			domain := strings.ToLower(t.DeliveryDomain)
+			if other, ok := ts.byDomain[domain]; ok {
+				return nil, fmt.Errorf("tenant %s: delivery domain %s already used by tenant %s", t.Name, domain, other.Name)
+			}
+			ts.byDomain[domain] = t
+		}
+	}
+	return ts, nil
+}
+
+// ForRequest returns the tenant request is for, or nil. An unknown
+// API key gets nil regardless of the hostname.
+func (ts *Tenants) ForRequest(request *http.Request) *Tenant {
+	if key := request.Header.Get(APIKeyHeader); key != "" {
+		return ts.byKey[key]
+	}
+	host, _, err := net.SplitHostPort(request.Host)
+	if err != nil {
+		// no port
+		host = request.Host
+	}
+	if t, ok := ts.byHost[strings.ToLower(host)]; ok {
+		return t
+	}
+	return ts.fallback
+}
+
+// ForDomain returns the tenant whose devices connect asking for
+// domain, or nil.
+func (ts *Tenants) ForDomain(domain string) *Tenant {
+	if t, ok := ts.byDomain[strings.ToLower(domain)]; ok {
+		return t
+	}
+	return ts.fallback
+}
+
+// ForConn returns the tenant a device connection is for, going by the
+// server name asked for in the TLS handshake, which is done within
+// timeout.
+func (ts *Tenants) ForConn(conn net.Conn, timeout time.Duration) (*Tenant, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ts.forDomainOrErr("")
+	}
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	err := tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return ts.forDomainOrErr(tlsConn.ConnectionState().ServerName)
+}
+
+func (ts *Tenants) forDomainOrErr(domain string) (*Tenant, error) {
+	t := ts.ForDomain(domain)
+	if t == nil {
+		return nil, ErrUnknownDomain
+	}
+	return t, nil
+}
+
+// ServeHTTP dispatches request to the handler of its tenant.
+func (ts *Tenants) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	t := ts.ForRequest(request)
+	if t == nil {
+		api.RespondError(writer, api.ErrUnknownTenant)
+		return
+	}
+	t.Handler.ServeHTTP(writer, request)
+}
+
+// Stop stops serving all the tenants.
+func (ts *Tenants) Stop() {
+	for _, t := range ts.tenants {
+		if t.Stop != nil {
+			t.Stop()
+		}
+	}
+}
@@ -0,0 +1,217 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package tenant
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/ubports/ubuntu-push/server/api"
+)
+
+func TestTenant(t *testing.T) { TestingT(t) }
+
+type tenantSuite struct{}
+
+var _ = Suite(&tenantSuite{})
+
+func named(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	})
+}
+
+var (
+	acme = &Tenant{
+		Name: "acme",
+		Config: Config{
+			APIKeys:        []string{"acme-key"},
+			Hosts:          []string{"push.acme.example"},
+			DeliveryDomain: "push-delivery.acme.example",
+		},
+		Handler: named("acme"),
+	}
+	globex = &Tenant{
+		Name: "globex",
+		Config: Config{
+			APIKeys:        []string{"globex-key1", "globex-key2"},
+			Hosts:          []string{"Push.Globex.Example"},
+			DeliveryDomain: "push-delivery.globex.example",
+		},
+		Handler: named("globex"),
+	}
+	other = &Tenant{Name: "other", Handler: named("other")}
+)
+
+func request(host, key string) *http.Request {
+	request, _ := http.NewRequest("POST", "http://"+host+"/notify", nil)
+	if key != "" {
+		request.Header.Set(APIKeyHeader, key)
+	}
+	return request
+}
+
+func (s *tenantSuite) TestForRequest(c *C) {
+	ts, err := New([]*Tenant{acme, globex}, nil)
+	c.Assert(err, IsNil)
+	c.Check(ts.ForRequest(request("push.acme.example", "")), Equals, acme)
+	c.Check(ts.ForRequest(request("push.acme.example:8080", "")), Equals, acme)
+	c.Check(ts.ForRequest(request("push.globex.example", "")), Equals, globex)
+	c.Check(ts.ForRequest(request("127.0.0.1:8080", "globex-key2")), Equals, globex)
+	// the key wins over the host
+	c.Check(ts.ForRequest(request("push.acme.example", "globex-key1")), Equals, globex)
+	c.Check(ts.ForRequest(request("push.acme.example", "bad-key")), IsNil)
+	c.Check(ts.ForRequest(request("127.0.0.1:8080", "")), IsNil)
+
+	ts, err = New([]*Tenant{acme}, other)
+	c.Assert(err, IsNil)
+	c.Check(ts.ForRequest(request("push.acme.example", "")), Equals, acme)
+	c.Check(ts.ForRequest(request("127.0.0.1:8080", "")), Equals, other)
+	c.Check(ts.ForRequest(request("127.0.0.1:8080", "bad-key")), IsNil)
+}
+
+func (s *tenantSuite) TestForDomain(c *C) {
+	ts, err := New([]*Tenant{acme, globex}, nil)
+	c.Assert(err, IsNil)
+	c.Check(ts.ForDomain("push-delivery.acme.example"), Equals, acme)
+	c.Check(ts.ForDomain("PUSH-DELIVERY.globex.example"), Equals, globex)
+	c.Check(ts.ForDomain(""), IsNil)
+	ts, err = New([]*Tenant{acme}, other)
+	c.Assert(err, IsNil)
+	c.Check(ts.ForDomain(""), Equals, other)
+}
+
+func (s *tenantSuite) TestNewClashes(c *C) {
+	for _, clash := range []*Tenant{
+		{Name: "clash", Config: Config{APIKeys: []string{"acme-key"}}},
+		{Name: "clash", Config: Config{Hosts: []string{"PUSH.acme.example"}}},
+		{Name: "clash", Config: Config{DeliveryDomain: "push-delivery.acme.example"}},
+	} {
+		_, err := New([]*Tenant{acme, clash}, nil)
+		c.Check(err, ErrorMatches, "tenant clash: .* already used by tenant acme")
+	}
+}
+
+func (s *tenantSuite) TestServeHTTP(c *C) {
+	ts, err := New([]*Tenant{acme, globex}, nil)
+	c.Assert(err, IsNil)
+	rec := httptest.NewRecorder()
+	ts.ServeHTTP(rec, request("push.globex.example", ""))
+	c.Check(rec.Body.String(), Equals, "globex")
+	rec = httptest.NewRecorder()
+	ts.ServeHTTP(rec, request("push.acme.example", "bad-key"))
+	c.Check(rec.Code, Equals, http.StatusUnauthorized)
+	c.Check(rec.Body.String(), Matches, `.*"error":"unauthorized".*`)
+	c.Check(rec.Body.String(), Matches, ".*"+api.ErrUnknownTenant.Message+".*")
+}
+
+func (s *tenantSuite) TestStop(c *C) {
+	var stopped []string
+	stopper := func(name string) *Tenant {
+		return &Tenant{Name: name, Stop: func() {
+			stopped = append(stopped, name)
+		}}
+	}
+	ts, err := New([]*Tenant{stopper("t1"), acme, stopper("t2")}, stopper("fallback"))
+	c.Assert(err, IsNil)
+	ts.Stop()
+	c.Check(stopped, DeepEquals, []string{"t1", "t2", "fallback"})
+}
+
+func selfSignedCert(c *C) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "push-delivery"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// forConnAsking resolves the tenant of a connection asking for
+// serverName.
+func forConnAsking(c *C, ts *Tenants, serverName string) (*Tenant, error) {
+	lst, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{selfSignedCert(c)},
+	})
+	c.Assert(err, IsNil)
+	defer lst.Close()
+	go func() {
+		conn, err := tls.Dial("tcp", lst.Addr().String(), &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		})
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := lst.Accept()
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	return ts.ForConn(conn, 5*time.Second)
+}
+
+func (s *tenantSuite) TestForConn(c *C) {
+	ts, err := New([]*Tenant{acme, globex}, nil)
+	c.Assert(err, IsNil)
+	t, err := forConnAsking(c, ts, "push-delivery.globex.example")
+	c.Assert(err, IsNil)
+	c.Check(t, Equals, globex)
+	_, err = forConnAsking(c, ts, "push-delivery.initech.example")
+	c.Check(err, Equals, ErrUnknownDomain)
+}
+
+func (s *tenantSuite) TestForConnNotTLS(c *C) {
+	ts, err := New([]*Tenant{acme}, other)
+	c.Assert(err, IsNil)
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	defer conn2.Close()
+	t, err := ts.ForConn(conn1, time.Second)
+	c.Assert(err, IsNil)
+	c.Check(t, Equals, other)
+}
+
+func (s *tenantSuite) TestForConnHandshakeFails(c *C) {
+	ts, err := New([]*Tenant{acme}, other)
+	c.Assert(err, IsNil)
+	conn1, conn2 := net.Pipe()
+	defer conn2.Close()
+	conn1.Close()
+	tlsConn := tls.Server(conn2, &tls.Config{Certificates: []tls.Certificate{selfSignedCert(c)}})
+	_, err = ts.ForConn(tlsConn, time.Second)
+	c.Check(err, NotNil)
+}
@@ -0,0 +1,240 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package faults wraps connections to inject faults into the protocol
+// traffic going over them, for testing how sessions cope.
+package faults
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrCut is returned by writes a Cut fault acted on.
+var ErrCut = errors.New("connection cut by fault injection")
+
+// Frame is what a single write on a connection carries; for the
+// protocol this is one whole message, its big-endian uint16 length
+// followed by its JSON body.
+type Frame []byte
+
+// Type returns the type ("T") of the message in the frame, or "" if
+// there is none.
+func (f Frame) Type() string {
+	if len(f) < 2 {
+		return ""
+	}
+	var msg struct {
+		T string
+	}
+	if json.Unmarshal(f[2:], &msg) != nil {
+		return ""
+	}
+	return msg.T
+}
+
+// Matcher selects the writes a fault acts on; n counts the writes on
+// the connection from 0.
+type Matcher func(n int, f Frame) bool
+
+// Nth matches the n-th write on the connection.
+func Nth(n int) Matcher {
+	return func(i int, f Frame) bool {
+		return i == n
+	}
+}
+
+// OfType matches the writes of messages of the given type.
+func OfType(t string) Matcher {
+	return func(i int, f Frame) bool {
+		return f.Type() == t
+	}
+}
+
+// Action performs a faulty write of f on conn.
+type Action func(conn net.Conn, f Frame) (int, error)
+
+// Delay writes the frame after waiting for d.
+func Delay(d time.Duration) Action {
+	return func(conn net.Conn, f Frame) (int, error) {
+		time.Sleep(d)
+		return conn.Write(f)
+	}
+}
+
+// Split writes the frame in pieces of size bytes, pausing in between.
+func Split(size int, pause time.Duration) Action {
+	return func(conn net.Conn, f Frame) (int, error) {
+		written := 0
+		for written < len(f) {
+			if written > 0 {
+				time.Sleep(pause)
+			}
+			end := written + size
+			if end > len(f) {
+				end = len(f)
+			}
+			n, err := conn.Write(f[written:end])
+			written += n
+			if err != nil {
+				return written, err
+			}
+		}
+		return written, nil
+	}
+}
+
+// Drop pretends to write the frame, which is lost.
+func Drop() Action {
+	return func(conn net.Conn, f Frame) (int, error) {
+		return len(f), nil
+	}
+}
+
+// Cut writes only the first n bytes of the frame and then closes the
+// connection.
+func Cut(n int) Action {
+	return func(conn net.Conn, f Frame) (int, error) {
+		if n > len(f) {
+			n = len(f)
+		}
+		written, _ := conn.Write(f[:n])
+		conn.Close()
+		return written, ErrCut
+	}
+}
+
+// CorruptLength writes the frame with its length prefix replaced by
+// length.
+func CorruptLength(length uint16) Action {
+	return func(conn net.Conn, f Frame) (int, error) {
+		if len(f) < 2 {
+			return conn.Write(f)
+		}
+		corrupted := make([]byte, len(f))
+		copy(corrupted, f)
+		binary.BigEndian.PutUint16(corrupted, length)
+		return conn.Write(corrupted)
+	}
+}
+
+// Fault has Action act on the first Times writes selected by Match,
+// on the first one only if Times is zero.
+type Fault struct {
+	Match  Matcher
+	Action Action
+	Times  int
+}
+
+func (fault *Fault) times() int {
+	if fault.Times == 0 {
+		return 1
+	}
+	return fault.Times
+}
+
+// Conn is a net.Conn injecting faults into its writes.
+type Conn struct {
+	net.Conn
+	lock   sync.Mutex
+	faults []*Fault
+	fired  []int
+	writes int
+}
+
+// NewConn wraps conn to inject faults; for each write the first of
+// them that matches and has not run out acts.
+func NewConn(conn net.Conn, faults ...*Fault) *Conn {
+	return &Conn{
+		Conn:   conn,
+		faults: faults,
+		fired:  make([]int, len(faults)),
+	}
+}
+
+// Write writes b, unless a fault acts on it instead.
+func (c *Conn) Write(b []byte) (int, error) {
+	var action Action
+	c.lock.Lock()
+	n := c.writes
+	c.writes++
+	for i, fault := range c.faults {
+		if c.fired[i] < fault.times() && fault.Match(n, Frame(b)) {
+			c.fired[i]++
+			action = fault.Action
+			break
+		}
+	}
+	c.lock.Unlock()
+	if action == nil {
+		return c.Conn.Write(b)
+	}
+	return action(c.Conn, Frame(b))
+}
+
+// Fired returns how many times each of the faults acted.
+func (c *Conn) Fired() []int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	fired := make([]int, len(c.fired))
+	copy(fired, c.fired)
+	return fired
+}
+
+// Script is a scenario spanning reconnects: it has the faults to
+// inject for each successive connection.
+type Script struct {
+	lock  sync.Mutex
+	conns [][]*Fault
+	n     int
+}
+
+// NewScript makes a Script with the faults for each connection in
+// turn; connections past those are left alone.
+func NewScript(conns ...[]*Fault) *Script {
+	return &Script{conns: conns}
+}
+
+// Wrap wraps conn, the next connection of the scenario, with its
+// faults.
+func (s *Script) Wrap(conn net.Conn) *Conn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var faults []*Fault
+	if s.n < len(s.conns) {
+		faults = s.conns[s.n]
+	}
+	s.n++
+	return NewConn(conn, faults...)
+}
+
+// Connections returns how many connections were wrapped so far.
+func (s *Script) Connections() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.n
+}
+
+// Done returns whether all the scripted connections were wrapped.
+func (s *Script) Done() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.n >= len(s.conns)
+}
@@ -0,0 +1,159 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package faults
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+func TestFaults(t *testing.T) { TestingT(t) }
+
+type faultsSuite struct {
+	lst net.Listener
+	cli net.Conn
+	srv net.Conn
+}
+
+var _ = Suite(&faultsSuite{})
+
+func (s *faultsSuite) SetUpTest(c *C) {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	s.lst = lst
+	s.cli, err = net.Dial("tcp", lst.Addr().String())
+	c.Assert(err, IsNil)
+	s.srv, err = lst.Accept()
+	c.Assert(err, IsNil)
+}
+
+func (s *faultsSuite) TearDownTest(c *C) {
+	s.cli.Close()
+	s.srv.Close()
+	s.lst.Close()
+}
+
+// read reads n bytes from the server side
+func (s *faultsSuite) read(c *C, n int) string {
+	s.srv.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, n)
+	_, err := io.ReadFull(s.srv, buf)
+	c.Assert(err, IsNil)
+	return string(buf)
+}
+
+const ping = "\x00\x0c{\"T\":\"ping\"}"
+const ack = "\x00\x0b{\"T\":\"ack\"}"
+
+func (s *faultsSuite) TestFrameType(c *C) {
+	c.Check(Frame(ping).Type(), Equals, "ping")
+	c.Check(Frame("\x00").Type(), Equals, "")
+	c.Check(Frame("\x00\x02{{").Type(), Equals, "")
+}
+
+func (s *faultsSuite) TestMatchers(c *C) {
+	c.Check(Nth(1)(1, Frame(ping)), Equals, true)
+	c.Check(Nth(1)(0, Frame(ping)), Equals, false)
+	c.Check(OfType("ping")(3, Frame(ping)), Equals, true)
+	c.Check(OfType("ack")(3, Frame(ping)), Equals, false)
+}
+
+func (s *faultsSuite) TestNoFaults(c *C) {
+	conn := NewConn(s.cli)
+	n, err := conn.Write([]byte(ping))
+	c.Check(err, IsNil)
+	c.Check(n, Equals, len(ping))
+	c.Check(s.read(c, len(ping)), Equals, ping)
+}
+
+func (s *faultsSuite) TestDropOnce(c *C) {
+	conn := NewConn(s.cli, &Fault{Match: OfType("ack"), Action: Drop()})
+	n, err := conn.Write([]byte(ack))
+	c.Check(err, IsNil)
+	c.Check(n, Equals, len(ack))
+	conn.Write([]byte(ping))
+	conn.Write([]byte(ack))
+	c.Check(s.read(c, len(ping)+len(ack)), Equals, ping+ack)
+	c.Check(conn.Fired(), DeepEquals, []int{1})
+}
+
+func (s *faultsSuite) TestTimesAndFirstMatchActs(c *C) {
+	conn := NewConn(s.cli,
+		&Fault{Match: OfType("ping"), Action: Drop(), Times: 2},
+		&Fault{Match: Nth(1), Action: CorruptLength(2)},
+	)
+	conn.Write([]byte(ping))
+	conn.Write([]byte(ping))
+	conn.Write([]byte(ping))
+	c.Check(s.read(c, len(ping)), Equals, ping)
+	c.Check(conn.Fired(), DeepEquals, []int{2, 0})
+}
+
+func (s *faultsSuite) TestDelay(c *C) {
+	conn := NewConn(s.cli, &Fault{Match: Nth(0), Action: Delay(20 * time.Millisecond)})
+	t0 := time.Now()
+	_, err := conn.Write([]byte(ping))
+	c.Check(err, IsNil)
+	c.Check(time.Since(t0) >= 20*time.Millisecond, Equals, true)
+	c.Check(s.read(c, len(ping)), Equals, ping)
+}
+
+func (s *faultsSuite) TestSplit(c *C) {
+	conn := NewConn(s.cli, &Fault{Match: Nth(0), Action: Split(5, time.Millisecond)})
+	n, err := conn.Write([]byte(ping))
+	c.Check(err, IsNil)
+	c.Check(n, Equals, len(ping))
+	c.Check(s.read(c, len(ping)), Equals, ping)
+}
+
+func (s *faultsSuite) TestCut(c *C) {
+	conn := NewConn(s.cli, &Fault{Match: OfType("ping"), Action: Cut(5)})
+	n, err := conn.Write([]byte(ping))
+	c.Check(err, Equals, ErrCut)
+	c.Check(n, Equals, 5)
+	c.Check(s.read(c, 5), Equals, ping[:5])
+	_, err = s.srv.Read(make([]byte, 1))
+	c.Check(err, Equals, io.EOF)
+}
+
+func (s *faultsSuite) TestCorruptLength(c *C) {
+	conn := NewConn(s.cli, &Fault{Match: Nth(0), Action: CorruptLength(0x102)})
+	n, err := conn.Write([]byte(ping))
+	c.Check(err, IsNil)
+	c.Check(n, Equals, len(ping))
+	c.Check(s.read(c, len(ping)), Equals, "\x01\x02"+ping[2:])
+}
+
+func (s *faultsSuite) TestScript(c *C) {
+	drop := &Fault{Match: Nth(0), Action: Drop()}
+	script := NewScript([]*Fault{drop}, nil)
+	c.Check(script.Done(), Equals, false)
+	conn1 := script.Wrap(s.cli)
+	conn1.Write([]byte(ping))
+	c.Check(conn1.Fired(), DeepEquals, []int{1})
+	conn2 := script.Wrap(s.cli)
+	c.Check(script.Done(), Equals, true)
+	conn3 := script.Wrap(s.cli)
+	c.Check(script.Connections(), Equals, 3)
+	conn2.Write([]byte(ack))
+	conn3.Write([]byte(ping))
+	c.Check(s.read(c, len(ack)+len(ping)), Equals, ack+ping)
+}
@@ -0,0 +1,67 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package urldispatcher
+
+import (
+	"net/url"
+	"os/exec"
+
+	"github.com/ubports/ubuntu-push/click"
+	"github.com/ubports/ubuntu-push/logger"
+)
+
+type xdgOpen struct {
+	log     logger.Logger
+	command string
+}
+
+// NewXdgOpen builds a URL dispatcher for systems without the url
+// dispatcher service, that opens URLs with xdg-open(1).
+func NewXdgOpen(log logger.Logger) URLDispatcher {
+	return &xdgOpen{log, "xdg-open"}
+}
+
+var _ URLDispatcher = &xdgOpen{} // ensures it conforms
+
+func (xo *xdgOpen) DispatchURL(url string, app *click.AppId) error {
+	xo.log.Debugf("opening %s", url)
+	cmd := exec.Command(xo.command, url)
+	if err := cmd.Start(); err != nil {
+		xo.log.Errorf("DispatchURL failed: %s", err)
+		return err
+	}
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			xo.log.Debugf("%s %s failed: %v", xo.command, url, err)
+		}
+	}()
+	return nil
+}
+
+// TestURL only lets web URLs through, as there's no telling what app
+// xdg-open would hand anything else to.
+func (xo *xdgOpen) TestURL(app *click.AppId, urls []string) bool {
+	xo.log.Debugf("TestURL: %s", urls)
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			xo.log.Debugf("notification skipped because of non-web url for actions: %v", u)
+			return false
+		}
+	}
+	return true
+}
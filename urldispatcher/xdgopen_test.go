@@ -0,0 +1,56 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package urldispatcher
+
+import (
+	. "launchpad.net/gocheck"
+
+	clickhelp "github.com/ubports/ubuntu-push/click/testing"
+	helpers "github.com/ubports/ubuntu-push/testing"
+)
+
+type xdgOpenSuite struct {
+	log *helpers.TestLogger
+}
+
+var _ = Suite(&xdgOpenSuite{})
+
+func (s *xdgOpenSuite) SetUpTest(c *C) {
+	s.log = helpers.NewTestLogger(c, "debug")
+}
+
+func (s *xdgOpenSuite) TestDispatchURL(c *C) {
+	xo := &xdgOpen{s.log, "true"}
+	appId := clickhelp.MustParseAppId("_python3")
+	c.Check(xo.DispatchURL("https://example.com", appId), IsNil)
+}
+
+func (s *xdgOpenSuite) TestDispatchURLFailsIfNoCommand(c *C) {
+	xo := &xdgOpen{s.log, "/does/not/exist"}
+	appId := clickhelp.MustParseAppId("_python3")
+	c.Check(xo.DispatchURL("https://example.com", appId), NotNil)
+	c.Check(s.log.Captured(), Matches, `(?s).*DispatchURL failed.*`)
+}
+
+func (s *xdgOpenSuite) TestTestURL(c *C) {
+	xo := NewXdgOpen(s.log)
+	appId := clickhelp.MustParseAppId("_python3")
+	c.Check(xo.TestURL(appId, []string{"https://example.com", "http://example.com/x"}), Equals, true)
+	c.Check(xo.TestURL(appId, []string{"https://example.com", "appid://com.example.test/app/current-user-version"}), Equals, false)
+	c.Check(xo.TestURL(appId, []string{"file:///etc/passwd"}), Equals, false)
+	c.Check(xo.TestURL(appId, []string{"%zz"}), Equals, false)
+}